@@ -0,0 +1,192 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// operations and results of the audit log records
+const (
+	auditOperationAdd    = "add"
+	auditOperationDelete = "delete"
+
+	auditResultSuccess = "success"
+	auditResultError   = "error"
+)
+
+// auditRecord is a line of the --audit-log-file
+type auditRecord struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Provider        string    `json:"provider"`
+	PVCName         string    `json:"pvc_name"`
+	Namespace       string    `json:"namespace"`
+	CloudResourceID string    `json:"cloud_resource_id"`
+	Operation       string    `json:"operation"`
+	// Labels is the map of labels added or the list of label keys deleted
+	Labels       any    `json:"labels"`
+	Result       string `json:"result"`
+	ErrorMessage string `json:"error_message"`
+	// the labels of the cloud resource before and after the operation, only
+	// set when it changed them and they are known
+	*auditChange
+}
+
+// auditChange is all the labels of a cloud resource before and after an
+// operation, and their diff
+type auditChange struct {
+	Before map[string]string `json:"before"`
+	After  map[string]string `json:"after"`
+	Diff   auditDiff         `json:"diff"`
+}
+
+// auditDiff is the difference between the Before and After labels of an
+// auditRecord
+type auditDiff struct {
+	Added   map[string]string           `json:"added"`
+	Removed map[string]string           `json:"removed"`
+	Updated map[string]auditValueChange `json:"updated"`
+}
+
+// auditValueChange is a label whose value was changed
+type auditValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// newAuditDiff returns the labels added, removed and updated from before to
+// after
+func newAuditDiff(before, after map[string]string) auditDiff {
+	diff := auditDiff{Added: map[string]string{}, Removed: map[string]string{}, Updated: map[string]auditValueChange{}}
+	for k, v := range after {
+		old, ok := before[k]
+		if !ok {
+			diff.Added[k] = v
+		} else if old != v {
+			diff.Updated[k] = auditValueChange{From: old, To: v}
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok {
+			diff.Removed[k] = v
+		}
+	}
+	return diff
+}
+
+// auditLogger writes auditRecords as JSON lines to a buffered file
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// auditLog is the logger of --audit-log-file, nil when it isn't set
+var auditLog *auditLogger
+
+// openAuditLog opens the file at path for appending, creating it if needed
+func openAuditLog(path string) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// write appends the record as a JSON line
+func (a *auditLogger) write(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorln("Failed to marshal audit log record:", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Errorln("Failed to write audit log record:", err)
+	}
+}
+
+// Close flushes the buffered records and closes the file
+func (a *auditLogger) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.w.Flush(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// auditTagOperation writes the outcome of adding or deleting the labels of
+// the cloud resource of the PVC to the --audit-log-file and returns err, so
+// that it can wrap the cloud call. Nothing is written with --dry-run.
+func auditTagOperation(pvc *corev1.PersistentVolumeClaim, resourceID, operation string, labels any, err error) error {
+	writeAuditRecord(pvc, resourceID, operation, labels, err, nil, nil)
+	return err
+}
+
+// writeAuditRecord writes the record of an operation on the labels of the
+// cloud resource of the PVC. The before and after labels of the resource, and
+// their diff, are only written when after is set.
+func writeAuditRecord(pvc *corev1.PersistentVolumeClaim, resourceID, operation string, labels any, err error, before, after map[string]string) {
+	if auditLog == nil || dryRun {
+		return
+	}
+	record := auditRecord{
+		Timestamp:       clock.Now().UTC(),
+		Provider:        cloud,
+		PVCName:         pvc.GetName(),
+		Namespace:       pvc.GetNamespace(),
+		CloudResourceID: resourceID,
+		Operation:       operation,
+		Labels:          labels,
+		Result:          auditResultSuccess,
+	}
+	if err != nil {
+		record.Result = auditResultError
+		record.ErrorMessage = err.Error()
+	}
+	if after != nil {
+		if before == nil {
+			before = map[string]string{}
+		}
+		record.auditChange = &auditChange{Before: before, After: after, Diff: newAuditDiff(before, after)}
+	}
+	auditLog.write(record)
+}
+
+// auditResult is auditTagOperation for the cloud calls returning a
+// ReconcileResult. The labels of the resource before and after the operation
+// are written when it changed them.
+func auditResult(pvc *corev1.PersistentVolumeClaim, resourceID, operation string, labels any, res ReconcileResult) ReconcileResult {
+	if res.Changed {
+		writeAuditRecord(pvc, resourceID, operation, labels, res.Err, res.LabelsBefore, res.LabelsAfter)
+	} else {
+		writeAuditRecord(pvc, resourceID, operation, labels, res.Err, nil, nil)
+	}
+	return res
+}
@@ -0,0 +1,261 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clocks "k8s.io/utils/clock"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+// readAuditLog returns the lines of the audit log file decoded as JSON
+func readAuditLog(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func Test_auditLog(t *testing.T) {
+	defer func(old *auditLogger) { auditLog = old }(auditLog)
+	defer func(old bool) { dryRun = old }(dryRun)
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock = testingclock.NewFakePassiveClock(now)
+	defer func() { clock = clocks.RealClock{} }()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"operation":"add"}`+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"}}
+
+	var err error
+	auditLog, err = openAuditLog(path)
+	if err != nil {
+		t.Fatalf("openAuditLog() error = %v", err)
+	}
+	if got := auditTagOperation(pvc, "vol-1", auditOperationAdd, map[string]string{"team": "db"}, nil); got != nil {
+		t.Errorf("auditTagOperation() = %v, want nil", got)
+	}
+	failed := errors.New("access denied")
+	if got := auditTagOperation(pvc, "vol-1", auditOperationDelete, []string{"env"}, failed); got != failed {
+		t.Errorf("auditTagOperation() = %v, want %v", got, failed)
+	}
+	dryRun = true
+	auditTagOperation(pvc, "vol-1", auditOperationAdd, map[string]string{"team": "web"}, nil)
+	dryRun = false
+	// the records are buffered until the log is closed
+	if got := len(readAuditLog(t, path)); got != 1 {
+		t.Errorf("%d records before closing, want 1", got)
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// reopening appends
+	auditLog, err = openAuditLog(path)
+	if err != nil {
+		t.Fatalf("openAuditLog() error = %v", err)
+	}
+	auditResult(pvc, "projects/p/zones/z/disks/d", auditOperationAdd, map[string]string{"team": "web"}, ReconcileResult{})
+	auditResult(pvc, "projects/p/zones/z/disks/d", auditOperationAdd, map[string]string{"key1": "new", "key2": "val"}, ReconcileResult{
+		Changed:      true,
+		LabelsAdded:  map[string]string{"key1": "new", "key2": "val"},
+		LabelsBefore: map[string]string{"key1": "old", "gone": "x"},
+		LabelsAfter:  map[string]string{"key1": "new", "key2": "val"},
+	})
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := []map[string]any{
+		{"operation": "add"},
+		{
+			"timestamp":         "2024-05-01T12:00:00Z",
+			"provider":          "gcp",
+			"pvc_name":          "my-pvc",
+			"namespace":         "default",
+			"cloud_resource_id": "vol-1",
+			"operation":         "add",
+			"labels":            map[string]any{"team": "db"},
+			"result":            "success",
+			"error_message":     "",
+		},
+		{
+			"timestamp":         "2024-05-01T12:00:00Z",
+			"provider":          "gcp",
+			"pvc_name":          "my-pvc",
+			"namespace":         "default",
+			"cloud_resource_id": "vol-1",
+			"operation":         "delete",
+			"labels":            []any{"env"},
+			"result":            "error",
+			"error_message":     "access denied",
+		},
+		{
+			"timestamp":         "2024-05-01T12:00:00Z",
+			"provider":          "gcp",
+			"pvc_name":          "my-pvc",
+			"namespace":         "default",
+			"cloud_resource_id": "projects/p/zones/z/disks/d",
+			"operation":         "add",
+			"labels":            map[string]any{"team": "web"},
+			"result":            "success",
+			"error_message":     "",
+		},
+		{
+			"timestamp":         "2024-05-01T12:00:00Z",
+			"provider":          "gcp",
+			"pvc_name":          "my-pvc",
+			"namespace":         "default",
+			"cloud_resource_id": "projects/p/zones/z/disks/d",
+			"operation":         "add",
+			"labels":            map[string]any{"key1": "new", "key2": "val"},
+			"result":            "success",
+			"error_message":     "",
+			"before":            map[string]any{"key1": "old", "gone": "x"},
+			"after":             map[string]any{"key1": "new", "key2": "val"},
+			"diff": map[string]any{
+				"added":   map[string]any{"key2": "val"},
+				"removed": map[string]any{"gone": "x"},
+				"updated": map[string]any{"key1": map[string]any{"from": "old", "to": "new"}},
+			},
+		},
+	}
+	if got := readAuditLog(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("audit log = %v, want %v", got, want)
+	}
+}
+
+func Test_reconcileAuditLog(t *testing.T) {
+	defer func(old *auditLogger) { auditLog = old }(auditLog)
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	copyLabels = []string{"*"}
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	oldPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pvc",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"team": "db", "env": "prod"},
+			Annotations:     map[string]string{"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	newPVC := oldPVC.DeepCopy()
+	newPVC.ResourceVersion = "2"
+	newPVC.Labels = map[string]string{"team": "db"}
+
+	diskLabels := map[string]string{"team": "db", "env": "prod"}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	auditLog, err = openAuditLog(path)
+	if err != nil {
+		t.Fatalf("openAuditLog() error = %v", err)
+	}
+	r := &pvcReconciler{gcpClient: client}
+	if err := r.reconcileUpdate(context.Background(), oldPVC, newPVC); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	records := readAuditLog(t, path)
+	var operations []string
+	for _, record := range records {
+		if record["cloud_resource_id"] != volumeID || record["pvc_name"] != "my-pvc" || record["result"] != "success" {
+			t.Errorf("unexpected record %v", record)
+		}
+		operations = append(operations, record["operation"].(string))
+	}
+	if want := []string{"add", "delete"}; !slices.Equal(operations, want) {
+		t.Fatalf("operations = %v, want %v", operations, want)
+	}
+	if got, want := records[1]["labels"], []any{"env"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted labels = %v, want %v", got, want)
+	}
+	wantDiff := map[string]any{"added": map[string]any{}, "removed": map[string]any{"env": "prod"}, "updated": map[string]any{}}
+	if got := records[1]["diff"]; !reflect.DeepEqual(got, wantDiff) {
+		t.Errorf("delete diff = %v, want %v", got, wantDiff)
+	}
+}
@@ -19,18 +19,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/efs"
 	"github.com/aws/aws-sdk-go/service/efs/efsiface"
 	"github.com/aws/aws-sdk-go/service/fsx"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
@@ -38,11 +48,24 @@ import (
 // awsSession the AWS Session
 var awsSession *session.Session
 
+// awsAccountID is the account the FSx for ONTAP file system ARNs are built for
+var awsAccountID string
+
 const (
 	// Matching strings for region
 	regexpAWSRegion = `^[\w]{2}[-][\w]{4,9}[-][\d]$`
 )
 
+var fsxFileSystemIDRegMatch = regexp.MustCompile(`^fs-[0-9a-f]+$`)
+
+// AWS tag limits, see
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/Using_Tags.html#tag-restrictions
+const (
+	awsMaxTagKeyLength   = 128
+	awsMaxTagValueLength = 256
+	awsReservedTagPrefix = "aws:"
+)
+
 // Client efs interface
 type EFSClient struct {
 	efsiface.EFSAPI
@@ -58,6 +81,12 @@ type FSxClient struct {
 	*fsx.FSx
 }
 
+// FSxONTAPClient tags FSx for ONTAP file systems
+type FSxONTAPClient interface {
+	TagResourceWithContext(ctx aws.Context, input *fsx.TagResourceInput, opts ...request.Option) (*fsx.TagResourceOutput, error)
+	UntagResourceWithContext(ctx aws.Context, input *fsx.UntagResourceInput, opts ...request.Option) (*fsx.UntagResourceOutput, error)
+}
+
 // CustomRetryer for custom retry settings
 type CustomRetryer struct {
 	client.DefaultRetryer
@@ -65,7 +94,7 @@ type CustomRetryer struct {
 
 func createAWSSession(awsRegion string) *session.Session {
 	// Build an AWS session
-	log.Debugln("Building AWS session")
+	logger.Debug("Building AWS session")
 	awsConfig := aws.NewConfig().WithCredentialsChainVerboseErrors(true)
 	awsConfig.Region = aws.String(awsRegion)
 	minDelay, _ := time.ParseDuration("1s")
@@ -78,7 +107,20 @@ func createAWSSession(awsRegion string) *session.Session {
 		MaxThrottleDelay: maxDelay,
 	}}
 
-	return session.Must(session.NewSession(awsConfig))
+	sess := session.Must(session.NewSession(awsConfig))
+	sess.Handlers.Build.PushFrontNamed(awsRequestTimeoutHandler)
+	return sess
+}
+
+// awsRequestTimeoutHandler sets the --cloud-request-timeout deadline on the
+// context of each AWS API request, including its retries
+var awsRequestTimeoutHandler = request.NamedHandler{
+	Name: "k8s-pvc-tagger.RequestTimeout",
+	Fn: func(r *request.Request) {
+		ctx, cancel := withCloudRequestTimeout(r.Context())
+		r.SetContext(ctx)
+		r.Handlers.Complete.PushBack(func(*request.Request) { cancel() })
+	},
 }
 
 // newEFSClient initializes an EFS client
@@ -99,6 +141,15 @@ func newFSxClient() (*FSxClient, error) {
 	return &FSxClient{svc}, nil
 }
 
+// getAWSAccountID returns the account of the AWS credentials in use
+func getAWSAccountID() (string, error) {
+	output, err := sts.New(awsSession).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("could not get AWS caller identity: %w", err)
+	}
+	return aws.StringValue(output.Account), nil
+}
+
 func getMetadataRegion() (string, error) {
 	sess := session.Must(session.NewSession(&aws.Config{}))
 	svc := ec2metadata.New(sess)
@@ -112,138 +163,524 @@ func getMetadataRegion() (string, error) {
 	return doc.Region, nil
 }
 
-func (client *EBSClient) addEBSVolumeTags(volumeID string, tags map[string]string, storageclass string) {
+func (client *EBSClient) addEBSVolumeTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	if awsInjectIOPS {
+		tags = client.withIOPSTag(ctx, volumeID, tags)
+	}
+	tags = sanitizeLabelsForAWS(tags)
+	if len(tags) == 0 {
+		logger.WithContext(ctx).Debug("No tags to add to EBS volume", "volumeID", volumeID)
+		return nil
+	}
+
+	if skipForDryRun("create tags on EBS volume", volumeID, tags, storageclass) {
+		return nil
+	}
+
 	var ec2Tags []*ec2.Tag
 	for k, v := range tags {
 		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
 	}
 
 	// Add tags to the volume
-	_, err := client.CreateTags(&ec2.CreateTagsInput{
+	_, err := client.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
 		Resources: []*string{aws.String(volumeID)},
 		Tags:      ec2Tags,
 	})
 	if err != nil {
-		log.Errorln("Could not create tags for volumeID:", volumeID, err)
+		log.WithContext(ctx).Errorln("Could not create tags for volumeID:", volumeID, err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
 		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		return err
 	}
 
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
 	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
 }
 
-func (client *EBSClient) deleteEBSVolumeTags(volumeID string, tags []string, storageclass string) {
+// withIOPSTag returns a copy of tags with the provisioned IOPS of an io1 or
+// io2 volume added as the ebs-iops tag
+func (client *EBSClient) withIOPSTag(ctx context.Context, volumeID string, tags map[string]string) map[string]string {
+	output, err := client.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		log.WithContext(ctx).Errorln("Could not describe EBS volumeID:", volumeID, err)
+		return tags
+	}
+	if len(output.Volumes) == 0 {
+		return tags
+	}
+
+	volume := output.Volumes[0]
+	switch aws.StringValue(volume.VolumeType) {
+	case ec2.VolumeTypeIo1, ec2.VolumeTypeIo2:
+	default:
+		return tags
+	}
+	if volume.Iops == nil {
+		return tags
+	}
+
+	tags = maps.Clone(tags)
+	tags["ebs-iops"] = strconv.FormatInt(aws.Int64Value(volume.Iops), 10)
+	return tags
+}
+
+func (client *EBSClient) deleteEBSVolumeTags(ctx context.Context, volumeID string, tags []string, storageclass string) error {
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	tags = sanitizeKeysForAWS(tags)
+	// DeleteTags without any tags deletes all tags on the volume
+	if len(tags) == 0 {
+		logger.WithContext(ctx).Debug("No tags to delete from EBS volume", "volumeID", volumeID)
+		return nil
+	}
+
+	if skipForDryRun("delete tags from EBS volume", volumeID, tags, storageclass) {
+		return nil
+	}
+
 	var ec2Tags []*ec2.Tag
 	for _, k := range tags {
 		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k)})
 	}
 
 	// Add tags to the volume
-	_, err := client.DeleteTags(&ec2.DeleteTagsInput{
+	_, err := client.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
 		Resources: []*string{aws.String(volumeID)},
 		Tags:      ec2Tags,
 	})
 	if err != nil {
-		log.Errorln("Could not EBS delete tags for volumeID:", volumeID, err)
+		log.WithContext(ctx).Errorln("Could not EBS delete tags for volumeID:", volumeID, err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
 		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		return err
 	}
 
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
 	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+// awsMaxTagResources is the maximum number of resources CreateTags and
+// DeleteTags accept in a single call
+const awsMaxTagResources = 1000
+
+// addEBSSnapshotTags sets the tags on every snapshot of the EBS volume, see
+// --sync-aws-snapshots. Snapshots that already have the tags aren't changed.
+func (client *EBSClient) addEBSSnapshotTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	tags = sanitizeLabelsForAWS(tags)
+	if len(tags) == 0 {
+		return nil
+	}
+	snapshotIDs, err := client.getEBSSnapshotIDs(ctx, volumeID, func(snapshotTags map[string]string) bool {
+		for k, v := range tags {
+			if current, ok := snapshotTags[k]; !ok || current != v {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil || len(snapshotIDs) == 0 {
+		return err
+	}
+	if skipForDryRun("create tags on EBS snapshots of volume", volumeID, tags, storageclass) {
+		return nil
+	}
+
+	var ec2Tags []*ec2.Tag
+	for k, v := range tags {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	for start := 0; start < len(snapshotIDs); start += awsMaxTagResources {
+		_, err := client.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: snapshotIDs[start:min(start+awsMaxTagResources, len(snapshotIDs))],
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			log.WithContext(ctx).Errorln("Could not create tags for the snapshots of volumeID:", volumeID, err)
+			return err
+		}
+	}
+	logger.WithContext(ctx).Debug("Tagged EBS snapshots", "volumeID", volumeID, "snapshots", len(snapshotIDs))
+	return nil
+}
+
+// deleteEBSSnapshotTags removes the tags from every snapshot of the EBS
+// volume that has one of them
+func (client *EBSClient) deleteEBSSnapshotTags(ctx context.Context, volumeID string, tags []string, storageclass string) error {
+	tags = sanitizeKeysForAWS(tags)
+	// DeleteTags without any tags deletes all tags on the snapshots
+	if len(tags) == 0 {
+		return nil
+	}
+	snapshotIDs, err := client.getEBSSnapshotIDs(ctx, volumeID, func(snapshotTags map[string]string) bool {
+		for _, k := range tags {
+			if _, ok := snapshotTags[k]; ok {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil || len(snapshotIDs) == 0 {
+		return err
+	}
+	if skipForDryRun("delete tags from EBS snapshots of volume", volumeID, tags, storageclass) {
+		return nil
+	}
+
+	var ec2Tags []*ec2.Tag
+	for _, k := range tags {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k)})
+	}
+	for start := 0; start < len(snapshotIDs); start += awsMaxTagResources {
+		_, err := client.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+			Resources: snapshotIDs[start:min(start+awsMaxTagResources, len(snapshotIDs))],
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			log.WithContext(ctx).Errorln("Could not delete tags from the snapshots of volumeID:", volumeID, err)
+			return err
+		}
+	}
+	logger.WithContext(ctx).Debug("Deleted tags from EBS snapshots", "volumeID", volumeID, "snapshots", len(snapshotIDs))
+	return nil
+}
+
+// getEBSSnapshotIDs returns the IDs of the snapshots of the EBS volume owned
+// by the account for whose tags needsUpdate returns true. All pages of
+// snapshots are read.
+func (client *EBSClient) getEBSSnapshotIDs(ctx context.Context, volumeID string, needsUpdate func(tags map[string]string) bool) ([]*string, error) {
+	var snapshotIDs []*string
+	err := client.DescribeSnapshotsPagesWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		Filters:  []*ec2.Filter{{Name: aws.String("volume-id"), Values: []*string{aws.String(volumeID)}}},
+		OwnerIds: []*string{aws.String("self")},
+	}, func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range page.Snapshots {
+			tags := make(map[string]string, len(snapshot.Tags))
+			for _, tag := range snapshot.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			if needsUpdate(tags) {
+				snapshotIDs = append(snapshotIDs, snapshot.SnapshotId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.WithContext(ctx).Errorln("Could not describe the snapshots of EBS volumeID:", volumeID, err)
+		return nil, err
+	}
+	return snapshotIDs, nil
+}
+
+// sanitizeLabelsForAWS returns a copy of labels that fits the AWS tag
+// restrictions. Keys are truncated to 128 characters and values to 256
+// characters. Keys using the reserved aws: prefix are dropped.
+func sanitizeLabelsForAWS(labels map[string]string) map[string]string {
+	sanitized := make(map[string]string, len(labels))
+	for k, v := range labels {
+		key, ok := sanitizeKeyForAWS(k)
+		if !ok {
+			continue
+		}
+		sanitized[key] = awsSanitizer.sanitizeValue(v)
+	}
+	return sanitized
+}
+
+// sanitizeKeysForAWS sanitizes tag keys the same way as sanitizeLabelsForAWS
+func sanitizeKeysForAWS(keys []string) []string {
+	sanitized := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if key, ok := sanitizeKeyForAWS(k); ok {
+			sanitized = append(sanitized, key)
+		}
+	}
+	return sanitized
+}
+
+func sanitizeKeyForAWS(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	if strings.HasPrefix(strings.ToLower(key), awsReservedTagPrefix) {
+		log.Warnln(key, "uses the reserved aws: prefix. Skipping...")
+		return "", false
+	}
+	return awsSanitizer.sanitizeKey(key), true
 }
 
-func (client *EFSClient) addEFSVolumeTags(volumeID string, tags map[string]string, storageclass string) {
+// getEFSAccessPointTags returns the current tags of an EFS access point
+func (client *EFSClient) getEFSAccessPointTags(ctx context.Context, accessPointID string) (map[string]string, error) {
+	output, err := client.DescribeAccessPointsWithContext(ctx, &efs.DescribeAccessPointsInput{
+		AccessPointId: aws.String(accessPointID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.AccessPoints) == 0 {
+		return nil, fmt.Errorf("EFS access point %s not found", accessPointID)
+	}
+
+	tags := map[string]string{}
+	for _, t := range output.AccessPoints[0].Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
+
+// addEFSAccessPointTags tags the EFS access point of the volume. The parent
+// file system is shared by every access point on it, so it isn't tagged.
+func (client *EFSClient) addEFSAccessPointTags(ctx context.Context, accessPointID string, tags map[string]string, storageclass string) error {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	tags = sanitizeLabelsForAWS(tags)
+	if len(tags) == 0 {
+		logger.WithContext(ctx).Debug("No tags to add to EFS access point", "accessPointID", accessPointID)
+		return nil
+	}
+
+	current, err := client.getEFSAccessPointTags(ctx, accessPointID)
+	if err != nil {
+		log.WithContext(ctx).Warnln("Could not describe EFS access point:", accessPointID, err)
+	} else if isTagSubset(tags, current) {
+		logger.WithContext(ctx).Debug("Tags already set on EFS access point", "accessPointID", accessPointID)
+		return nil
+	}
+
+	if skipForDryRun("create tags on EFS access point", accessPointID, tags, storageclass) {
+		return nil
+	}
+
 	var efsTags []*efs.Tag
 	for k, v := range tags {
 		efsTags = append(efsTags, &efs.Tag{Key: aws.String(k), Value: aws.String(v)})
 	}
 
-	// Add tags to the volume
-	_, err := client.TagResource(&efs.TagResourceInput{
-		ResourceId: aws.String(volumeID),
+	_, err = client.TagResourceWithContext(ctx, &efs.TagResourceInput{
+		ResourceId: aws.String(accessPointID),
 		Tags:       efsTags,
 	})
 	if err != nil {
-		log.Errorln("Could not EFS create tags for volumeID:", volumeID, err)
+		log.WithContext(ctx).Errorln("Could not EFS create tags for access point:", accessPointID, err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
 		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		return err
 	}
 
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
 	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
 }
 
-func (client *EFSClient) deleteEFSVolumeTags(volumeID string, tags []string, storageclass string) {
-	var efsTags []*string
-	for _, k := range tags {
-		efsTags = append(efsTags, aws.String(k))
+func (client *EFSClient) deleteEFSAccessPointTags(ctx context.Context, accessPointID string, tags []string, storageclass string) error {
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	tags = sanitizeKeysForAWS(tags)
+	if len(tags) == 0 {
+		logger.WithContext(ctx).Debug("No tags to delete from EFS access point", "accessPointID", accessPointID)
+		return nil
 	}
 
-	// Add tags to the volume
-	_, err := client.UntagResource(&efs.UntagResourceInput{
-		ResourceId: aws.String(volumeID),
-		TagKeys:    efsTags,
+	current, err := client.getEFSAccessPointTags(ctx, accessPointID)
+	if err != nil {
+		log.WithContext(ctx).Warnln("Could not describe EFS access point:", accessPointID, err)
+	} else {
+		tags = slices.DeleteFunc(tags, func(k string) bool {
+			_, ok := current[k]
+			return !ok
+		})
+		if len(tags) == 0 {
+			logger.WithContext(ctx).Debug("Tags already removed from EFS access point", "accessPointID", accessPointID)
+			return nil
+		}
+	}
+
+	if skipForDryRun("delete tags from EFS access point", accessPointID, tags, storageclass) {
+		return nil
+	}
+
+	_, err = client.UntagResourceWithContext(ctx, &efs.UntagResourceInput{
+		ResourceId: aws.String(accessPointID),
+		TagKeys:    aws.StringSlice(tags),
 	})
 	if err != nil {
-		log.Errorln("Could not EFS delete tags for volumeID:", volumeID, err)
+		log.WithContext(ctx).Errorln("Could not EFS delete tags for access point:", accessPointID, err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
 		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		return err
 	}
 
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
 	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+// isTagSubset reports whether every tag in tags is set to the same value in
+// current
+func isTagSubset(tags, current map[string]string) bool {
+	for k, v := range tags {
+		if cv, ok := current[k]; !ok || cv != v {
+			return false
+		}
+	}
+	return true
 }
 
-func (client *FSxClient) addFSxVolumeTags(volumeID string, tags map[string]string, storageclass string) {
+func (client *FSxClient) addFSxVolumeTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
 	volumeIDs := []*string{&volumeID}
-	describeFileSystemOutput, err := client.DescribeFileSystems(&fsx.DescribeFileSystemsInput{
+	describeFileSystemOutput, err := client.DescribeFileSystemsWithContext(ctx, &fsx.DescribeFileSystemsInput{
 		FileSystemIds: volumeIDs,
 	})
 	if err != nil {
-		log.WithError(err)
-		return
+		log.WithContext(ctx).WithError(err)
+		return err
 	}
-	_, err = client.TagResource(&fsx.TagResourceInput{
+	if skipForDryRun("create tags on FSx file system", volumeID, tags, storageclass) {
+		return nil
+	}
+	_, err = client.TagResourceWithContext(ctx, &fsx.TagResourceInput{
 		ResourceARN: describeFileSystemOutput.FileSystems[0].ResourceARN,
 		Tags:        convertTagsToFSxTags(tags),
 	})
 	if err != nil {
-		log.Errorln("Could not FSx create tags for volumeID:", volumeID, err)
+		log.WithContext(ctx).Errorln("Could not FSx create tags for volumeID:", volumeID, err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
 		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		return err
 	}
 
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
 	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
 }
 
-func (client *FSxClient) deleteFSxVolumeTags(volumeID string, tags []*string, storageclass string) {
+func (client *FSxClient) deleteFSxVolumeTags(ctx context.Context, volumeID string, tags []*string, storageclass string) error {
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
 	volumeIDs := []*string{&volumeID}
-	describeVolumesOutput, err := client.DescribeVolumes(&fsx.DescribeVolumesInput{
+	describeVolumesOutput, err := client.DescribeVolumesWithContext(ctx, &fsx.DescribeVolumesInput{
 		VolumeIds: volumeIDs,
 	})
 	if err != nil {
-		log.WithError(err)
-		return
+		log.WithContext(ctx).WithError(err)
+		return err
+	}
+	if skipForDryRun("delete tags from FSx volume", volumeID, aws.StringValueSlice(tags), storageclass) {
+		return nil
 	}
-	_, err = client.UntagResource(&fsx.UntagResourceInput{
+	_, err = client.UntagResourceWithContext(ctx, &fsx.UntagResourceInput{
 		ResourceARN: describeVolumesOutput.Volumes[0].ResourceARN,
 		TagKeys:     tags,
 	})
 	if err != nil {
-		log.Errorln("Could not FSx delete tags for volumeID:", volumeID, err)
+		log.WithContext(ctx).Errorln("Could not FSx delete tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+// isFSxONTAPVolumeHandle reports whether the FSx CSI volume handle is for an
+// FSx for ONTAP volume, which has the form {filesystem-id}:{volume-path}
+func isFSxONTAPVolumeHandle(volumeID string) bool {
+	return strings.Contains(volumeID, ":")
+}
+
+// parseFSxONTAPVolumeHandle returns the file system ID and volume path of an
+// FSx for ONTAP volume handle
+func parseFSxONTAPVolumeHandle(volumeID string) (string, string, error) {
+	fileSystemID, volumePath, ok := strings.Cut(volumeID, ":")
+	if !ok || !fsxFileSystemIDRegMatch.MatchString(fileSystemID) || volumePath == "" {
+		return "", "", fmt.Errorf("invalid FSx for ONTAP volume handle format: %s", volumeID)
+	}
+	return fileSystemID, volumePath, nil
+}
+
+// fsxFileSystemARN builds the ARN of an FSx file system
+func fsxFileSystemARN(region, accountID, fileSystemID string) (string, error) {
+	if accountID == "" {
+		return "", fmt.Errorf("unknown AWS account ID")
+	}
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return "", fmt.Errorf("unknown AWS partition for region %s", region)
+	}
+	return arn.ARN{
+		Partition: partition.ID(),
+		Service:   "fsx",
+		Region:    region,
+		AccountID: accountID,
+		Resource:  "file-system/" + fileSystemID,
+	}.String(), nil
+}
+
+// fsxONTAPFileSystemARN returns the ARN of the file system of an FSx for
+// ONTAP volume. ONTAP volumes can't be tagged individually through the FSx
+// API, so their tags are set on the file system.
+func fsxONTAPFileSystemARN(volumeID string) (string, error) {
+	fileSystemID, _, err := parseFSxONTAPVolumeHandle(volumeID)
+	if err != nil {
+		return "", err
+	}
+	return fsxFileSystemARN(aws.StringValue(awsSession.Config.Region), awsAccountID, fileSystemID)
+}
+
+func addFSxONTAPVolumeTags(ctx context.Context, client FSxONTAPClient, volumeID string, tags map[string]string, storageclass string) error {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	resourceARN, err := fsxONTAPFileSystemARN(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Errorln("Could not get FSx for ONTAP file system ARN for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	if skipForDryRun("create tags on FSx for ONTAP file system", resourceARN, tags, storageclass) {
+		return nil
+	}
+	_, err = client.TagResourceWithContext(ctx, &fsx.TagResourceInput{
+		ResourceARN: aws.String(resourceARN),
+		Tags:        convertTagsToFSxTags(tags),
+	})
+	if err != nil {
+		log.WithContext(ctx).Errorln("Could not FSx for ONTAP create tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+func deleteFSxONTAPVolumeTags(ctx context.Context, client FSxONTAPClient, volumeID string, tags []string, storageclass string) error {
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	resourceARN, err := fsxONTAPFileSystemARN(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Errorln("Could not get FSx for ONTAP file system ARN for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	if skipForDryRun("delete tags from FSx for ONTAP file system", resourceARN, tags, storageclass) {
+		return nil
+	}
+	_, err = client.UntagResourceWithContext(ctx, &fsx.UntagResourceInput{
+		ResourceARN: aws.String(resourceARN),
+		TagKeys:     aws.StringSlice(tags),
+	})
+	if err != nil {
+		log.WithContext(ctx).Errorln("Could not FSx for ONTAP delete tags for volumeID:", volumeID, err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
 		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
-		return
+		return err
 	}
 
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
 	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
 }
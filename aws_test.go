@@ -0,0 +1,619 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+	"github.com/aws/aws-sdk-go/service/fsx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeEC2Client struct {
+	ec2iface.EC2API
+
+	volumes           []*ec2.Volume
+	snapshotPages     [][]*ec2.Snapshot
+	describeSnapshots *ec2.DescribeSnapshotsInput
+	createTags        *ec2.CreateTagsInput
+	deleteTags        *ec2.DeleteTagsInput
+	err               error
+}
+
+func (c *fakeEC2Client) DescribeSnapshotsPagesWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, fn func(*ec2.DescribeSnapshotsOutput, bool) bool, opts ...request.Option) error {
+	c.describeSnapshots = input
+	for i, page := range c.snapshotPages {
+		if !fn(&ec2.DescribeSnapshotsOutput{Snapshots: page}, i == len(c.snapshotPages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *fakeEC2Client) DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	return &ec2.DescribeVolumesOutput{Volumes: c.volumes}, nil
+}
+
+func (c *fakeEC2Client) CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput, opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	c.createTags = input
+	return &ec2.CreateTagsOutput{}, c.err
+}
+
+func (c *fakeEC2Client) DeleteTagsWithContext(ctx aws.Context, input *ec2.DeleteTagsInput, opts ...request.Option) (*ec2.DeleteTagsOutput, error) {
+	c.deleteTags = input
+	return &ec2.DeleteTagsOutput{}, c.err
+}
+
+func ec2TagsToMap(tags []*ec2.Tag) map[string]string {
+	m := map[string]string{}
+	for _, t := range tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return m
+}
+
+func Test_addEBSVolumeTagsIOPS(t *testing.T) {
+	tests := []struct {
+		name       string
+		injectIOPS bool
+		volume     *ec2.Volume
+		wantTags   map[string]string
+	}{
+		{
+			name:       "io2 volume",
+			injectIOPS: true,
+			volume:     &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeIo2), Iops: aws.Int64(3000)},
+			wantTags:   map[string]string{"foo": "bar", "ebs-iops": "3000"},
+		},
+		{
+			name:       "io1 volume",
+			injectIOPS: true,
+			volume:     &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeIo1), Iops: aws.Int64(1000)},
+			wantTags:   map[string]string{"foo": "bar", "ebs-iops": "1000"},
+		},
+		{
+			name:       "gp3 volume",
+			injectIOPS: true,
+			volume:     &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeGp3), Iops: aws.Int64(3000)},
+			wantTags:   map[string]string{"foo": "bar"},
+		},
+		{
+			name:       "inject iops disabled",
+			injectIOPS: false,
+			volume:     &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeIo2), Iops: aws.Int64(3000)},
+			wantTags:   map[string]string{"foo": "bar"},
+		},
+	}
+	defer func() { awsInjectIOPS = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			awsInjectIOPS = tt.injectIOPS
+			fake := &fakeEC2Client{volumes: []*ec2.Volume{tt.volume}}
+			client := &EBSClient{fake}
+			tags := map[string]string{"foo": "bar"}
+
+			client.addEBSVolumeTags(context.Background(), "vol-12345", tags, "gp3")
+
+			if fake.createTags == nil {
+				t.Fatal("CreateTags() was not called")
+			}
+			if got := ec2TagsToMap(fake.createTags.Tags); !maps.Equal(got, tt.wantTags) {
+				t.Errorf("CreateTags(), got tags = %v, want = %v", got, tt.wantTags)
+			}
+			if len(tags) != 1 {
+				t.Errorf("addEBSVolumeTags() modified the tags passed in: %v", tags)
+			}
+		})
+	}
+}
+
+func Test_EBSVolumeTags(t *testing.T) {
+	longKey := strings.Repeat("k", 200)
+	longValue := strings.Repeat("v", 300)
+	tests := []struct {
+		name           string
+		addTags        map[string]string
+		deleteTags     []string
+		err            error
+		wantCreateTags map[string]string
+		wantDeleteTags []string
+		wantStatus     string
+	}{
+		{
+			name:           "add tags",
+			addTags:        map[string]string{"foo": "bar", longKey: longValue, "aws:cloudformation:stack-name": "stack"},
+			wantCreateTags: map[string]string{"foo": "bar", longKey[:128]: longValue[:256]},
+			wantStatus:     "success",
+		},
+		{
+			name:           "delete tags",
+			deleteTags:     []string{"foo", longKey, "AWS:reserved"},
+			wantDeleteTags: []string{"foo", longKey[:128]},
+			wantStatus:     "success",
+		},
+		{
+			name:       "nothing to add",
+			addTags:    map[string]string{"aws:reserved": "value"},
+			wantStatus: "",
+		},
+		{
+			name:       "nothing to delete",
+			deleteTags: []string{},
+			wantStatus: "",
+		},
+		{
+			name:           "add tags error",
+			addTags:        map[string]string{"foo": "bar"},
+			err:            errors.New("boom"),
+			wantCreateTags: map[string]string{"foo": "bar"},
+			wantStatus:     "error",
+		},
+		{
+			name:           "delete tags error",
+			deleteTags:     []string{"foo"},
+			err:            errors.New("boom"),
+			wantDeleteTags: []string{"foo"},
+			wantStatus:     "error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageclass := "ebs-" + strings.ReplaceAll(tt.name, " ", "-")
+			fake := &fakeEC2Client{err: tt.err}
+			client := &EBSClient{fake}
+			success := promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass})
+			failed := promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass})
+
+			if tt.addTags != nil {
+				client.addEBSVolumeTags(context.Background(), "vol-12345", tt.addTags, storageclass)
+			}
+			if tt.deleteTags != nil {
+				client.deleteEBSVolumeTags(context.Background(), "vol-12345", tt.deleteTags, storageclass)
+			}
+
+			if tt.wantCreateTags == nil && fake.createTags != nil {
+				t.Errorf("CreateTags() called with %v", fake.createTags)
+			}
+			if tt.wantCreateTags != nil {
+				if fake.createTags == nil {
+					t.Fatal("CreateTags() was not called")
+				}
+				if got := ec2TagsToMap(fake.createTags.Tags); !maps.Equal(got, tt.wantCreateTags) {
+					t.Errorf("CreateTags(), got tags = %v, want = %v", got, tt.wantCreateTags)
+				}
+			}
+			if tt.wantDeleteTags == nil && fake.deleteTags != nil {
+				t.Errorf("DeleteTags() called with %v", fake.deleteTags)
+			}
+			if tt.wantDeleteTags != nil {
+				if fake.deleteTags == nil {
+					t.Fatal("DeleteTags() was not called")
+				}
+				var got []string
+				for _, tag := range fake.deleteTags.Tags {
+					got = append(got, aws.StringValue(tag.Key))
+				}
+				if !slices.Equal(got, tt.wantDeleteTags) {
+					t.Errorf("DeleteTags(), got keys = %v, want = %v", got, tt.wantDeleteTags)
+				}
+			}
+			wantSuccess, wantError := 0.0, 0.0
+			switch tt.wantStatus {
+			case "success":
+				wantSuccess = 1
+			case "error":
+				wantError = 1
+			}
+			if got := testutil.ToFloat64(success); got != wantSuccess {
+				t.Errorf("success count = %v, want %v", got, wantSuccess)
+			}
+			if got := testutil.ToFloat64(failed); got != wantError {
+				t.Errorf("error count = %v, want %v", got, wantError)
+			}
+		})
+	}
+}
+
+type fakeFSxONTAPClient struct {
+	tagResource   *fsx.TagResourceInput
+	untagResource *fsx.UntagResourceInput
+}
+
+func (c *fakeFSxONTAPClient) TagResourceWithContext(ctx aws.Context, input *fsx.TagResourceInput, opts ...request.Option) (*fsx.TagResourceOutput, error) {
+	c.tagResource = input
+	return &fsx.TagResourceOutput{}, nil
+}
+
+func (c *fakeFSxONTAPClient) UntagResourceWithContext(ctx aws.Context, input *fsx.UntagResourceInput, opts ...request.Option) (*fsx.UntagResourceOutput, error) {
+	c.untagResource = input
+	return &fsx.UntagResourceOutput{}, nil
+}
+
+func Test_parseFSxONTAPVolumeHandle(t *testing.T) {
+	tests := []struct {
+		name             string
+		volumeID         string
+		wantFileSystemID string
+		wantVolumePath   string
+		wantErr          bool
+	}{
+		{
+			name:             "valid volume handle",
+			volumeID:         "fs-0123456789abcdef0:/vol1",
+			wantFileSystemID: "fs-0123456789abcdef0",
+			wantVolumePath:   "/vol1",
+		},
+		{
+			name:     "missing volume path",
+			volumeID: "fs-0123456789abcdef0:",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid file system ID",
+			volumeID: "vol-0123456789abcdef0:/vol1",
+			wantErr:  true,
+		},
+		{
+			name:     "lustre volume handle",
+			volumeID: "fs-0123456789abcdef0",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSystemID, volumePath, err := parseFSxONTAPVolumeHandle(tt.volumeID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFSxONTAPVolumeHandle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fileSystemID != tt.wantFileSystemID || volumePath != tt.wantVolumePath {
+				t.Errorf("parseFSxONTAPVolumeHandle() = %q, %q, want %q, %q", fileSystemID, volumePath, tt.wantFileSystemID, tt.wantVolumePath)
+			}
+		})
+	}
+}
+
+func Test_FSxONTAPVolumeTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		region    string
+		accountID string
+		wantARN   string
+	}{
+		{
+			name:      "aws partition",
+			region:    "us-west-2",
+			accountID: "123456789012",
+			wantARN:   "arn:aws:fsx:us-west-2:123456789012:file-system/fs-0123456789abcdef0",
+		},
+		{
+			name:      "aws-cn partition",
+			region:    "cn-north-1",
+			accountID: "123456789012",
+			wantARN:   "arn:aws-cn:fsx:cn-north-1:123456789012:file-system/fs-0123456789abcdef0",
+		},
+		{
+			name:      "aws-us-gov partition",
+			region:    "us-gov-west-1",
+			accountID: "123456789012",
+			wantARN:   "arn:aws-us-gov:fsx:us-gov-west-1:123456789012:file-system/fs-0123456789abcdef0",
+		},
+		{
+			name:   "unknown account",
+			region: "us-west-2",
+		},
+	}
+	defer func(session *session.Session, accountID string) {
+		awsSession, awsAccountID = session, accountID
+	}(awsSession, awsAccountID)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			awsSession = session.Must(session.NewSession(&aws.Config{Region: aws.String(tt.region)}))
+			awsAccountID = tt.accountID
+			client := &fakeFSxONTAPClient{}
+
+			addFSxONTAPVolumeTags(context.Background(), client, "fs-0123456789abcdef0:/vol1", map[string]string{"foo": "bar"}, "fsx-ontap")
+			deleteFSxONTAPVolumeTags(context.Background(), client, "fs-0123456789abcdef0:/vol1", []string{"baz"}, "fsx-ontap")
+
+			if tt.wantARN == "" {
+				if client.tagResource != nil || client.untagResource != nil {
+					t.Error("FSx API called without a file system ARN")
+				}
+				return
+			}
+			if client.tagResource == nil {
+				t.Fatal("TagResource() was not called")
+			}
+			if got := aws.StringValue(client.tagResource.ResourceARN); got != tt.wantARN {
+				t.Errorf("TagResource() ARN = %v, want %v", got, tt.wantARN)
+			}
+			if got := fsxTagsToMap(client.tagResource.Tags); !maps.Equal(got, map[string]string{"foo": "bar"}) {
+				t.Errorf("TagResource() tags = %v, want map[foo:bar]", got)
+			}
+			if client.untagResource == nil {
+				t.Fatal("UntagResource() was not called")
+			}
+			if got := aws.StringValue(client.untagResource.ResourceARN); got != tt.wantARN {
+				t.Errorf("UntagResource() ARN = %v, want %v", got, tt.wantARN)
+			}
+			if got := aws.StringValueSlice(client.untagResource.TagKeys); len(got) != 1 || got[0] != "baz" {
+				t.Errorf("UntagResource() tag keys = %v, want [baz]", got)
+			}
+		})
+	}
+}
+
+func fsxTagsToMap(tags []*fsx.Tag) map[string]string {
+	m := map[string]string{}
+	for _, t := range tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return m
+}
+
+type fakeEFSClient struct {
+	efsiface.EFSAPI
+
+	tags        map[string]string
+	describeErr error
+	tagInput    *efs.TagResourceInput
+	untagInput  *efs.UntagResourceInput
+}
+
+func (c *fakeEFSClient) DescribeAccessPointsWithContext(ctx aws.Context, input *efs.DescribeAccessPointsInput, opts ...request.Option) (*efs.DescribeAccessPointsOutput, error) {
+	if c.describeErr != nil {
+		return nil, c.describeErr
+	}
+	var tags []*efs.Tag
+	for k, v := range c.tags {
+		tags = append(tags, &efs.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return &efs.DescribeAccessPointsOutput{AccessPoints: []*efs.AccessPointDescription{{AccessPointId: input.AccessPointId, Tags: tags}}}, nil
+}
+
+func (c *fakeEFSClient) TagResourceWithContext(ctx aws.Context, input *efs.TagResourceInput, opts ...request.Option) (*efs.TagResourceOutput, error) {
+	c.tagInput = input
+	return &efs.TagResourceOutput{}, nil
+}
+
+func (c *fakeEFSClient) UntagResourceWithContext(ctx aws.Context, input *efs.UntagResourceInput, opts ...request.Option) (*efs.UntagResourceOutput, error) {
+	c.untagInput = input
+	return &efs.UntagResourceOutput{}, nil
+}
+
+func Test_EFSAccessPointTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		currentTags map[string]string
+		describeErr error
+		addTags     map[string]string
+		deleteTags  []string
+		wantTags    map[string]string
+		wantUntag   []string
+	}{
+		{
+			name:        "add new tags",
+			currentTags: map[string]string{"foo": "bar"},
+			addTags:     map[string]string{"foo": "bar", "team": "db"},
+			wantTags:    map[string]string{"foo": "bar", "team": "db"},
+		},
+		{
+			name:        "add changed tag value",
+			currentTags: map[string]string{"foo": "bar"},
+			addTags:     map[string]string{"foo": "baz"},
+			wantTags:    map[string]string{"foo": "baz"},
+		},
+		{
+			name:        "tags already set",
+			currentTags: map[string]string{"foo": "bar", "other": "value"},
+			addTags:     map[string]string{"foo": "bar"},
+		},
+		{
+			name:        "describe fails",
+			describeErr: errors.New("AccessDenied"),
+			addTags:     map[string]string{"foo": "bar"},
+			wantTags:    map[string]string{"foo": "bar"},
+		},
+		{
+			name:        "delete existing tags",
+			currentTags: map[string]string{"foo": "bar", "team": "db"},
+			deleteTags:  []string{"team", "missing"},
+			wantUntag:   []string{"team"},
+		},
+		{
+			name:        "tags already removed",
+			currentTags: map[string]string{"foo": "bar"},
+			deleteTags:  []string{"team"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeEFSClient{tags: tt.currentTags, describeErr: tt.describeErr}
+			client := &EFSClient{fake}
+
+			if tt.addTags != nil {
+				client.addEFSAccessPointTags(context.Background(), "fsap-12345", tt.addTags, "efs")
+			}
+			if tt.deleteTags != nil {
+				client.deleteEFSAccessPointTags(context.Background(), "fsap-12345", tt.deleteTags, "efs")
+			}
+
+			if tt.wantTags == nil && fake.tagInput != nil {
+				t.Errorf("TagResource() called with %v", fake.tagInput)
+			}
+			if tt.wantTags != nil {
+				if fake.tagInput == nil {
+					t.Fatal("TagResource() was not called")
+				}
+				if got := aws.StringValue(fake.tagInput.ResourceId); got != "fsap-12345" {
+					t.Errorf("TagResource(), got resource = %v, want = fsap-12345", got)
+				}
+				got := map[string]string{}
+				for _, tag := range fake.tagInput.Tags {
+					got[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+				}
+				if !maps.Equal(got, tt.wantTags) {
+					t.Errorf("TagResource(), got tags = %v, want = %v", got, tt.wantTags)
+				}
+			}
+			if tt.wantUntag == nil && fake.untagInput != nil {
+				t.Errorf("UntagResource() called with %v", fake.untagInput)
+			}
+			if tt.wantUntag != nil {
+				if fake.untagInput == nil {
+					t.Fatal("UntagResource() was not called")
+				}
+				if got := aws.StringValueSlice(fake.untagInput.TagKeys); !slices.Equal(got, tt.wantUntag) {
+					t.Errorf("UntagResource(), got keys = %v, want = %v", got, tt.wantUntag)
+				}
+			}
+		})
+	}
+}
+
+func Test_EBSSnapshotTags(t *testing.T) {
+	snapshot := func(id string, tags map[string]string) *ec2.Snapshot {
+		s := &ec2.Snapshot{SnapshotId: aws.String(id)}
+		for k, v := range tags {
+			s.Tags = append(s.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		return s
+	}
+	pages := [][]*ec2.Snapshot{
+		{snapshot("snap-1", nil), snapshot("snap-2", map[string]string{"foo": "bar"})},
+		{snapshot("snap-3", map[string]string{"foo": "old"})},
+		{snapshot("snap-4", map[string]string{"foo": "bar", "other": "value"})},
+	}
+	tests := []struct {
+		name          string
+		addTags       map[string]string
+		deleteTags    []string
+		wantResources []string
+	}{
+		{
+			name:          "add tags to the snapshots missing them",
+			addTags:       map[string]string{"foo": "bar"},
+			wantResources: []string{"snap-1", "snap-3"},
+		},
+		{
+			name:          "add tags to every snapshot",
+			addTags:       map[string]string{"foo": "bar", "new": "tag"},
+			wantResources: []string{"snap-1", "snap-2", "snap-3", "snap-4"},
+		},
+		{
+			name:    "add only reserved tags",
+			addTags: map[string]string{"aws:reserved": "value"},
+		},
+		{
+			name:          "delete tags from the snapshots with them",
+			deleteTags:    []string{"foo"},
+			wantResources: []string{"snap-2", "snap-3", "snap-4"},
+		},
+		{
+			name:       "delete tags not on any snapshot",
+			deleteTags: []string{"missing"},
+		},
+		{
+			name:       "delete no tags",
+			deleteTags: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeEC2Client{snapshotPages: pages}
+			client := &EBSClient{fake}
+
+			var resources []*string
+			if tt.addTags != nil {
+				if err := client.addEBSSnapshotTags(context.Background(), "vol-12345", tt.addTags, "ebs"); err != nil {
+					t.Fatalf("addEBSSnapshotTags() error = %v", err)
+				}
+				if fake.createTags != nil {
+					resources = fake.createTags.Resources
+					if got := ec2TagsToMap(fake.createTags.Tags); !maps.Equal(got, tt.addTags) {
+						t.Errorf("CreateTags(), got tags = %v, want = %v", got, tt.addTags)
+					}
+				}
+			}
+			if tt.deleteTags != nil {
+				if err := client.deleteEBSSnapshotTags(context.Background(), "vol-12345", tt.deleteTags, "ebs"); err != nil {
+					t.Fatalf("deleteEBSSnapshotTags() error = %v", err)
+				}
+				if fake.deleteTags != nil {
+					resources = fake.deleteTags.Resources
+				}
+			}
+
+			if got := aws.StringValueSlice(resources); !slices.Equal(got, tt.wantResources) {
+				t.Errorf("tagged snapshots = %v, want = %v", got, tt.wantResources)
+			}
+			if fake.describeSnapshots != nil {
+				filter := fake.describeSnapshots.Filters[0]
+				if aws.StringValue(filter.Name) != "volume-id" || aws.StringValue(filter.Values[0]) != "vol-12345" {
+					t.Errorf("DescribeSnapshots() filter = %v", filter)
+				}
+			}
+		})
+	}
+}
+
+func Test_awsRequestTimeoutHandler(t *testing.T) {
+	defer func(old time.Duration) { cloudRequestTimeout = old }(cloudRequestTimeout)
+	cloudRequestTimeout = 100 * time.Millisecond
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	client := ec2.New(createAWSSession("us-east-1"), aws.NewConfig().WithEndpoint(srv.URL))
+	start := time.Now()
+	_, err := client.DescribeVolumesWithContext(context.Background(), &ec2.DescribeVolumesInput{})
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != request.CanceledErrorCode {
+		t.Errorf("DescribeVolumesWithContext() error = %v, want %s", err, request.CanceledErrorCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("DescribeVolumesWithContext() took %v, want about %v", elapsed, cloudRequestTimeout)
+	}
+}
@@ -0,0 +1,755 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Azure tag limits for managed disks, see
+// https://learn.microsoft.com/en-us/azure/azure-resource-manager/management/tag-resources#limitations
+const (
+	azureMaxTags           = 50
+	azureMaxTagKeyLength   = 512
+	azureMaxTagValueLength = 256
+)
+
+var (
+	azureDiskIDRegMatch = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Compute/disks/([^/]+)$`)
+	// characters Azure doesn't allow in tag keys
+	azureTagKeyReplacer = strings.NewReplacer("<", "_", ">", "_", "%", "_", "&", "_", `\`, "_", "?", "_", "/", "_")
+	// characters Azure doesn't allow in file share metadata names
+	azureMetadataKeyRegMatch = regexp.MustCompile(`[^a-z0-9_]`)
+)
+
+// azureSubscriptionID is the subscription of Azure File shares whose volume
+// handle has none
+var azureSubscriptionID string
+
+// azureInjectZoneTag sets the zone of zonal Managed Disks as the az-zone tag,
+// see --inject-az-zone-label
+var azureInjectZoneTag bool
+
+const (
+	// azureDiskZoneTopologyKey is the node affinity key the Azure Disk CSI
+	// driver sets on the PVs of zonal disks
+	azureDiskZoneTopologyKey = "topology.disk.csi.azure.com/zone"
+	// azureZoneTagKey is the tag the zone of a disk is set as
+	azureZoneTagKey = "az-zone"
+)
+
+// AzureDiskClient gets and tags Azure Managed Disks and their snapshots
+type AzureDiskClient interface {
+	GetDisk(ctx context.Context, subscription, resourceGroup, name string) (*armcompute.Disk, error)
+	UpdateTags(ctx context.Context, subscription, resourceGroup, name string, tags map[string]*string) error
+	ListSnapshots(ctx context.Context, subscription, resourceGroup string) ([]*armcompute.Snapshot, error)
+	UpdateSnapshotTags(ctx context.Context, subscription, resourceGroup, name string, tags map[string]*string) error
+}
+
+type azureDiskClient struct {
+	credential azcore.TokenCredential
+
+	mu              sync.Mutex
+	clients         map[string]*armcompute.DisksClient
+	snapshotClients map[string]*armcompute.SnapshotsClient
+}
+
+func newAzureDiskClient() (AzureDiskClient, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &azureDiskClient{
+		credential:      credential,
+		clients:         map[string]*armcompute.DisksClient{},
+		snapshotClients: map[string]*armcompute.SnapshotsClient{},
+	}, nil
+}
+
+// disksClient returns the disks client for the subscription, creating it on
+// first use
+func (c *azureDiskClient) disksClient(subscription string) (*armcompute.DisksClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[subscription]; ok {
+		return client, nil
+	}
+	client, err := armcompute.NewDisksClient(subscription, c.credential, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[subscription] = client
+	return client, nil
+}
+
+func (c *azureDiskClient) GetDisk(ctx context.Context, subscription, resourceGroup, name string) (*armcompute.Disk, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	client, err := c.disksClient(subscription)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(ctx, resourceGroup, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Disk, nil
+}
+
+// UpdateTags replaces the tags of the disk and waits for the update to finish.
+// Only the update request has the --cloud-request-timeout deadline, not the
+// wait.
+func (c *azureDiskClient) UpdateTags(ctx context.Context, subscription, resourceGroup, name string, tags map[string]*string) error {
+	client, err := c.disksClient(subscription)
+	if err != nil {
+		return err
+	}
+	requestCtx, cancel := withCloudRequestTimeout(ctx)
+	poller, err := client.BeginUpdate(requestCtx, resourceGroup, name, armcompute.DiskUpdate{Tags: tags}, nil)
+	cancel()
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, nil)
+	return err
+}
+
+// snapshotsClient returns the snapshots client for the subscription, creating
+// it on first use
+func (c *azureDiskClient) snapshotsClient(subscription string) (*armcompute.SnapshotsClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.snapshotClients[subscription]; ok {
+		return client, nil
+	}
+	client, err := armcompute.NewSnapshotsClient(subscription, c.credential, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.snapshotClients[subscription] = client
+	return client, nil
+}
+
+// ListSnapshots returns all the snapshots of the resource group
+func (c *azureDiskClient) ListSnapshots(ctx context.Context, subscription, resourceGroup string) ([]*armcompute.Snapshot, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	client, err := c.snapshotsClient(subscription)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*armcompute.Snapshot
+	pager := client.NewListByResourceGroupPager(resourceGroup, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, page.Value...)
+	}
+	return snapshots, nil
+}
+
+// UpdateSnapshotTags replaces the tags of the snapshot and waits for the
+// update to finish. Like UpdateTags, only the update request has the
+// --cloud-request-timeout deadline.
+func (c *azureDiskClient) UpdateSnapshotTags(ctx context.Context, subscription, resourceGroup, name string, tags map[string]*string) error {
+	client, err := c.snapshotsClient(subscription)
+	if err != nil {
+		return err
+	}
+	requestCtx, cancel := withCloudRequestTimeout(ctx)
+	poller, err := client.BeginUpdate(requestCtx, resourceGroup, name, armcompute.SnapshotUpdate{Tags: tags}, nil)
+	cancel()
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, nil)
+	return err
+}
+
+// parseAzureDiskID returns the subscription, resource group and name of the
+// disk from a volume handle such as
+// /subscriptions/{sub}/resourceGroups/{rg}/providers/Microsoft.Compute/disks/{name}
+func parseAzureDiskID(id string) (string, string, string, error) {
+	matches := azureDiskIDRegMatch.FindStringSubmatch(id)
+	if matches == nil {
+		return "", "", "", fmt.Errorf("invalid Azure disk ID %q", id)
+	}
+	return matches[1], matches[2], matches[3], nil
+}
+
+// addAzureDiskLabels merges labels into the tags of the managed disk
+func addAzureDiskLabels(ctx context.Context, c AzureDiskClient, volumeID string, labels map[string]string, storageclass string) ReconcileResult {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	sanitizedLabels := sanitizeLabelsForAzure(labels)
+	logger.WithContext(ctx).Debug("labels to add to Azure disk", "volumeID", volumeID, "labels", sanitizedLabels)
+
+	subscription, resourceGroup, name, err := parseAzureDiskID(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return ReconcileResult{Err: err}
+	}
+	disk, err := c.GetDisk(ctx, subscription, resourceGroup, name)
+	if err != nil {
+		log.WithContext(ctx).Errorf("failed to get Azure disk %s: %s", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return ReconcileResult{Err: err}
+	}
+
+	current := azureTagsToMap(disk.Tags)
+	updated := maps.Clone(current)
+	dropped, removed := mergeLabelsForAzure(updated, sanitizedLabels, volumeID, storageclass)
+	if maps.Equal(current, updated) {
+		logger.WithContext(ctx).Debug("labels already set on Azure disk")
+		return ReconcileResult{LabelsDropped: dropped}
+	}
+	res := updateAzureDiskTags(ctx, c, subscription, resourceGroup, name, current, updated, storageclass)
+	res.LabelsDropped = dropped
+	res.TagsRemoved = removed
+	return res
+}
+
+// mergeLabelsForAzure copies labels into existing without letting it grow past
+// Azure's limit of tags per resource and returns the keys of the labels it
+// dropped and of the tags it removed. The labels of the PVC take priority over
+// the tags others set on the disk: those are removed from existing, the last
+// in compareLabelKeys order first, to make room. The --protected-label-keys
+// are never removed. Only when the labels and the protected tags alone exceed
+// the limit are labels dropped, keeping the first in compareLabelKeys order.
+func mergeLabelsForAzure(existing, labels map[string]string, volumeID string, storageclass string) ([]string, []string) {
+	var external []string
+	protected := 0
+	for k := range existing {
+		if _, ok := labels[k]; ok {
+			continue
+		}
+		if slices.Contains(protectedLabelKeys, k) {
+			protected++
+			continue
+		}
+		external = append(external, k)
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, compareLabelKeys)
+	var dropped []string
+	if limit := azureMaxTags - protected; len(keys) > limit {
+		keys, dropped = keys[:limit], keys[limit:]
+	}
+
+	var removed []string
+	if room := azureMaxTags - protected - len(keys); len(external) > room {
+		slices.SortFunc(external, compareLabelKeys)
+		removed = external[room:]
+		log.WithFields(log.Fields{"volumeID": volumeID, "removed": removed}).Warnf("Azure disk would exceed %d tags, removing tags not set by the PVC", azureMaxTags)
+		for _, k := range removed {
+			delete(existing, k)
+		}
+		countSkippedLabels(labelsSkippedTagRemoved, storageclass, len(removed))
+	}
+
+	for _, k := range keys {
+		existing[k] = labels[k]
+	}
+	if len(dropped) > 0 {
+		log.WithFields(log.Fields{"volumeID": volumeID, "dropped": dropped}).Warnf("PVC has more than %d labels, not setting some labels", azureMaxTags)
+		countSkippedLabels(labelsSkippedQuotaExceeded, storageclass, len(dropped))
+	}
+	return dropped, removed
+}
+
+// deleteAzureDiskLabels removes the tags with the given keys from the managed disk
+func deleteAzureDiskLabels(ctx context.Context, c AzureDiskClient, volumeID string, keys []string, storageclass string) ReconcileResult {
+	if len(keys) == 0 {
+		return ReconcileResult{}
+	}
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	sanitizedKeys := sanitizeKeysForAzure(keys)
+	logger.WithContext(ctx).Debug("labels to delete from Azure disk", "volumeID", volumeID, "labels", sanitizedKeys)
+
+	subscription, resourceGroup, name, err := parseAzureDiskID(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return ReconcileResult{Err: err}
+	}
+	disk, err := c.GetDisk(ctx, subscription, resourceGroup, name)
+	if err != nil {
+		log.WithContext(ctx).Errorf("failed to get Azure disk %s: %s", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return ReconcileResult{Err: err}
+	}
+
+	current := azureTagsToMap(disk.Tags)
+	updated := maps.Clone(current)
+	for _, k := range sanitizedKeys {
+		delete(updated, k)
+	}
+	if maps.Equal(current, updated) {
+		return ReconcileResult{}
+	}
+	return updateAzureDiskTags(ctx, c, subscription, resourceGroup, name, current, updated, storageclass)
+}
+
+func updateAzureDiskTags(ctx context.Context, c AzureDiskClient, subscription, resourceGroup, name string, current, updated map[string]string, storageclass string) ReconcileResult {
+	if skipForDryRun("set tags on Azure disk", name, updated, storageclass) {
+		added, removed := diffLabels(current, updated)
+		return ReconcileResult{LabelsAdded: added, LabelsRemoved: removed}
+	}
+	tags := make(map[string]*string, len(updated))
+	for k, v := range updated {
+		tags[k] = &v
+	}
+	if err := c.UpdateTags(ctx, subscription, resourceGroup, name, tags); err != nil {
+		log.WithContext(ctx).Errorf("failed to set tags on Azure disk %s: %s", name, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return ReconcileResult{Err: err}
+	}
+
+	logger.WithContext(ctx).Debug("successfully set tags on Azure disk")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	added, removed := diffLabels(current, updated)
+	return ReconcileResult{Changed: true, LabelsAdded: added, LabelsRemoved: removed, LabelsBefore: current, LabelsAfter: updated}
+}
+
+// propagateToSnapshotsAnnotation makes the tags of the PVC's Azure Managed
+// Disk also be set on the snapshots of the disk when it is "true"
+const propagateToSnapshotsAnnotation = "pvc-tagger.planetscale.com/propagate-to-snapshots"
+
+// propagatesToSnapshots reports whether the PVC's propagateToSnapshotsAnnotation
+// is "true"
+func propagatesToSnapshots(pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.GetAnnotations()[propagateToSnapshotsAnnotation] == "true"
+}
+
+// addAzureSnapshotTags sets the labels on every snapshot of the managed disk.
+// Like on the disk, the labels are merged with the tags the snapshots
+// already have.
+func addAzureSnapshotTags(ctx context.Context, c AzureDiskClient, volumeID string, labels map[string]string, storageclass string) error {
+	sanitizedLabels := sanitizeLabelsForAzure(labels)
+	return updateAzureSnapshotTags(ctx, c, volumeID, "set tags on Azure snapshot", storageclass, func(snapshot string, updated map[string]string) {
+		mergeLabelsForAzure(updated, sanitizedLabels, snapshot, storageclass)
+	})
+}
+
+// deleteAzureSnapshotTags removes the tags with the given keys from every
+// snapshot of the managed disk
+func deleteAzureSnapshotTags(ctx context.Context, c AzureDiskClient, volumeID string, keys []string, storageclass string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	sanitizedKeys := sanitizeKeysForAzure(keys)
+	return updateAzureSnapshotTags(ctx, c, volumeID, "delete tags from Azure snapshot", storageclass, func(snapshot string, updated map[string]string) {
+		for _, k := range sanitizedKeys {
+			delete(updated, k)
+		}
+	})
+}
+
+// updateAzureSnapshotTags applies update to the tags of each snapshot of the
+// managed disk, i.e. the snapshots of its resource group whose source is the
+// disk, and sets the tags of the snapshots they changed for. The snapshots
+// are all attempted and their errors joined.
+func updateAzureSnapshotTags(ctx context.Context, c AzureDiskClient, volumeID, action, storageclass string, update func(snapshot string, updated map[string]string)) error {
+	subscription, resourceGroup, _, err := parseAzureDiskID(volumeID)
+	if err != nil {
+		return err
+	}
+	snapshots, err := c.ListSnapshots(ctx, subscription, resourceGroup)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"volumeID": volumeID}).Errorln("failed to list Azure snapshots:", err)
+		return err
+	}
+	var errs []error
+	for _, snapshot := range snapshots {
+		if snapshot.Name == nil || !isAzureSnapshotOf(snapshot, volumeID) {
+			continue
+		}
+		name := *snapshot.Name
+		current := azureTagsToMap(snapshot.Tags)
+		updated := maps.Clone(current)
+		update(name, updated)
+		if maps.Equal(current, updated) {
+			continue
+		}
+		if skipForDryRun(action, name, updated, storageclass) {
+			continue
+		}
+		tags := make(map[string]*string, len(updated))
+		for k, v := range updated {
+			tags[k] = &v
+		}
+		if err := c.UpdateSnapshotTags(ctx, subscription, resourceGroup, name, tags); err != nil {
+			log.WithContext(ctx).WithFields(log.Fields{"volumeID": volumeID, "snapshot": name}).Errorln("failed to", action+":", err)
+			errs = append(errs, fmt.Errorf("snapshot %s: %w", name, err))
+			continue
+		}
+		logger.WithContext(ctx).Debug("successfully updated Azure snapshot tags", "volumeID", volumeID, "snapshot", name)
+	}
+	return errors.Join(errs...)
+}
+
+// isAzureSnapshotOf reports whether the snapshot was created from the disk.
+// Azure resource IDs are case-insensitive.
+func isAzureSnapshotOf(snapshot *armcompute.Snapshot, diskID string) bool {
+	if snapshot.Properties == nil || snapshot.Properties.CreationData == nil || snapshot.Properties.CreationData.SourceResourceID == nil {
+		return false
+	}
+	return strings.EqualFold(*snapshot.Properties.CreationData.SourceResourceID, diskID)
+}
+
+// azureDiskZone returns the zone of the disk of the PV from its required node
+// affinity. It returns false when the PV has no zone, e.g. an LRS disk without
+// a zone, or when the node affinity allows more than one zone.
+func azureDiskZone(pv *corev1.PersistentVolume) (string, bool) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return "", false
+	}
+	var zones []string
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key != azureDiskZoneTopologyKey || expr.Operator != corev1.NodeSelectorOpIn {
+				continue
+			}
+			for _, zone := range expr.Values {
+				if zone != "" && !slices.Contains(zones, zone) {
+					zones = append(zones, zone)
+				}
+			}
+		}
+	}
+	if len(zones) != 1 {
+		return "", false
+	}
+	return zones[0], true
+}
+
+// withAzureZoneTag adds the zone of the Managed Disk of the PV to the tags as
+// azureZoneTagKey with --inject-az-zone-label. A tag of the PVC with the same
+// key takes precedence.
+func withAzureZoneTag(ctx context.Context, pv *corev1.PersistentVolume, provisionedBy string, tags map[string]string) map[string]string {
+	if !azureInjectZoneTag || cloud != AZURE || (provisionedBy != AZURE_DISK_CSI && provisionedBy != AZURE_DISK_LEGACY) {
+		return tags
+	}
+	if _, ok := tags[azureZoneTagKey]; ok {
+		return tags
+	}
+	zone, ok := azureDiskZone(pv)
+	if !ok {
+		logger.WithContext(ctx).Debug("No single zone in the PersistentVolume's node affinity, not setting the zone tag", "pv", pv.GetName(), "tag", azureZoneTagKey)
+		return tags
+	}
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tags[azureZoneTagKey] = zone
+	return tags
+}
+
+func azureTagsToMap(tags map[string]*string) map[string]string {
+	m := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if v != nil {
+			m[k] = *v
+		}
+	}
+	return m
+}
+
+// sanitizeLabelsForAzure replaces the characters Azure doesn't allow in tag
+// keys with _ and truncates keys to 512 and values to 256 characters. When
+// several keys become the same tag key, the first of them in sorted order is
+// used.
+func sanitizeLabelsForAzure(labels map[string]string) map[string]string {
+	labels = withoutAzureKeyCollisions(labels, sanitizeKeyForAzure)
+	sanitized := make(map[string]string, len(labels))
+	for k, v := range labels {
+		sanitized[sanitizeKeyForAzure(k)] = azureSanitizer.sanitizeValue(v)
+	}
+	return sanitized
+}
+
+// withoutAzureKeyCollisions returns the labels without the keys that become
+// the same key once sanitized with sanitizeKey as a key sorting before them
+func withoutAzureKeyCollisions(labels map[string]string, sanitizeKey func(string) string) map[string]string {
+	collisions := labelKeyCollisions(labels, sanitizeKey)
+	if len(collisions) == 0 {
+		return labels
+	}
+	labels = maps.Clone(labels)
+	for sanitizedKey, keys := range collisions {
+		log.WithFields(log.Fields{"keys": keys, "azure_key": sanitizedKey}).Warnln("Label keys collide after sanitization, using", keys[0])
+		for _, k := range keys[1:] {
+			delete(labels, k)
+		}
+	}
+	return labels
+}
+
+func sanitizeKeysForAzure(keys []string) []string {
+	sanitized := make([]string, 0, len(keys))
+	for _, k := range keys {
+		sanitized = append(sanitized, sanitizeKeyForAzure(k))
+	}
+	return sanitized
+}
+
+func sanitizeKeyForAzure(key string) string {
+	return azureSanitizer.sanitizeKey(key)
+}
+
+// AzureFileClient gets and updates the metadata of Azure File shares
+type AzureFileClient interface {
+	GetShare(ctx context.Context, subscription, resourceGroup, account, share string) (*armstorage.FileShare, error)
+	UpdateShareMetadata(ctx context.Context, subscription, resourceGroup, account, share string, metadata map[string]*string) error
+}
+
+type azureFileClient struct {
+	credential azcore.TokenCredential
+
+	mu      sync.Mutex
+	clients map[string]*armstorage.FileSharesClient
+}
+
+func newAzureFileClient() (AzureFileClient, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &azureFileClient{credential: credential, clients: map[string]*armstorage.FileSharesClient{}}, nil
+}
+
+// fileSharesClient returns the file shares client for the subscription,
+// creating it on first use
+func (c *azureFileClient) fileSharesClient(subscription string) (*armstorage.FileSharesClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[subscription]; ok {
+		return client, nil
+	}
+	client, err := armstorage.NewFileSharesClient(subscription, c.credential, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[subscription] = client
+	return client, nil
+}
+
+func (c *azureFileClient) GetShare(ctx context.Context, subscription, resourceGroup, account, share string) (*armstorage.FileShare, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	client, err := c.fileSharesClient(subscription)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(ctx, resourceGroup, account, share, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.FileShare, nil
+}
+
+// UpdateShareMetadata replaces the metadata of the file share
+func (c *azureFileClient) UpdateShareMetadata(ctx context.Context, subscription, resourceGroup, account, share string, metadata map[string]*string) error {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	client, err := c.fileSharesClient(subscription)
+	if err != nil {
+		return err
+	}
+	_, err = client.Update(ctx, resourceGroup, account, share, armstorage.FileShare{
+		FileShareProperties: &armstorage.FileShareProperties{Metadata: metadata},
+	}, nil)
+	return err
+}
+
+// azureFileShare identifies an Azure File share
+type azureFileShare struct {
+	subscription  string
+	resourceGroup string
+	account       string
+	share         string
+}
+
+// parseAzureFileVolumeHandle parses the volume handle of the Azure File CSI
+// driver, {resource-group}#{account}#{share}#{disk}#{uuid}#{secret-namespace}#{subscription}.
+// Only the first three fields are required; azureSubscriptionID is used when
+// the handle has no subscription.
+func parseAzureFileVolumeHandle(id string) (azureFileShare, error) {
+	parts := strings.Split(id, "#")
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return azureFileShare{}, fmt.Errorf("invalid Azure File volume handle %q", id)
+	}
+	fs := azureFileShare{subscription: azureSubscriptionID, resourceGroup: parts[0], account: parts[1], share: parts[2]}
+	if len(parts) > 6 && parts[6] != "" {
+		fs.subscription = parts[6]
+	}
+	if fs.subscription == "" {
+		return azureFileShare{}, fmt.Errorf("no subscription for Azure File volume handle %q, set --azure-subscription-id", id)
+	}
+	return fs, nil
+}
+
+// addAzureFileShareTags merges tags into the metadata of the file share.
+// File shares don't support Azure resource tags, so their metadata is used.
+func addAzureFileShareTags(ctx context.Context, c AzureFileClient, volumeID string, tags map[string]string, storageclass string) ReconcileResult {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	sanitizedTags := sanitizeLabelsForAzureFile(tags)
+	logger.WithContext(ctx).Debug("tags to add to Azure File share", "volumeID", volumeID, "tags", sanitizedTags)
+
+	fs, err := parseAzureFileVolumeHandle(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return ReconcileResult{Err: err}
+	}
+	share, err := c.GetShare(ctx, fs.subscription, fs.resourceGroup, fs.account, fs.share)
+	if err != nil {
+		return handleGetAzureFileShareError(err, volumeID, storageclass)
+	}
+
+	current := azureFileShareMetadata(share)
+	updated := maps.Clone(current)
+	maps.Copy(updated, sanitizedTags)
+	if maps.Equal(current, updated) {
+		logger.WithContext(ctx).Debug("tags already set on Azure File share")
+		return ReconcileResult{}
+	}
+	return updateAzureFileShareMetadata(ctx, c, fs, current, updated, storageclass)
+}
+
+// deleteAzureFileShareTags removes the metadata with the given keys from the
+// file share
+func deleteAzureFileShareTags(ctx context.Context, c AzureFileClient, volumeID string, keys []string, storageclass string) ReconcileResult {
+	if len(keys) == 0 {
+		return ReconcileResult{}
+	}
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	sanitizedKeys := sanitizeKeysForAzureFile(keys)
+	logger.WithContext(ctx).Debug("tags to delete from Azure File share", "volumeID", volumeID, "tags", sanitizedKeys)
+
+	fs, err := parseAzureFileVolumeHandle(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return ReconcileResult{Err: err}
+	}
+	share, err := c.GetShare(ctx, fs.subscription, fs.resourceGroup, fs.account, fs.share)
+	if err != nil {
+		return handleGetAzureFileShareError(err, volumeID, storageclass)
+	}
+
+	current := azureFileShareMetadata(share)
+	updated := maps.Clone(current)
+	for _, k := range sanitizedKeys {
+		delete(updated, k)
+	}
+	if maps.Equal(current, updated) {
+		return ReconcileResult{}
+	}
+	return updateAzureFileShareMetadata(ctx, c, fs, current, updated, storageclass)
+}
+
+// handleGetAzureFileShareError logs the error of getting a file share. A
+// missing share is only a warning, as it may have been deleted already.
+func handleGetAzureFileShareError(err error, volumeID, storageclass string) ReconcileResult {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		log.Warnf("Azure File share %s not found", volumeID)
+		return ReconcileResult{}
+	}
+	log.Errorf("failed to get Azure File share %s: %s", volumeID, err)
+	promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+	return ReconcileResult{Err: err}
+}
+
+func updateAzureFileShareMetadata(ctx context.Context, c AzureFileClient, fs azureFileShare, current, updated map[string]string, storageclass string) ReconcileResult {
+	if skipForDryRun("set metadata on Azure File share", fs.account+"/"+fs.share, updated, storageclass) {
+		added, removed := diffLabels(current, updated)
+		return ReconcileResult{LabelsAdded: added, LabelsRemoved: removed}
+	}
+	metadata := make(map[string]*string, len(updated))
+	for k, v := range updated {
+		metadata[k] = &v
+	}
+	if err := c.UpdateShareMetadata(ctx, fs.subscription, fs.resourceGroup, fs.account, fs.share, metadata); err != nil {
+		log.WithContext(ctx).Errorf("failed to set metadata on Azure File share %s/%s: %s", fs.account, fs.share, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return ReconcileResult{Err: err}
+	}
+
+	logger.WithContext(ctx).Debug("successfully set metadata on Azure File share")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	added, removed := diffLabels(current, updated)
+	return ReconcileResult{Changed: true, LabelsAdded: added, LabelsRemoved: removed, LabelsBefore: current, LabelsAfter: updated}
+}
+
+func azureFileShareMetadata(share *armstorage.FileShare) map[string]string {
+	if share.FileShareProperties == nil {
+		return map[string]string{}
+	}
+	return azureTagsToMap(share.FileShareProperties.Metadata)
+}
+
+// sanitizeLabelsForAzureFile makes the keys valid file share metadata names.
+// Metadata names are case-insensitive C# identifiers, so keys are lowercased,
+// characters other than letters, digits and _ are replaced with _ and keys
+// starting with a digit are prefixed with _. Like with sanitizeLabelsForAzure,
+// the first of the keys that become the same name is used.
+func sanitizeLabelsForAzureFile(labels map[string]string) map[string]string {
+	labels = withoutAzureKeyCollisions(labels, sanitizeKeyForAzureFile)
+	sanitized := make(map[string]string, len(labels))
+	for k, v := range labels {
+		sanitized[sanitizeKeyForAzureFile(k)] = v
+	}
+	return sanitized
+}
+
+func sanitizeKeysForAzureFile(keys []string) []string {
+	sanitized := make([]string, 0, len(keys))
+	for _, k := range keys {
+		sanitized = append(sanitized, sanitizeKeyForAzureFile(k))
+	}
+	return sanitized
+}
+
+func sanitizeKeyForAzureFile(key string) string {
+	key = azureMetadataKeyRegMatch.ReplaceAllString(strings.ToLower(key), "_")
+	if key != "" && key[0] >= '0' && key[0] <= '9' {
+		key = "_" + key
+	}
+	return key
+}
@@ -0,0 +1,805 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+type fakeAzureDiskClient struct {
+	tags      map[string]*string
+	getErr    error
+	updateErr error
+
+	snapshots         []*armcompute.Snapshot
+	listSnapshotsErr  error
+	updateSnapshotErr error
+
+	updatedTags         map[string]*string
+	updatedSnapshotTags map[string]map[string]string
+}
+
+func (c *fakeAzureDiskClient) GetDisk(ctx context.Context, subscription, resourceGroup, name string) (*armcompute.Disk, error) {
+	if c.getErr != nil {
+		return nil, c.getErr
+	}
+	return &armcompute.Disk{Name: ptr.To(name), Tags: c.tags}, nil
+}
+
+func (c *fakeAzureDiskClient) UpdateTags(ctx context.Context, subscription, resourceGroup, name string, tags map[string]*string) error {
+	c.updatedTags = tags
+	return c.updateErr
+}
+
+func (c *fakeAzureDiskClient) ListSnapshots(ctx context.Context, subscription, resourceGroup string) ([]*armcompute.Snapshot, error) {
+	return c.snapshots, c.listSnapshotsErr
+}
+
+func (c *fakeAzureDiskClient) UpdateSnapshotTags(ctx context.Context, subscription, resourceGroup, name string, tags map[string]*string) error {
+	if c.updatedSnapshotTags == nil {
+		c.updatedSnapshotTags = map[string]map[string]string{}
+	}
+	c.updatedSnapshotTags[name] = azureTagsToMap(tags)
+	return c.updateSnapshotErr
+}
+
+// azureSnapshot returns a snapshot of the disk with the tags
+func azureSnapshot(name, diskID string, tags map[string]*string) *armcompute.Snapshot {
+	return &armcompute.Snapshot{
+		Name:       ptr.To(name),
+		Tags:       tags,
+		Properties: &armcompute.SnapshotProperties{CreationData: &armcompute.CreationData{SourceResourceID: ptr.To(diskID)}},
+	}
+}
+
+func Test_parseAzureDiskID(t *testing.T) {
+	tests := []struct {
+		id                string
+		wantSubscription  string
+		wantResourceGroup string
+		wantName          string
+		wantErr           bool
+	}{
+		{
+			id:                "/subscriptions/1234/resourceGroups/my-rg/providers/Microsoft.Compute/disks/pvc-abc",
+			wantSubscription:  "1234",
+			wantResourceGroup: "my-rg",
+			wantName:          "pvc-abc",
+		},
+		{
+			id:                "/subscriptions/1234/resourcegroups/MC_my-rg/providers/microsoft.compute/disks/pvc-abc",
+			wantSubscription:  "1234",
+			wantResourceGroup: "MC_my-rg",
+			wantName:          "pvc-abc",
+		},
+		{
+			id:      "/subscriptions/1234/resourceGroups/my-rg/providers/Microsoft.Storage/storageAccounts/abc",
+			wantErr: true,
+		},
+		{
+			id:      "pvc-abc",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			subscription, resourceGroup, name, err := parseAzureDiskID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAzureDiskID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if subscription != tt.wantSubscription || resourceGroup != tt.wantResourceGroup || name != tt.wantName {
+				t.Errorf("parseAzureDiskID() = %q, %q, %q, want %q, %q, %q", subscription, resourceGroup, name, tt.wantSubscription, tt.wantResourceGroup, tt.wantName)
+			}
+		})
+	}
+}
+
+func Test_sanitizeLabelsForAzure(t *testing.T) {
+	longKey := strings.Repeat("k", 600)
+	longValue := strings.Repeat("v", 300)
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   map[string]string
+	}{
+		{
+			name:   "valid labels",
+			labels: map[string]string{"foo": "bar", "dom.tld-key": "Value with spaces"},
+			want:   map[string]string{"foo": "bar", "dom.tld-key": "Value with spaces"},
+		},
+		{
+			name:   "forbidden characters",
+			labels: map[string]string{"dom.tld/key": "a/b", "a<b>c%d&e\\f?g": "value"},
+			want:   map[string]string{"dom.tld_key": "a/b", "a_b_c_d_e_f_g": "value"},
+		},
+		{
+			name:   "too long",
+			labels: map[string]string{longKey: longValue},
+			want:   map[string]string{longKey[:512]: longValue[:256]},
+		},
+		{
+			name:   "colliding keys",
+			labels: map[string]string{"dom.tld_key": "b", "dom.tld/key": "a", "other": "c"},
+			want:   map[string]string{"dom.tld_key": "a", "other": "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeLabelsForAzure(tt.labels); !maps.Equal(got, tt.want) {
+				t.Errorf("sanitizeLabelsForAzure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_AzureDiskLabels(t *testing.T) {
+	volumeID := "/subscriptions/1234/resourceGroups/my-rg/providers/Microsoft.Compute/disks/pvc-abc"
+	tests := []struct {
+		name        string
+		client      *fakeAzureDiskClient
+		add         map[string]string
+		delete      []string
+		wantUpdated map[string]string
+		want        ReconcileResult
+	}{
+		{
+			name:        "add labels",
+			client:      &fakeAzureDiskClient{tags: map[string]*string{"existing": ptr.To("tag")}},
+			add:         map[string]string{"foo": "bar", "dom.tld/key": "value"},
+			wantUpdated: map[string]string{"existing": "tag", "foo": "bar", "dom.tld_key": "value"},
+			want: ReconcileResult{
+				Changed:      true,
+				LabelsAdded:  map[string]string{"foo": "bar", "dom.tld_key": "value"},
+				LabelsBefore: map[string]string{"existing": "tag"},
+				LabelsAfter:  map[string]string{"existing": "tag", "foo": "bar", "dom.tld_key": "value"},
+			},
+		},
+		{
+			name:   "labels already set",
+			client: &fakeAzureDiskClient{tags: map[string]*string{"foo": ptr.To("bar")}},
+			add:    map[string]string{"foo": "bar"},
+			want:   ReconcileResult{},
+		},
+		{
+			name:        "delete labels",
+			client:      &fakeAzureDiskClient{tags: map[string]*string{"foo": ptr.To("bar"), "dom.tld_key": ptr.To("value"), "keep": ptr.To("me")}},
+			delete:      []string{"foo", "dom.tld/key"},
+			wantUpdated: map[string]string{"keep": "me"},
+			want: ReconcileResult{
+				Changed:       true,
+				LabelsRemoved: map[string]string{"foo": "bar", "dom.tld_key": "value"},
+				LabelsBefore:  map[string]string{"foo": "bar", "dom.tld_key": "value", "keep": "me"},
+				LabelsAfter:   map[string]string{"keep": "me"},
+			},
+		},
+		{
+			name:   "no matching labels to delete",
+			client: &fakeAzureDiskClient{tags: map[string]*string{"keep": ptr.To("me")}},
+			delete: []string{"foo"},
+			want:   ReconcileResult{},
+		},
+		{
+			name:   "get disk error",
+			client: &fakeAzureDiskClient{getErr: errors.New("boom")},
+			add:    map[string]string{"foo": "bar"},
+			want:   ReconcileResult{Err: errors.New("boom")},
+		},
+		{
+			name:        "update error",
+			client:      &fakeAzureDiskClient{updateErr: errors.New("boom")},
+			add:         map[string]string{"foo": "bar"},
+			wantUpdated: map[string]string{"foo": "bar"},
+			want:        ReconcileResult{Err: errors.New("boom")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ReconcileResult
+			if tt.add != nil {
+				got = addAzureDiskLabels(context.Background(), tt.client, volumeID, tt.add, "managed-csi")
+			} else {
+				got = deleteAzureDiskLabels(context.Background(), tt.client, volumeID, tt.delete, "managed-csi")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %+v, want %+v", got, tt.want)
+			}
+			if tt.wantUpdated == nil {
+				if tt.client.updatedTags != nil {
+					t.Errorf("UpdateTags() called with %v", azureTagsToMap(tt.client.updatedTags))
+				}
+				return
+			}
+			if got := azureTagsToMap(tt.client.updatedTags); !maps.Equal(got, tt.wantUpdated) {
+				t.Errorf("UpdateTags() tags = %v, want %v", got, tt.wantUpdated)
+			}
+		})
+	}
+}
+
+func Test_AzureSnapshotTags(t *testing.T) {
+	volumeID := "/subscriptions/1234/resourceGroups/my-rg/providers/Microsoft.Compute/disks/pvc-abc"
+	otherDisk := "/subscriptions/1234/resourceGroups/my-rg/providers/Microsoft.Compute/disks/pvc-other"
+	snapshots := func() []*armcompute.Snapshot {
+		return []*armcompute.Snapshot{
+			azureSnapshot("snap-1", volumeID, map[string]*string{"existing": ptr.To("tag"), "foo": ptr.To("old")}),
+			azureSnapshot("snap-2", strings.ToLower(volumeID), nil),
+			azureSnapshot("snap-other", otherDisk, nil),
+			{Name: ptr.To("snap-no-source")},
+		}
+	}
+	tests := []struct {
+		name        string
+		client      *fakeAzureDiskClient
+		add         map[string]string
+		delete      []string
+		wantUpdated map[string]map[string]string
+		wantErr     bool
+	}{
+		{
+			name:   "add tags to the snapshots of the disk",
+			client: &fakeAzureDiskClient{snapshots: snapshots()},
+			add:    map[string]string{"foo": "bar", "dom.tld/key": "value"},
+			wantUpdated: map[string]map[string]string{
+				"snap-1": {"existing": "tag", "foo": "bar", "dom.tld_key": "value"},
+				"snap-2": {"foo": "bar", "dom.tld_key": "value"},
+			},
+		},
+		{
+			name:        "delete tags from the snapshots of the disk",
+			client:      &fakeAzureDiskClient{snapshots: snapshots()},
+			delete:      []string{"foo"},
+			wantUpdated: map[string]map[string]string{"snap-1": {"existing": "tag"}},
+		},
+		{
+			name:   "tags already set",
+			client: &fakeAzureDiskClient{snapshots: []*armcompute.Snapshot{azureSnapshot("snap-1", volumeID, map[string]*string{"foo": ptr.To("bar")})}},
+			add:    map[string]string{"foo": "bar"},
+		},
+		{
+			name:    "list error",
+			client:  &fakeAzureDiskClient{listSnapshotsErr: errors.New("boom")},
+			add:     map[string]string{"foo": "bar"},
+			wantErr: true,
+		},
+		{
+			name:   "update error",
+			client: &fakeAzureDiskClient{snapshots: snapshots(), updateSnapshotErr: errors.New("boom")},
+			add:    map[string]string{"foo": "bar"},
+			wantUpdated: map[string]map[string]string{
+				"snap-1": {"existing": "tag", "foo": "bar"},
+				"snap-2": {"foo": "bar"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.add != nil {
+				err = addAzureSnapshotTags(context.Background(), tt.client, volumeID, tt.add, "managed-csi")
+			} else {
+				err = deleteAzureSnapshotTags(context.Background(), tt.client, volumeID, tt.delete, "managed-csi")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tt.client.updatedSnapshotTags, tt.wantUpdated) {
+				t.Errorf("UpdateSnapshotTags() tags = %v, want %v", tt.client.updatedSnapshotTags, tt.wantUpdated)
+			}
+		})
+	}
+}
+
+func Test_propagatesToSnapshots(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        bool
+	}{
+		{annotations: nil, want: false},
+		{annotations: map[string]string{propagateToSnapshotsAnnotation: "true"}, want: true},
+		{annotations: map[string]string{propagateToSnapshotsAnnotation: "false"}, want: false},
+		{annotations: map[string]string{propagateToSnapshotsAnnotation: "yes"}, want: false},
+	}
+	for _, tt := range tests {
+		pvc := &corev1.PersistentVolumeClaim{}
+		pvc.SetAnnotations(tt.annotations)
+		if got := propagatesToSnapshots(pvc); got != tt.want {
+			t.Errorf("propagatesToSnapshots(%v) = %v, want %v", tt.annotations, got, tt.want)
+		}
+	}
+}
+
+func Test_AzureDiskLabelsTagLimit(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { protectedLabelKeys = old }(protectedLabelKeys)
+	cloud = AZURE
+	volumeID := "/subscriptions/1234/resourceGroups/my-rg/providers/Microsoft.Compute/disks/pvc-abc"
+	numberedLabels := func(prefix string, n int) map[string]string {
+		labels := make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			labels[fmt.Sprintf("%s%02d", prefix, i)] = "value"
+		}
+		return labels
+	}
+	union := func(labels ...map[string]string) map[string]string {
+		m := map[string]string{}
+		for _, l := range labels {
+			maps.Copy(m, l)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name        string
+		current     map[string]string
+		add         map[string]string
+		protected   []string
+		wantDropped []string
+		wantRemoved []string
+		wantUpdate  bool
+	}{
+		{
+			name:       "exactly 50 labels",
+			add:        numberedLabels("pvc", 50),
+			wantUpdate: true,
+		},
+		{
+			name:        "51 labels",
+			add:         numberedLabels("pvc", 51),
+			wantDropped: []string{"pvc50"},
+			wantUpdate:  true,
+		},
+		{
+			name:       "external tags and labels add up to 50",
+			current:    numberedLabels("disk", 45),
+			add:        numberedLabels("pvc", 5),
+			wantUpdate: true,
+		},
+		{
+			name:        "external tags are removed for the labels",
+			current:     numberedLabels("disk", 45),
+			add:         numberedLabels("pvc", 6),
+			wantRemoved: []string{"disk44"},
+			wantUpdate:  true,
+		},
+		{
+			name:        "disk already at the limit",
+			current:     union(numberedLabels("disk", 48), numberedLabels("pvc", 2)),
+			add:         numberedLabels("pvc", 3),
+			wantRemoved: []string{"disk47"},
+			wantUpdate:  true,
+		},
+		{
+			name:    "labels already set on a disk at the limit",
+			current: union(numberedLabels("disk", 48), numberedLabels("pvc", 2)),
+			add:     numberedLabels("pvc", 2),
+		},
+		{
+			name:        "protected tags aren't removed",
+			current:     numberedLabels("disk", 45),
+			add:         numberedLabels("pvc", 6),
+			protected:   []string{"disk43", "disk44"},
+			wantRemoved: []string{"disk42"},
+			wantUpdate:  true,
+		},
+		{
+			name:        "labels are dropped for protected tags",
+			current:     union(numberedLabels("keep", 2), numberedLabels("disk", 1)),
+			add:         numberedLabels("pvc", 49),
+			protected:   []string{"keep00", "keep01"},
+			wantDropped: []string{"pvc48"},
+			wantRemoved: []string{"disk00"},
+			wantUpdate:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := make(map[string]*string, len(tt.current))
+			for k, v := range tt.current {
+				tags[k] = ptr.To(v)
+			}
+			client := &fakeAzureDiskClient{tags: tags}
+			storageclass := "managed-" + strings.ReplaceAll(tt.name, " ", "-")
+			protectedLabelKeys = tt.protected
+
+			res := addAzureDiskLabels(context.Background(), client, volumeID, tt.add, storageclass)
+			if res.Err != nil {
+				t.Fatalf("addAzureDiskLabels() error = %v", res.Err)
+			}
+			if !slices.Equal(res.LabelsDropped, tt.wantDropped) {
+				t.Errorf("addAzureDiskLabels() dropped %v, want %v", res.LabelsDropped, tt.wantDropped)
+			}
+			if skipped := testutil.ToFloat64(promLabelsSkipped.WithLabelValues(labelsSkippedQuotaExceeded, AZURE, storageclass)); skipped != float64(len(tt.wantDropped)) {
+				t.Errorf("promLabelsSkipped = %v, want %v", skipped, len(tt.wantDropped))
+			}
+			if !slices.Equal(res.TagsRemoved, tt.wantRemoved) {
+				t.Errorf("addAzureDiskLabels() removed tags %v, want %v", res.TagsRemoved, tt.wantRemoved)
+			}
+			if removed := testutil.ToFloat64(promLabelsSkipped.WithLabelValues(labelsSkippedTagRemoved, AZURE, storageclass)); removed != float64(len(tt.wantRemoved)) {
+				t.Errorf("promLabelsSkipped{reason=%q} = %v, want %v", labelsSkippedTagRemoved, removed, len(tt.wantRemoved))
+			}
+			if !tt.wantUpdate {
+				if client.updatedTags != nil {
+					t.Errorf("UpdateTags() called with %v", azureTagsToMap(client.updatedTags))
+				}
+				return
+			}
+
+			updated := azureTagsToMap(client.updatedTags)
+			if len(updated) > azureMaxTags {
+				t.Errorf("UpdateTags() got %d tags, want at most %d", len(updated), azureMaxTags)
+			}
+			for k := range tt.add {
+				if _, ok := updated[k]; !ok && !slices.Contains(tt.wantDropped, k) {
+					t.Errorf("UpdateTags() is missing label %s", k)
+				}
+			}
+			var removed []string
+			for k := range tt.current {
+				if _, ok := updated[k]; !ok {
+					removed = append(removed, k)
+				}
+			}
+			slices.Sort(removed)
+			if !slices.Equal(removed, tt.wantRemoved) {
+				t.Errorf("UpdateTags() removed %v, want %v", removed, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+type fakeAzureFileClient struct {
+	metadata  map[string]*string
+	getErr    error
+	updateErr error
+
+	gotShare        azureFileShare
+	updatedMetadata map[string]*string
+}
+
+func (c *fakeAzureFileClient) GetShare(ctx context.Context, subscription, resourceGroup, account, share string) (*armstorage.FileShare, error) {
+	c.gotShare = azureFileShare{subscription: subscription, resourceGroup: resourceGroup, account: account, share: share}
+	if c.getErr != nil {
+		return nil, c.getErr
+	}
+	return &armstorage.FileShare{Name: ptr.To(share), FileShareProperties: &armstorage.FileShareProperties{Metadata: c.metadata}}, nil
+}
+
+func (c *fakeAzureFileClient) UpdateShareMetadata(ctx context.Context, subscription, resourceGroup, account, share string, metadata map[string]*string) error {
+	c.updatedMetadata = metadata
+	return c.updateErr
+}
+
+func Test_azureDiskZone(t *testing.T) {
+	zoneTerm := func(key string, zones ...string) corev1.NodeSelectorTerm {
+		return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+			{Key: key, Operator: corev1.NodeSelectorOpIn, Values: zones},
+		}}
+	}
+	tests := []struct {
+		name         string
+		nodeAffinity *corev1.VolumeNodeAffinity
+		wantZone     string
+		wantOk       bool
+	}{
+		{
+			name:         "single zone",
+			nodeAffinity: &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{zoneTerm(azureDiskZoneTopologyKey, "eastus-1")}}},
+			wantZone:     "eastus-1",
+			wantOk:       true,
+		},
+		{
+			name: "same zone in several terms",
+			nodeAffinity: &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				zoneTerm(azureDiskZoneTopologyKey, "eastus-1"),
+				zoneTerm(azureDiskZoneTopologyKey, "eastus-1"),
+			}}},
+			wantZone: "eastus-1",
+			wantOk:   true,
+		},
+		{
+			name:         "multi-zone expression",
+			nodeAffinity: &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{zoneTerm(azureDiskZoneTopologyKey, "eastus-1", "eastus-2")}}},
+		},
+		{
+			name: "multi-zone terms",
+			nodeAffinity: &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				zoneTerm(azureDiskZoneTopologyKey, "eastus-1"),
+				zoneTerm(azureDiskZoneTopologyKey, "eastus-2"),
+			}}},
+		},
+		{
+			name:         "other topology key",
+			nodeAffinity: &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{zoneTerm("topology.kubernetes.io/zone", "eastus-1")}}},
+		},
+		{
+			name:         "no required node affinity",
+			nodeAffinity: &corev1.VolumeNodeAffinity{},
+		},
+		{
+			name: "no node affinity",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{NodeAffinity: tt.nodeAffinity}}
+			zone, ok := azureDiskZone(pv)
+			if zone != tt.wantZone || ok != tt.wantOk {
+				t.Errorf("azureDiskZone() = %q, %v, want %q, %v", zone, ok, tt.wantZone, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_withAzureZoneTag(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old bool) { azureInjectZoneTag = old }(azureInjectZoneTag)
+
+	pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{NodeAffinity: &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+			{Key: azureDiskZoneTopologyKey, Operator: corev1.NodeSelectorOpIn, Values: []string{"eastus-1"}},
+		}}}},
+	}}}
+	tests := []struct {
+		name          string
+		cloud         string
+		inject        bool
+		provisionedBy string
+		tags          map[string]string
+		want          map[string]string
+	}{
+		{
+			name:          "zone injected",
+			cloud:         AZURE,
+			inject:        true,
+			provisionedBy: AZURE_DISK_CSI,
+			tags:          map[string]string{"foo": "bar"},
+			want:          map[string]string{"foo": "bar", azureZoneTagKey: "eastus-1"},
+		},
+		{
+			name:          "disabled",
+			cloud:         AZURE,
+			provisionedBy: AZURE_DISK_CSI,
+			tags:          map[string]string{"foo": "bar"},
+			want:          map[string]string{"foo": "bar"},
+		},
+		{
+			name:          "PVC tag wins",
+			cloud:         AZURE,
+			inject:        true,
+			provisionedBy: AZURE_DISK_CSI,
+			tags:          map[string]string{azureZoneTagKey: "mine"},
+			want:          map[string]string{azureZoneTagKey: "mine"},
+		},
+		{
+			name:          "Azure File share",
+			cloud:         AZURE,
+			inject:        true,
+			provisionedBy: AZURE_FILE_CSI,
+			tags:          map[string]string{"foo": "bar"},
+			want:          map[string]string{"foo": "bar"},
+		},
+		{
+			name:          "not azure",
+			cloud:         GCP,
+			inject:        true,
+			provisionedBy: AZURE_DISK_CSI,
+			tags:          map[string]string{"foo": "bar"},
+			want:          map[string]string{"foo": "bar"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud, azureInjectZoneTag = tt.cloud, tt.inject
+			if got := withAzureZoneTag(context.Background(), pv, tt.provisionedBy, tt.tags); !maps.Equal(got, tt.want) {
+				t.Errorf("withAzureZoneTag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseAzureFileVolumeHandle(t *testing.T) {
+	defer func(old string) { azureSubscriptionID = old }(azureSubscriptionID)
+	azureSubscriptionID = "default-sub"
+
+	tests := []struct {
+		id      string
+		want    azureFileShare
+		wantErr bool
+	}{
+		{
+			id:   "my-rg#myaccount#pvc-abc###",
+			want: azureFileShare{subscription: "default-sub", resourceGroup: "my-rg", account: "myaccount", share: "pvc-abc"},
+		},
+		{
+			id:   "my-rg#myaccount#pvc-abc",
+			want: azureFileShare{subscription: "default-sub", resourceGroup: "my-rg", account: "myaccount", share: "pvc-abc"},
+		},
+		{
+			id:   "my-rg#myaccount#pvc-abc#disk#uuid#default#1234",
+			want: azureFileShare{subscription: "1234", resourceGroup: "my-rg", account: "myaccount", share: "pvc-abc"},
+		},
+		{
+			id:      "my-rg#myaccount",
+			wantErr: true,
+		},
+		{
+			id:      "#myaccount#pvc-abc",
+			wantErr: true,
+		},
+		{
+			id:      "/subscriptions/1234/resourceGroups/my-rg/providers/Microsoft.Compute/disks/pvc-abc",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := parseAzureFileVolumeHandle(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAzureFileVolumeHandle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseAzureFileVolumeHandle() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	azureSubscriptionID = ""
+	if _, err := parseAzureFileVolumeHandle("my-rg#myaccount#pvc-abc"); err == nil {
+		t.Error("parseAzureFileVolumeHandle() without a subscription, want error")
+	}
+}
+
+func Test_sanitizeLabelsForAzureFile(t *testing.T) {
+	labels := map[string]string{"Foo": "Bar", "dom.tld/key": "a/b", "1st-key": "value"}
+	want := map[string]string{"foo": "Bar", "dom_tld_key": "a/b", "_1st_key": "value"}
+	if got := sanitizeLabelsForAzureFile(labels); !maps.Equal(got, want) {
+		t.Errorf("sanitizeLabelsForAzureFile() = %v, want %v", got, want)
+	}
+
+	colliding := map[string]string{"team": "b", "Team": "a"}
+	for range 10 {
+		if got, want := sanitizeLabelsForAzureFile(colliding), map[string]string{"team": "a"}; !maps.Equal(got, want) {
+			t.Fatalf("sanitizeLabelsForAzureFile() = %v, want %v", got, want)
+		}
+	}
+}
+
+func Test_AzureFileShareTags(t *testing.T) {
+	volumeID := "my-rg#myaccount#pvc-abc#disk#uuid#default#1234"
+	notFound := &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: "ShareNotFound"}
+	authErr := &azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: "AuthorizationFailed"}
+	tests := []struct {
+		name        string
+		client      *fakeAzureFileClient
+		add         map[string]string
+		delete      []string
+		wantUpdated map[string]string
+		want        ReconcileResult
+	}{
+		{
+			name:        "add tags",
+			client:      &fakeAzureFileClient{metadata: map[string]*string{"existing": ptr.To("tag")}},
+			add:         map[string]string{"foo": "bar", "dom.tld/key": "value"},
+			wantUpdated: map[string]string{"existing": "tag", "foo": "bar", "dom_tld_key": "value"},
+			want: ReconcileResult{
+				Changed:      true,
+				LabelsAdded:  map[string]string{"foo": "bar", "dom_tld_key": "value"},
+				LabelsBefore: map[string]string{"existing": "tag"},
+				LabelsAfter:  map[string]string{"existing": "tag", "foo": "bar", "dom_tld_key": "value"},
+			},
+		},
+		{
+			name:        "add tags to share without metadata",
+			client:      &fakeAzureFileClient{},
+			add:         map[string]string{"foo": "bar"},
+			wantUpdated: map[string]string{"foo": "bar"},
+			want: ReconcileResult{
+				Changed:      true,
+				LabelsAdded:  map[string]string{"foo": "bar"},
+				LabelsBefore: map[string]string{},
+				LabelsAfter:  map[string]string{"foo": "bar"},
+			},
+		},
+		{
+			name:   "tags already set",
+			client: &fakeAzureFileClient{metadata: map[string]*string{"foo": ptr.To("bar")}},
+			add:    map[string]string{"foo": "bar"},
+			want:   ReconcileResult{},
+		},
+		{
+			name:        "delete tags",
+			client:      &fakeAzureFileClient{metadata: map[string]*string{"foo": ptr.To("bar"), "keep": ptr.To("me")}},
+			delete:      []string{"foo"},
+			wantUpdated: map[string]string{"keep": "me"},
+			want: ReconcileResult{
+				Changed:       true,
+				LabelsRemoved: map[string]string{"foo": "bar"},
+				LabelsBefore:  map[string]string{"foo": "bar", "keep": "me"},
+				LabelsAfter:   map[string]string{"keep": "me"},
+			},
+		},
+		{
+			name:   "share not found",
+			client: &fakeAzureFileClient{getErr: notFound},
+			add:    map[string]string{"foo": "bar"},
+			want:   ReconcileResult{},
+		},
+		{
+			name:   "share not found on delete",
+			client: &fakeAzureFileClient{getErr: notFound},
+			delete: []string{"foo"},
+			want:   ReconcileResult{},
+		},
+		{
+			name:   "authentication error",
+			client: &fakeAzureFileClient{getErr: authErr},
+			add:    map[string]string{"foo": "bar"},
+			want:   ReconcileResult{Err: authErr},
+		},
+		{
+			name:        "update error",
+			client:      &fakeAzureFileClient{updateErr: authErr},
+			add:         map[string]string{"foo": "bar"},
+			wantUpdated: map[string]string{"foo": "bar"},
+			want:        ReconcileResult{Err: authErr},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ReconcileResult
+			if tt.add != nil {
+				got = addAzureFileShareTags(context.Background(), tt.client, volumeID, tt.add, "azurefile-csi")
+			} else {
+				got = deleteAzureFileShareTags(context.Background(), tt.client, volumeID, tt.delete, "azurefile-csi")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %+v, want %+v", got, tt.want)
+			}
+			wantShare := azureFileShare{subscription: "1234", resourceGroup: "my-rg", account: "myaccount", share: "pvc-abc"}
+			if tt.client.gotShare != wantShare {
+				t.Errorf("GetShare() share = %+v, want %+v", tt.client.gotShare, wantShare)
+			}
+			if tt.wantUpdated == nil {
+				if tt.client.updatedMetadata != nil {
+					t.Errorf("UpdateShareMetadata() called with %v", azureTagsToMap(tt.client.updatedMetadata))
+				}
+				return
+			}
+			if got := azureTagsToMap(tt.client.updatedMetadata); !maps.Equal(got, tt.wantUpdated) {
+				t.Errorf("UpdateShareMetadata() metadata = %v, want %v", got, tt.wantUpdated)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// circuitState is the state of a circuitBreaker, as exported by the
+// k8s_pvc_tagger_circuit_breaker_state metric
+type circuitState int
+
+const (
+	// circuitClosed lets every cloud API call through
+	circuitClosed circuitState = iota
+	// circuitOpen blocks every cloud API call until the timeout passed
+	circuitOpen
+	// circuitHalfOpen lets calls through again. The first failure opens the
+	// circuit again and the first success closes it.
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// errCircuitOpen is returned for the PVCs that aren't reconciled while the
+// circuit is open
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// cloudBreaker stops calling the cloud API after it failed repeatedly. It is
+// nil, and never opens, when --circuit-breaker-threshold is 0.
+var cloudBreaker *circuitBreaker
+
+// circuitBreaker opens after threshold consecutive cloud API failures and
+// lets calls through again once it has been open for timeout
+type circuitBreaker struct {
+	provider  string
+	threshold int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(provider string, threshold int, timeout time.Duration) *circuitBreaker {
+	b := &circuitBreaker{provider: provider, threshold: threshold, timeout: timeout}
+	b.setState(circuitClosed)
+	return b
+}
+
+// allow returns errCircuitOpen while the circuit is open
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen {
+		if clock.Since(b.openedAt) < b.timeout {
+			return errCircuitOpen
+		}
+		log.WithFields(log.Fields{"cloud": b.provider}).Infoln("Circuit breaker is half-open, retrying cloud API calls")
+		b.setState(circuitHalfOpen)
+	}
+	return nil
+}
+
+// record updates the circuit with the outcome of a cloud API call. Only
+// errors returned by isCloudAPIFailure count as failures.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isCloudAPIFailure(err) {
+		if b.state != circuitClosed {
+			log.WithFields(log.Fields{"cloud": b.provider}).Infoln("Circuit breaker is closed")
+		}
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.threshold) {
+		log.WithFields(log.Fields{"cloud": b.provider, "failures": b.failures, "timeout": b.timeout}).Warnln("Circuit breaker is open, pausing cloud API calls:", err)
+		b.openedAt = clock.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state circuitState) {
+	b.state = state
+	promCircuitBreakerState.WithLabelValues(b.provider).Set(float64(state))
+}
+
+// isCloudAPIFailure reports whether err shows the cloud API is unavailable:
+// a rate limit or server error response, a timeout or a network error. Errors
+// caused by a single PVC, such as a volume that doesn't exist, don't count.
+func isCloudAPIFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var gcpErr *googleapi.Error
+	if errors.As(err, &gcpErr) {
+		return isFailureStatusCode(gcpErr.Code)
+	}
+	var awsErr awserr.RequestFailure
+	if errors.As(err, &awsErr) {
+		return isFailureStatusCode(awsErr.StatusCode())
+	}
+	var azureErr *azcore.ResponseError
+	if errors.As(err, &azureErr) {
+		return isFailureStatusCode(azureErr.StatusCode)
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+func isFailureStatusCode(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
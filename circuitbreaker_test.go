@@ -0,0 +1,256 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clocks "k8s.io/utils/clock"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	clock = fakeClock
+	defer func() { clock = clocks.RealClock{} }()
+
+	failure := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	type step struct {
+		advance   time.Duration
+		record    []error
+		wantAllow bool
+		wantState circuitState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "stays closed below the threshold",
+			steps: []step{
+				{record: []error{failure, failure}, wantAllow: true, wantState: circuitClosed},
+			},
+		},
+		{
+			name: "success resets the failure count",
+			steps: []step{
+				{record: []error{failure, failure, nil, failure, failure}, wantAllow: true, wantState: circuitClosed},
+			},
+		},
+		{
+			name: "errors that aren't API failures reset the failure count",
+			steps: []step{
+				{record: []error{failure, failure, &googleapi.Error{Code: http.StatusNotFound}, failure}, wantAllow: true, wantState: circuitClosed},
+			},
+		},
+		{
+			name: "opens at the threshold",
+			steps: []step{
+				{record: []error{failure, failure, failure}, wantAllow: false, wantState: circuitOpen},
+				{advance: 59 * time.Second, wantAllow: false, wantState: circuitOpen},
+			},
+		},
+		{
+			name: "half-open after the timeout then closed on success",
+			steps: []step{
+				{record: []error{failure, failure, failure}, wantAllow: false, wantState: circuitOpen},
+				{advance: time.Minute, wantAllow: true, wantState: circuitHalfOpen},
+				{record: []error{nil}, wantAllow: true, wantState: circuitClosed},
+				{record: []error{failure, failure}, wantAllow: true, wantState: circuitClosed},
+			},
+		},
+		{
+			name: "half-open reopens on the first failure",
+			steps: []step{
+				{record: []error{failure, failure, failure}, wantAllow: false, wantState: circuitOpen},
+				{advance: time.Minute, wantAllow: true, wantState: circuitHalfOpen},
+				{record: []error{failure}, wantAllow: false, wantState: circuitOpen},
+				{advance: 30 * time.Second, wantAllow: false, wantState: circuitOpen},
+				{advance: 30 * time.Second, wantAllow: true, wantState: circuitHalfOpen},
+			},
+		},
+		{
+			name: "failures of calls in flight don't extend the timeout",
+			steps: []step{
+				{record: []error{failure, failure, failure}, wantAllow: false, wantState: circuitOpen},
+				{advance: 30 * time.Second, record: []error{failure}, wantAllow: false, wantState: circuitOpen},
+				{advance: 30 * time.Second, wantAllow: true, wantState: circuitHalfOpen},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker("test", 3, time.Minute)
+			for i, s := range tt.steps {
+				fakeClock.SetTime(fakeClock.Now().Add(s.advance))
+				for _, err := range s.record {
+					b.record(err)
+				}
+				err := b.allow()
+				if (err == nil) != s.wantAllow {
+					t.Errorf("step %d: allow() = %v, want allowed %v", i, err, s.wantAllow)
+				}
+				if b.state != s.wantState {
+					t.Errorf("step %d: state = %s, want %s", i, b.state, s.wantState)
+				}
+				if got := testutil.ToFloat64(promCircuitBreakerState.WithLabelValues("test")); got != float64(s.wantState) {
+					t.Errorf("step %d: state metric = %v, want %v", i, got, float64(s.wantState))
+				}
+			}
+		})
+	}
+}
+
+func Test_circuitBreakerNil(t *testing.T) {
+	var b *circuitBreaker
+	for i := 0; i < 10; i++ {
+		b.record(&googleapi.Error{Code: http.StatusServiceUnavailable})
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("allow() = %v, want nil", err)
+	}
+}
+
+func Test_isCloudAPIFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "other error", err: errors.New("invalid volume handle format"), want: false},
+		{name: "gcp rate limit", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: true},
+		{name: "gcp server error", err: &googleapi.Error{Code: http.StatusBadGateway}, want: true},
+		{name: "gcp not found", err: &googleapi.Error{Code: http.StatusNotFound}, want: false},
+		{name: "wrapped gcp server error", err: fmt.Errorf("%w: %w", errRequeue, &googleapi.Error{Code: http.StatusInternalServerError}), want: true},
+		{name: "aws throttling", err: awserr.NewRequestFailure(awserr.New("Throttling", "rate exceeded", nil), http.StatusTooManyRequests, "req"), want: true},
+		{name: "aws unavailable", err: awserr.NewRequestFailure(awserr.New("Unavailable", "unavailable", nil), http.StatusServiceUnavailable, "req"), want: true},
+		{name: "aws invalid volume", err: awserr.NewRequestFailure(awserr.New("InvalidVolume.NotFound", "not found", nil), http.StatusBadRequest, "req"), want: false},
+		{name: "azure server error", err: &azcore.ResponseError{StatusCode: http.StatusInternalServerError}, want: true},
+		{name: "azure forbidden", err: &azcore.ResponseError{StatusCode: http.StatusForbidden}, want: false},
+		{name: "timeout", err: context.DeadlineExceeded, want: true},
+		{name: "network error", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCloudAPIFailure(tt.err); got != tt.want {
+				t.Errorf("isCloudAPIFailure(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reconcileAddCircuitBreaker(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old *circuitBreaker) { cloudBreaker = old }(cloudBreaker)
+	defer func(old int) { cloudRetryAttempts = old }(cloudRetryAttempts)
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	clock = fakeClock
+	defer func() { clock = clocks.RealClock{} }()
+	cloud = GCP
+	cloudRetryAttempts = 1
+	cloudBreaker = newCircuitBreaker(GCP, 2, time.Minute)
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	var setLabelsErr error = &googleapi.Error{Code: http.StatusServiceUnavailable}
+	calls := 0
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			calls++
+			if setLabelsErr != nil {
+				return nil, setLabelsErr
+			}
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+
+	// two failures open the circuit
+	for i := 0; i < 2; i++ {
+		if err := r.reconcileAdd(context.Background(), pvc); err != nil {
+			t.Fatalf("reconcileAdd() = %v, want nil", err)
+		}
+	}
+	err := r.reconcileAdd(context.Background(), pvc)
+	if !errors.Is(err, errRequeue) || !errors.Is(err, errCircuitOpen) {
+		t.Errorf("reconcileAdd() with the circuit open = %v, want a requeued %v", err, errCircuitOpen)
+	}
+	if calls != 2 {
+		t.Errorf("SetDiskLabels() called %d times, want 2", calls)
+	}
+
+	// after the timeout the next call goes through and closes the circuit
+	fakeClock.SetTime(fakeClock.Now().Add(time.Minute))
+	setLabelsErr = nil
+	if err := r.reconcileAdd(context.Background(), pvc); err != nil {
+		t.Errorf("reconcileAdd() with the circuit half-open = %v, want nil", err)
+	}
+	if calls != 3 {
+		t.Errorf("SetDiskLabels() called %d times, want 3", calls)
+	}
+	if cloudBreaker.state != circuitClosed {
+		t.Errorf("state = %s, want %s", cloudBreaker.state, circuitClosed)
+	}
+}
@@ -0,0 +1,127 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// cloudAuto detects the cloud provider from the CSI drivers of the
+// PersistentVolumes in the cluster, see detectCloudProvider
+const cloudAuto = "auto"
+
+// driverCloudProviders maps the supported CSI drivers and in-tree
+// provisioners to the cloud provider of their volumes
+var driverCloudProviders = map[string]string{
+	AWS_EBS_CSI:       AWS,
+	AWS_EBS_LEGACY:    AWS,
+	AWS_EFS_CSI:       AWS,
+	AWS_FSX_CSI:       AWS,
+	GCP_PD_CSI:        GCP,
+	GCP_PD_LEGACY:     GCP,
+	GCP_BIGTABLE_CSI:  GCP,
+	GCP_FILESTORE_CSI: GCP,
+	AZURE_DISK_CSI:    AZURE,
+	AZURE_DISK_LEGACY: AZURE,
+	AZURE_FILE_CSI:    AZURE,
+}
+
+// getPVDriver returns the spec.csi.driver of the PV. In-tree volumes have no
+// CSI driver, so their provisioned-by annotation is returned instead.
+func getPVDriver(pv *corev1.PersistentVolume) (string, bool) {
+	if pv.Spec.CSI != nil && pv.Spec.CSI.Driver != "" {
+		return pv.Spec.CSI.Driver, true
+	}
+	provisionedBy := pv.GetAnnotations()[pvProvisionedByAnnotation]
+	return provisionedBy, provisionedBy != ""
+}
+
+// getPVCDriver looks up the PVC's bound PV in the informer cache and returns
+// the CSI driver of the volume, falling back to its provisioner like
+// getPVCProvisioner when the PV isn't cached
+func getPVCDriver(pvc *corev1.PersistentVolumeClaim) (string, bool) {
+	if pvLister != nil && pvc.Spec.VolumeName != "" {
+		if pv, err := pvLister.Get(pvc.Spec.VolumeName); err == nil {
+			if driver, ok := getPVDriver(pv); ok {
+				return driver, true
+			}
+		}
+	}
+	return getPVCProvisioner(pvc)
+}
+
+// detectCloudProvider returns the cloud provider of the volumes of the PVs for
+// --cloud-provider=auto. PVs of unknown drivers are ignored. When no PV has a
+// known driver, aws, the default before auto detection was added, is
+// returned. PVs of more than one cloud provider are an error because the
+// tagger only runs against one.
+func detectCloudProvider(pvs []corev1.PersistentVolume) (string, error) {
+	var providers []string
+	for _, pv := range pvs {
+		driver, ok := getPVDriver(&pv)
+		if !ok {
+			continue
+		}
+		if provider, ok := driverCloudProviders[driver]; ok && !slices.Contains(providers, provider) {
+			providers = append(providers, provider)
+		}
+	}
+	slices.Sort(providers)
+	switch len(providers) {
+	case 0:
+		log.Warnln("No PersistentVolume of a known CSI driver found, using the aws cloud provider")
+		return AWS, nil
+	case 1:
+		return providers[0], nil
+	default:
+		return "", fmt.Errorf("found PersistentVolumes of the cloud providers %v, set --cloud-provider", providers)
+	}
+}
+
+// skipOtherCloudProvider reports whether the PVC is skipped because the CSI
+// driver of its volume belongs to another cloud provider than the one the
+// tagger runs against. Volumes of unknown drivers aren't skipped here.
+func skipOtherCloudProvider(pvc *corev1.PersistentVolumeClaim) bool {
+	driver, ok := getPVCDriver(pvc)
+	if !ok {
+		return false
+	}
+	provider, ok := driverCloudProviders[driver]
+	if !ok || provider == cloud {
+		return false
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "driver": driver, "cloud": cloud}).Debugln("Volume belongs to another cloud provider")
+	promCloudProviderMismatchTotal.With(prometheus.Labels{"cloud_provider": cloud, "driver": driver}).Inc()
+	return true
+}
+
+// withCloudRequestTimeout returns a copy of ctx whose deadline is
+// --cloud-request-timeout away, for a single cloud API call
+func withCloudRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cloudRequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, cloudRequestTimeout)
+}
@@ -0,0 +1,184 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+)
+
+func csiPV(name, driver string) corev1.PersistentVolume {
+	return corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: name},
+			},
+		},
+	}
+}
+
+func Test_detectCloudProvider(t *testing.T) {
+	legacyPV := corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Annotations: map[string]string{pvProvisionedByAnnotation: GCP_PD_LEGACY}},
+	}
+
+	tests := []struct {
+		name    string
+		pvs     []corev1.PersistentVolume
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "gcp",
+			pvs:  []corev1.PersistentVolume{csiPV("pv-1", GCP_PD_CSI)},
+			want: GCP,
+		},
+		{
+			name: "aws",
+			pvs:  []corev1.PersistentVolume{csiPV("pv-1", AWS_EBS_CSI)},
+			want: AWS,
+		},
+		{
+			name: "azure",
+			pvs:  []corev1.PersistentVolume{csiPV("pv-1", AZURE_DISK_CSI)},
+			want: AZURE,
+		},
+		{
+			name: "several drivers of one provider",
+			pvs:  []corev1.PersistentVolume{csiPV("pv-1", AWS_EBS_CSI), csiPV("pv-2", AWS_EFS_CSI)},
+			want: AWS,
+		},
+		{
+			name: "in-tree volume",
+			pvs:  []corev1.PersistentVolume{legacyPV},
+			want: GCP,
+		},
+		{
+			name: "unknown drivers are ignored",
+			pvs:  []corev1.PersistentVolume{csiPV("pv-1", "nfs.csi.k8s.io"), csiPV("pv-2", AZURE_FILE_CSI)},
+			want: AZURE,
+		},
+		{
+			name: "no PVs",
+			want: AWS,
+		},
+		{
+			name:    "several providers",
+			pvs:     []corev1.PersistentVolume{csiPV("pv-1", GCP_PD_CSI), csiPV("pv-2", AWS_EBS_CSI)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectCloudProvider(tt.pvs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectCloudProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("detectCloudProvider() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_skipOtherCloudProvider(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func() { pvLister = nil }()
+
+	tests := []struct {
+		name           string
+		cloud          string
+		pv             *corev1.PersistentVolume
+		pvcAnnotations map[string]string
+		wantSkipped    bool
+	}{
+		{
+			name:  "matching CSI driver",
+			cloud: GCP,
+			pv:    ptr.To(csiPV("pv-1", GCP_PD_CSI)),
+		},
+		{
+			name:        "CSI driver of another provider",
+			cloud:       GCP,
+			pv:          ptr.To(csiPV("pv-1", AWS_EBS_CSI)),
+			wantSkipped: true,
+		},
+		{
+			name:        "azure driver when running in aws",
+			cloud:       AWS,
+			pv:          ptr.To(csiPV("pv-1", AZURE_FILE_CSI)),
+			wantSkipped: true,
+		},
+		{
+			name:  "unknown CSI driver",
+			cloud: AZURE,
+			pv:    ptr.To(csiPV("pv-1", "nfs.csi.k8s.io")),
+		},
+		{
+			name:           "PV not cached falls back to the provisioner annotation",
+			cloud:          AZURE,
+			pvcAnnotations: map[string]string{"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI},
+			wantSkipped:    true,
+		},
+		{
+			name:  "no driver",
+			cloud: AWS,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud = tt.cloud
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			driver := ""
+			if tt.pv != nil {
+				if err := indexer.Add(tt.pv); err != nil {
+					t.Fatal(err)
+				}
+				driver = tt.pv.Spec.CSI.Driver
+			} else if tt.pvcAnnotations != nil {
+				driver = tt.pvcAnnotations["volume.kubernetes.io/storage-provisioner"]
+			}
+			pvLister = corelisters.NewPersistentVolumeLister(indexer)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetAnnotations(tt.pvcAnnotations)
+			pvc.Spec.VolumeName = "pv-1"
+
+			before := testutil.ToFloat64(promCloudProviderMismatchTotal.WithLabelValues(tt.cloud, driver))
+			if got := skipOtherCloudProvider(pvc); got != tt.wantSkipped {
+				t.Errorf("skipOtherCloudProvider() = %v, want %v", got, tt.wantSkipped)
+			}
+			want := before
+			if tt.wantSkipped {
+				want++
+			}
+			if got := testutil.ToFloat64(promCloudProviderMismatchTotal.WithLabelValues(tt.cloud, driver)); got != want {
+				t.Errorf("promCloudProviderMismatchTotal = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -1,185 +1,1505 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"cloud.google.com/go/compute/metadata"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/bigtableadmin/v2"
 	"google.golang.org/api/compute/v1"
+	file "google.golang.org/api/file/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/api/spanner/v1"
+	htransport "google.golang.org/api/transport/http"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
 )
 
+// gcpMaxLabels is the maximum number of labels GCP allows on a resource
+const gcpMaxLabels = 64
+
+// gcpMaxLabelLength is the maximum length of GCP label keys and values. The
+// key length can be overridden with --gcp-label-key-max-length and the value
+// length lowered with --label-value-max-length.
+const gcpMaxLabelLength = 63
+
+// strategies for GCP disks that are not found, see --gcp-disk-not-found-strategy
+const (
+	diskNotFoundSkip = "skip"
+	diskNotFoundWarn = "warn"
+	diskNotFoundFail = "fail"
+)
+
+// strategies for label keys that become the same GCP key, see
+// --collision-strategy
+const (
+	collisionFirstAlphabetical = "first-alphabetical"
+	collisionLastAlphabetical  = "last-alphabetical"
+	collisionLongestValue      = "longest-value"
+	collisionError             = "error"
+)
+
+// gcpCollisionStrategy picks which of the label keys that become the same GCP
+// key is used, see resolveGCPKeyCollision
+var gcpCollisionStrategy = collisionFirstAlphabetical
+
+// gcpDefaultProject is used for volume handles without a project
+var gcpDefaultProject string
+
 type GCPClient interface {
-	GetDisk(project, zone, name string) (*compute.Disk, error)
-	SetDiskLabels(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error)
-	GetGCEOp(project, zone, name string) (*compute.Operation, error)
+	GetDisk(ctx context.Context, project, zone, name string) (*compute.Disk, error)
+	SetDiskLabels(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error)
+	GetGCEOp(ctx context.Context, project, zone, name string) (*compute.Operation, error)
+	GetRegion(ctx context.Context, project, region string) (*compute.Region, error)
+	GetRegionalDisk(ctx context.Context, project, region, name string) (*compute.Disk, error)
+	SetRegionalDiskLabels(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error)
+	GetRegionalGCEOp(ctx context.Context, project, region, name string) (*compute.Operation, error)
+	ListSnapshots(ctx context.Context, project, filter string) ([]*compute.Snapshot, error)
+	SetSnapshotLabels(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error)
+	GetGlobalGCEOp(ctx context.Context, project, name string) (*compute.Operation, error)
 }
 
 type gcpClient struct {
 	gce *compute.Service
 }
 
-func newGCPClient(ctx context.Context) (GCPClient, error) {
-	client, err := compute.NewService(ctx)
+// newImpersonatedTokenSource is replaced in tests
+var newImpersonatedTokenSource = impersonate.CredentialsTokenSource
+
+// newGCPHTTPClient returns an authenticated HTTP client for the scope whose
+// requests time out after timeout. With --gcp-impersonate-service-account the
+// default credentials are only used to get tokens of that service account
+func newGCPHTTPClient(ctx context.Context, timeout time.Duration, scope string, opts ...option.ClientOption) (*http.Client, error) {
+	if gcpImpersonateAccount != "" {
+		ts, err := newImpersonatedTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: gcpImpersonateAccount,
+			Scopes:          []string{scope},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("impersonating %s: %w", gcpImpersonateAccount, err)
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+	}
+	// option.WithHTTPClient bypasses the default credentials, so build the
+	// authenticated transport ourselves and wrap it with the timeout
+	transport, err := htransport.NewTransport(ctx, http.DefaultTransport, append(opts, option.WithScopes(scope))...)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// newGCPClient creates a GCPClient whose API calls time out after timeout
+func newGCPClient(ctx context.Context, timeout time.Duration, opts ...option.ClientOption) (GCPClient, error) {
+	httpClient, err := newGCPHTTPClient(ctx, timeout, compute.ComputeScope, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := compute.NewService(ctx, append(opts, option.WithHTTPClient(httpClient))...)
 	if err != nil {
 		return nil, err
 	}
 	return &gcpClient{gce: client}, nil
 }
 
-func (c *gcpClient) GetDisk(project, zone, name string) (*compute.Disk, error) {
-	return c.gce.Disks.Get(project, zone, name).Do()
+func (c *gcpClient) GetDisk(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.Disks.Get(project, zone, name).Context(ctx).Do()
 }
 
-func (c *gcpClient) SetDiskLabels(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
-	return c.gce.Disks.SetLabels(project, zone, name, labelReq).Do()
+func (c *gcpClient) SetDiskLabels(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.Disks.SetLabels(project, zone, name, labelReq).Context(ctx).Do()
 }
 
-func (c *gcpClient) GetGCEOp(project, zone, name string) (*compute.Operation, error) {
-	return c.gce.ZoneOperations.Get(project, zone, name).Do()
+func (c *gcpClient) GetGCEOp(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.ZoneOperations.Get(project, zone, name).Context(ctx).Do()
 }
 
-func addPDVolumeLabels(c GCPClient, volumeID string, labels map[string]string, storageclass string) {
-	sanitizedLabels := sanitizeLabelsForGCP(labels)
-	log.Debugf("labels to add to PD volume: %s: %s", volumeID, sanitizedLabels)
+func (c *gcpClient) GetRegionalDisk(ctx context.Context, project, region, name string) (*compute.Disk, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.RegionDisks.Get(project, region, name).Context(ctx).Do()
+}
+
+func (c *gcpClient) SetRegionalDiskLabels(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.RegionDisks.SetLabels(project, region, name, labelReq).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetRegionalGCEOp(ctx context.Context, project, region, name string) (*compute.Operation, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.RegionOperations.Get(project, region, name).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetRegion(ctx context.Context, project, region string) (*compute.Region, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.Regions.Get(project, region).Context(ctx).Do()
+}
+
+func (c *gcpClient) ListSnapshots(ctx context.Context, project, filter string) ([]*compute.Snapshot, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	var snapshots []*compute.Snapshot
+	err := c.gce.Snapshots.List(project).Filter(filter).Pages(ctx, func(page *compute.SnapshotList) error {
+		snapshots = append(snapshots, page.Items...)
+		return nil
+	})
+	return snapshots, err
+}
+
+func (c *gcpClient) SetSnapshotLabels(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.Snapshots.SetLabels(project, name, labelReq).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetGlobalGCEOp(ctx context.Context, project, name string) (*compute.Operation, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.gce.GlobalOperations.Get(project, name).Context(ctx).Do()
+}
+
+// getMetadataProjectID fetches the project ID from the GCE metadata server
+func getMetadataProjectID() (string, error) {
+	client := metadata.NewClient(&http.Client{Timeout: 5 * time.Second})
+	project, err := client.Get("project/project-id")
+	if err != nil {
+		return "", fmt.Errorf("could not get GCE project metadata: %w", err)
+	}
+	project = strings.TrimSpace(project)
+	if project == "" {
+		return "", fmt.Errorf("could not get valid GCE project")
+	}
+	return project, nil
+}
+
+// ReconcileResult is the outcome of syncing labels to a volume. LabelsAdded
+// and LabelsRemoved hold the sanitized labels changed on the volume and are
+// only set when Changed is true.
+type ReconcileResult struct {
+	Changed       bool
+	LabelsAdded   map[string]string
+	LabelsRemoved map[string]string
+	// LabelsDropped are the label keys not set because the resource would
+	// exceed GCP's label limit
+	LabelsDropped []string
+	// TagsRemoved are the keys of the tags set by others removed from the
+	// resource to make room for the labels within Azure's tag limit
+	TagsRemoved []string
+	// LabelsBefore and LabelsAfter are all the labels of the resource before
+	// and after the change, only set when Changed is true
+	LabelsBefore map[string]string
+	LabelsAfter  map[string]string
+	// Skipped is set when the volume wasn't found and was skipped, see
+	// --gcp-disk-not-found-strategy
+	Skipped bool
+	Err     error
+}
+
+// addPDVolumeLabels merges labels into the labels of the PD. The result's Err
+// is nil once the labels are set on the disk.
+func addPDVolumeLabels(ctx context.Context, c GCPClient, volumeID string, labels map[string]string, storageclass string) ReconcileResult {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	sanitizedLabels := withoutProtectedLabels(sanitizeLabelsForGCP(labels), volumeID)
+	logger.WithContext(ctx).Debug("labels to add to PD volume", "volumeID", volumeID, "labels", sanitizedLabels)
 
 	project, location, name, err := parseVolumeID(volumeID)
 	if err != nil {
-		log.Error(err)
-		return
+		log.WithContext(ctx).Error(err)
+		return ReconcileResult{Err: err}
+	}
+	location = pdLocation(volumeID, location)
+	if !labelCacheBypassed(ctx) && pdLabelsCached(volumeID, sanitizedLabels) {
+		logger.WithContext(ctx).Debug("labels already set on PD according to the label cache")
+		return ReconcileResult{}
 	}
-	disk, err := c.GetDisk(project, location, name)
+	disk, location, regional, err := getDisk(ctx, c, project, location, name, isRegionalVolumeID(volumeID))
 	if err != nil {
-		log.Error(err)
-		return
+		return handleGetDiskError(err, volumeID, storageclass)
 	}
 
-	// merge existing disk labels with new labels:
-	updatedLabels := make(map[string]string)
-	if disk.Labels != nil {
-		updatedLabels = maps.Clone(disk.Labels)
+	// merge existing disk labels with new labels, the protected labels were
+	// dropped from the new labels so their values on the disk are kept:
+	var dropped []string
+	merge := func(disk *compute.Disk) map[string]string {
+		updatedLabels := make(map[string]string)
+		if disk.Labels != nil {
+			updatedLabels = maps.Clone(disk.Labels)
+		}
+		dropped = mergeLabelsForGCP(updatedLabels, sanitizedLabels, volumeID, storageclass)
+		return updatedLabels
 	}
-	maps.Copy(updatedLabels, sanitizedLabels)
+	updatedLabels := merge(disk)
 	if maps.Equal(disk.Labels, updatedLabels) {
-		log.Debug("labels already set on PD")
-		return
+		logger.WithContext(ctx).Debug("labels already set on PD")
+		cachePDLabels(volumeID, disk.Labels)
+		return ReconcileResult{LabelsDropped: dropped}
 	}
 
-	req := &compute.ZoneSetLabelsRequest{
-		Labels:           updatedLabels,
-		LabelFingerprint: disk.LabelFingerprint,
+	// GCP accepts an empty fingerprint for disks that have never had labels
+	// set (e.g. newly created disks), so it is passed through as is
+	if disk.LabelFingerprint == "" {
+		logger.WithContext(ctx).Debug("PD has no label fingerprint", "volumeID", volumeID)
+	}
+	if !isValidGCPFingerprint(disk.LabelFingerprint) {
+		log.WithContext(ctx).WithFields(log.Fields{"volumeID": volumeID, "fingerprint": disk.LabelFingerprint}).Warnln("PD label fingerprint is not valid base64, skipping label update")
+		return ReconcileResult{Err: fmt.Errorf("invalid label fingerprint %q", disk.LabelFingerprint)}
+	}
+	if skipForDryRun("set labels on PD", volumeID, updatedLabels, storageclass) {
+		added, _ := diffLabels(disk.Labels, updatedLabels)
+		return ReconcileResult{LabelsAdded: added, LabelsDropped: dropped}
 	}
-	op, err := c.SetDiskLabels(project, location, name, req)
+	pdLabelCache.Delete(volumeID)
+	release, err := acquireZoneDiskOp(ctx, location)
 	if err != nil {
-		log.Errorf("failed to set labels on PD: %s", err)
+		log.WithContext(ctx).Errorf("failed to wait for a disk operation slot in %s: %s", location, err)
+		return ReconcileResult{Err: err}
+	}
+	defer release()
+	op, disk, updatedLabels, err := setPDLabelsRetryFingerprint(ctx, c, project, location, name, regional, disk, updatedLabels, storageclass, merge)
+	if err != nil {
+		log.WithContext(ctx).Errorf("failed to set labels on PD: %s", err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
-		return
+		return ReconcileResult{Err: err}
+	}
+	if op == nil {
+		logger.WithContext(ctx).Debug("labels already set on PD")
+		cachePDLabels(volumeID, disk.Labels)
+		return ReconcileResult{LabelsDropped: dropped}
 	}
 
-	waitForCompletion := func(_ context.Context) (bool, error) {
-		resp, err := c.GetGCEOp(project, location, op.Name)
+	waitForCompletion := func(ctx context.Context) (bool, error) {
+		countPollIteration(operationAddLabels, storageclass)
+		resp, err := getPDOperation(ctx, c, project, location, op.Name, regional)
 		if err != nil {
 			return false, fmt.Errorf("failed to set labels on PD %s: %s", disk.Name, err)
 		}
 		return resp.Status == "DONE", nil
 	}
-	if err := wait.PollUntilContextTimeout(context.TODO(),
-		time.Second,
-		time.Minute,
-		false,
+	// check right away when the operation already finished
+	if err := wait.PollUntilContextTimeout(ctx,
+		gcpPollInterval,
+		pdOperationTimeout(disk),
+		op.Status == "DONE",
 		waitForCompletion); err != nil {
-		log.Errorf("set label operation failed: %s", err)
-		return
+		log.WithContext(ctx).Errorf("set label operation failed: %s", err)
+		return ReconcileResult{Err: err}
 	}
 
-	log.Debug("successfully set labels on PD")
+	logger.WithContext(ctx).Debug("successfully set labels on PD")
+	cachePDLabels(volumeID, updatedLabels)
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	added, _ := diffLabels(disk.Labels, updatedLabels)
+	return ReconcileResult{Changed: true, LabelsAdded: added, LabelsDropped: dropped, LabelsBefore: disk.Labels, LabelsAfter: updatedLabels}
+}
+
+// isHyperdisk returns whether the disk type, the URL of a diskTypes resource,
+// is a Hyperdisk type such as hyperdisk-balanced
+func isHyperdisk(disk *compute.Disk) bool {
+	diskType := disk.Type[strings.LastIndex(disk.Type, "/")+1:]
+	return strings.HasPrefix(diskType, "hyperdisk-")
 }
 
-func deletePDVolumeLabels(c GCPClient, volumeID string, keys []string, storageclass string) {
+// pdOperationTimeout returns how long to wait for a label operation on the
+// disk. Operations on Hyperdisks can take longer while their provisioned IOPS
+// and throughput are applied, so they wait for --gcp-hyperdisk-operation-timeout
+// when it's longer than --gcp-operation-timeout.
+func pdOperationTimeout(disk *compute.Disk) time.Duration {
+	if isHyperdisk(disk) {
+		return max(gcpOperationTimeout, gcpHyperdiskOpTimeout)
+	}
+	return gcpOperationTimeout
+}
+
+// mergeLabelsForGCP copies labels into existing without letting it grow past
+// GCP's limit of labels per resource and returns the keys of the labels it
+// dropped. Labels already on the resource are always updated; new ones are
+// added in compareGCPLabelKeys order until the limit is reached.
+func mergeLabelsForGCP(existing, labels map[string]string, volumeID string, storageclass string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, compareGCPLabelKeys)
+
+	var dropped []string
+	for _, k := range keys {
+		if _, ok := existing[k]; !ok && len(existing) >= gcpMaxLabels {
+			dropped = append(dropped, k)
+			continue
+		}
+		existing[k] = labels[k]
+	}
+	if len(dropped) > 0 {
+		log.WithFields(log.Fields{"volumeID": volumeID, "dropped": dropped}).Warnf("PD would exceed %d labels, not setting some labels", gcpMaxLabels)
+		promLabelsTruncatedTotal.With(prometheus.Labels{"storageclass": storageclass}).Add(float64(len(dropped)))
+		countSkippedLabels(labelsSkippedQuotaExceeded, storageclass, len(dropped))
+	}
+	return dropped
+}
+
+// compareGCPLabelKeys orders label keys by the priority they get when not all
+// fit on a resource: the --gcp-priority-label-keys in their order first, then
+// shorter keys before longer ones, and keys of the same length sorted
+func compareGCPLabelKeys(a, b string) int {
+	ia, ib := slices.Index(gcpPriorityLabelKeys, a), slices.Index(gcpPriorityLabelKeys, b)
+	switch {
+	case ia >= 0 && ib >= 0:
+		return cmp.Compare(ia, ib)
+	case ia >= 0:
+		return -1
+	case ib >= 0:
+		return 1
+	}
+	return compareLabelKeys(a, b)
+}
+
+// compareLabelKeys orders shorter label keys before longer ones, and keys of
+// the same length sorted
+func compareLabelKeys(a, b string) int {
+	if c := cmp.Compare(len(a), len(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// withoutProtectedLabels returns the labels without the --protected-label-keys,
+// which the tagger never sets on a PD
+func withoutProtectedLabels(labels map[string]string, volumeID string) map[string]string {
+	var skipped []string
+	for _, k := range protectedLabelKeys {
+		if _, ok := labels[k]; ok {
+			skipped = append(skipped, k)
+		}
+	}
+	if len(skipped) == 0 {
+		return labels
+	}
+	logger.Debug("Not setting protected labels on PD", "volumeID", volumeID, "keys", skipped)
+	labels = maps.Clone(labels)
+	for _, k := range skipped {
+		delete(labels, k)
+	}
+	return labels
+}
+
+// deletePDVolumeLabels removes the labels with the given keys from the PD,
+// except for the --protected-label-keys
+func deletePDVolumeLabels(ctx context.Context, c GCPClient, volumeID string, keys []string, storageclass string) ReconcileResult {
 	if len(keys) == 0 {
-		return
+		return ReconcileResult{}
+	}
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	sanitizedKeys := slices.DeleteFunc(sanitizeKeysForGCP(keys), func(k string) bool {
+		return slices.Contains(protectedLabelKeys, k)
+	})
+	logger.WithContext(ctx).Debug("labels to delete from PD volume", "volumeID", volumeID, "labels", sanitizedKeys)
+	if len(sanitizedKeys) == 0 {
+		return ReconcileResult{}
 	}
-	sanitizedKeys := sanitizeKeysForGCP(keys)
-	log.Debugf("labels to delete from PD volume: %s: %s", volumeID, sanitizedKeys)
 
 	project, location, name, err := parseVolumeID(volumeID)
 	if err != nil {
-		log.Error(err)
-		return
+		log.WithContext(ctx).Error(err)
+		return ReconcileResult{Err: err}
 	}
-	disk, err := c.GetDisk(project, location, name)
+	location = pdLocation(volumeID, location)
+	disk, location, regional, err := getDisk(ctx, c, project, location, name, isRegionalVolumeID(volumeID))
 	if err != nil {
-		log.Error(err)
-		return
+		return handleGetDiskError(err, volumeID, storageclass)
 	}
 	// if disk.Labels is nil, then there are no labels to delete
 	if disk.Labels == nil {
-		return
+		return ReconcileResult{}
 	}
 
-	updatedLabels := maps.Clone(disk.Labels)
-	for _, k := range sanitizedKeys {
-		delete(updatedLabels, k)
+	remove := func(disk *compute.Disk) map[string]string {
+		updatedLabels := maps.Clone(disk.Labels)
+		for _, k := range sanitizedKeys {
+			delete(updatedLabels, k)
+		}
+		return updatedLabels
 	}
+	updatedLabels := remove(disk)
 	if maps.Equal(disk.Labels, updatedLabels) {
-		return
+		return ReconcileResult{}
 	}
 
-	req := &compute.ZoneSetLabelsRequest{
-		Labels:           updatedLabels,
-		LabelFingerprint: disk.LabelFingerprint,
+	// GCP accepts an empty fingerprint for disks that have never had labels
+	// set (e.g. newly created disks), so it is passed through as is
+	if disk.LabelFingerprint == "" {
+		logger.WithContext(ctx).Debug("PD has no label fingerprint", "volumeID", volumeID)
+	}
+	if !isValidGCPFingerprint(disk.LabelFingerprint) {
+		log.WithContext(ctx).WithFields(log.Fields{"volumeID": volumeID, "fingerprint": disk.LabelFingerprint}).Warnln("PD label fingerprint is not valid base64, skipping label update")
+		return ReconcileResult{Err: fmt.Errorf("invalid label fingerprint %q", disk.LabelFingerprint)}
+	}
+	if skipForDryRun("delete labels from PD", volumeID, updatedLabels, storageclass) {
+		_, removed := diffLabels(disk.Labels, updatedLabels)
+		return ReconcileResult{LabelsRemoved: removed}
 	}
-	op, err := c.SetDiskLabels(project, location, name, req)
+	pdLabelCache.Delete(volumeID)
+	release, err := acquireZoneDiskOp(ctx, location)
 	if err != nil {
-		log.Errorf("failed to delete labels from PD: %s", err)
+		log.WithContext(ctx).Errorf("failed to wait for a disk operation slot in %s: %s", location, err)
+		return ReconcileResult{Err: err}
+	}
+	defer release()
+	op, disk, updatedLabels, err := setPDLabelsRetryFingerprint(ctx, c, project, location, name, regional, disk, updatedLabels, storageclass, remove)
+	if err != nil {
+		log.WithContext(ctx).Errorf("failed to delete labels from PD: %s", err)
 		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
-		return
+		return ReconcileResult{Err: err}
+	}
+	if op == nil {
+		return ReconcileResult{}
 	}
 
-	waitForCompletion := func(_ context.Context) (bool, error) {
-		resp, err := c.GetGCEOp(project, location, op.Name)
+	waitForCompletion := func(ctx context.Context) (bool, error) {
+		countPollIteration(operationDeleteLabels, storageclass)
+		resp, err := getPDOperation(ctx, c, project, location, op.Name, regional)
 		if err != nil {
 			return false, fmt.Errorf("failed to delete labels from PD %s: %s", disk.Name, err)
 		}
 		return resp.Status == "DONE", nil
 	}
-	if err := wait.PollUntilContextTimeout(context.TODO(),
-		time.Second,
-		time.Minute,
-		false,
+	// check right away when the operation already finished
+	if err := wait.PollUntilContextTimeout(ctx,
+		gcpPollInterval,
+		pdOperationTimeout(disk),
+		op.Status == "DONE",
 		waitForCompletion); err != nil {
-		log.Errorf("delete label operation failed: %s", err)
-		return
+		log.WithContext(ctx).Errorf("delete label operation failed: %s", err)
+		return ReconcileResult{Err: err}
 	}
 
-	log.Debug("successfully deleted labels from PD")
+	logger.WithContext(ctx).Debug("successfully deleted labels from PD")
+	cachePDLabels(volumeID, updatedLabels)
 	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	_, removed := diffLabels(disk.Labels, updatedLabels)
+	return ReconcileResult{Changed: true, LabelsRemoved: removed, LabelsBefore: disk.Labels, LabelsAfter: updatedLabels}
+}
+
+// addSnapshotLabels sets the labels on every snapshot of the PD, see
+// --sync-gcp-snapshots. Like on the PD, the labels are merged with those the
+// snapshots already have.
+func addSnapshotLabels(ctx context.Context, c GCPClient, volumeID string, labels map[string]string, storageclass string) error {
+	sanitizedLabels := withoutProtectedLabels(sanitizeLabelsForGCP(labels), volumeID)
+	return updateSnapshotLabels(ctx, c, volumeID, "set labels on snapshot", storageclass, func(snapshot string, updatedLabels map[string]string) {
+		mergeLabelsForGCP(updatedLabels, sanitizedLabels, snapshot, storageclass)
+	})
+}
+
+// deleteSnapshotLabels removes the labels with the given keys from every
+// snapshot of the PD, except for the --protected-label-keys
+func deleteSnapshotLabels(ctx context.Context, c GCPClient, volumeID string, keys []string, storageclass string) error {
+	sanitizedKeys := slices.DeleteFunc(sanitizeKeysForGCP(keys), func(k string) bool {
+		return slices.Contains(protectedLabelKeys, k)
+	})
+	if len(sanitizedKeys) == 0 {
+		return nil
+	}
+	return updateSnapshotLabels(ctx, c, volumeID, "delete labels from snapshot", storageclass, func(snapshot string, updatedLabels map[string]string) {
+		for _, k := range sanitizedKeys {
+			delete(updatedLabels, k)
+		}
+	})
 }
 
+// updateSnapshotLabels applies update to the labels of each snapshot of the PD
+// and sets the labels of the snapshots they changed for. The snapshots are
+// all attempted and their errors joined.
+func updateSnapshotLabels(ctx context.Context, c GCPClient, volumeID, action, storageclass string, update func(snapshot string, updatedLabels map[string]string)) error {
+	project, snapshots, err := listPDSnapshots(ctx, c, volumeID)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"volumeID": volumeID}).Errorln("failed to list PD snapshots:", err)
+		return err
+	}
+	var errs []error
+	for _, snapshot := range snapshots {
+		updatedLabels := make(map[string]string)
+		if snapshot.Labels != nil {
+			updatedLabels = maps.Clone(snapshot.Labels)
+		}
+		update(snapshot.Name, updatedLabels)
+		if maps.Equal(snapshot.Labels, updatedLabels) {
+			continue
+		}
+		if skipForDryRun(action, snapshot.Name, updatedLabels, storageclass) {
+			continue
+		}
+		if err := setSnapshotLabels(ctx, c, project, snapshot, updatedLabels); err != nil {
+			log.WithContext(ctx).WithFields(log.Fields{"volumeID": volumeID, "snapshot": snapshot.Name}).Errorln("failed to", action+":", err)
+			errs = append(errs, fmt.Errorf("snapshot %s: %w", snapshot.Name, err))
+			continue
+		}
+		logger.WithContext(ctx).Debug("successfully updated snapshot labels", "volumeID", volumeID, "snapshot", snapshot.Name)
+	}
+	return errors.Join(errs...)
+}
+
+// listPDSnapshots returns the project of the PD and the snapshots in it whose
+// source is the PD
+func listPDSnapshots(ctx context.Context, c GCPClient, volumeID string) (string, []*compute.Snapshot, error) {
+	project, location, name, err := parseVolumeID(volumeID)
+	if err != nil {
+		return "", nil, err
+	}
+	disk, _, _, err := getDisk(ctx, c, project, pdLocation(volumeID, location), name, isRegionalVolumeID(volumeID))
+	if err != nil {
+		return "", nil, err
+	}
+	snapshots, err := c.ListSnapshots(ctx, project, fmt.Sprintf("sourceDisk = %q", disk.SelfLink))
+	return project, snapshots, err
+}
+
+// setSnapshotLabels sets the labels of the snapshot and waits for the
+// operation to finish. Transient API errors are retried with backoff.
+func setSnapshotLabels(ctx context.Context, c GCPClient, project string, snapshot *compute.Snapshot, labels map[string]string) error {
+	var op *compute.Operation
+	err := retry.OnError(cloudRetryBackoff(), isRetriableGCPError, func() error {
+		if err := waitGCPWrite(ctx); err != nil {
+			return err
+		}
+		var err error
+		op, err = c.SetSnapshotLabels(ctx, project, snapshot.Name, &compute.GlobalSetLabelsRequest{
+			Labels:           labels,
+			LabelFingerprint: snapshot.LabelFingerprint,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// check right away when the operation already finished
+	return wait.PollUntilContextTimeout(ctx, gcpPollInterval, gcpOperationTimeout, op.Status == "DONE", func(ctx context.Context) (bool, error) {
+		resp, err := c.GetGlobalGCEOp(ctx, project, op.Name)
+		if err != nil {
+			return false, err
+		}
+		return resp.Status == "DONE", nil
+	})
+}
+
+// diffLabels returns the labels of updated that are new or have a different
+// value than in current, and the labels of current missing from updated
+func diffLabels(current, updated map[string]string) (added, removed map[string]string) {
+	for k, v := range updated {
+		if old, ok := current[k]; !ok || old != v {
+			if added == nil {
+				added = map[string]string{}
+			}
+			added[k] = v
+		}
+	}
+	for k, v := range current {
+		if _, ok := updated[k]; !ok {
+			if removed == nil {
+				removed = map[string]string{}
+			}
+			removed[k] = v
+		}
+	}
+	return added, removed
+}
+
+// isValidGCPFingerprint reports whether fp is a base64 encoded fingerprint as
+// returned by GCP. GCP would reject a SetLabels request with anything else.
+func isValidGCPFingerprint(fp string) bool {
+	_, err := base64.StdEncoding.DecodeString(fp)
+	return err == nil
+}
+
+// gcpWriteLimiter limits the GCP Compute API write calls of all goroutines to
+// --gcp-writes-per-second, to stay within the project's write quota. nil
+// disables the limit.
+var gcpWriteLimiter *rate.Limiter
+
+// newGCPWriteLimiter returns a limiter allowing writesPerSecond calls, or nil
+// when writesPerSecond isn't positive
+func newGCPWriteLimiter(writesPerSecond float64) *rate.Limiter {
+	if writesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(writesPerSecond), 1)
+}
+
+// waitGCPWrite blocks until gcpWriteLimiter allows a write call
+func waitGCPWrite(ctx context.Context) error {
+	if gcpWriteLimiter == nil {
+		return nil
+	}
+	return gcpWriteLimiter.Wait(ctx)
+}
+
+// zoneDiskOps holds a semaphore per zone, lazily created, that limits the
+// concurrent disk operations in the zone to gcpZoneDiskOps
+var zoneDiskOps sync.Map
+
+// acquireZoneDiskOp blocks until a disk operation can be started in the zone
+// and returns the function that releases it once the operation is done
+func acquireZoneDiskOp(ctx context.Context, zone string) (func(), error) {
+	if gcpZoneDiskOps <= 0 {
+		return func() {}, nil
+	}
+	v, _ := zoneDiskOps.LoadOrStore(zone, make(chan struct{}, gcpZoneDiskOps))
+	sem := v.(chan struct{})
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pdLabelCache holds the labels last known to be set on each PD, keyed by
+// volumeID, so unchanged labels can be skipped without calling GetDisk
+var pdLabelCache sync.Map
+
+type cachedLabels struct {
+	labels  map[string]string
+	expires time.Time
+}
+
+func cachePDLabels(volumeID string, labels map[string]string) {
+	if gcpLabelCacheTTL <= 0 {
+		return
+	}
+	pdLabelCache.Store(volumeID, cachedLabels{labels: maps.Clone(labels), expires: clock.Now().Add(gcpLabelCacheTTL)})
+}
+
+type bypassLabelCacheKey struct{}
+
+// withoutLabelCache returns a context whose label operations read the labels
+// of the PD instead of trusting the label cache, so that the resync repairs
+// labels changed outside of the tagger
+func withoutLabelCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassLabelCacheKey{}, true)
+}
+
+// labelCacheBypassed reports whether ctx is from withoutLabelCache
+func labelCacheBypassed(ctx context.Context) bool {
+	bypassed, _ := ctx.Value(bypassLabelCacheKey{}).(bool)
+	return bypassed
+}
+
+// pdLabelsCached reports whether all labels are set on the PD according to
+// the label cache
+func pdLabelsCached(volumeID string, labels map[string]string) bool {
+	v, ok := pdLabelCache.Load(volumeID)
+	if !ok {
+		return false
+	}
+	entry := v.(cachedLabels)
+	if !clock.Now().Before(entry.expires) {
+		pdLabelCache.Delete(volumeID)
+		return false
+	}
+	for k, v := range labels {
+		if cached, ok := entry.labels[k]; !ok || cached != v {
+			return false
+		}
+	}
+	return true
+}
+
+// getDisk fetches the zonal or regional disk and returns the location it was
+// found in and whether it is a regional disk. When gcpEnableZonalFallback is
+// set and the lookup in a region fails because the disk or the location isn't
+// found, the first zone of that region is tried instead. Other errors, e.g.
+// rate limits or server errors, are returned as is so that they are retried,
+// and so is the regional error when the zonal lookup fails too.
+func getDisk(ctx context.Context, c GCPClient, project, location, name string, regional bool) (*compute.Disk, string, bool, error) {
+	var disk *compute.Disk
+	var err error
+	if regional {
+		disk, err = c.GetRegionalDisk(ctx, project, location, name)
+	} else {
+		disk, err = c.GetDisk(ctx, project, location, name)
+	}
+	if err == nil || !gcpEnableZonalFallback || !isGCPRegion(location) || !isGCPLocationNotFound(err) {
+		return disk, location, regional, err
+	}
+
+	zone, zoneErr := firstZoneOfRegion(ctx, c, project, location)
+	if zoneErr != nil {
+		log.WithContext(ctx).Errorf("failed to get zones of region %s: %s", location, zoneErr)
+		return nil, location, regional, err
+	}
+	log.WithContext(ctx).WithFields(log.Fields{"region": location, "zone": zone}).Warnln("regional disk lookup failed, falling back to zonal disk")
+	zonalDisk, zonalErr := c.GetDisk(ctx, project, zone, name)
+	if zonalErr != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"zone": zone}).Warnln("zonal disk lookup failed:", zonalErr)
+		return nil, location, regional, err
+	}
+	return zonalDisk, zone, false, nil
+}
+
+// setPDLabels starts the operation setting the labels of a zonal or regional
+// PD. Transient API errors are retried with backoff.
+func setPDLabels(ctx context.Context, c GCPClient, project, location, name string, regional bool, labels map[string]string, fingerprint string) (*compute.Operation, error) {
+	var op *compute.Operation
+	err := retry.OnError(cloudRetryBackoff(), isRetriableGCPError, func() error {
+		if err := waitGCPWrite(ctx); err != nil {
+			return err
+		}
+		var err error
+		if regional {
+			op, err = c.SetRegionalDiskLabels(ctx, project, location, name, &compute.RegionSetLabelsRequest{
+				Labels:           labels,
+				LabelFingerprint: fingerprint,
+			})
+		} else {
+			op, err = c.SetDiskLabels(ctx, project, location, name, &compute.ZoneSetLabelsRequest{
+				Labels:           labels,
+				LabelFingerprint: fingerprint,
+			})
+		}
+		if isRetriableGCPError(err) {
+			log.WithContext(ctx).WithFields(log.Fields{"disk": name, "location": location}).Warnln("transient error setting PD labels, retrying:", err)
+		}
+		return err
+	})
+	return op, err
+}
+
+// setPDLabelsRetryFingerprint sets the labels on the PD like setPDLabels. When
+// the labels of the PD were changed since it was fetched, e.g. by another
+// agent, GCP rejects the stale fingerprint with 412 Precondition Failed; the PD
+// is then fetched again and the labels to set recomputed from its current
+// labels by update, up to --gcp-fingerprint-retry-count times. It returns the
+// PD and the labels last used, and a nil operation when the current labels of
+// the PD need no update anymore.
+func setPDLabelsRetryFingerprint(ctx context.Context, c GCPClient, project, location, name string, regional bool, disk *compute.Disk, labels map[string]string, storageclass string, update func(*compute.Disk) map[string]string) (*compute.Operation, *compute.Disk, map[string]string, error) {
+	op, err := setPDLabels(ctx, c, project, location, name, regional, labels, disk.LabelFingerprint)
+	for retries := 0; isFingerprintMismatch(err) && retries < gcpFingerprintRetries; retries++ {
+		log.WithContext(ctx).WithFields(log.Fields{"disk": name, "location": location}).Warnln("PD labels were changed concurrently, retrying with the new label fingerprint")
+		promFingerprintRetries.With(prometheus.Labels{"storageclass": storageclass}).Inc()
+		current, _, _, getErr := getDisk(ctx, c, project, location, name, regional)
+		if getErr != nil {
+			return nil, disk, labels, getErr
+		}
+		disk, labels = current, update(current)
+		if maps.Equal(disk.Labels, labels) {
+			return nil, disk, labels, nil
+		}
+		op, err = setPDLabels(ctx, c, project, location, name, regional, labels, disk.LabelFingerprint)
+	}
+	return op, disk, labels, err
+}
+
+// isFingerprintMismatch reports whether err is GCP rejecting a label update
+// because the label fingerprint is not the current one
+func isFingerprintMismatch(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// cloudRetryBackoff returns the backoff between attempts of a cloud API call
+// that failed with a transient error
+func cloudRetryBackoff() wait.Backoff {
+	return wait.Backoff{
+		Steps:    cloudRetryAttempts,
+		Duration: cloudRetryInterval,
+		Factor:   2,
+		Jitter:   0.5,
+	}
+}
+
+// isRetriableGCPError reports whether err is a rate limit or server error
+// that may succeed when retried
+func isRetriableGCPError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// getPDOperation returns a zonal or regional disk operation
+func getPDOperation(ctx context.Context, c GCPClient, project, location, name string, regional bool) (*compute.Operation, error) {
+	if regional {
+		return c.GetRegionalGCEOp(ctx, project, location, name)
+	}
+	return c.GetGCEOp(ctx, project, location, name)
+}
+
+// isGCPRegion reports whether location is a region (us-central1) rather than
+// a zone (us-central1-a)
+func isGCPRegion(location string) bool {
+	return strings.Count(location, "-") == 1
+}
+
+func firstZoneOfRegion(ctx context.Context, c GCPClient, project, region string) (string, error) {
+	r, err := c.GetRegion(ctx, project, region)
+	if err != nil {
+		return "", err
+	}
+	if len(r.Zones) == 0 {
+		return "", fmt.Errorf("region %s has no zones", region)
+	}
+	// zones are returned as resource URLs
+	zones := make([]string, len(r.Zones))
+	for i, z := range r.Zones {
+		zones[i] = path.Base(z)
+	}
+	slices.Sort(zones)
+	return zones[0], nil
+}
+
+// handleGetDiskError logs a GetDisk failure, updates the metrics and returns
+// the result to report for it. How a disk that no longer exists is handled
+// depends on --gcp-disk-not-found-strategy: with skip and warn the disk is
+// skipped without an error.
+func handleGetDiskError(err error, volumeID string, storageclass string) ReconcileResult {
+	if isGCPNotFound(err) {
+		switch gcpDiskNotFound {
+		case diskNotFoundFail:
+			log.WithFields(log.Fields{"volumeID": volumeID}).Errorln("disk not found")
+			promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+			return ReconcileResult{Err: fmt.Errorf("%w: %w", errRequeue, err)}
+		case diskNotFoundWarn:
+			promDiskNotFoundTotal.With(prometheus.Labels{"storageclass": storageclass}).Inc()
+		}
+		log.WithFields(log.Fields{"volumeID": volumeID}).Warnln("disk not found, skipping label sync")
+		return ReconcileResult{Skipped: true}
+	}
+	log.Error(err)
+	promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+	return ReconcileResult{Err: err}
+}
+
+func isGCPNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// isGCPLocationNotFound reports whether a disk lookup failed because the
+// disk wasn't found or GCP rejected its zone or region, the errors
+// --gcp-enable-zonal-fallback applies to
+func isGCPLocationNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusNotFound {
+		return true
+	}
+	message := strings.ToLower(apiErr.Message)
+	return apiErr.Code == http.StatusBadRequest && (strings.Contains(message, "zone") || strings.Contains(message, "region"))
+}
+
+// parseVolumeID returns the project, location and name of the disk of a PD
+// volume handle. The location is the zone of zonal PDs
+// (projects/{project}/zones/{zone}/disks/{name}) and the region of regional
+// PDs (projects/{project}/regions/{region}/disks/{name}). Hyperdisk volumes
+// use the same handles. Trailing slashes and a query string are ignored and
+// URL-encoded components are decoded.
 func parseVolumeID(id string) (string, string, string, error) {
-	parts := strings.Split(id, "/")
-	if len(parts) < 5 {
-		return "", "", "", fmt.Errorf("invalid volume handle format")
+	handle, _, _ := strings.Cut(id, "?")
+	handle = strings.TrimRight(handle, "/")
+	parts := strings.Split(handle, "/")
+	if len(parts) < 6 {
+		return "", "", "", fmt.Errorf("invalid volume handle %q: want projects/{project}/zones/{zone}/disks/{name}", id)
+	}
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid volume handle %q: invalid component %q: %w", id, part, err)
+		}
+		parts[i] = unescaped
+	}
+	if parts[0] != "projects" {
+		return "", "", "", fmt.Errorf("invalid volume handle %q: want \"projects\", got %q", id, parts[0])
+	}
+	if parts[2] != "zones" && parts[2] != "regions" {
+		return "", "", "", fmt.Errorf("invalid volume handle %q: want \"zones\" or \"regions\", got %q", id, parts[2])
+	}
+	if parts[3] == "" {
+		return "", "", "", fmt.Errorf("invalid volume handle %q: empty %s", id, strings.TrimSuffix(parts[2], "s"))
+	}
+	if parts[4] != "disks" {
+		return "", "", "", fmt.Errorf("invalid volume handle %q: want \"disks\", got %q", id, parts[4])
+	}
+	if parts[5] == "" {
+		return "", "", "", fmt.Errorf("invalid volume handle %q: empty disk name", id)
 	}
 	project := parts[1]
-	location := parts[3]
-	name := parts[5]
-	return project, location, name, nil
+	if project == "" {
+		project = gcpDefaultProject
+	}
+	return project, parts[3], parts[5], nil
+}
+
+// pdLocation returns the location the GCP API is called with for the PD of
+// the volume handle: --cloud-provider-zone-override replaces the zone of
+// zonal PDs, regional PDs keep their region
+func pdLocation(volumeID, location string) string {
+	if gcpZoneOverride == "" || isRegionalVolumeID(volumeID) {
+		return location
+	}
+	return gcpZoneOverride
+}
+
+// isRegionalVolumeID reports whether the volume handle is of a regional PD
+func isRegionalVolumeID(id string) bool {
+	parts := strings.Split(id, "/")
+	return len(parts) > 2 && parts[2] == "regions"
+}
+
+type BigtableClient interface {
+	GetInstance(ctx context.Context, project, instance string) (*bigtableadmin.Instance, error)
+	UpdateInstance(ctx context.Context, project, instance string, labels map[string]string) error
 }
 
+type bigtableClient struct {
+	admin *bigtableadmin.Service
+}
+
+// newBigtableClient creates a BigtableClient whose API calls time out after timeout
+func newBigtableClient(ctx context.Context, timeout time.Duration, opts ...option.ClientOption) (BigtableClient, error) {
+	httpClient, err := newGCPHTTPClient(ctx, timeout, bigtableadmin.BigtableAdminInstanceScope, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := bigtableadmin.NewService(ctx, append(opts, option.WithHTTPClient(httpClient))...)
+	if err != nil {
+		return nil, err
+	}
+	return &bigtableClient{admin: client}, nil
+}
+
+func (c *bigtableClient) GetInstance(ctx context.Context, project, instance string) (*bigtableadmin.Instance, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.admin.Projects.Instances.Get(fmt.Sprintf("projects/%s/instances/%s", project, instance)).Context(ctx).Do()
+}
+
+func (c *bigtableClient) UpdateInstance(ctx context.Context, project, instance string, labels map[string]string) error {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	req := &bigtableadmin.Instance{
+		Labels: labels,
+		// send an empty map when all labels are removed
+		ForceSendFields: []string{"Labels"},
+	}
+	_, err := c.admin.Projects.Instances.PartialUpdateInstance(fmt.Sprintf("projects/%s/instances/%s", project, instance), req).UpdateMask("labels").Context(ctx).Do()
+	return err
+}
+
+// addBigtableInstanceLabels merges labels into the labels of the Bigtable
+// instance that holds the volume's table
+func addBigtableInstanceLabels(ctx context.Context, c BigtableClient, volumeID string, labels map[string]string, storageclass string) error {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	sanitizedLabels := sanitizeLabelsForGCP(labels)
+	logger.WithContext(ctx).Debug("labels to add to Bigtable instance", "volumeID", volumeID, "labels", sanitizedLabels)
+
+	project, instanceName, _, err := parseBigtableVolumeHandle(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return err
+	}
+	instance, err := c.GetInstance(ctx, project, instanceName)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	updatedLabels := make(map[string]string)
+	if instance.Labels != nil {
+		updatedLabels = maps.Clone(instance.Labels)
+	}
+	maps.Copy(updatedLabels, sanitizedLabels)
+	if maps.Equal(instance.Labels, updatedLabels) {
+		logger.WithContext(ctx).Debug("labels already set on Bigtable instance")
+		return nil
+	}
+
+	if skipForDryRun("set labels on Bigtable instance", volumeID, updatedLabels, storageclass) {
+		return nil
+	}
+
+	if err := c.UpdateInstance(ctx, project, instanceName, updatedLabels); err != nil {
+		log.WithContext(ctx).Errorf("failed to set labels on Bigtable instance: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	logger.WithContext(ctx).Debug("successfully set labels on Bigtable instance")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+func deleteBigtableInstanceLabels(ctx context.Context, c BigtableClient, volumeID string, keys []string, storageclass string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	sanitizedKeys := sanitizeKeysForGCP(keys)
+	logger.WithContext(ctx).Debug("labels to delete from Bigtable instance", "volumeID", volumeID, "labels", sanitizedKeys)
+
+	project, instanceName, _, err := parseBigtableVolumeHandle(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return err
+	}
+	instance, err := c.GetInstance(ctx, project, instanceName)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	// if instance.Labels is nil, then there are no labels to delete
+	if instance.Labels == nil {
+		return nil
+	}
+
+	updatedLabels := maps.Clone(instance.Labels)
+	for _, k := range sanitizedKeys {
+		delete(updatedLabels, k)
+	}
+	if maps.Equal(instance.Labels, updatedLabels) {
+		return nil
+	}
+
+	if skipForDryRun("delete labels from Bigtable instance", volumeID, updatedLabels, storageclass) {
+		return nil
+	}
+
+	if err := c.UpdateInstance(ctx, project, instanceName, updatedLabels); err != nil {
+		log.WithContext(ctx).Errorf("failed to delete labels from Bigtable instance: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	logger.WithContext(ctx).Debug("successfully deleted labels from Bigtable instance")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// parseBigtableVolumeHandle parses a Bigtable CSI volume handle of the form
+// projects/{project}/instances/{instance}/tables/{table}
+func parseBigtableVolumeHandle(id string) (string, string, string, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "instances" || parts[4] != "tables" {
+		return "", "", "", fmt.Errorf("invalid Bigtable volume handle format: %s", id)
+	}
+	if parts[1] == "" || parts[3] == "" || parts[5] == "" {
+		return "", "", "", fmt.Errorf("invalid Bigtable volume handle format: %s", id)
+	}
+	return parts[1], parts[3], parts[5], nil
+}
+
+type FilestoreClient interface {
+	GetInstance(ctx context.Context, project, location, instance string) (*file.Instance, error)
+	UpdateInstanceLabels(ctx context.Context, project, location, instance string, labels map[string]string) error
+}
+
+type filestoreClient struct {
+	file *file.Service
+}
+
+// newFilestoreClient creates a FilestoreClient whose API calls time out after timeout
+func newFilestoreClient(ctx context.Context, timeout time.Duration, opts ...option.ClientOption) (FilestoreClient, error) {
+	httpClient, err := newGCPHTTPClient(ctx, timeout, file.CloudPlatformScope, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := file.NewService(ctx, append(opts, option.WithHTTPClient(httpClient))...)
+	if err != nil {
+		return nil, err
+	}
+	return &filestoreClient{file: client}, nil
+}
+
+func (c *filestoreClient) GetInstance(ctx context.Context, project, location, instance string) (*file.Instance, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.file.Projects.Locations.Instances.Get(fmt.Sprintf("projects/%s/locations/%s/instances/%s", project, location, instance)).Context(ctx).Do()
+}
+
+func (c *filestoreClient) UpdateInstanceLabels(ctx context.Context, project, location, instance string, labels map[string]string) error {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	req := &file.Instance{
+		Labels: labels,
+		// send an empty map when all labels are removed
+		ForceSendFields: []string{"Labels"},
+	}
+	_, err := c.file.Projects.Locations.Instances.Patch(fmt.Sprintf("projects/%s/locations/%s/instances/%s", project, location, instance), req).UpdateMask("labels").Context(ctx).Do()
+	return err
+}
+
+// addFilestoreLabels merges labels into the labels of the Filestore instance
+// backing the volume
+func addFilestoreLabels(ctx context.Context, c FilestoreClient, volumeID string, labels map[string]string, storageclass string) error {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	sanitizedLabels := sanitizeLabelsForGCP(labels)
+	logger.WithContext(ctx).Debug("labels to add to Filestore instance", "volumeID", volumeID, "labels", sanitizedLabels)
+
+	project, location, instanceName, err := parseFilestoreVolumeHandle(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return err
+	}
+	instance, err := c.GetInstance(ctx, project, location, instanceName)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	updatedLabels := make(map[string]string)
+	if instance.Labels != nil {
+		updatedLabels = maps.Clone(instance.Labels)
+	}
+	maps.Copy(updatedLabels, sanitizedLabels)
+	if maps.Equal(instance.Labels, updatedLabels) {
+		logger.WithContext(ctx).Debug("labels already set on Filestore instance")
+		return nil
+	}
+
+	if skipForDryRun("set labels on Filestore instance", volumeID, updatedLabels, storageclass) {
+		return nil
+	}
+
+	if err := c.UpdateInstanceLabels(ctx, project, location, instanceName, updatedLabels); err != nil {
+		log.WithContext(ctx).Errorf("failed to set labels on Filestore instance: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	logger.WithContext(ctx).Debug("successfully set labels on Filestore instance")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+func deleteFilestoreLabels(ctx context.Context, c FilestoreClient, volumeID string, keys []string, storageclass string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	sanitizedKeys := sanitizeKeysForGCP(keys)
+	logger.WithContext(ctx).Debug("labels to delete from Filestore instance", "volumeID", volumeID, "labels", sanitizedKeys)
+
+	project, location, instanceName, err := parseFilestoreVolumeHandle(volumeID)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		return err
+	}
+	instance, err := c.GetInstance(ctx, project, location, instanceName)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	// if instance.Labels is nil, then there are no labels to delete
+	if instance.Labels == nil {
+		return nil
+	}
+
+	updatedLabels := maps.Clone(instance.Labels)
+	for _, k := range sanitizedKeys {
+		delete(updatedLabels, k)
+	}
+	if maps.Equal(instance.Labels, updatedLabels) {
+		return nil
+	}
+
+	if skipForDryRun("delete labels from Filestore instance", volumeID, updatedLabels, storageclass) {
+		return nil
+	}
+
+	if err := c.UpdateInstanceLabels(ctx, project, location, instanceName, updatedLabels); err != nil {
+		log.WithContext(ctx).Errorf("failed to delete labels from Filestore instance: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	logger.WithContext(ctx).Debug("successfully deleted labels from Filestore instance")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// parseFilestoreVolumeHandle returns the project, location and instance of a
+// Filestore volume handle. Both the instance resource name,
+// projects/{project}/locations/{location}/instances/{instance}, and the
+// Filestore CSI driver's modeInstance/{location}/{instance}/{share} are
+// accepted. The latter has no project, so gcpDefaultProject is used.
+func parseFilestoreVolumeHandle(id string) (string, string, string, error) {
+	parts := strings.Split(id, "/")
+	switch {
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "locations" && parts[4] == "instances":
+		if parts[1] != "" && parts[3] != "" && parts[5] != "" {
+			return parts[1], parts[3], parts[5], nil
+		}
+	case len(parts) == 4 && parts[0] == "modeInstance":
+		if gcpDefaultProject == "" {
+			return "", "", "", fmt.Errorf("no project for Filestore volume handle %s, set --gcp-project-id-from-metadata", id)
+		}
+		if parts[1] != "" && parts[2] != "" {
+			return gcpDefaultProject, parts[1], parts[2], nil
+		}
+	}
+	return "", "", "", fmt.Errorf("invalid Filestore volume handle format: %s", id)
+}
+
+type SpannerClient interface {
+	GetInstance(ctx context.Context, project, instance string) (*spanner.Instance, error)
+	PatchInstance(ctx context.Context, project, instance string, labels map[string]string) error
+}
+
+type spannerClient struct {
+	admin *spanner.Service
+}
+
+// newSpannerClient creates a SpannerClient whose API calls time out after timeout
+func newSpannerClient(ctx context.Context, timeout time.Duration, opts ...option.ClientOption) (SpannerClient, error) {
+	httpClient, err := newGCPHTTPClient(ctx, timeout, spanner.SpannerAdminScope, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := spanner.NewService(ctx, append(opts, option.WithHTTPClient(httpClient))...)
+	if err != nil {
+		return nil, err
+	}
+	return &spannerClient{admin: client}, nil
+}
+
+func (c *spannerClient) GetInstance(ctx context.Context, project, instance string) (*spanner.Instance, error) {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	return c.admin.Projects.Instances.Get(spannerInstanceName(project, instance)).Context(ctx).Do()
+}
+
+func (c *spannerClient) PatchInstance(ctx context.Context, project, instance string, labels map[string]string) error {
+	ctx, cancel := withCloudRequestTimeout(ctx)
+	defer cancel()
+	name := spannerInstanceName(project, instance)
+	req := &spanner.UpdateInstanceRequest{
+		Instance: &spanner.Instance{
+			Name:   name,
+			Labels: labels,
+			// send an empty map when all labels are removed
+			ForceSendFields: []string{"Labels"},
+		},
+		FieldMask: "labels",
+	}
+	_, err := c.admin.Projects.Instances.Patch(name, req).Context(ctx).Do()
+	return err
+}
+
+// spannerInstanceName returns the resource name of a Spanner instance
+func spannerInstanceName(project, instance string) string {
+	return fmt.Sprintf("projects/%s/instances/%s", project, instance)
+}
+
+// spannerInstanceAnnotation names the Spanner instance that gets the same
+// labels as the PVC's volume, see getSpannerInstance
+const spannerInstanceAnnotation = "pvc-tagger.planetscale.com/spanner-instance"
+
+// getSpannerInstance returns the project and name of the Spanner instance set
+// in the PVC's spanner-instance annotation. The annotation is either an
+// instance name, which is looked up in the project of the volume, or a full
+// projects/{project}/instances/{instance} resource name.
+func getSpannerInstance(pvc *corev1.PersistentVolumeClaim, volumeID string) (string, string, bool) {
+	value, ok := pvc.GetAnnotations()[spannerInstanceAnnotation]
+	if !ok || value == "" {
+		return "", "", false
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) == 4 && parts[0] == "projects" && parts[2] == "instances" && parts[1] != "" && parts[3] != "" {
+		return parts[1], parts[3], true
+	}
+	if len(parts) != 1 {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("invalid " + spannerInstanceAnnotation + " annotation: " + value)
+		return "", "", false
+	}
+
+	project := gcpDefaultProject
+	if volumeParts := strings.Split(volumeID, "/"); len(volumeParts) > 1 && volumeParts[0] == "projects" && volumeParts[1] != "" {
+		project = volumeParts[1]
+	}
+	if project == "" {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("cannot determine the project of Spanner instance " + value)
+		return "", "", false
+	}
+	return project, value, true
+}
+
+// addSpannerInstanceLabels merges labels into the labels of the Spanner instance
+func addSpannerInstanceLabels(ctx context.Context, c SpannerClient, project, instanceName string, labels map[string]string, storageclass string) error {
+	defer observeOperationDuration(operationAddLabels, storageclass, clock.Now())
+	sanitizedLabels := sanitizeLabelsForGCP(labels)
+	logger.WithContext(ctx).Debug("labels to add to Spanner instance", "project", project, "instance", instanceName, "labels", sanitizedLabels)
+
+	instance, err := c.GetInstance(ctx, project, instanceName)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	updatedLabels := make(map[string]string)
+	if instance.Labels != nil {
+		updatedLabels = maps.Clone(instance.Labels)
+	}
+	maps.Copy(updatedLabels, sanitizedLabels)
+	if maps.Equal(instance.Labels, updatedLabels) {
+		logger.WithContext(ctx).Debug("labels already set on Spanner instance")
+		return nil
+	}
+
+	if skipForDryRun("set labels on Spanner instance", "projects/"+project+"/instances/"+instanceName, updatedLabels, storageclass) {
+		return nil
+	}
+
+	if err := c.PatchInstance(ctx, project, instanceName, updatedLabels); err != nil {
+		log.WithContext(ctx).Errorf("failed to set labels on Spanner instance: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	logger.WithContext(ctx).Debug("successfully set labels on Spanner instance")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+func deleteSpannerInstanceLabels(ctx context.Context, c SpannerClient, project, instanceName string, keys []string, storageclass string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	defer observeOperationDuration(operationDeleteLabels, storageclass, clock.Now())
+	sanitizedKeys := sanitizeKeysForGCP(keys)
+	logger.WithContext(ctx).Debug("labels to delete from Spanner instance", "project", project, "instance", instanceName, "labels", sanitizedKeys)
+
+	instance, err := c.GetInstance(ctx, project, instanceName)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	// if instance.Labels is nil, then there are no labels to delete
+	if instance.Labels == nil {
+		return nil
+	}
+
+	updatedLabels := maps.Clone(instance.Labels)
+	for _, k := range sanitizedKeys {
+		delete(updatedLabels, k)
+	}
+	if maps.Equal(instance.Labels, updatedLabels) {
+		return nil
+	}
+
+	if skipForDryRun("delete labels from Spanner instance", "projects/"+project+"/instances/"+instanceName, updatedLabels, storageclass) {
+		return nil
+	}
+
+	if err := c.PatchInstance(ctx, project, instanceName, updatedLabels); err != nil {
+		log.WithContext(ctx).Errorf("failed to delete labels from Spanner instance: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	logger.WithContext(ctx).Debug("successfully deleted labels from Spanner instance")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// sanitizeLabelsForGCP returns a copy of labels that fits GCP's label
+// constraints. When several keys become the same GCP key, the value of the
+// key picked by --collision-strategy is used, see resolveGCPKeyCollision.
 func sanitizeLabelsForGCP(labels map[string]string) map[string]string {
+	collisions := gcpLabelKeyCollisions(labels)
 	newLabels := make(map[string]string, len(labels))
 	for k, v := range labels {
-		newLabels[sanitizeKeyForGCP(k)] = sanitizeValueForGCP(v)
+		sanitizedKey, sanitizedValue := sanitizeKeyForGCP(k), sanitizeValueForGCP(v)
+		if keys, ok := collisions[sanitizedKey]; ok {
+			if winner, ok := resolveGCPKeyCollision(keys, labels); !ok || winner != k {
+				continue
+			}
+		}
+		if logSanitizationChanges {
+			if sanitizedKey != k {
+				logger.Debug("Sanitized label key", "original_key", k, "sanitized_key", sanitizedKey)
+			}
+			if sanitizedValue != v {
+				logger.Debug("Sanitized label value", "key", k, "original_value", v, "sanitized_value", sanitizedValue)
+			}
+		}
+		newLabels[sanitizedKey] = sanitizedValue
 	}
 	return newLabels
 }
 
+// gcpLabelKeyCollisions returns the label keys that become the same GCP key
+// after sanitization, by GCP key. The keys are sorted.
+func gcpLabelKeyCollisions(labels map[string]string) map[string][]string {
+	return labelKeyCollisions(labels, sanitizeKeyForGCP)
+}
+
+// resolveGCPKeyCollision returns the key of the sorted colliding keys whose
+// value is used with --collision-strategy. It returns false with the error
+// strategy, when none of them is used. Ties of the longest-value strategy go
+// to the first key.
+func resolveGCPKeyCollision(keys []string, labels map[string]string) (string, bool) {
+	switch gcpCollisionStrategy {
+	case collisionLastAlphabetical:
+		return keys[len(keys)-1], true
+	case collisionLongestValue:
+		winner := keys[0]
+		for _, k := range keys[1:] {
+			if len(labels[k]) > len(labels[winner]) {
+				winner = k
+			}
+		}
+		return winner, true
+	case collisionError:
+		return "", false
+	}
+	return keys[0], true
+}
+
 func sanitizeKeysForGCP(keys []string) []string {
 	newKeys := make([]string, len(keys))
 	for i, k := range keys {
@@ -188,22 +1508,98 @@ func sanitizeKeysForGCP(keys []string) []string {
 	return newKeys
 }
 
-// sanitizeKeyForGCP sanitizes a Kubernetes label key to fit GCP's label key constraints
+// gcpCharReplacementsEnv overrides the --gcp-char-replacement-map flag
+const gcpCharReplacementsEnv = "K8S_PVC_TAGGER_GCP_CHAR_REPLACEMENTS"
+
+// defaultGCPCharReplacements are the replacements for the characters of a
+// Kubernetes label key that GCP does not allow
+var defaultGCPCharReplacements = map[string]string{"/": "_", ".": "-"}
+
+var validGCPCharReplacement = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// newGCPKeyReplacer returns a replacer for the default character replacements
+// with overrides applied on top
+func newGCPKeyReplacer(overrides map[string]string) *strings.Replacer {
+	replacements := maps.Clone(defaultGCPCharReplacements)
+	maps.Copy(replacements, overrides)
+
+	chars := make([]string, 0, len(replacements))
+	for char := range replacements {
+		chars = append(chars, char)
+	}
+	slices.Sort(chars)
+	oldnew := make([]string, 0, 2*len(chars))
+	for _, char := range chars {
+		oldnew = append(oldnew, char, replacements[char])
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// loadGCPCharReplacements parses the char=replacement pairs of the
+// --gcp-char-replacement-map flag. When the K8S_PVC_TAGGER_GCP_CHAR_REPLACEMENTS
+// environment variable is set it is used instead of the flag.
+func loadGCPCharReplacements(flagValue string) (map[string]string, error) {
+	value := flagValue
+	if env, ok := os.LookupEnv(gcpCharReplacementsEnv); ok {
+		value = env
+	}
+
+	replacements := parseCsv(value)
+	for char, replacement := range replacements {
+		if utf8.RuneCountInString(char) != 1 {
+			return nil, fmt.Errorf("invalid GCP character replacement %q: must replace a single character", char)
+		}
+		if !validGCPCharReplacement.MatchString(replacement) {
+			return nil, fmt.Errorf("invalid GCP character replacement %q for %q: may only contain lowercase letters, numbers, '-' and '_'", replacement, char)
+		}
+	}
+	// a replacement that is itself replaced would change the key again the
+	// next time it is sanitized
+	for char, replacement := range replacements {
+		for other := range replacements {
+			if strings.Contains(replacement, other) {
+				return nil, fmt.Errorf("invalid GCP character replacement %q for %q: contains replaced character %q", replacement, char, other)
+			}
+		}
+	}
+	return replacements, nil
+}
+
+// sanitizeKeyForGCP sanitizes a Kubernetes label key to fit GCP's label key
+// constraints: [\p{Ll}\p{Lo}][\p{Ll}\p{Lo}\p{N}_-]{0,62}, with the length
+// limited to the KeyMaxLen of gcpSanitizer
 func sanitizeKeyForGCP(key string) string {
-	key = strings.ToLower(key)
-	key = strings.NewReplacer("/", "_", ".", "-").Replace(key) // Replace disallowed characters
-	key = strings.TrimRight(key, "-_")                         // Ensure it does not end with '-' or '_'
+	key = gcpSanitizer.replaceKeyChars(strings.ToLower(key))
 
-	if len(key) > 63 {
-		key = key[:63]
+	// Keys must start with a letter
+	if r, _ := utf8.DecodeRuneInString(key); key != "" && !isGCPLabelLetter(r) {
+		key = "k" + key
 	}
-	return key
+	key = gcpSanitizer.truncateKey(key)
+	// Trim after truncating so the key can't be cut to end with '-' or '_'
+	return strings.TrimRight(key, "-_")
+}
+
+// isGCPLabelLetter reports whether r is a lowercase letter or a letter
+// without case, such as Chinese or Arabic characters
+func isGCPLabelLetter(r rune) bool {
+	return unicode.In(r, unicode.Ll, unicode.Lo)
 }
 
-// sanitizeKeyForGCP sanitizes a Kubernetes label value to fit GCP's label value constraints
+// sanitizeValueForGCP sanitizes a Kubernetes label value to fit GCP's label value constraints
 func sanitizeValueForGCP(value string) string {
-	if len(value) > 63 {
-		value = value[:63]
+	return gcpSanitizer.sanitizeValue(value)
+}
+
+// truncateRunes truncates s to at most n characters without splitting a
+// multi-byte character
+func truncateRunes(s string, n int) string {
+	i := 0
+	for j := range s {
+		if i == n {
+			return s[:j]
+		}
+		i++
 	}
-	return value
+	return s
 }
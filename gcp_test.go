@@ -1,56 +1,172 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"maps"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/bigtableadmin/v2"
 	"google.golang.org/api/compute/v1"
+	file "google.golang.org/api/file/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/api/spanner/v1"
+	corev1 "k8s.io/api/core/v1"
+	clocks "k8s.io/utils/clock"
+	testingclock "k8s.io/utils/clock/testing"
+	"k8s.io/utils/ptr"
 )
 
 type fakeGCPClient struct {
-	fakeGetDisk       func(project, zone, name string) (*compute.Disk, error)
-	fakeSetDiskLabels func(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error)
-	fakeGetGCEOp      func(project, zone, name string) (*compute.Operation, error)
+	fakeGetDisk       func(ctx context.Context, project, zone, name string) (*compute.Disk, error)
+	fakeSetDiskLabels func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error)
+	fakeGetGCEOp      func(ctx context.Context, project, zone, name string) (*compute.Operation, error)
+	fakeGetRegion     func(ctx context.Context, project, region string) (*compute.Region, error)
 
+	fakeGetRegionalDisk       func(ctx context.Context, project, region, name string) (*compute.Disk, error)
+	fakeSetRegionalDiskLabels func(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error)
+	fakeGetRegionalGCEOp      func(ctx context.Context, project, region, name string) (*compute.Operation, error)
+
+	fakeListSnapshots     func(ctx context.Context, project, filter string) ([]*compute.Snapshot, error)
+	fakeSetSnapshotLabels func(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error)
+	fakeGetGlobalGCEOp    func(ctx context.Context, project, name string) (*compute.Operation, error)
+
+	// mu guards the fields below, which are set by the fake functions
+	mu              sync.Mutex
 	setLabelsCalled bool
+	// setLabelsErrs are returned by the first calls setting the labels of a
+	// disk, one per call, before the fake functions are called
+	setLabelsErrs  []error
+	setLabelsCalls int
+	// opDeadline is the deadline of the context of the last operation poll
+	opDeadline time.Time
 }
 
-func (c *fakeGCPClient) GetDisk(project, zone, name string) (*compute.Disk, error) {
+func (c *fakeGCPClient) GetDisk(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
 	if c.fakeGetDisk == nil {
 		return nil, nil
 	}
-	return c.fakeGetDisk(project, zone, name)
+	return c.fakeGetDisk(ctx, project, zone, name)
 }
 
-func (c *fakeGCPClient) SetDiskLabels(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
-	c.setLabelsCalled = true
+func (c *fakeGCPClient) SetDiskLabels(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+	if err := c.nextSetLabelsErr(); err != nil {
+		return nil, err
+	}
 	if c.fakeSetDiskLabels == nil {
 		return nil, nil
 	}
-	return c.fakeSetDiskLabels(project, zone, name, labelReq)
+	return c.fakeSetDiskLabels(ctx, project, zone, name, labelReq)
+}
+
+func (c *fakeGCPClient) nextSetLabelsErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLabelsCalled = true
+	c.setLabelsCalls++
+	if c.setLabelsCalls > len(c.setLabelsErrs) {
+		return nil
+	}
+	return c.setLabelsErrs[c.setLabelsCalls-1]
 }
 
-func (c *fakeGCPClient) GetGCEOp(project, zone, name string) (*compute.Operation, error) {
+func (c *fakeGCPClient) setOpDeadline(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opDeadline, _ = ctx.Deadline()
+}
+
+func (c *fakeGCPClient) GetGCEOp(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+	c.setOpDeadline(ctx)
 	if c.fakeSetDiskLabels == nil {
 		return nil, nil
 	}
-	return c.fakeGetGCEOp(project, zone, name)
+	return c.fakeGetGCEOp(ctx, project, zone, name)
+}
+
+func (c *fakeGCPClient) GetRegion(ctx context.Context, project, region string) (*compute.Region, error) {
+	if c.fakeGetRegion == nil {
+		return nil, nil
+	}
+	return c.fakeGetRegion(ctx, project, region)
+}
+
+func (c *fakeGCPClient) GetRegionalDisk(ctx context.Context, project, region, name string) (*compute.Disk, error) {
+	if c.fakeGetRegionalDisk == nil {
+		return nil, nil
+	}
+	return c.fakeGetRegionalDisk(ctx, project, region, name)
+}
+
+func (c *fakeGCPClient) SetRegionalDiskLabels(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error) {
+	if err := c.nextSetLabelsErr(); err != nil {
+		return nil, err
+	}
+	if c.fakeSetRegionalDiskLabels == nil {
+		return nil, nil
+	}
+	return c.fakeSetRegionalDiskLabels(ctx, project, region, name, labelReq)
+}
+
+func (c *fakeGCPClient) GetRegionalGCEOp(ctx context.Context, project, region, name string) (*compute.Operation, error) {
+	c.setOpDeadline(ctx)
+	if c.fakeGetRegionalGCEOp == nil {
+		return nil, nil
+	}
+	return c.fakeGetRegionalGCEOp(ctx, project, region, name)
+}
+
+func (c *fakeGCPClient) ListSnapshots(ctx context.Context, project, filter string) ([]*compute.Snapshot, error) {
+	if c.fakeListSnapshots == nil {
+		return nil, nil
+	}
+	return c.fakeListSnapshots(ctx, project, filter)
+}
+
+func (c *fakeGCPClient) SetSnapshotLabels(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error) {
+	if c.fakeSetSnapshotLabels == nil {
+		return nil, nil
+	}
+	return c.fakeSetSnapshotLabels(ctx, project, name, labelReq)
+}
+
+func (c *fakeGCPClient) GetGlobalGCEOp(ctx context.Context, project, name string) (*compute.Operation, error) {
+	if c.fakeGetGlobalGCEOp == nil {
+		return nil, nil
+	}
+	return c.fakeGetGlobalGCEOp(ctx, project, name)
 }
 
 func setupFakeGCPClient(t *testing.T, currentLabels map[string]string, expectedSetLabels map[string]string) *fakeGCPClient {
 	return &fakeGCPClient{
-		fakeGetDisk: func(project, zone, name string) (*compute.Disk, error) {
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
 			return &compute.Disk{Labels: currentLabels}, nil
 		},
-		fakeSetDiskLabels: func(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
 			if !maps.Equal(labelReq.Labels, expectedSetLabels) {
 				t.Errorf("SetDiskLabels(), got labels = %v, want = %v", labelReq.Labels, expectedSetLabels)
 			}
 			return &compute.Operation{Status: "PENDING"}, nil
 		},
-		fakeGetGCEOp: func(project, zone, name string) (*compute.Operation, error) {
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
 			return &compute.Operation{Status: "DONE"}, nil
 		},
 	}
@@ -64,6 +180,7 @@ func TestAddPDVolumeLabels(t *testing.T) {
 		newPvcLabels          map[string]string
 		expectSetLabelsCalled bool
 		expectedSetLabels     map[string]string
+		want                  ReconcileResult
 	}{
 		{
 			name:                  "add new labels",
@@ -72,12 +189,39 @@ func TestAddPDVolumeLabels(t *testing.T) {
 			newPvcLabels:          map[string]string{"foo": "bar", "dom.tld/key": "value"},
 			expectSetLabelsCalled: true,
 			expectedSetLabels:     map[string]string{"key1": "val1", "key2": "val2", "foo": "bar", "dom-tld_key": "value"},
+			want: ReconcileResult{
+				Changed:      true,
+				LabelsAdded:  map[string]string{"foo": "bar", "dom-tld_key": "value"},
+				LabelsBefore: map[string]string{"key1": "val1", "key2": "val2"},
+				LabelsAfter:  map[string]string{"key1": "val1", "key2": "val2", "foo": "bar", "dom-tld_key": "value"},
+			},
+		},
+		{
+			name:                  "update existing label",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
+			newPvcLabels:          map[string]string{"key1": "new"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key1": "new", "key2": "val2"},
+			want: ReconcileResult{
+				Changed:      true,
+				LabelsAdded:  map[string]string{"key1": "new"},
+				LabelsBefore: map[string]string{"key1": "val1", "key2": "val2"},
+				LabelsAfter:  map[string]string{"key1": "new", "key2": "val2"},
+			},
 		},
 		{
 			name:                  "labels already set",
 			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
 			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
 			expectSetLabelsCalled: false,
+			want:                  ReconcileResult{},
+		},
+		{
+			name:                  "invalid volume ID",
+			volumeID:              "mydisk",
+			expectSetLabelsCalled: false,
+			want:                  ReconcileResult{Err: fmt.Errorf(`invalid volume handle "mydisk": want projects/{project}/zones/{zone}/disks/{name}`)},
 		},
 	}
 
@@ -85,174 +229,2611 @@ func TestAddPDVolumeLabels(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			client := setupFakeGCPClient(t, tt.currentLabels, tt.expectedSetLabels)
 
-			addPDVolumeLabels(client, tt.volumeID, tt.newPvcLabels, "storage-ssd")
+			got := addPDVolumeLabels(context.Background(), client, tt.volumeID, tt.newPvcLabels, "storage-ssd")
 
 			if client.setLabelsCalled != tt.expectSetLabelsCalled {
 				t.Error("SetDiskLabels() was not called")
 			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("addPDVolumeLabels() = %+v, want %+v", got, tt.want)
+			}
 		})
 	}
 }
 
-func TestDeletePDVolumeLabels(t *testing.T) {
+func TestAddPDVolumeLabelsWithLargeNumberOfLabels(t *testing.T) {
+	numberedLabels := func(prefix string, n int) map[string]string {
+		labels := make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			labels[fmt.Sprintf("%s%02d", prefix, i)] = "value"
+		}
+		return labels
+	}
+
 	tests := []struct {
-		name                  string
-		volumeID              string
-		currentLabels         map[string]string
-		labelsToDelete        []string
-		expectSetLabelsCalled bool
-		expectedSetLabels     map[string]string
+		name          string
+		currentLabels map[string]string
+		newPvcLabels  map[string]string
+		priorityKeys  []string
+		wantLabels    int
+		wantDropped   float64
+		// wantDroppedKeys are checked when set
+		wantDroppedKeys []string
 	}{
 		{
-			name:                  "delete existing labels",
-			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
-			currentLabels:         map[string]string{"key1": "val1", "key2": "val2", "dom-tld_key": "bar"},
-			labelsToDelete:        []string{"key1", "dom.tld/key"},
-			expectSetLabelsCalled: true,
-			expectedSetLabels:     map[string]string{"key2": "val2"},
+			name:          "70 pvc labels onto a disk with 10 labels",
+			currentLabels: numberedLabels("disk", 10),
+			newPvcLabels:  numberedLabels("pvc", 70),
+			wantLabels:    64,
+			wantDropped:   16,
 		},
 		{
-			name:                  "no labels to delete",
-			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
-			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
-			labelsToDelete:        []string{},
-			expectSetLabelsCalled: false,
+			name:          "5 pvc labels onto a disk with 62 labels",
+			currentLabels: numberedLabels("disk", 62),
+			newPvcLabels:  numberedLabels("pvc", 5),
+			wantLabels:    64,
+			wantDropped:   3,
 		},
 		{
-			name:                  "no matching labels to delete",
-			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
-			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
-			labelsToDelete:        []string{"foo"},
-			expectSetLabelsCalled: false,
+			name:            "existing labels are updated on a full disk",
+			currentLabels:   numberedLabels("disk", 64),
+			newPvcLabels:    map[string]string{"disk00": "updated", "pvc": "value"},
+			wantLabels:      64,
+			wantDropped:     1,
+			wantDroppedKeys: []string{"pvc"},
 		},
 		{
-			name:                  "all labels deleted",
-			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
-			currentLabels:         map[string]string{"key1": "val1"},
-			labelsToDelete:        []string{"key1"},
-			expectSetLabelsCalled: true,
-			expectedSetLabels:     map[string]string{},
+			name:            "shorter keys are set first",
+			currentLabels:   numberedLabels("disk", 62),
+			newPvcLabels:    map[string]string{"a-long-key": "1", "team": "2", "b": "3", "c": "4"},
+			wantLabels:      64,
+			wantDropped:     2,
+			wantDroppedKeys: []string{"team", "a-long-key"},
 		},
 		{
-			name:                  "no labels on disk",
-			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
-			currentLabels:         nil,
-			labelsToDelete:        []string{"foo"},
-			expectSetLabelsCalled: false,
+			name:            "priority keys are set first",
+			currentLabels:   numberedLabels("disk", 62),
+			newPvcLabels:    map[string]string{"zzz-long-key": "1", "b": "2", "team": "3", "owner": "4"},
+			priorityKeys:    []string{"zzz-long-key", "owner"},
+			wantLabels:      64,
+			wantDropped:     2,
+			wantDroppedKeys: []string{"b", "team"},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			client := setupFakeGCPClient(t, tt.currentLabels, tt.expectedSetLabels)
+			defer func(old []string) { gcpPriorityLabelKeys = old }(gcpPriorityLabelKeys)
+			gcpPriorityLabelKeys = tt.priorityKeys
+			var got map[string]string
+			client := setupFakeGCPClient(t, tt.currentLabels, nil)
+			client.fakeSetDiskLabels = func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+				got = labelReq.Labels
+				return &compute.Operation{Status: "PENDING"}, nil
+			}
+			storageclass := "storage-" + strings.ReplaceAll(tt.name, " ", "-")
 
-			deletePDVolumeLabels(client, tt.volumeID, tt.labelsToDelete, "storage-ssd")
+			res := addPDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/"+storageclass, tt.newPvcLabels, storageclass)
+			if res.Err != nil {
+				t.Fatalf("addPDVolumeLabels() error = %v", res.Err)
+			}
+			if len(res.LabelsDropped) != int(tt.wantDropped) || (tt.wantDroppedKeys != nil && !slices.Equal(res.LabelsDropped, tt.wantDroppedKeys)) {
+				t.Errorf("addPDVolumeLabels() dropped %v, want %d labels %v", res.LabelsDropped, int(tt.wantDropped), tt.wantDroppedKeys)
+			}
 
-			if client.setLabelsCalled != tt.expectSetLabelsCalled {
-				t.Error("SetDiskLabels() was not called")
+			if len(got) != tt.wantLabels {
+				t.Errorf("SetDiskLabels() got %d labels, want %d", len(got), tt.wantLabels)
+			}
+			for k, v := range tt.currentLabels {
+				if _, ok := got[k]; !ok {
+					t.Errorf("SetDiskLabels() dropped existing label %s=%s", k, v)
+				}
+			}
+			for k, v := range tt.newPvcLabels {
+				if _, ok := tt.currentLabels[k]; ok && got[k] != v {
+					t.Errorf("SetDiskLabels() label %s = %q, want %q", k, got[k], v)
+				}
+			}
+			if dropped := testutil.ToFloat64(promLabelsTruncatedTotal.WithLabelValues(storageclass)); dropped != tt.wantDropped {
+				t.Errorf("promLabelsTruncatedTotal = %v, want %v", dropped, tt.wantDropped)
+			}
+			if dropped := testutil.ToFloat64(promLabelsSkipped.WithLabelValues(labelsSkippedQuotaExceeded, cloud, storageclass)); dropped != tt.wantDropped {
+				t.Errorf("promLabelsSkipped = %v, want %v", dropped, tt.wantDropped)
 			}
 		})
 	}
 }
 
-func TestSanitizeLabelsForGCP(t *testing.T) {
+func TestZoneDiskOpsLimit(t *testing.T) {
+	defer func(old int) { gcpZoneDiskOps = old }(gcpZoneDiskOps)
+	gcpZoneDiskOps = 5
+
+	var mu sync.Mutex
+	inflight, maxInflight := 0, 0
+	newClient := func() *fakeGCPClient {
+		return &fakeGCPClient{
+			fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+				return &compute.Disk{Name: name}, nil
+			},
+			fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+				mu.Lock()
+				inflight++
+				maxInflight = max(maxInflight, inflight)
+				mu.Unlock()
+				time.Sleep(50 * time.Millisecond)
+				return &compute.Operation{Name: name, Status: "PENDING"}, nil
+			},
+			fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+				mu.Lock()
+				inflight--
+				mu.Unlock()
+				return &compute.Operation{Name: name, Status: "DONE"}, nil
+			},
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			volumeID := fmt.Sprintf("projects/myproject/zones/limited-zone-a/disks/disk-%d", i)
+			if res := addPDVolumeLabels(context.Background(), newClient(), volumeID, map[string]string{"foo": "bar"}, "storage-ssd"); res.Err != nil {
+				t.Errorf("addPDVolumeLabels() error = %v", res.Err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if maxInflight != gcpZoneDiskOps {
+		t.Errorf("max inflight disk operations = %d, want %d", maxInflight, gcpZoneDiskOps)
+	}
+	if inflight != 0 {
+		t.Errorf("inflight disk operations = %d after all updates finished, want 0", inflight)
+	}
+}
+
+func TestGCPWriteLimiter(t *testing.T) {
+	defer func(old *rate.Limiter) { gcpWriteLimiter = old }(gcpWriteLimiter)
+	defer func(old int) { gcpZoneDiskOps = old }(gcpZoneDiskOps)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	const writesPerSecond, writes = 20, 10
+	gcpWriteLimiter = newGCPWriteLimiter(writesPerSecond)
+	gcpZoneDiskOps = 0
+	gcpLabelCacheTTL = 0
+
+	var mu sync.Mutex
+	var calls []time.Time
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			mu.Lock()
+			calls = append(calls, time.Now())
+			mu.Unlock()
+			return &compute.Operation{Name: name, Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Name: name, Status: "DONE"}, nil
+		},
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			volumeID := fmt.Sprintf("projects/myproject/zones/myzone/disks/rate-limited-%d", i)
+			if res := addPDVolumeLabels(context.Background(), client, volumeID, map[string]string{"foo": "bar"}, "storage-ssd"); res.Err != nil {
+				t.Errorf("addPDVolumeLabels() error = %v", res.Err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(calls) != writes {
+		t.Fatalf("SetDiskLabels() called %d times, want %d", len(calls), writes)
+	}
+	// the first write doesn't wait, every further one waits for a token
+	minDuration := time.Duration(writes-1) * time.Second / writesPerSecond
+	if elapsed := time.Since(start); elapsed < minDuration*9/10 {
+		t.Errorf("%d writes took %v, want at least %v", writes, elapsed, minDuration)
+	}
+
+	if newGCPWriteLimiter(0) != nil {
+		t.Error("newGCPWriteLimiter(0) != nil, want no limit")
+	}
+}
+
+func TestAddPDVolumeLabelsEmptyFingerprint(t *testing.T) {
+	var gotFingerprint *string
+	client := setupFakeGCPClient(t, nil, map[string]string{"foo": "bar"})
+	client.fakeGetDisk = func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+		return &compute.Disk{Name: name, LabelFingerprint: ""}, nil
+	}
+	setDiskLabels := client.fakeSetDiskLabels
+	client.fakeSetDiskLabels = func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+		gotFingerprint = &labelReq.LabelFingerprint
+		return setDiskLabels(ctx, project, zone, name, labelReq)
+	}
+
+	if res := addPDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/newdisk", map[string]string{"foo": "bar"}, "storage-ssd"); res.Err != nil {
+		t.Errorf("addPDVolumeLabels() error = %v", res.Err)
+	}
+	if !client.setLabelsCalled {
+		t.Fatal("SetDiskLabels() was not called")
+	}
+	if gotFingerprint == nil || *gotFingerprint != "" {
+		t.Errorf("SetDiskLabels() fingerprint = %v, want empty", gotFingerprint)
+	}
+}
+
+func TestPDVolumeLabelsInvalidFingerprint(t *testing.T) {
+	client := setupFakeGCPClient(t, map[string]string{"key1": "val1"}, nil)
+	client.fakeGetDisk = func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+		return &compute.Disk{Name: name, Labels: map[string]string{"key1": "val1"}, LabelFingerprint: "not a fingerprint!"}, nil
+	}
+
+	volumeID := "projects/myproject/zones/myzone/disks/mydisk"
+	if res := addPDVolumeLabels(context.Background(), client, volumeID, map[string]string{"foo": "bar"}, "storage-ssd"); res.Err == nil || res.Changed {
+		t.Errorf("addPDVolumeLabels() = %+v, want an error", res)
+	}
+	if res := deletePDVolumeLabels(context.Background(), client, volumeID, []string{"key1"}, "storage-ssd"); res.Err == nil || res.Changed {
+		t.Errorf("deletePDVolumeLabels() = %+v, want an error", res)
+	}
+	if client.setLabelsCalled {
+		t.Error("SetDiskLabels() should not be called")
+	}
+}
+
+func TestPDVolumeLabelsDryRun(t *testing.T) {
+	defer func(old bool) { dryRun = old }(dryRun)
+	dryRun = true
+
+	client := setupFakeGCPClient(t, map[string]string{"key1": "val1"}, nil)
+	volumeID := "projects/myproject/zones/myzone/disks/mydisk"
+	dryRuns := promActionsTotal.With(prometheus.Labels{"status": "dry-run", "storageclass": "dry-run-ssd"})
+	before := testutil.ToFloat64(dryRuns)
+
+	res := addPDVolumeLabels(context.Background(), client, volumeID, map[string]string{"foo": "bar"}, "dry-run-ssd")
+	if want := (ReconcileResult{LabelsAdded: map[string]string{"foo": "bar"}}); !reflect.DeepEqual(res, want) {
+		t.Errorf("addPDVolumeLabels() = %+v, want %+v", res, want)
+	}
+	res = deletePDVolumeLabels(context.Background(), client, volumeID, []string{"key1"}, "dry-run-ssd")
+	if want := (ReconcileResult{LabelsRemoved: map[string]string{"key1": "val1"}}); !reflect.DeepEqual(res, want) {
+		t.Errorf("deletePDVolumeLabels() = %+v, want %+v", res, want)
+	}
+	if client.setLabelsCalled {
+		t.Error("SetDiskLabels() should not be called in dry-run mode")
+	}
+	if got := testutil.ToFloat64(dryRuns) - before; got != 2 {
+		t.Errorf("dry-run actions = %v, want 2", got)
+	}
+}
+
+func TestPDVolumeLabelsOperationMetrics(t *testing.T) {
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	gcpLabelCacheTTL = 0
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+	defer func(old time.Duration) { gcpPollInterval = old }(gcpPollInterval)
+	gcpPollInterval = 10 * time.Millisecond
+
+	storageclass := "metrics-ssd"
+	volumeID := "projects/myproject/zones/myzone/disks/mydisk"
 	tests := []struct {
-		name   string
-		labels map[string]string
-		want   map[string]string
+		name      string
+		operation string
+		run       func(c GCPClient) ReconcileResult
 	}{
 		{
-			name: "simple labels",
-			labels: map[string]string{
-				"Example/Key": "Example Value",
-				"Another.Key": "Another Value",
-			},
-			want: map[string]string{
-				"example_key": "Example Value",
-				"another-key": "Another Value",
+			name:      "add labels",
+			operation: operationAddLabels,
+			run: func(c GCPClient) ReconcileResult {
+				return addPDVolumeLabels(context.Background(), c, volumeID, map[string]string{"foo": "bar"}, storageclass)
 			},
 		},
 		{
-			name: "labels with special characters",
-			labels: map[string]string{
-				"Domain.com/Key":  "Value_1",
-				"Project.Version": "Version-1.2.3",
-			},
-			want: map[string]string{
-				"domain-com_key":  "Value_1",
-				"project-version": "Version-1.2.3",
+			name:      "delete labels",
+			operation: operationDeleteLabels,
+			run: func(c GCPClient) ReconcileResult {
+				return deletePDVolumeLabels(context.Background(), c, volumeID, []string{"key1"}, storageclass)
 			},
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metricLabels := prometheus.Labels{"operation": tt.operation, "cloud_provider": GCP, "storageclass": storageclass}
+			iterations := promPollIterations.With(metricLabels)
+			histogram := promOperationDuration.With(metricLabels).(prometheus.Histogram)
+			iterationsBefore := testutil.ToFloat64(iterations)
+			before := &dto.Metric{}
+			if err := histogram.Write(before); err != nil {
+				t.Fatal(err)
+			}
+
+			// the operation is still pending on the first poll and done on the second
+			polls := 0
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Labels: map[string]string{"key1": "val1"}}, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+					polls++
+					if polls == 1 {
+						return &compute.Operation{Status: "PENDING"}, nil
+					}
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+			}
+			if res := tt.run(client); res.Err != nil {
+				t.Fatalf("unexpected error: %v", res.Err)
+			}
+
+			if got := testutil.ToFloat64(iterations) - iterationsBefore; got != 2 {
+				t.Errorf("poll iterations increased by %v, want 2", got)
+			}
+			after := &dto.Metric{}
+			if err := histogram.Write(after); err != nil {
+				t.Fatal(err)
+			}
+			if got := after.GetHistogram().GetSampleCount() - before.GetHistogram().GetSampleCount(); got != 1 {
+				t.Errorf("histogram sample count increased by %v, want 1", got)
+			}
+			// the duration includes the time spent waiting between polls
+			if got := after.GetHistogram().GetSampleSum() - before.GetHistogram().GetSampleSum(); got < gcpPollInterval.Seconds() {
+				t.Errorf("histogram recorded %vs, want at least %v", got, gcpPollInterval)
+			}
+		})
+	}
+}
+
+func TestPDVolumeLabelsOperationPolling(t *testing.T) {
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	gcpLabelCacheTTL = 0
+	defer func(old time.Duration) { gcpPollInterval = old }(gcpPollInterval)
+	gcpPollInterval = 10 * time.Millisecond
+	defer func(old time.Duration) { gcpOperationTimeout = old }(gcpOperationTimeout)
+	defer func(old time.Duration) { gcpHyperdiskOpTimeout = old }(gcpHyperdiskOpTimeout)
+	gcpHyperdiskOpTimeout = 5 * time.Minute
+
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		diskType    string
+		doneAfter   int
+		wantErr     bool
+		wantTimeout time.Duration
+	}{
+		{
+			name:      "operation finishes",
+			timeout:   5 * time.Minute,
+			doneAfter: 3,
+		},
 		{
-			name: "labels exceeding maximum length",
-			labels: map[string]string{
-				strings.Repeat("a", 70): strings.Repeat("b", 70),
-			},
-			want: map[string]string{
-				strings.Repeat("a", 63): strings.Repeat("b", 63),
-			},
+			name:      "operation times out",
+			timeout:   50 * time.Millisecond,
+			doneAfter: -1,
+			wantErr:   true,
+		},
+		{
+			name:        "hyperdisk operation waits longer",
+			timeout:     50 * time.Millisecond,
+			diskType:    "https://www.googleapis.com/compute/v1/projects/myproject/zones/myzone/diskTypes/hyperdisk-balanced",
+			doneAfter:   8,
+			wantTimeout: 5 * time.Minute,
+		},
+		{
+			name:        "pd-ssd operation times out",
+			timeout:     50 * time.Millisecond,
+			diskType:    "https://www.googleapis.com/compute/v1/projects/myproject/zones/myzone/diskTypes/pd-ssd",
+			doneAfter:   -1,
+			wantErr:     true,
+			wantTimeout: 50 * time.Millisecond,
 		},
 	}
 
+	volumeID := "projects/myproject/zones/myzone/disks/mydisk"
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := sanitizeLabelsForGCP(tt.labels); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("sanitizeLabelsForGCP(), got = %v, want = %v", got, tt.want)
+			gcpOperationTimeout = tt.timeout
+
+			for _, run := range []func(c GCPClient) ReconcileResult{
+				func(c GCPClient) ReconcileResult {
+					return addPDVolumeLabels(context.Background(), c, volumeID, map[string]string{"foo": "bar"}, "storage-ssd")
+				},
+				func(c GCPClient) ReconcileResult {
+					return deletePDVolumeLabels(context.Background(), c, volumeID, []string{"key1"}, "storage-ssd")
+				},
+			} {
+				polls := 0
+				client := &fakeGCPClient{
+					fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+						return &compute.Disk{Labels: map[string]string{"key1": "val1"}, Type: tt.diskType}, nil
+					},
+					fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+						return &compute.Operation{Status: "PENDING"}, nil
+					},
+					fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+						polls++
+						if polls == tt.doneAfter {
+							return &compute.Operation{Status: "DONE"}, nil
+						}
+						return &compute.Operation{Status: "RUNNING"}, nil
+					},
+				}
+
+				start := time.Now()
+				res := run(client)
+				if (res.Err != nil) != tt.wantErr {
+					t.Fatalf("error = %v, wantErr %v", res.Err, tt.wantErr)
+				}
+				wantTimeout := tt.timeout
+				if tt.wantTimeout != 0 {
+					wantTimeout = tt.wantTimeout
+				}
+				if want := start.Add(wantTimeout); client.opDeadline.Before(want) || client.opDeadline.After(want.Add(time.Second)) {
+					t.Errorf("operation poll deadline = %v, want ~%v", client.opDeadline, want)
+				}
+				if !tt.wantErr && polls != tt.doneAfter {
+					t.Errorf("polled %d times, want %d", polls, tt.doneAfter)
+				}
 			}
 		})
 	}
 }
 
-func TestParseVolumeID(t *testing.T) {
+func Test_pdOperationTimeout(t *testing.T) {
+	defer func(old time.Duration) { gcpOperationTimeout = old }(gcpOperationTimeout)
+	defer func(old time.Duration) { gcpHyperdiskOpTimeout = old }(gcpHyperdiskOpTimeout)
+
 	tests := []struct {
-		name         string
-		id           string
-		wantProject  string
-		wantLocation string
-		wantName     string
-		wantErr      bool
+		name             string
+		diskType         string
+		operationTimeout time.Duration
+		hyperdiskTimeout time.Duration
+		wantHyperdisk    bool
+		wantTimeout      time.Duration
 	}{
 		{
-			name:         "valid volume ID",
-			id:           "projects/my-project/zones/us-central1/disks/my-disk",
-			wantProject:  "my-project",
-			wantLocation: "us-central1",
-			wantName:     "my-disk",
-			wantErr:      false,
+			name:             "pd-balanced",
+			diskType:         "https://www.googleapis.com/compute/v1/projects/myproject/zones/myzone/diskTypes/pd-balanced",
+			operationTimeout: time.Minute,
+			hyperdiskTimeout: 5 * time.Minute,
+			wantTimeout:      time.Minute,
 		},
 		{
-			name:         "missing parts",
-			id:           "projects/my-project/zones/",
-			wantProject:  "",
-			wantLocation: "",
-			wantName:     "",
-			wantErr:      true,
+			name:             "hyperdisk-balanced",
+			diskType:         "https://www.googleapis.com/compute/v1/projects/myproject/zones/myzone/diskTypes/hyperdisk-balanced",
+			operationTimeout: time.Minute,
+			hyperdiskTimeout: 5 * time.Minute,
+			wantHyperdisk:    true,
+			wantTimeout:      5 * time.Minute,
 		},
 		{
-			name:         "empty input",
-			id:           "",
-			wantProject:  "",
-			wantLocation: "",
-			wantName:     "",
-			wantErr:      true,
+			name:             "regional hyperdisk-balanced-high-availability",
+			diskType:         "projects/myproject/regions/myregion/diskTypes/hyperdisk-balanced-high-availability",
+			operationTimeout: time.Minute,
+			hyperdiskTimeout: 5 * time.Minute,
+			wantHyperdisk:    true,
+			wantTimeout:      5 * time.Minute,
+		},
+		{
+			name:             "hyperdisk-extreme with a longer operation timeout",
+			diskType:         "hyperdisk-extreme",
+			operationTimeout: 10 * time.Minute,
+			hyperdiskTimeout: 5 * time.Minute,
+			wantHyperdisk:    true,
+			wantTimeout:      10 * time.Minute,
+		},
+		{
+			name:             "no type",
+			operationTimeout: time.Minute,
+			hyperdiskTimeout: 5 * time.Minute,
+			wantTimeout:      time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gcpOperationTimeout = tt.operationTimeout
+			gcpHyperdiskOpTimeout = tt.hyperdiskTimeout
+			disk := &compute.Disk{Type: tt.diskType}
+
+			if got := isHyperdisk(disk); got != tt.wantHyperdisk {
+				t.Errorf("isHyperdisk() = %v, want %v", got, tt.wantHyperdisk)
+			}
+			if got := pdOperationTimeout(disk); got != tt.wantTimeout {
+				t.Errorf("pdOperationTimeout() = %v, want %v", got, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestPDVolumeLabelsRetry(t *testing.T) {
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	gcpLabelCacheTTL = 0
+	defer func(old int) { cloudRetryAttempts = old }(cloudRetryAttempts)
+	cloudRetryAttempts = 3
+	defer func(old time.Duration) { cloudRetryInterval = old }(cloudRetryInterval)
+	cloudRetryInterval = time.Millisecond
+
+	rateLimited := &googleapi.Error{Code: http.StatusTooManyRequests, Message: "rate limit exceeded"}
+	serverErr := &googleapi.Error{Code: http.StatusInternalServerError, Message: "internal error"}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "unavailable"}
+	forbidden := &googleapi.Error{Code: http.StatusForbidden, Message: "permission denied"}
+
+	tests := []struct {
+		name      string
+		volumeID  string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name:      "no error",
+			volumeID:  "projects/myproject/zones/myzone/disks/mydisk",
+			wantCalls: 1,
+		},
+		{
+			name:      "transient errors then success",
+			volumeID:  "projects/myproject/zones/myzone/disks/mydisk",
+			errs:      []error{rateLimited, serverErr},
+			wantCalls: 3,
+		},
+		{
+			name:      "regional disk retried",
+			volumeID:  "projects/myproject/regions/myregion/disks/mydisk",
+			errs:      []error{unavailable},
+			wantCalls: 2,
+		},
+		{
+			name:      "attempts exhausted",
+			volumeID:  "projects/myproject/zones/myzone/disks/mydisk",
+			errs:      []error{unavailable, unavailable, unavailable},
+			wantCalls: 3,
+			wantErr:   unavailable,
+		},
+		{
+			name:      "non-retriable error",
+			volumeID:  "projects/myproject/zones/myzone/disks/mydisk",
+			errs:      []error{forbidden},
+			wantCalls: 1,
+			wantErr:   forbidden,
+		},
+		{
+			name:      "non-retriable error after a transient error",
+			volumeID:  "projects/myproject/zones/myzone/disks/mydisk",
+			errs:      []error{rateLimited, forbidden},
+			wantCalls: 2,
+			wantErr:   forbidden,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			project, location, name, err := parseVolumeID(tt.id)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("parseVolumeID() error = %v, wantErr %v", err, tt.wantErr)
+			done := func(ctx context.Context, project, location, name string) (*compute.Operation, error) {
+				return &compute.Operation{Status: "DONE"}, nil
 			}
-			if project != tt.wantProject {
-				t.Errorf("Expected project %q, got %q", tt.wantProject, project)
+			getDisk := func(ctx context.Context, project, location, name string) (*compute.Disk, error) {
+				return &compute.Disk{Labels: map[string]string{"key1": "val1"}}, nil
 			}
-			if location != tt.wantLocation {
-				t.Errorf("Expected location %q, got %q", tt.wantLocation, location)
+			client := &fakeGCPClient{
+				fakeGetDisk: getDisk,
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				fakeGetGCEOp:        done,
+				fakeGetRegionalDisk: getDisk,
+				fakeSetRegionalDiskLabels: func(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				fakeGetRegionalGCEOp: done,
+				setLabelsErrs:        tt.errs,
 			}
-			if name != tt.wantName {
-				t.Errorf("Expected name %q, got %q", tt.wantName, name)
+
+			res := addPDVolumeLabels(context.Background(), client, tt.volumeID, map[string]string{"foo": "bar"}, "storage-ssd")
+			if !errors.Is(res.Err, tt.wantErr) {
+				t.Errorf("addPDVolumeLabels() error = %v, want %v", res.Err, tt.wantErr)
+			}
+			if client.setLabelsCalls != tt.wantCalls {
+				t.Errorf("set labels called %d times, want %d", client.setLabelsCalls, tt.wantCalls)
 			}
 		})
 	}
 }
+
+func TestPDVolumeLabelsFingerprintRetry(t *testing.T) {
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	gcpLabelCacheTTL = 0
+	defer func(old int) { gcpFingerprintRetries = old }(gcpFingerprintRetries)
+	gcpFingerprintRetries = 2
+
+	mismatch := &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "Labels fingerprint either invalid or resource labels have changed"}
+
+	tests := []struct {
+		name        string
+		errs        []error
+		concurrent  map[string]string
+		remove      bool
+		wantCalls   int
+		wantRetries float64
+		wantLabels  map[string]string
+		wantErr     error
+	}{
+		{
+			name:        "mismatch then success",
+			errs:        []error{mismatch},
+			concurrent:  map[string]string{"key1": "val1", "other": "agent"},
+			wantCalls:   2,
+			wantRetries: 1,
+			wantLabels:  map[string]string{"key1": "val1", "other": "agent", "foo": "bar"},
+		},
+		{
+			name:        "retries exhausted",
+			errs:        []error{mismatch, mismatch, mismatch},
+			concurrent:  map[string]string{"key1": "val1"},
+			wantCalls:   3,
+			wantRetries: 2,
+			wantErr:     mismatch,
+		},
+		{
+			name:        "labels set concurrently",
+			errs:        []error{mismatch},
+			concurrent:  map[string]string{"key1": "val1", "foo": "bar"},
+			wantCalls:   1,
+			wantRetries: 1,
+		},
+		{
+			name:        "delete after mismatch",
+			errs:        []error{mismatch},
+			concurrent:  map[string]string{"key1": "val1", "other": "agent"},
+			remove:      true,
+			wantCalls:   2,
+			wantRetries: 1,
+			wantLabels:  map[string]string{"other": "agent"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageclass := "storage-" + strings.ReplaceAll(tt.name, " ", "-")
+			var getDiskCalls int
+			var got map[string]string
+			var gotFingerprint string
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					getDiskCalls++
+					if getDiskCalls == 1 {
+						return &compute.Disk{Name: name, Labels: map[string]string{"key1": "val1"}, LabelFingerprint: "MTIz"}, nil
+					}
+					return &compute.Disk{Name: name, Labels: tt.concurrent, LabelFingerprint: "NDU2"}, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					got, gotFingerprint = labelReq.Labels, labelReq.LabelFingerprint
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				setLabelsErrs: tt.errs,
+			}
+
+			var res ReconcileResult
+			if tt.remove {
+				res = deletePDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/mydisk", []string{"key1"}, storageclass)
+			} else {
+				res = addPDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"foo": "bar"}, storageclass)
+			}
+			if !errors.Is(res.Err, tt.wantErr) {
+				t.Errorf("PD labels error = %v, want %v", res.Err, tt.wantErr)
+			}
+			if client.setLabelsCalls != tt.wantCalls {
+				t.Errorf("set labels called %d times, want %d", client.setLabelsCalls, tt.wantCalls)
+			}
+			if res.Changed != (tt.wantLabels != nil) {
+				t.Errorf("PD labels changed = %v, want %v", res.Changed, tt.wantLabels != nil)
+			}
+			if tt.wantLabels != nil {
+				if !maps.Equal(got, tt.wantLabels) {
+					t.Errorf("SetDiskLabels() got labels = %v, want %v", got, tt.wantLabels)
+				}
+				if gotFingerprint != "NDU2" {
+					t.Errorf("SetDiskLabels() got fingerprint = %q, want the re-fetched one", gotFingerprint)
+				}
+			}
+			if retries := testutil.ToFloat64(promFingerprintRetries.WithLabelValues(storageclass)); retries != tt.wantRetries {
+				t.Errorf("promFingerprintRetries = %v, want %v", retries, tt.wantRetries)
+			}
+		})
+	}
+}
+
+func TestIsValidGCPFingerprint(t *testing.T) {
+	tests := []struct {
+		fp   string
+		want bool
+	}{
+		{fp: "42WmSpB8rSM=", want: true},
+		{fp: "", want: true},
+		{fp: "not a fingerprint!", want: false},
+		{fp: "42WmSpB8rSM", want: false},
+	}
+	for _, tt := range tests {
+		if got := isValidGCPFingerprint(tt.fp); got != tt.want {
+			t.Errorf("isValidGCPFingerprint(%q) = %v, want %v", tt.fp, got, tt.want)
+		}
+	}
+}
+
+func TestDeletePDVolumeLabels(t *testing.T) {
+	tests := []struct {
+		name                  string
+		volumeID              string
+		currentLabels         map[string]string
+		labelsToDelete        []string
+		expectSetLabelsCalled bool
+		expectedSetLabels     map[string]string
+		want                  ReconcileResult
+	}{
+		{
+			name:                  "delete existing labels",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2", "dom-tld_key": "bar"},
+			labelsToDelete:        []string{"key1", "dom.tld/key"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key2": "val2"},
+			want: ReconcileResult{
+				Changed:       true,
+				LabelsRemoved: map[string]string{"key1": "val1", "dom-tld_key": "bar"},
+				LabelsBefore:  map[string]string{"key1": "val1", "key2": "val2", "dom-tld_key": "bar"},
+				LabelsAfter:   map[string]string{"key2": "val2"},
+			},
+		},
+		{
+			name:                  "no labels to delete",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
+			labelsToDelete:        []string{},
+			expectSetLabelsCalled: false,
+			want:                  ReconcileResult{},
+		},
+		{
+			name:                  "no matching labels to delete",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
+			labelsToDelete:        []string{"foo"},
+			expectSetLabelsCalled: false,
+			want:                  ReconcileResult{},
+		},
+		{
+			name:                  "all labels deleted",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1"},
+			labelsToDelete:        []string{"key1"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{},
+			want: ReconcileResult{
+				Changed:       true,
+				LabelsRemoved: map[string]string{"key1": "val1"},
+				LabelsBefore:  map[string]string{"key1": "val1"},
+				LabelsAfter:   map[string]string{},
+			},
+		},
+		{
+			name:                  "no labels on disk",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         nil,
+			labelsToDelete:        []string{"foo"},
+			expectSetLabelsCalled: false,
+			want:                  ReconcileResult{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := setupFakeGCPClient(t, tt.currentLabels, tt.expectedSetLabels)
+
+			got := deletePDVolumeLabels(context.Background(), client, tt.volumeID, tt.labelsToDelete, "storage-ssd")
+
+			if client.setLabelsCalled != tt.expectSetLabelsCalled {
+				t.Error("SetDiskLabels() was not called")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deletePDVolumeLabels() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPDVolumeLabelsProtectedKeys(t *testing.T) {
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	gcpLabelCacheTTL = 0
+	defer func(old []string) { protectedLabelKeys = old }(protectedLabelKeys)
+	protectedLabelKeys = []string{"compliance", "goog-managed"}
+
+	volumeID := "projects/myproject/zones/myzone/disks/mydisk"
+	diskLabels := map[string]string{"compliance": "pci", "goog-managed": "true", "team": "old"}
+	setLabelsCalls := 0
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			setLabelsCalls++
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	ctx := context.Background()
+
+	// the PVC's labels don't override the protected labels
+	res := addPDVolumeLabels(ctx, client, volumeID, map[string]string{"team": "db", "compliance": "none"}, "storage-ssd")
+	if res.Err != nil {
+		t.Fatalf("addPDVolumeLabels() error = %v", res.Err)
+	}
+	if want := map[string]string{"compliance": "pci", "goog-managed": "true", "team": "db"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("labels after add = %v, want %v", diskLabels, want)
+	}
+	if want := map[string]string{"team": "db"}; !maps.Equal(res.LabelsAdded, want) {
+		t.Errorf("addPDVolumeLabels() added = %v, want %v", res.LabelsAdded, want)
+	}
+
+	// only protected labels don't change the disk
+	res = addPDVolumeLabels(ctx, client, volumeID, map[string]string{"goog-managed": "false"}, "storage-ssd")
+	if res.Err != nil || res.Changed {
+		t.Errorf("addPDVolumeLabels() of protected labels = %+v, want no change", res)
+	}
+
+	// and are never deleted
+	res = deletePDVolumeLabels(ctx, client, volumeID, []string{"team", "compliance", "goog-managed"}, "storage-ssd")
+	if res.Err != nil {
+		t.Fatalf("deletePDVolumeLabels() error = %v", res.Err)
+	}
+	if want := map[string]string{"compliance": "pci", "goog-managed": "true"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("labels after delete = %v, want %v", diskLabels, want)
+	}
+	res = deletePDVolumeLabels(ctx, client, volumeID, []string{"compliance"}, "storage-ssd")
+	if res.Err != nil || res.Changed {
+		t.Errorf("deletePDVolumeLabels() of protected labels = %+v, want no change", res)
+	}
+	if setLabelsCalls != 2 {
+		t.Errorf("SetDiskLabels() called %d times, want 2", setLabelsCalls)
+	}
+}
+
+func TestPDVolumeLabelsGetDiskErrors(t *testing.T) {
+	notFoundErr := &googleapi.Error{Code: http.StatusNotFound, Message: "not found"}
+	tests := []struct {
+		name             string
+		strategy         string
+		err              error
+		wantLevel        log.Level
+		wantNotFoundInc  float64
+		wantErrorInc     float64
+		wantRequeue      bool
+		wantSkipped      bool
+		storageclassName string
+	}{
+		{
+			name:             "disk not found, skip",
+			strategy:         diskNotFoundSkip,
+			err:              notFoundErr,
+			wantLevel:        log.WarnLevel,
+			wantSkipped:      true,
+			storageclassName: "getdisk-not-found-skip",
+		},
+		{
+			name:             "disk not found, warn",
+			strategy:         diskNotFoundWarn,
+			err:              notFoundErr,
+			wantLevel:        log.WarnLevel,
+			wantNotFoundInc:  1,
+			wantSkipped:      true,
+			storageclassName: "getdisk-not-found-warn",
+		},
+		{
+			name:             "disk not found, fail",
+			strategy:         diskNotFoundFail,
+			err:              notFoundErr,
+			wantLevel:        log.ErrorLevel,
+			wantErrorInc:     1,
+			wantRequeue:      true,
+			storageclassName: "getdisk-not-found-fail",
+		},
+		{
+			name:             "other error",
+			strategy:         diskNotFoundFail,
+			err:              errors.New("boom"),
+			wantLevel:        log.ErrorLevel,
+			wantErrorInc:     1,
+			storageclassName: "getdisk-error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old string) { gcpDiskNotFound = old }(gcpDiskNotFound)
+			gcpDiskNotFound = tt.strategy
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return nil, tt.err
+				},
+			}
+			notFound := promDiskNotFoundTotal.With(prometheus.Labels{"storageclass": tt.storageclassName})
+			errored := promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": tt.storageclassName})
+			notFoundBefore := testutil.ToFloat64(notFound)
+			errorBefore := testutil.ToFloat64(errored)
+
+			results := []ReconcileResult{
+				addPDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"foo": "bar"}, tt.storageclassName),
+				deletePDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/mydisk", []string{"foo"}, tt.storageclassName),
+			}
+
+			if got := testutil.ToFloat64(notFound) - notFoundBefore; got != 2*tt.wantNotFoundInc {
+				t.Errorf("disk not found counter increased by %v, want %v", got, 2*tt.wantNotFoundInc)
+			}
+			if got := testutil.ToFloat64(errored) - errorBefore; got != 2*tt.wantErrorInc {
+				t.Errorf("error counter increased by %v, want %v", got, 2*tt.wantErrorInc)
+			}
+			for _, res := range results {
+				if res.Skipped != tt.wantSkipped {
+					t.Errorf("result skipped = %v, want %v", res.Skipped, tt.wantSkipped)
+				}
+				if tt.wantSkipped && res.Err != nil {
+					t.Errorf("result error = %v, want nil", res.Err)
+				}
+				if !tt.wantSkipped && !errors.Is(res.Err, tt.err) {
+					t.Errorf("result error = %v, want %v", res.Err, tt.err)
+				}
+				if got := errors.Is(res.Err, errRequeue); got != tt.wantRequeue {
+					t.Errorf("result requeue = %v, want %v", got, tt.wantRequeue)
+				}
+			}
+			if entry := hook.LastEntry(); entry == nil || entry.Level != tt.wantLevel {
+				t.Errorf("last log entry = %v, want level %v", entry, tt.wantLevel)
+			}
+			if client.setLabelsCalled {
+				t.Error("SetDiskLabels() should not be called")
+			}
+		})
+	}
+}
+
+func TestGetDiskZonalFallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		fallback     bool
+		location     string
+		wantLocation string
+		wantErr      bool
+		wantCalls    []string
+	}{
+		{
+			name:         "fallback to first zone of region",
+			fallback:     true,
+			location:     "us-east1",
+			wantLocation: "us-east1-b",
+			wantErr:      false,
+			wantCalls:    []string{"us-east1", "us-east1-b"},
+		},
+		{
+			name:         "fallback disabled",
+			fallback:     false,
+			location:     "us-east1",
+			wantLocation: "us-east1",
+			wantErr:      true,
+			wantCalls:    []string{"us-east1"},
+		},
+		{
+			name:         "zonal disk is not retried",
+			fallback:     true,
+			location:     "us-east1-c",
+			wantLocation: "us-east1-c",
+			wantErr:      true,
+			wantCalls:    []string{"us-east1-c"},
+		},
+	}
+
+	defer func() { gcpEnableZonalFallback = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gcpEnableZonalFallback = tt.fallback
+			var calls []string
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					calls = append(calls, zone)
+					if zone == "us-east1-b" {
+						return &compute.Disk{Name: name}, nil
+					}
+					return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: "zone not found"}
+				},
+				fakeGetRegion: func(ctx context.Context, project, region string) (*compute.Region, error) {
+					return &compute.Region{Zones: []string{
+						"https://www.googleapis.com/compute/v1/projects/myproject/zones/us-east1-d",
+						"https://www.googleapis.com/compute/v1/projects/myproject/zones/us-east1-b",
+						"https://www.googleapis.com/compute/v1/projects/myproject/zones/us-east1-c",
+					}}, nil
+				},
+			}
+
+			_, location, _, err := getDisk(context.Background(), client, "myproject", tt.location, "mydisk", false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getDisk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if location != tt.wantLocation {
+				t.Errorf("getDisk() location = %v, want %v", location, tt.wantLocation)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("GetDisk() called with zones %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestPDVolumeLabelsRegional(t *testing.T) {
+	tests := []struct {
+		name         string
+		volumeID     string
+		zoneOverride string
+		wantRegional bool
+		wantLocation string
+	}{
+		{
+			name:         "zonal disk",
+			volumeID:     "projects/myproject/zones/us-east1-b/disks/mydisk",
+			wantRegional: false,
+			wantLocation: "us-east1-b",
+		},
+		{
+			name:         "regional disk",
+			volumeID:     "projects/myproject/regions/us-east1/disks/mydisk",
+			wantRegional: true,
+			wantLocation: "us-east1",
+		},
+		{
+			name:         "zonal disk with zone override",
+			volumeID:     "projects/myproject/zones/us-east1-b/disks/mydisk",
+			zoneOverride: "us-west1-a",
+			wantRegional: false,
+			wantLocation: "us-west1-a",
+		},
+		{
+			name:         "regional disk with zone override",
+			volumeID:     "projects/myproject/regions/us-east1/disks/mydisk",
+			zoneOverride: "us-west1-a",
+			wantRegional: true,
+			wantLocation: "us-east1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old string) { gcpZoneOverride = old }(gcpZoneOverride)
+			gcpZoneOverride = tt.zoneOverride
+			var calls []string
+			var gotLabels []map[string]string
+			disk := &compute.Disk{Name: "mydisk", Labels: map[string]string{"existing": "label"}, LabelFingerprint: "42WmSpB8rSM="}
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					calls = append(calls, "GetDisk "+zone)
+					return disk, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					calls = append(calls, "SetDiskLabels "+zone)
+					gotLabels = append(gotLabels, labelReq.Labels)
+					return &compute.Operation{Name: "op", Status: "DONE"}, nil
+				},
+				fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+					calls = append(calls, "GetGCEOp "+zone)
+					return &compute.Operation{Name: name, Status: "DONE"}, nil
+				},
+				fakeGetRegionalDisk: func(ctx context.Context, project, region, name string) (*compute.Disk, error) {
+					calls = append(calls, "GetRegionalDisk "+region)
+					return disk, nil
+				},
+				fakeSetRegionalDiskLabels: func(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error) {
+					calls = append(calls, "SetRegionalDiskLabels "+region)
+					gotLabels = append(gotLabels, labelReq.Labels)
+					return &compute.Operation{Name: "op", Status: "DONE"}, nil
+				},
+				fakeGetRegionalGCEOp: func(ctx context.Context, project, region, name string) (*compute.Operation, error) {
+					calls = append(calls, "GetRegionalGCEOp "+region)
+					return &compute.Operation{Name: name, Status: "DONE"}, nil
+				},
+			}
+
+			if res := addPDVolumeLabels(context.Background(), client, tt.volumeID, map[string]string{"foo": "bar"}, "storage-ssd"); res.Err != nil {
+				t.Fatalf("addPDVolumeLabels() error = %v", res.Err)
+			}
+			if res := deletePDVolumeLabels(context.Background(), client, tt.volumeID, []string{"existing"}, "storage-ssd"); res.Err != nil {
+				t.Fatalf("deletePDVolumeLabels() error = %v", res.Err)
+			}
+
+			prefix := ""
+			if tt.wantRegional {
+				prefix = "Regional"
+			}
+			wantCalls := []string{
+				"Get" + prefix + "Disk " + tt.wantLocation,
+				"Set" + prefix + "DiskLabels " + tt.wantLocation,
+				"Get" + prefix + "GCEOp " + tt.wantLocation,
+				"Get" + prefix + "Disk " + tt.wantLocation,
+				"Set" + prefix + "DiskLabels " + tt.wantLocation,
+				"Get" + prefix + "GCEOp " + tt.wantLocation,
+			}
+			if !reflect.DeepEqual(calls, wantCalls) {
+				t.Errorf("GCP calls = %v, want %v", calls, wantCalls)
+			}
+			wantLabels := []map[string]string{
+				{"existing": "label", "foo": "bar"},
+				{},
+			}
+			if !reflect.DeepEqual(gotLabels, wantLabels) {
+				t.Errorf("labels set = %v, want %v", gotLabels, wantLabels)
+			}
+		})
+	}
+}
+
+func TestGetDiskRegionalZonalFallback(t *testing.T) {
+	defer func(old bool) { gcpEnableZonalFallback = old }(gcpEnableZonalFallback)
+	gcpEnableZonalFallback = true
+
+	client := &fakeGCPClient{
+		fakeGetRegionalDisk: func(ctx context.Context, project, region, name string) (*compute.Disk, error) {
+			return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "not found"}
+		},
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeGetRegion: func(ctx context.Context, project, region string) (*compute.Region, error) {
+			return &compute.Region{Zones: []string{"https://www.googleapis.com/compute/v1/projects/myproject/zones/us-east1-b"}}, nil
+		},
+	}
+	_, location, regional, err := getDisk(context.Background(), client, "myproject", "us-east1", "mydisk", true)
+	if err != nil {
+		t.Fatalf("getDisk() error = %v", err)
+	}
+	if location != "us-east1-b" || regional {
+		t.Errorf("getDisk() location = %v, regional = %v, want us-east1-b, false", location, regional)
+	}
+}
+
+func TestGetDiskZonalFallbackErrors(t *testing.T) {
+	notFound := &googleapi.Error{Code: http.StatusNotFound, Message: "not found"}
+	tests := []struct {
+		name         string
+		regionalErr  error
+		zonalErr     error
+		wantErr      error
+		wantLocation string
+		wantRegional bool
+		wantCalls    []string
+	}{
+		{
+			name:         "not found falls back",
+			regionalErr:  notFound,
+			wantLocation: "us-east1-b",
+			wantCalls:    []string{"GetRegionalDisk us-east1", "GetDisk us-east1-b"},
+		},
+		{
+			name:         "unknown zone falls back",
+			regionalErr:  &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid value for field 'zone': 'us-east1'. Unknown zone."},
+			wantLocation: "us-east1-b",
+			wantCalls:    []string{"GetRegionalDisk us-east1", "GetDisk us-east1-b"},
+		},
+		{
+			name:         "server error does not fall back",
+			regionalErr:  &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backend error"},
+			wantErr:      &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backend error"},
+			wantLocation: "us-east1",
+			wantRegional: true,
+			wantCalls:    []string{"GetRegionalDisk us-east1"},
+		},
+		{
+			name:         "rate limit does not fall back",
+			regionalErr:  &googleapi.Error{Code: http.StatusTooManyRequests, Message: "rate limit exceeded"},
+			wantErr:      &googleapi.Error{Code: http.StatusTooManyRequests, Message: "rate limit exceeded"},
+			wantLocation: "us-east1",
+			wantRegional: true,
+			wantCalls:    []string{"GetRegionalDisk us-east1"},
+		},
+		{
+			name:         "failed fallback returns the regional error",
+			regionalErr:  notFound,
+			zonalErr:     &googleapi.Error{Code: http.StatusInternalServerError, Message: "zonal error"},
+			wantErr:      notFound,
+			wantLocation: "us-east1",
+			wantRegional: true,
+			wantCalls:    []string{"GetRegionalDisk us-east1", "GetDisk us-east1-b"},
+		},
+	}
+
+	defer func(old bool) { gcpEnableZonalFallback = old }(gcpEnableZonalFallback)
+	gcpEnableZonalFallback = true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			client := &fakeGCPClient{
+				fakeGetRegionalDisk: func(ctx context.Context, project, region, name string) (*compute.Disk, error) {
+					calls = append(calls, "GetRegionalDisk "+region)
+					return nil, tt.regionalErr
+				},
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					calls = append(calls, "GetDisk "+zone)
+					if tt.zonalErr != nil {
+						return nil, tt.zonalErr
+					}
+					return &compute.Disk{Name: name}, nil
+				},
+				fakeGetRegion: func(ctx context.Context, project, region string) (*compute.Region, error) {
+					return &compute.Region{Zones: []string{"https://www.googleapis.com/compute/v1/projects/myproject/zones/us-east1-b"}}, nil
+				},
+			}
+
+			_, location, regional, err := getDisk(context.Background(), client, "myproject", "us-east1", "mydisk", true)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("getDisk() error = %v, want %v", err, tt.wantErr)
+			}
+			if location != tt.wantLocation || regional != tt.wantRegional {
+				t.Errorf("getDisk() location = %v, regional = %v, want %v, %v", location, regional, tt.wantLocation, tt.wantRegional)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("GCP calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+var sanitizeLabelsForGCPTests = []struct {
+	name   string
+	labels map[string]string
+	want   map[string]string
+}{
+	{
+		name: "simple labels",
+		labels: map[string]string{
+			"Example/Key": "Example Value",
+			"Another.Key": "Another Value",
+		},
+		want: map[string]string{
+			"example_key": "Example Value",
+			"another-key": "Another Value",
+		},
+	},
+	{
+		name: "labels with special characters",
+		labels: map[string]string{
+			"Domain.com/Key":  "Value_1",
+			"Project.Version": "Version-1.2.3",
+		},
+		want: map[string]string{
+			"domain-com_key":  "Value_1",
+			"project-version": "Version-1.2.3",
+		},
+	},
+	{
+		name: "labels exceeding maximum length",
+		labels: map[string]string{
+			strings.Repeat("a", 70): strings.Repeat("b", 70),
+		},
+		want: map[string]string{
+			strings.Repeat("a", 63): strings.Repeat("b", 63),
+		},
+	},
+	{
+		name: "key truncated to end with a separator",
+		labels: map[string]string{
+			strings.Repeat("a", 62) + ".b": "value",
+		},
+		want: map[string]string{
+			strings.Repeat("a", 62): "value",
+		},
+	},
+	{
+		name: "colliding keys use the first key in sorted order",
+		labels: map[string]string{
+			"app.foo/bar": "first",
+			"app-foo_bar": "second",
+			"App.Foo/Bar": "third",
+		},
+		want: map[string]string{
+			"app-foo_bar": "third",
+		},
+	},
+}
+
+func TestGCPLabelKeyCollisions(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   map[string][]string
+	}{
+		{
+			name:   "no collisions",
+			labels: map[string]string{"app.foo/bar": "a", "owner": "b"},
+			want:   map[string][]string{},
+		},
+		{
+			name:   "two keys collide",
+			labels: map[string]string{"app.foo/bar": "a", "app-foo_bar": "b", "owner": "c"},
+			want:   map[string][]string{"app-foo_bar": {"app-foo_bar", "app.foo/bar"}},
+		},
+		{
+			name: "keys collide after truncation",
+			labels: map[string]string{
+				strings.Repeat("a", 63) + "-x": "a",
+				strings.Repeat("a", 63) + "-y": "b",
+			},
+			want: map[string][]string{strings.Repeat("a", 63): {strings.Repeat("a", 63) + "-x", strings.Repeat("a", 63) + "-y"}},
+		},
+		{
+			name:   "several collisions",
+			labels: map[string]string{"A": "a", "a": "b", "b.c": "c", "b-c": "d", "B-C": "e"},
+			want:   map[string][]string{"a": {"A", "a"}, "b-c": {"B-C", "b-c", "b.c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gcpLabelKeyCollisions(tt.labels); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("gcpLabelKeyCollisions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resolveGCPKeyCollision(t *testing.T) {
+	defer func(old string) { gcpCollisionStrategy = old }(gcpCollisionStrategy)
+
+	labels := map[string]string{"app.foo/bar": "longest", "app-foo_bar": "short"}
+	tests := []struct {
+		strategy string
+		want     map[string]string
+	}{
+		{strategy: collisionFirstAlphabetical, want: map[string]string{"app-foo_bar": "short"}},
+		{strategy: collisionLastAlphabetical, want: map[string]string{"app-foo_bar": "longest"}},
+		{strategy: collisionLongestValue, want: map[string]string{"app-foo_bar": "longest"}},
+		{strategy: collisionError, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			gcpCollisionStrategy = tt.strategy
+			if got := sanitizeLabelsForGCP(labels); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitizeLabelsForGCP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("longest-value tie goes to the first key", func(t *testing.T) {
+		gcpCollisionStrategy = collisionLongestValue
+		got, ok := resolveGCPKeyCollision([]string{"app-foo_bar", "app.foo/bar"}, map[string]string{"app.foo/bar": "same", "app-foo_bar": "size"})
+		if got != "app-foo_bar" || !ok {
+			t.Errorf("resolveGCPKeyCollision() = %q, %v, want %q, true", got, ok, "app-foo_bar")
+		}
+	})
+}
+
+func TestSanitizeLabelsForGCP(t *testing.T) {
+	tests := sanitizeLabelsForGCPTests
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeLabelsForGCP(tt.labels); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitizeLabelsForGCP(), got = %v, want = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizersAreIdempotent(t *testing.T) {
+	sanitizers := []struct {
+		name     string
+		sanitize func(string) string
+	}{
+		{name: "sanitizeKeyForGCP", sanitize: sanitizeKeyForGCP},
+		{name: "sanitizeValueForGCP", sanitize: sanitizeValueForGCP},
+		{name: "sanitizeKeyForAzure", sanitize: sanitizeKeyForAzure},
+		{name: "sanitizeKeyForAzureFile", sanitize: sanitizeKeyForAzureFile},
+		{name: "azureSanitizer.sanitizeValue", sanitize: azureSanitizer.sanitizeValue},
+		{name: "sanitizeKeyForAWS", sanitize: func(key string) string {
+			sanitized, _ := sanitizeKeyForAWS(key)
+			return sanitized
+		}},
+		{name: "awsSanitizer.sanitizeValue", sanitize: awsSanitizer.sanitizeValue},
+	}
+
+	var inputs []string
+	for _, tt := range sanitizeLabelsForGCPTests {
+		for k, v := range tt.labels {
+			inputs = append(inputs, k, v)
+		}
+	}
+	inputs = append(inputs, "", "app---", "app/", "-app-", "APP.example.com/__name__", strings.Repeat("a.", 40), "🚀team", "1st", strings.Repeat("ü", 64))
+	inputs = append(inputs, "dom.tld/key", `a<b>c%d&e\f?g`, "Team_Name", strings.Repeat("ü/", 300), strings.Repeat("v", 600))
+	inputs = append(inputs, "aws:cloudformation:stack-name", "kubernetes.io/created-for/pvc/name", strings.Repeat("ü", 200))
+
+	for _, s := range sanitizers {
+		for _, input := range inputs {
+			once := s.sanitize(input)
+			if twice := s.sanitize(once); twice != once {
+				t.Errorf("%s(%q) is not idempotent: first pass = %q, second pass = %q", s.name, input, once, twice)
+			}
+		}
+	}
+}
+
+// gcpLabelKeyRegexp is the label key format from GCP's documentation
+var gcpLabelKeyRegexp = regexp.MustCompile(`^[\p{Ll}\p{Lo}][\p{Ll}\p{Lo}\p{N}_-]{0,62}$`)
+
+func TestGCPLabelValidity(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{name: "valid key", key: "environment", want: "environment"},
+		{name: "valid key with numbers, dashes and underscores", key: "cost_center-2024", want: "cost_center-2024"},
+		{name: "mixed case", key: "CostCenter", want: "costcenter"},
+		{name: "chinese", key: "成本中心", want: "成本中心"},
+		{name: "arabic", key: "مركز_التكلفة", want: "مركز_التكلفة"},
+		{name: "accented latin", key: "équipe", want: "équipe"},
+		{name: "accented latin uppercase", key: "Équipe", want: "équipe"},
+		{name: "emoji", key: "team🚀name", want: "team_name"},
+		{name: "trailing emoji", key: "team🚀", want: "team"},
+		{name: "leading emoji", key: "🚀team", want: "k_team"},
+		{name: "only emoji", key: "🚀", want: "k"},
+		{name: "leading digit", key: "1st-place", want: "k1st-place"},
+		{name: "leading underscore", key: "_private", want: "k_private"},
+		{name: "spaces", key: "cost center", want: "cost_center"},
+		{name: "kubernetes label", key: "app.kubernetes.io/name", want: "app-kubernetes-io_name"},
+		{name: "maximum length", key: strings.Repeat("a", 63), want: strings.Repeat("a", 63)},
+		{name: "maximum length plus one", key: strings.Repeat("a", 64), want: strings.Repeat("a", 63)},
+		{name: "maximum length with a leading digit", key: "1" + strings.Repeat("a", 62), want: "k1" + strings.Repeat("a", 61)},
+		{name: "maximum length plus one international", key: strings.Repeat("ü", 64), want: strings.Repeat("ü", 63)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeKeyForGCP(tt.key)
+			if got != tt.want {
+				t.Errorf("sanitizeKeyForGCP(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+			if !gcpLabelKeyRegexp.MatchString(got) {
+				t.Errorf("sanitizeKeyForGCP(%q) = %q is not a valid GCP label key", tt.key, got)
+			}
+		})
+	}
+}
+
+func TestGCPLabelKeyMaxLength(t *testing.T) {
+	defer func(old int) { gcpSanitizer.KeyMaxLen = old }(gcpSanitizer.KeyMaxLen)
+
+	tests := []struct {
+		name      string
+		maxLength int
+		key       string
+		want      string
+	}{
+		{name: "default maximum length", maxLength: gcpMaxLabelLength, key: strings.Repeat("a", 64), want: strings.Repeat("a", 63)},
+		{name: "longer maximum length", maxLength: 128, key: strings.Repeat("a", 128), want: strings.Repeat("a", 128)},
+		{name: "longer maximum length plus one", maxLength: 128, key: strings.Repeat("a", 129), want: strings.Repeat("a", 128)},
+		{name: "longer maximum length international", maxLength: 128, key: strings.Repeat("ü", 129), want: strings.Repeat("ü", 128)},
+		{name: "shorter maximum length", maxLength: 10, key: "cost-center-name", want: "cost-cente"},
+		{name: "shorter maximum length trims separators", maxLength: 5, key: "cost-center", want: "cost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gcpSanitizer.KeyMaxLen = tt.maxLength
+			if got := sanitizeKeyForGCP(tt.key); got != tt.want {
+				t.Errorf("sanitizeKeyForGCP(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	// values are not affected by the key length
+	gcpSanitizer.KeyMaxLen = 128
+	if got := sanitizeValueForGCP(strings.Repeat("v", 128)); got != strings.Repeat("v", 63) {
+		t.Errorf("sanitizeValueForGCP() = %q, want %d characters", got, 63)
+	}
+}
+
+func TestGCPCharReplacements(t *testing.T) {
+	tests := []struct {
+		name      string
+		flagValue string
+		env       *string
+		key       string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "defaults",
+			key:  "dom.tld/key",
+			want: "dom-tld_key",
+		},
+		{
+			name:      "flag overrides a default replacement",
+			flagValue: ".=_",
+			key:       "dom.tld/key",
+			want:      "dom_tld_key",
+		},
+		{
+			name:      "flag adds a replacement",
+			flagValue: "+=-plus-",
+			key:       "c++",
+			want:      "c-plus--plus",
+		},
+		{
+			name:      "env overrides the flag",
+			flagValue: ".=_",
+			env:       ptr.To("/=-"),
+			key:       "dom.tld/key",
+			want:      "dom-tld-key",
+		},
+		{
+			name:      "empty env clears the flag",
+			flagValue: ".=_",
+			env:       ptr.To(""),
+			key:       "dom.tld/key",
+			want:      "dom-tld_key",
+		},
+		{
+			name:    "replacement with invalid characters",
+			env:     ptr.To("/=."),
+			wantErr: true,
+		},
+		{
+			name:    "multi-character key",
+			env:     ptr.To("ab=c"),
+			wantErr: true,
+		},
+		{
+			name:    "replacement that is replaced again",
+			env:     ptr.To("-=_,_=-"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != nil {
+				t.Setenv(gcpCharReplacementsEnv, *tt.env)
+			}
+			defer func(old *strings.Replacer) { gcpSanitizer.ReplacementTable = old }(gcpSanitizer.ReplacementTable)
+
+			replacements, err := loadGCPCharReplacements(tt.flagValue)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadGCPCharReplacements() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			gcpSanitizer.ReplacementTable = newGCPKeyReplacer(replacements)
+			if got := sanitizeLabelsForGCP(map[string]string{tt.key: "value"}); !reflect.DeepEqual(got, map[string]string{tt.want: "value"}) {
+				t.Errorf("sanitizeLabelsForGCP() = %v, want key %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogSanitizationChanges(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.DebugLevel)
+
+	labels := map[string]string{
+		"unchanged":       "value",
+		"Dom.tld/Key":     "value",
+		"long":            strings.Repeat("v", 70),
+		"example.com/app": strings.Repeat("x", 64),
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    []log.Fields
+	}{
+		{
+			name:    "disabled",
+			enabled: false,
+			want:    []log.Fields{},
+		},
+		{
+			name:    "enabled",
+			enabled: true,
+			want: []log.Fields{
+				{"original_key": "Dom.tld/Key", "sanitized_key": "dom-tld_key"},
+				{"key": "long", "original_value": strings.Repeat("v", 70), "sanitized_value": strings.Repeat("v", 63)},
+				{"original_key": "example.com/app", "sanitized_key": "example-com_app"},
+				{"key": "example.com/app", "original_value": strings.Repeat("x", 64), "sanitized_value": strings.Repeat("x", 63)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			defer func(old bool) { logSanitizationChanges = old }(logSanitizationChanges)
+			logSanitizationChanges = tt.enabled
+
+			sanitizeLabelsForGCP(labels)
+
+			got := []log.Fields{}
+			for _, entry := range hook.AllEntries() {
+				if entry.Level != log.DebugLevel {
+					t.Errorf("log level = %v, want %v", entry.Level, log.DebugLevel)
+				}
+				got = append(got, entry.Data)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d log entries = %v, want %d", len(got), got, len(tt.want))
+			}
+			for _, want := range tt.want {
+				found := false
+				for _, fields := range got {
+					if reflect.DeepEqual(fields, want) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("missing log entry %v in %v", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseVolumeID(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		wantProject  string
+		wantLocation string
+		wantName     string
+		wantErr      bool
+		errText      string
+	}{
+		{
+			name:         "valid volume ID",
+			id:           "projects/my-project/zones/us-central1/disks/my-disk",
+			wantProject:  "my-project",
+			wantLocation: "us-central1",
+			wantName:     "my-disk",
+			wantErr:      false,
+		},
+		{
+			name:         "regional volume ID",
+			id:           "projects/my-project/regions/us-central1/disks/my-disk",
+			wantProject:  "my-project",
+			wantLocation: "us-central1",
+			wantName:     "my-disk",
+			wantErr:      false,
+		},
+		{
+			name:         "missing disk name",
+			id:           "projects/my-project/zones/us-central1-a/disks",
+			wantProject:  "",
+			wantLocation: "",
+			wantName:     "",
+			wantErr:      true,
+		},
+		{
+			name:         "missing parts",
+			id:           "projects/my-project/zones/",
+			wantProject:  "",
+			wantLocation: "",
+			wantName:     "",
+			wantErr:      true,
+		},
+		{
+			name:         "empty input",
+			id:           "",
+			wantProject:  "",
+			wantLocation: "",
+			wantName:     "",
+			wantErr:      true,
+		},
+		{
+			name:         "hyperdisk volume ID",
+			id:           "projects/my-project/zones/us-central1-a/disks/pvc-0f1e2d3c-hyperdisk-balanced",
+			wantProject:  "my-project",
+			wantLocation: "us-central1-a",
+			wantName:     "pvc-0f1e2d3c-hyperdisk-balanced",
+		},
+		{
+			name:         "trailing slash",
+			id:           "projects/my-project/zones/us-central1-a/disks/my-disk/",
+			wantProject:  "my-project",
+			wantLocation: "us-central1-a",
+			wantName:     "my-disk",
+		},
+		{
+			name:         "regional volume ID with trailing slashes",
+			id:           "projects/my-project/regions/us-central1/disks/my-disk//",
+			wantProject:  "my-project",
+			wantLocation: "us-central1",
+			wantName:     "my-disk",
+		},
+		{
+			name:         "query string",
+			id:           "projects/my-project/zones/us-central1-a/disks/my-disk?alt=json",
+			wantProject:  "my-project",
+			wantLocation: "us-central1-a",
+			wantName:     "my-disk",
+		},
+		{
+			name:         "trailing slash and query string",
+			id:           "projects/my-project/zones/us-central1-a/disks/my-disk/?alt=json",
+			wantProject:  "my-project",
+			wantLocation: "us-central1-a",
+			wantName:     "my-disk",
+		},
+		{
+			name:         "URL-encoded characters",
+			id:           "projects/my%2Dproject/zones/us-central1-a/disks/my%2Ddisk",
+			wantProject:  "my-project",
+			wantLocation: "us-central1-a",
+			wantName:     "my-disk",
+		},
+		{
+			name:    "invalid URL encoding",
+			id:      "projects/my-project/zones/us-central1-a/disks/my%zzdisk",
+			wantErr: true,
+			errText: `invalid component "my%zzdisk"`,
+		},
+		{
+			name:    "empty disk name",
+			id:      "projects/my-project/zones/us-central1-a/disks/?alt=json",
+			wantErr: true,
+			errText: "want projects/{project}/zones/{zone}/disks/{name}",
+		},
+		{
+			name:    "wrong projects component",
+			id:      "project/my-project/zones/us-central1-a/disks/my-disk",
+			wantErr: true,
+			errText: `want "projects", got "project"`,
+		},
+		{
+			name:    "wrong location kind",
+			id:      "projects/my-project/locations/us-central1-a/disks/my-disk",
+			wantErr: true,
+			errText: `want "zones" or "regions", got "locations"`,
+		},
+		{
+			name:    "empty zone",
+			id:      "projects/my-project/zones//disks/my-disk",
+			wantErr: true,
+			errText: "empty zone",
+		},
+		{
+			name:    "wrong disks component",
+			id:      "projects/my-project/zones/us-central1-a/snapshots/my-disk",
+			wantErr: true,
+			errText: `want "disks", got "snapshots"`,
+		},
+		{
+			name:    "empty disk name between slashes",
+			id:      "projects/my-project/zones/us-central1-a/disks//extra",
+			wantErr: true,
+			errText: "empty disk name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project, location, name, err := parseVolumeID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseVolumeID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("parseVolumeID() error = %v, want it to contain %q", err, tt.errText)
+			}
+			if project != tt.wantProject {
+				t.Errorf("Expected project %q, got %q", tt.wantProject, project)
+			}
+			if location != tt.wantLocation {
+				t.Errorf("Expected location %q, got %q", tt.wantLocation, location)
+			}
+			if name != tt.wantName {
+				t.Errorf("Expected name %q, got %q", tt.wantName, name)
+			}
+		})
+	}
+}
+
+func TestNewGCPClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client, err := newGCPClient(context.Background(), 500*time.Millisecond,
+		option.WithoutAuthentication(), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatalf("newGCPClient() error = %v", err)
+	}
+
+	_, err = client.GetDisk(context.Background(), "myproject", "myzone", "mydisk")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetDisk() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGCPClientCloudRequestTimeout(t *testing.T) {
+	defer func(old time.Duration) { cloudRequestTimeout = old }(cloudRequestTimeout)
+	cloudRequestTimeout = 100 * time.Millisecond
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	// no HTTP client timeout, so only the request deadline applies
+	client, err := newGCPClient(context.Background(), 0,
+		option.WithoutAuthentication(), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatalf("newGCPClient() error = %v", err)
+	}
+
+	start := time.Now()
+	_, err = client.SetDiskLabels(context.Background(), "myproject", "myzone", "mydisk", &compute.ZoneSetLabelsRequest{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetDiskLabels() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("SetDiskLabels() took %v, want about %v", elapsed, cloudRequestTimeout)
+	}
+}
+
+func TestNewGCPClientImpersonation(t *testing.T) {
+	defer func(old string) { gcpImpersonateAccount = old }(gcpImpersonateAccount)
+	defer func(old func(context.Context, impersonate.CredentialsConfig, ...option.ClientOption) (oauth2.TokenSource, error)) {
+		newImpersonatedTokenSource = old
+	}(newImpersonatedTokenSource)
+
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	var gotConfig impersonate.CredentialsConfig
+	newImpersonatedTokenSource = func(_ context.Context, config impersonate.CredentialsConfig, _ ...option.ClientOption) (oauth2.TokenSource, error) {
+		gotConfig = config
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "impersonated-token"}), nil
+	}
+	gcpImpersonateAccount = "tagger@myproject.iam.gserviceaccount.com"
+
+	client, err := newGCPClient(context.Background(), time.Second, option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatalf("newGCPClient() error = %v", err)
+	}
+	if _, err := client.GetDisk(context.Background(), "myproject", "myzone", "mydisk"); err != nil {
+		t.Fatalf("GetDisk() error = %v", err)
+	}
+
+	if gotConfig.TargetPrincipal != gcpImpersonateAccount {
+		t.Errorf("TargetPrincipal = %q, want %q", gotConfig.TargetPrincipal, gcpImpersonateAccount)
+	}
+	if !reflect.DeepEqual(gotConfig.Scopes, []string{compute.ComputeScope}) {
+		t.Errorf("Scopes = %v, want %v", gotConfig.Scopes, []string{compute.ComputeScope})
+	}
+	if gotAuth != "Bearer impersonated-token" {
+		t.Errorf("Authorization = %q, want %q", gotAuth, "Bearer impersonated-token")
+	}
+
+	newImpersonatedTokenSource = func(context.Context, impersonate.CredentialsConfig, ...option.ClientOption) (oauth2.TokenSource, error) {
+		return nil, errors.New("permission denied")
+	}
+	if _, err := newGCPClient(context.Background(), time.Second, option.WithEndpoint(srv.URL)); err == nil {
+		t.Errorf("newGCPClient() error = nil, want the impersonation error")
+	}
+}
+
+func TestGCPProjectIDFromMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/project/project-id" || r.Header.Get("Metadata-Flavor") != "Google" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		_, _ = w.Write([]byte("metadata-project"))
+	}))
+	defer srv.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	project, err := getMetadataProjectID()
+	if err != nil {
+		t.Fatalf("getMetadataProjectID() error = %v", err)
+	}
+	if project != "metadata-project" {
+		t.Fatalf("getMetadataProjectID() = %q, want %q", project, "metadata-project")
+	}
+
+	gcpDefaultProject = project
+	defer func() { gcpDefaultProject = "" }()
+
+	tests := []struct {
+		name        string
+		volumeID    string
+		wantProject string
+	}{
+		{
+			name:        "volume handle without project",
+			volumeID:    "projects//zones/myzone/disks/mydisk",
+			wantProject: "metadata-project",
+		},
+		{
+			name:        "volume handle with project",
+			volumeID:    "projects/myproject/zones/myzone/disks/mydisk",
+			wantProject: "myproject",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotProject string
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					gotProject = project
+					return &compute.Disk{Labels: map[string]string{"foo": "bar"}}, nil
+				},
+			}
+			if res := addPDVolumeLabels(context.Background(), client, tt.volumeID, map[string]string{"foo": "bar"}, "storage-ssd"); res.Err != nil {
+				t.Errorf("addPDVolumeLabels() error = %v", res.Err)
+			}
+			if gotProject != tt.wantProject {
+				t.Errorf("GetDisk() project = %q, want %q", gotProject, tt.wantProject)
+			}
+		})
+	}
+}
+
+type fakeBigtableClient struct {
+	labels map[string]string
+
+	updateCalled  bool
+	updatedLabels map[string]string
+}
+
+func (c *fakeBigtableClient) GetInstance(ctx context.Context, project, instance string) (*bigtableadmin.Instance, error) {
+	return &bigtableadmin.Instance{Name: "projects/" + project + "/instances/" + instance, Labels: c.labels}, nil
+}
+
+func (c *fakeBigtableClient) UpdateInstance(ctx context.Context, project, instance string, labels map[string]string) error {
+	c.updateCalled = true
+	c.updatedLabels = labels
+	return nil
+}
+
+func TestBigtableInstanceLabels(t *testing.T) {
+	tests := []struct {
+		name              string
+		currentLabels     map[string]string
+		newPvcLabels      map[string]string
+		labelsToDelete    []string
+		expectUpdate      bool
+		expectedSetLabels map[string]string
+	}{
+		{
+			name:              "add new labels",
+			currentLabels:     map[string]string{"key1": "val1"},
+			newPvcLabels:      map[string]string{"foo": "bar", "dom.tld/key": "value"},
+			expectUpdate:      true,
+			expectedSetLabels: map[string]string{"key1": "val1", "foo": "bar", "dom-tld_key": "value"},
+		},
+		{
+			name:          "labels already set",
+			currentLabels: map[string]string{"key1": "val1"},
+			newPvcLabels:  map[string]string{"key1": "val1"},
+			expectUpdate:  false,
+		},
+		{
+			name:              "delete existing labels",
+			currentLabels:     map[string]string{"key1": "val1", "dom-tld_key": "bar"},
+			labelsToDelete:    []string{"dom.tld/key"},
+			expectUpdate:      true,
+			expectedSetLabels: map[string]string{"key1": "val1"},
+		},
+		{
+			name:           "no matching labels to delete",
+			currentLabels:  map[string]string{"key1": "val1"},
+			labelsToDelete: []string{"foo"},
+			expectUpdate:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeBigtableClient{labels: tt.currentLabels}
+			volumeID := "projects/myproject/instances/myinstance/tables/mytable"
+
+			if tt.newPvcLabels != nil {
+				if err := addBigtableInstanceLabels(context.Background(), client, volumeID, tt.newPvcLabels, "bigtable"); err != nil {
+					t.Errorf("addBigtableInstanceLabels() error = %v", err)
+				}
+			}
+			deleteBigtableInstanceLabels(context.Background(), client, volumeID, tt.labelsToDelete, "bigtable")
+
+			if client.updateCalled != tt.expectUpdate {
+				t.Errorf("UpdateInstance() called = %v, want %v", client.updateCalled, tt.expectUpdate)
+			}
+			if tt.expectUpdate && !maps.Equal(client.updatedLabels, tt.expectedSetLabels) {
+				t.Errorf("UpdateInstance(), got labels = %v, want = %v", client.updatedLabels, tt.expectedSetLabels)
+			}
+		})
+	}
+}
+
+func TestParseBigtableVolumeHandle(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		wantProject  string
+		wantInstance string
+		wantTable    string
+		wantErr      bool
+	}{
+		{
+			name:         "valid volume handle",
+			id:           "projects/my-project/instances/my-instance/tables/my-table",
+			wantProject:  "my-project",
+			wantInstance: "my-instance",
+			wantTable:    "my-table",
+		},
+		{
+			name:    "PD volume handle",
+			id:      "projects/my-project/zones/us-central1-a/disks/my-disk",
+			wantErr: true,
+		},
+		{
+			name:    "missing table",
+			id:      "projects/my-project/instances/my-instance/tables/",
+			wantErr: true,
+		},
+		{
+			name:    "empty input",
+			id:      "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project, instance, table, err := parseBigtableVolumeHandle(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseBigtableVolumeHandle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if project != tt.wantProject || instance != tt.wantInstance || table != tt.wantTable {
+				t.Errorf("parseBigtableVolumeHandle() = %q, %q, %q, want %q, %q, %q", project, instance, table, tt.wantProject, tt.wantInstance, tt.wantTable)
+			}
+		})
+	}
+}
+
+type fakeFilestoreClient struct {
+	labels map[string]string
+
+	instanceName  string
+	updateCalled  bool
+	updatedLabels map[string]string
+}
+
+func (c *fakeFilestoreClient) GetInstance(ctx context.Context, project, location, instance string) (*file.Instance, error) {
+	c.instanceName = "projects/" + project + "/locations/" + location + "/instances/" + instance
+	return &file.Instance{Name: c.instanceName, Labels: c.labels}, nil
+}
+
+func (c *fakeFilestoreClient) UpdateInstanceLabels(ctx context.Context, project, location, instance string, labels map[string]string) error {
+	c.updateCalled = true
+	c.updatedLabels = labels
+	return nil
+}
+
+func TestFilestoreLabels(t *testing.T) {
+	tests := []struct {
+		name              string
+		currentLabels     map[string]string
+		newPvcLabels      map[string]string
+		labelsToDelete    []string
+		expectUpdate      bool
+		expectedSetLabels map[string]string
+	}{
+		{
+			name:              "add new labels",
+			currentLabels:     map[string]string{"key1": "val1"},
+			newPvcLabels:      map[string]string{"foo": "bar", "dom.tld/key": "value"},
+			expectUpdate:      true,
+			expectedSetLabels: map[string]string{"key1": "val1", "foo": "bar", "dom-tld_key": "value"},
+		},
+		{
+			name:              "add labels to instance without labels",
+			newPvcLabels:      map[string]string{"foo": "bar"},
+			expectUpdate:      true,
+			expectedSetLabels: map[string]string{"foo": "bar"},
+		},
+		{
+			name:          "labels already set",
+			currentLabels: map[string]string{"key1": "val1"},
+			newPvcLabels:  map[string]string{"key1": "val1"},
+			expectUpdate:  false,
+		},
+		{
+			name:              "delete existing labels",
+			currentLabels:     map[string]string{"key1": "val1", "dom-tld_key": "bar"},
+			labelsToDelete:    []string{"dom.tld/key"},
+			expectUpdate:      true,
+			expectedSetLabels: map[string]string{"key1": "val1"},
+		},
+		{
+			name:           "no matching labels to delete",
+			currentLabels:  map[string]string{"key1": "val1"},
+			labelsToDelete: []string{"foo"},
+			expectUpdate:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeFilestoreClient{labels: tt.currentLabels}
+			volumeID := "projects/myproject/locations/us-central1-a/instances/myinstance"
+
+			if tt.newPvcLabels != nil {
+				if err := addFilestoreLabels(context.Background(), client, volumeID, tt.newPvcLabels, "filestore"); err != nil {
+					t.Errorf("addFilestoreLabels() error = %v", err)
+				}
+			}
+			deleteFilestoreLabels(context.Background(), client, volumeID, tt.labelsToDelete, "filestore")
+
+			if client.instanceName != "projects/myproject/locations/us-central1-a/instances/myinstance" {
+				t.Errorf("GetInstance() name = %q", client.instanceName)
+			}
+			if client.updateCalled != tt.expectUpdate {
+				t.Errorf("UpdateInstanceLabels() called = %v, want %v", client.updateCalled, tt.expectUpdate)
+			}
+			if tt.expectUpdate && !maps.Equal(client.updatedLabels, tt.expectedSetLabels) {
+				t.Errorf("UpdateInstanceLabels(), got labels = %v, want = %v", client.updatedLabels, tt.expectedSetLabels)
+			}
+		})
+	}
+}
+
+func TestParseFilestoreVolumeHandle(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		defaultProject string
+		wantProject    string
+		wantLocation   string
+		wantInstance   string
+		wantErr        bool
+	}{
+		{
+			name:         "instance resource name",
+			id:           "projects/my-project/locations/us-central1-a/instances/my-instance",
+			wantProject:  "my-project",
+			wantLocation: "us-central1-a",
+			wantInstance: "my-instance",
+		},
+		{
+			name:           "CSI volume handle",
+			id:             "modeInstance/us-central1/my-instance/vol1",
+			defaultProject: "metadata-project",
+			wantProject:    "metadata-project",
+			wantLocation:   "us-central1",
+			wantInstance:   "my-instance",
+		},
+		{
+			name:    "CSI volume handle without default project",
+			id:      "modeInstance/us-central1/my-instance/vol1",
+			wantErr: true,
+		},
+		{
+			name:    "PD volume handle",
+			id:      "projects/my-project/zones/us-central1-a/disks/my-disk",
+			wantErr: true,
+		},
+		{
+			name:    "missing instance",
+			id:      "projects/my-project/locations/us-central1-a/instances/",
+			wantErr: true,
+		},
+		{
+			name:    "empty input",
+			id:      "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old string) { gcpDefaultProject = old }(gcpDefaultProject)
+			gcpDefaultProject = tt.defaultProject
+
+			project, location, instance, err := parseFilestoreVolumeHandle(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFilestoreVolumeHandle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if project != tt.wantProject || location != tt.wantLocation || instance != tt.wantInstance {
+				t.Errorf("parseFilestoreVolumeHandle() = %q, %q, %q, want %q, %q, %q", project, location, instance, tt.wantProject, tt.wantLocation, tt.wantInstance)
+			}
+		})
+	}
+}
+
+type fakeSpannerClient struct {
+	labels map[string]string
+
+	instanceName  string
+	patchCalled   bool
+	patchedLabels map[string]string
+}
+
+func (c *fakeSpannerClient) GetInstance(ctx context.Context, project, instance string) (*spanner.Instance, error) {
+	c.instanceName = "projects/" + project + "/instances/" + instance
+	return &spanner.Instance{Name: c.instanceName, Labels: c.labels}, nil
+}
+
+func (c *fakeSpannerClient) PatchInstance(ctx context.Context, project, instance string, labels map[string]string) error {
+	c.patchCalled = true
+	c.patchedLabels = labels
+	return nil
+}
+
+func TestSpannerInstanceLabels(t *testing.T) {
+	tests := []struct {
+		name              string
+		currentLabels     map[string]string
+		newPvcLabels      map[string]string
+		labelsToDelete    []string
+		expectPatch       bool
+		expectedSetLabels map[string]string
+	}{
+		{
+			name:              "add new labels",
+			currentLabels:     map[string]string{"key1": "val1"},
+			newPvcLabels:      map[string]string{"foo": "bar", "dom.tld/key": "value"},
+			expectPatch:       true,
+			expectedSetLabels: map[string]string{"key1": "val1", "foo": "bar", "dom-tld_key": "value"},
+		},
+		{
+			name:          "labels already set",
+			currentLabels: map[string]string{"key1": "val1"},
+			newPvcLabels:  map[string]string{"key1": "val1"},
+			expectPatch:   false,
+		},
+		{
+			name:              "delete existing labels",
+			currentLabels:     map[string]string{"key1": "val1", "dom-tld_key": "bar"},
+			labelsToDelete:    []string{"dom.tld/key"},
+			expectPatch:       true,
+			expectedSetLabels: map[string]string{"key1": "val1"},
+		},
+		{
+			name:           "no matching labels to delete",
+			currentLabels:  map[string]string{"key1": "val1"},
+			labelsToDelete: []string{"foo"},
+			expectPatch:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSpannerClient{labels: tt.currentLabels}
+
+			if tt.newPvcLabels != nil {
+				if err := addSpannerInstanceLabels(context.Background(), client, "myproject", "myinstance", tt.newPvcLabels, "spanner"); err != nil {
+					t.Errorf("addSpannerInstanceLabels() error = %v", err)
+				}
+			}
+			deleteSpannerInstanceLabels(context.Background(), client, "myproject", "myinstance", tt.labelsToDelete, "spanner")
+
+			if client.instanceName != "projects/myproject/instances/myinstance" {
+				t.Errorf("GetInstance() name = %v, want projects/myproject/instances/myinstance", client.instanceName)
+			}
+			if client.patchCalled != tt.expectPatch {
+				t.Errorf("PatchInstance() called = %v, want %v", client.patchCalled, tt.expectPatch)
+			}
+			if tt.expectPatch && !maps.Equal(client.patchedLabels, tt.expectedSetLabels) {
+				t.Errorf("PatchInstance(), got labels = %v, want = %v", client.patchedLabels, tt.expectedSetLabels)
+			}
+		})
+	}
+}
+
+func TestGetSpannerInstance(t *testing.T) {
+	tests := []struct {
+		name           string
+		annotation     *string
+		volumeID       string
+		defaultProject string
+		wantProject    string
+		wantInstance   string
+		wantOk         bool
+	}{
+		{
+			name:     "no annotation",
+			volumeID: "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantOk:   false,
+		},
+		{
+			name:         "instance in the project of a PD",
+			annotation:   ptr.To("my-instance"),
+			volumeID:     "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantProject:  "my-project",
+			wantInstance: "my-instance",
+			wantOk:       true,
+		},
+		{
+			name:         "instance in the project of a Bigtable table",
+			annotation:   ptr.To("my-instance"),
+			volumeID:     "projects/bt-project/instances/bt-instance/tables/my-table",
+			wantProject:  "bt-project",
+			wantInstance: "my-instance",
+			wantOk:       true,
+		},
+		{
+			name:           "instance in the default project",
+			annotation:     ptr.To("my-instance"),
+			volumeID:       "projects//zones/us-east1-a/disks/my-disk",
+			defaultProject: "default-project",
+			wantProject:    "default-project",
+			wantInstance:   "my-instance",
+			wantOk:         true,
+		},
+		{
+			name:         "full resource name",
+			annotation:   ptr.To("projects/other-project/instances/my-instance"),
+			volumeID:     "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantProject:  "other-project",
+			wantInstance: "my-instance",
+			wantOk:       true,
+		},
+		{
+			name:       "invalid resource name",
+			annotation: ptr.To("projects/other-project/my-instance"),
+			volumeID:   "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantOk:     false,
+		},
+		{
+			name:       "empty annotation",
+			annotation: ptr.To(""),
+			volumeID:   "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantOk:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old string) { gcpDefaultProject = old }(gcpDefaultProject)
+			gcpDefaultProject = tt.defaultProject
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			if tt.annotation != nil {
+				pvc.SetAnnotations(map[string]string{spannerInstanceAnnotation: *tt.annotation})
+			}
+
+			project, instance, ok := getSpannerInstance(pvc, tt.volumeID)
+			if ok != tt.wantOk || project != tt.wantProject || instance != tt.wantInstance {
+				t.Errorf("getSpannerInstance() = %q, %q, %v, want %q, %q, %v", project, instance, ok, tt.wantProject, tt.wantInstance, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestSnapshotLabels(t *testing.T) {
+	defer func(old []string) { protectedLabelKeys = old }(protectedLabelKeys)
+	defer func(old time.Duration) { gcpPollInterval = old }(gcpPollInterval)
+	gcpPollInterval = time.Millisecond
+
+	selfLink := "https://www.googleapis.com/compute/v1/projects/myproject/zones/myzone/disks/mydisk"
+	tests := []struct {
+		name      string
+		snapshots []*compute.Snapshot
+		protected []string
+		setErrs   map[string]error
+		listErr   error
+		sync      func(ctx context.Context, c GCPClient) error
+		// wantLabels are the labels set on each snapshot
+		wantLabels map[string]map[string]string
+		wantErr    bool
+	}{
+		{
+			name: "labels added to every snapshot",
+			snapshots: []*compute.Snapshot{
+				{Name: "snap-1", LabelFingerprint: "fp-1"},
+				{Name: "snap-2", LabelFingerprint: "fp-2", Labels: map[string]string{"other": "x"}},
+			},
+			sync: func(ctx context.Context, c GCPClient) error {
+				return addSnapshotLabels(ctx, c, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"dom.tld/key": "value"}, "storage-ssd")
+			},
+			wantLabels: map[string]map[string]string{
+				"snap-1": {"dom-tld_key": "value"},
+				"snap-2": {"dom-tld_key": "value", "other": "x"},
+			},
+		},
+		{
+			name: "snapshot with the labels already set is skipped",
+			snapshots: []*compute.Snapshot{
+				{Name: "snap-1", Labels: map[string]string{"key": "value"}},
+				{Name: "snap-2", Labels: map[string]string{"key": "old"}},
+			},
+			sync: func(ctx context.Context, c GCPClient) error {
+				return addSnapshotLabels(ctx, c, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"key": "value"}, "storage-ssd")
+			},
+			wantLabels: map[string]map[string]string{"snap-2": {"key": "value"}},
+		},
+		{
+			name:      "protected labels are kept",
+			snapshots: []*compute.Snapshot{{Name: "snap-1", Labels: map[string]string{"compliance": "pci"}}},
+			protected: []string{"compliance"},
+			sync: func(ctx context.Context, c GCPClient) error {
+				return addSnapshotLabels(ctx, c, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"compliance": "none", "key": "value"}, "storage-ssd")
+			},
+			wantLabels: map[string]map[string]string{"snap-1": {"compliance": "pci", "key": "value"}},
+		},
+		{
+			name: "labels deleted from every snapshot",
+			snapshots: []*compute.Snapshot{
+				{Name: "snap-1", Labels: map[string]string{"key": "value", "other": "x"}},
+				{Name: "snap-2", Labels: map[string]string{"other": "x"}},
+			},
+			sync: func(ctx context.Context, c GCPClient) error {
+				return deleteSnapshotLabels(ctx, c, "projects/myproject/zones/myzone/disks/mydisk", []string{"key"}, "storage-ssd")
+			},
+			wantLabels: map[string]map[string]string{"snap-1": {"other": "x"}},
+		},
+		{
+			name:      "protected labels are not deleted",
+			snapshots: []*compute.Snapshot{{Name: "snap-1", Labels: map[string]string{"compliance": "pci"}}},
+			protected: []string{"compliance"},
+			sync: func(ctx context.Context, c GCPClient) error {
+				return deleteSnapshotLabels(ctx, c, "projects/myproject/zones/myzone/disks/mydisk", []string{"compliance"}, "storage-ssd")
+			},
+		},
+		{
+			name: "failed snapshot doesn't stop the others",
+			snapshots: []*compute.Snapshot{
+				{Name: "snap-1"},
+				{Name: "snap-2"},
+			},
+			setErrs: map[string]error{"snap-1": errors.New("permission denied")},
+			sync: func(ctx context.Context, c GCPClient) error {
+				return addSnapshotLabels(ctx, c, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"key": "value"}, "storage-ssd")
+			},
+			wantLabels: map[string]map[string]string{"snap-2": {"key": "value"}},
+			wantErr:    true,
+		},
+		{
+			name:    "list error",
+			listErr: errors.New("permission denied"),
+			sync: func(ctx context.Context, c GCPClient) error {
+				return addSnapshotLabels(ctx, c, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"key": "value"}, "storage-ssd")
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protectedLabelKeys = tt.protected
+			gotLabels := map[string]map[string]string{}
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Name: name, SelfLink: selfLink}, nil
+				},
+				fakeListSnapshots: func(ctx context.Context, project, filter string) ([]*compute.Snapshot, error) {
+					if project != "myproject" || filter != fmt.Sprintf("sourceDisk = %q", selfLink) {
+						t.Errorf("ListSnapshots(%q, %q), want the snapshots of %s", project, filter, selfLink)
+					}
+					return tt.snapshots, tt.listErr
+				},
+				fakeSetSnapshotLabels: func(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error) {
+					for _, snapshot := range tt.snapshots {
+						if snapshot.Name == name && snapshot.LabelFingerprint != labelReq.LabelFingerprint {
+							t.Errorf("SetSnapshotLabels(%s) fingerprint = %q, want %q", name, labelReq.LabelFingerprint, snapshot.LabelFingerprint)
+						}
+					}
+					if err := tt.setErrs[name]; err != nil {
+						return nil, err
+					}
+					gotLabels[name] = labelReq.Labels
+					return &compute.Operation{Name: "op-" + name, Status: "PENDING"}, nil
+				},
+				fakeGetGlobalGCEOp: func(ctx context.Context, project, name string) (*compute.Operation, error) {
+					return &compute.Operation{Name: name, Status: "DONE"}, nil
+				},
+			}
+
+			err := tt.sync(context.Background(), client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantLabels == nil {
+				tt.wantLabels = map[string]map[string]string{}
+			}
+			if !reflect.DeepEqual(gotLabels, tt.wantLabels) {
+				t.Errorf("snapshot labels = %v, want %v", gotLabels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestPDLabelCache(t *testing.T) {
+	fakeClock := testingclock.NewFakeClock(time.Now())
+	clock = fakeClock
+	gcpLabelCacheTTL = time.Minute
+	defer func() {
+		clock = clocks.RealClock{}
+		gcpLabelCacheTTL = 0
+	}()
+
+	volumeID := "projects/myproject/zones/myzone/disks/cached-disk"
+	getDiskCalls := 0
+	client := setupFakeGCPClient(t, map[string]string{"key1": "val1"}, map[string]string{"key1": "val1", "foo": "bar"})
+	client.fakeGetDisk = func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+		getDiskCalls++
+		return &compute.Disk{Labels: map[string]string{"key1": "val1"}}, nil
+	}
+
+	if res := addPDVolumeLabels(context.Background(), client, volumeID, map[string]string{"foo": "bar"}, "storage-ssd"); res.Err != nil {
+		t.Fatalf("addPDVolumeLabels() error = %v", res.Err)
+	}
+	if getDiskCalls != 1 || !client.setLabelsCalled {
+		t.Fatalf("first sync: GetDisk() calls = %d, SetDiskLabels() called = %v", getDiskCalls, client.setLabelsCalled)
+	}
+
+	// the labels are now cached, so neither GetDisk nor SetDiskLabels is called
+	client.setLabelsCalled = false
+	if res := addPDVolumeLabels(context.Background(), client, volumeID, map[string]string{"foo": "bar"}, "storage-ssd"); res.Err != nil {
+		t.Fatalf("addPDVolumeLabels() error = %v", res.Err)
+	}
+	if getDiskCalls != 1 || client.setLabelsCalled {
+		t.Errorf("cache hit: GetDisk() calls = %d, SetDiskLabels() called = %v", getDiskCalls, client.setLabelsCalled)
+	}
+
+	// a changed label misses the cache
+	client.fakeSetDiskLabels = func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+		return &compute.Operation{Status: "PENDING"}, nil
+	}
+	if res := addPDVolumeLabels(context.Background(), client, volumeID, map[string]string{"foo": "baz"}, "storage-ssd"); res.Err != nil {
+		t.Fatalf("addPDVolumeLabels() error = %v", res.Err)
+	}
+	if getDiskCalls != 2 {
+		t.Errorf("changed label: GetDisk() calls = %d, want 2", getDiskCalls)
+	}
+
+	// an expired entry misses the cache
+	cachePDLabels(volumeID, map[string]string{"key1": "val1", "foo": "bar"})
+	fakeClock.Step(time.Minute)
+	_ = addPDVolumeLabels(context.Background(), client, volumeID, map[string]string{"foo": "bar"}, "storage-ssd")
+	if getDiskCalls != 3 {
+		t.Errorf("expired entry: GetDisk() calls = %d, want 3", getDiskCalls)
+	}
+
+	// the resync reads the labels of the PD even when they are cached
+	cachePDLabels(volumeID, map[string]string{"key1": "val1", "foo": "bar"})
+	_ = addPDVolumeLabels(withoutLabelCache(context.Background()), client, volumeID, map[string]string{"foo": "bar"}, "storage-ssd")
+	if getDiskCalls != 4 {
+		t.Errorf("resync: GetDisk() calls = %d, want 4", getDiskCalls)
+	}
+}
@@ -0,0 +1,124 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// controllerInitialized is set once the flags are validated and the
+	// kubernetes client is created
+	controllerInitialized atomic.Bool
+
+	// informerSyncs holds the HasSynced functions of the PVC informers
+	// the /readyz endpoint waits for
+	informerSyncs struct {
+		sync.Mutex
+		expected int
+		checks   []cache.InformerSynced
+	}
+)
+
+// expectInformerSyncs resets the readiness gate to wait for n PVC informers.
+// 0 marks the controller as not ready, e.g. while it isn't the leader.
+func expectInformerSyncs(n int) {
+	informerSyncs.Lock()
+	defer informerSyncs.Unlock()
+	informerSyncs.expected = n
+	informerSyncs.checks = nil
+}
+
+// addInformerSync registers the HasSynced function of a PVC informer
+func addInformerSync(hasSynced cache.InformerSynced) {
+	informerSyncs.Lock()
+	defer informerSyncs.Unlock()
+	informerSyncs.checks = append(informerSyncs.checks, hasSynced)
+}
+
+// informersSynced returns true once every expected PVC informer has been
+// registered and its initial list has synced. The PV, namespace and key
+// mapping informers are synced before the PVC informers start.
+func informersSynced() bool {
+	informerSyncs.Lock()
+	defer informerSyncs.Unlock()
+	if informerSyncs.expected == 0 || len(informerSyncs.checks) < informerSyncs.expected {
+		return false
+	}
+	for _, hasSynced := range informerSyncs.checks {
+		if !hasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// newHealthMux returns the handler of the --health-addr server
+func newHealthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probeHandler(controllerInitialized.Load))
+	mux.HandleFunc("/readyz", probeHandler(func() bool {
+		return controllerInitialized.Load() && informersSynced()
+	}))
+	return mux
+}
+
+// newMetricsMux returns the handler of the --metrics-addr server. The
+// OpenMetrics format is served to clients that ask for it in the Accept
+// header, the Prometheus text format otherwise
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}),
+	))
+	return mux
+}
+
+// probeHandler responds with 200 when ok returns true and with 503 otherwise
+func probeHandler(ok func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			writeProbeMessage(w, "method is not implemented")
+			return
+		}
+		if !ok() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeProbeMessage(w, "not ready")
+			return
+		}
+		writeProbeMessage(w, "OK")
+	}
+}
+
+func writeProbeMessage(w http.ResponseWriter, msg string) {
+	if _, err := w.Write([]byte(msg)); err != nil {
+		log.Errorln("Cannot write status message:", err)
+	}
+}
@@ -0,0 +1,242 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_healthEndpoints(t *testing.T) {
+	synced := func() bool { return true }
+	notSynced := func() bool { return false }
+
+	tests := []struct {
+		name        string
+		initialized bool
+		expected    int
+		checks      []cache.InformerSynced
+		method      string
+		wantHealthz int
+		wantReadyz  int
+	}{
+		{
+			name:        "not initialized",
+			expected:    1,
+			checks:      []cache.InformerSynced{synced},
+			wantHealthz: http.StatusServiceUnavailable,
+			wantReadyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:        "initialized, informers not started",
+			initialized: true,
+			wantHealthz: http.StatusOK,
+			wantReadyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:        "initialized, informer not synced",
+			initialized: true,
+			expected:    1,
+			checks:      []cache.InformerSynced{notSynced},
+			wantHealthz: http.StatusOK,
+			wantReadyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:        "initialized, one of two informers registered",
+			initialized: true,
+			expected:    2,
+			checks:      []cache.InformerSynced{synced},
+			wantHealthz: http.StatusOK,
+			wantReadyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:        "initialized, one of two informers synced",
+			initialized: true,
+			expected:    2,
+			checks:      []cache.InformerSynced{synced, notSynced},
+			wantHealthz: http.StatusOK,
+			wantReadyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:        "initialized, all informers synced",
+			initialized: true,
+			expected:    2,
+			checks:      []cache.InformerSynced{synced, synced},
+			wantHealthz: http.StatusOK,
+			wantReadyz:  http.StatusOK,
+		},
+		{
+			name:        "POST is not implemented",
+			initialized: true,
+			expected:    1,
+			checks:      []cache.InformerSynced{synced},
+			method:      http.MethodPost,
+			wantHealthz: http.StatusNotImplemented,
+			wantReadyz:  http.StatusNotImplemented,
+		},
+	}
+
+	defer controllerInitialized.Store(controllerInitialized.Load())
+	defer expectInformerSyncs(0)
+
+	server := httptest.NewServer(newHealthMux())
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controllerInitialized.Store(tt.initialized)
+			expectInformerSyncs(tt.expected)
+			for _, check := range tt.checks {
+				addInformerSync(check)
+			}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			for path, want := range map[string]int{"/healthz": tt.wantHealthz, "/readyz": tt.wantReadyz} {
+				req, err := http.NewRequest(method, server.URL+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Errorf("GET %s = %d %q, want %d", path, resp.StatusCode, body, want)
+				}
+				if want == http.StatusOK && string(body) != "OK" {
+					t.Errorf("GET %s body = %q, want \"OK\"", path, body)
+				}
+			}
+		})
+	}
+}
+
+func Test_readyzWaitsForInformerSync(t *testing.T) {
+	defer controllerInitialized.Store(controllerInitialized.Load())
+	controllerInitialized.Store(true)
+	expectInformerSyncs(1)
+	defer expectInformerSyncs(0)
+
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	informer := factory.Core().V1().PersistentVolumeClaims().Informer()
+	addInformerSync(informer.HasSynced)
+
+	probe := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		newHealthMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	if got := probe("/readyz").Code; got != http.StatusServiceUnavailable {
+		t.Errorf("readyz before the informer started = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	if got := probe("/readyz").Code; got != http.StatusOK {
+		t.Errorf("readyz after the informer synced = %d, want %d", got, http.StatusOK)
+	}
+
+	// losing the lease resets the gate
+	expectInformerSyncs(0)
+	rec := probe("/readyz")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "not ready") {
+		t.Errorf("readyz after losing the lease = %d %q, want %d", rec.Code, rec.Body.String(), http.StatusServiceUnavailable)
+	}
+	// healthz is unaffected
+	if got := probe("/healthz").Code; got != http.StatusOK {
+		t.Errorf("healthz after losing the lease = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func Test_metricsEndpoint(t *testing.T) {
+	tests := []struct {
+		name            string
+		accept          string
+		wantContentType string
+		wantEOF         bool
+	}{
+		{
+			name:            "no accept header",
+			wantContentType: "text/plain; version=0.0.4",
+		},
+		{
+			name:            "prometheus text format",
+			accept:          "text/plain;version=0.0.4;q=1,*/*;q=0.1",
+			wantContentType: "text/plain; version=0.0.4",
+		},
+		{
+			name:            "openmetrics",
+			accept:          "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5",
+			wantContentType: "application/openmetrics-text; version=1.0.0",
+			wantEOF:         true,
+		},
+	}
+	server := httptest.NewServer(newMetricsMux())
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) {
+				t.Errorf("Content-Type = %q, want prefix %q", got, tt.wantContentType)
+			}
+			if got := strings.HasSuffix(string(body), "# EOF\n"); got != tt.wantEOF {
+				t.Errorf("body ends with # EOF = %v, want %v", got, tt.wantEOF)
+			}
+			if !strings.Contains(string(body), "promhttp_metric_handler_requests_total") {
+				t.Errorf("body is missing promhttp_metric_handler_requests_total")
+			}
+		})
+	}
+}
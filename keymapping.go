@@ -0,0 +1,190 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// keyMappingInformer watches the --label-key-mapping-configmap
+	// ConfigMap. It is nil when no ConfigMap is configured.
+	keyMappingInformer cache.SharedIndexInformer
+	// keyMappingKey is the namespace/name key of the ConfigMap
+	keyMappingKey string
+)
+
+// parseConfigMapName splits the value of a ConfigMap flag, such as
+// --label-key-mapping-configmap, into the namespace and name of the ConfigMap.
+// The namespace defaults to the controller's namespace. It's also used for
+// the Service of --webhook-service.
+func parseConfigMapName(flagName, s string) (string, string, error) {
+	namespace, name, found := strings.Cut(s, "/")
+	if !found {
+		namespace, name = getCurrentNamespace(), s
+	}
+	if namespace == "" || name == "" {
+		return "", "", fmt.Errorf("%s must be <namespace>/<name>, or <name> when running in a cluster", flagName)
+	}
+	return namespace, name, nil
+}
+
+// startConfigMapInformer starts watching a single ConfigMap and returns the
+// informer once its cache has synced. It returns nil when the cache fails to
+// sync.
+func startConfigMapInformer(ctx context.Context, namespace, name string) cache.SharedIndexInformer {
+	factory := informers.NewSharedInformerFactoryWithOptions(k8sClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	factory.Start(ctx.Done())
+	for informerType, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			log.Errorf("Failed to sync %v informer cache. Check RBAC permissions", informerType)
+			return nil
+		}
+	}
+	return informer
+}
+
+// startKeyMappingInformer starts watching the key mapping ConfigMap and sets
+// keyMappingInformer once its cache has synced
+func startKeyMappingInformer(ctx context.Context, namespace, name string) {
+	informer := startConfigMapInformer(ctx, namespace, name)
+	if informer == nil {
+		return
+	}
+	keyMappingKey = namespace + "/" + name
+	keyMappingInformer = informer
+}
+
+// getLabelKeyMapping returns the key mapping in the ConfigMap. It is empty
+// when no ConfigMap is configured or the ConfigMap doesn't exist.
+func getLabelKeyMapping() map[string]string {
+	if keyMappingInformer == nil {
+		return nil
+	}
+	obj, exists, err := keyMappingInformer.GetStore().GetByKey(keyMappingKey)
+	if err != nil || !exists {
+		return map[string]string{}
+	}
+	mapping, _ := parseLabelKeyMapping(obj.(*corev1.ConfigMap))
+	return mapping
+}
+
+// parseLabelKeyMapping parses the key mapping in the ConfigMap. ConfigMap keys
+// can't contain '/', so each data value holds one "original-key: target-key"
+// pair per line. The invalid lines are skipped and returned.
+func parseLabelKeyMapping(cm *corev1.ConfigMap) (map[string]string, []string) {
+	mapping := map[string]string{}
+	var invalid []string
+	for _, data := range cm.Data {
+		for _, line := range strings.Split(data, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			original, target, found := strings.Cut(line, ":")
+			original, target = strings.TrimSpace(original), strings.TrimSpace(target)
+			if !found || original == "" || target == "" {
+				invalid = append(invalid, line)
+				continue
+			}
+			mapping[original] = target
+		}
+	}
+	return mapping, invalid
+}
+
+// keyMappingFromObject returns the key mapping of a ConfigMap received from
+// the informer, logging the invalid lines
+func keyMappingFromObject(obj interface{}) map[string]string {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return map[string]string{}
+	}
+	mapping, invalid := parseLabelKeyMapping(cm)
+	for _, line := range invalid {
+		log.WithFields(log.Fields{"namespace": cm.GetNamespace(), "configmap": cm.GetName()}).Warnln("Skipping invalid label key mapping:", line)
+	}
+	return mapping
+}
+
+// keyMappingEvents returns a pvcEventKeyMapping for every PVC in pvcLister
+// when the key mapping has changed
+func keyMappingEvents(oldMapping, newMapping map[string]string, pvcLister corelisters.PersistentVolumeClaimLister) []*pvcEvent {
+	if maps.Equal(oldMapping, newMapping) {
+		return nil
+	}
+	pvcs, err := pvcLister.List(labels.Everything())
+	if err != nil {
+		log.Errorln("Unable to list PVCs:", err)
+		return nil
+	}
+	log.Infoln("Label key mapping changed, reconciling", len(pvcs), "PVCs")
+	var events []*pvcEvent
+	for _, pvc := range pvcs {
+		// objects in the informer cache must not be modified
+		e := newPVCEvent(pvcEventKeyMapping, nil, getPVC(pvc.DeepCopy()))
+		e.oldSources.keyMapping = oldMapping
+		events = append(events, e)
+	}
+	return events
+}
+
+// keyMappingEventHandler queues a pvcEventKeyMapping for every PVC in
+// pvcLister when the key mapping ConfigMap is created, updated or deleted
+func keyMappingEventHandler(queue eventQueue, pvcLister corelisters.PersistentVolumeClaimLister) cache.ResourceEventHandler {
+	enqueue := func(oldMapping, newMapping map[string]string) {
+		for _, e := range keyMappingEvents(oldMapping, newMapping, pvcLister) {
+			queue.Add(e)
+		}
+	}
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if !isInInitialList {
+				enqueue(map[string]string{}, keyMappingFromObject(obj))
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			enqueue(keyMappingFromObject(old), keyMappingFromObject(new))
+		},
+		DeleteFunc: func(obj interface{}) {
+			enqueue(keyMappingFromObject(obj), map[string]string{})
+		},
+	}
+}
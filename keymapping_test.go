@@ -0,0 +1,310 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_parseLabelKeyMapping(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{
+		"apps": "kubernetes.io/app: gcp-app\n  # comment\n\nteam:owner\n",
+		"bad":  "no-colon\n: missing-original\nmissing-target:",
+	}}
+	mapping, invalid := parseLabelKeyMapping(cm)
+	if want := map[string]string{"kubernetes.io/app": "gcp-app", "team": "owner"}; !reflect.DeepEqual(mapping, want) {
+		t.Errorf("parseLabelKeyMapping() mapping = %v, want %v", mapping, want)
+	}
+	if want := []string{"no-colon", ": missing-original", "missing-target:"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("parseLabelKeyMapping() invalid = %q, want %q", invalid, want)
+	}
+}
+
+func Test_parseConfigMapName(t *testing.T) {
+	tests := []struct {
+		name          string
+		s             string
+		wantNamespace string
+		wantName      string
+		wantErr       bool
+	}{
+		{name: "namespace and name", s: "kube-system/mapping", wantNamespace: "kube-system", wantName: "mapping"},
+		{name: "name outside a cluster", s: "mapping", wantErr: true},
+		{name: "empty name", s: "kube-system/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, name, err := parseConfigMapName("label-key-mapping-configmap", tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfigMapName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if namespace != tt.wantNamespace || name != tt.wantName {
+				t.Errorf("parseConfigMapName() = %s, %s, want %s, %s", namespace, name, tt.wantNamespace, tt.wantName)
+			}
+		})
+	}
+}
+
+func Test_remapTagKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		tags    map[string]string
+		want    map[string]string
+	}{
+		{
+			name:    "no mapping",
+			mapping: nil,
+			tags:    map[string]string{"kubernetes.io/app": "web"},
+			want:    map[string]string{"kubernetes.io/app": "web"},
+		},
+		{
+			name:    "mapped and unmapped keys",
+			mapping: map[string]string{"kubernetes.io/app": "gcp-app"},
+			tags:    map[string]string{"kubernetes.io/app": "web", "env": "prod"},
+			want:    map[string]string{"gcp-app": "web", "env": "prod"},
+		},
+		{
+			name:    "swapped keys",
+			mapping: map[string]string{"a": "b", "b": "a"},
+			tags:    map[string]string{"a": "1", "b": "2"},
+			want:    map[string]string{"a": "2", "b": "1"},
+		},
+		{
+			name:    "mapped key replaces an unmapped key",
+			mapping: map[string]string{"app": "env"},
+			tags:    map[string]string{"app": "web", "env": "prod"},
+			want:    map[string]string{"env": "web"},
+		},
+		{
+			name:    "first key in sorted order wins",
+			mapping: map[string]string{"b": "c", "a": "c"},
+			tags:    map[string]string{"a": "1", "b": "2"},
+			want:    map[string]string{"c": "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remapTagKeys(tt.tags, tt.mapping); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("remapTagKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildTagsKeyMappingAfterStripping(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { stripPrefixes = old }(stripPrefixes)
+	copyLabels = []string{"*"}
+	stripPrefixes = []string{"billing.acme.io"}
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Name:   "my-pvc",
+		Labels: map[string]string{"billing.acme.io/cost-center": "abc", "env": "prod"},
+	}}
+	tags, _ := buildTagsFromSources(context.Background(), pvc, tagSources{keyMapping: map[string]string{"cost-center": "cc"}})
+	if want := map[string]string{"cc": "abc", "env": "prod"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("buildTagsFromSources() = %v, want %v", tags, want)
+	}
+}
+
+func Test_getLabelKeyMapping(t *testing.T) {
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old cache.SharedIndexInformer) { keyMappingInformer = old }(keyMappingInformer)
+
+	keyMappingInformer = nil
+	if got := getLabelKeyMapping(); got != nil {
+		t.Errorf("getLabelKeyMapping() without a ConfigMap = %v, want nil", got)
+	}
+
+	k8sClient = fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "mapping", Namespace: "default"},
+			Data:       map[string]string{"mapping": "kubernetes.io/app: gcp-app"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+			Data:       map[string]string{"mapping": "env: environment"},
+		},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startKeyMappingInformer(ctx, "default", "mapping")
+
+	if got, want := getLabelKeyMapping(), map[string]string{"kubernetes.io/app": "gcp-app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getLabelKeyMapping() = %v, want %v", got, want)
+	}
+
+	// deleting the ConfigMap falls back to no remapping
+	if err := k8sClient.CoreV1().ConfigMaps("default").Delete(ctx, "mapping", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(getLabelKeyMapping()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("getLabelKeyMapping() = %v after the ConfigMap was deleted, want empty", getLabelKeyMapping())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_keyMappingEventHandler(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		if err := indexer.Add(&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvcLister := corelisters.NewPersistentVolumeClaimLister(indexer)
+
+	configMap := func(data string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{Data: map[string]string{"mapping": data}}
+	}
+	tests := []struct {
+		name        string
+		notify      func(h cache.ResourceEventHandler)
+		wantEvents  int
+		wantOldKeys map[string]string
+	}{
+		{
+			name:   "initial list",
+			notify: func(h cache.ResourceEventHandler) { h.OnAdd(configMap("a: b"), true) },
+		},
+		{
+			name:        "created",
+			notify:      func(h cache.ResourceEventHandler) { h.OnAdd(configMap("a: b"), false) },
+			wantEvents:  2,
+			wantOldKeys: map[string]string{},
+		},
+		{
+			name:        "updated",
+			notify:      func(h cache.ResourceEventHandler) { h.OnUpdate(configMap("a: b"), configMap("a: c")) },
+			wantEvents:  2,
+			wantOldKeys: map[string]string{"a": "b"},
+		},
+		{
+			name:   "updated without changing the mapping",
+			notify: func(h cache.ResourceEventHandler) { h.OnUpdate(configMap("a: b"), configMap("a: b\n# comment")) },
+		},
+		{
+			name: "deleted",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnDelete(cache.DeletedFinalStateUnknown{Obj: configMap("a: b")})
+			},
+			wantEvents:  2,
+			wantOldKeys: map[string]string{"a": "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := workqueue.New()
+			defer queue.ShutDown()
+			tt.notify(keyMappingEventHandler(queue, pvcLister))
+			if got := queue.Len(); got != tt.wantEvents {
+				t.Fatalf("queued %d events, want %d", got, tt.wantEvents)
+			}
+			for i := 0; i < tt.wantEvents; i++ {
+				item, _ := queue.Get()
+				e := item.(*pvcEvent)
+				if e.eventType != pvcEventKeyMapping || !maps.Equal(e.oldSources.keyMapping, tt.wantOldKeys) || e.oldSources.keyMapping == nil {
+					t.Errorf("event = %s with old mapping %v, want %s with %v", e.eventType, e.oldSources.keyMapping, pvcEventKeyMapping, tt.wantOldKeys)
+				}
+				queue.Done(item)
+			}
+		})
+	}
+}
+
+func Test_reconcileSourcesUpdateKeyMapping(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old cache.SharedIndexInformer) { keyMappingInformer = old }(keyMappingInformer)
+	cloud = GCP
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+				},
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "mapping", Namespace: "default"},
+			Data:       map[string]string{"mapping": "app: gcp-app"},
+		},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startKeyMappingInformer(ctx, "default", "mapping")
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"app": "web"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	// the tag was set before the mapping was added
+	diskLabels := map[string]string{"app": "web"}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	if err := r.reconcileSourcesUpdate(ctx, pvc, tagSources{keyMapping: map[string]string{}}); err != nil {
+		t.Fatalf("reconcileSourcesUpdate() error = %v", err)
+	}
+	if want := map[string]string{"gcp-app": "web"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("disk labels = %v, want %v", diskLabels, want)
+	}
+}
@@ -21,41 +21,68 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html/template"
+	"maps"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/fsx"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	clocks "k8s.io/utils/clock"
 )
 
 var (
 	// DefaultKubeConfigFile local kubeconfig if not running in cluster
 	DefaultKubeConfigFile = filepath.Join(os.Getenv("HOME"), ".kube", "config")
 	k8sClient             kubernetes.Interface
+	pvLister              corelisters.PersistentVolumeLister
+	scLister              storagelisters.StorageClassLister
+	nsLister              corelisters.NamespaceLister
+	nsInformer            cache.SharedIndexInformer
+	nodeLister            corelisters.NodeLister
+	nodeInformer          cache.SharedIndexInformer
+	pvInformer            cache.SharedIndexInformer
+	scInformer            cache.SharedIndexInformer
 	awsVolumeRegMatch     = regexp.MustCompile("^vol-[^/]*$")
+	// clock is replaced in tests
+	clock clocks.PassiveClock = clocks.RealClock{}
 )
 
 const (
 	// Matching strings for volume operations.
-	regexpEFSVolumeID = `^fs-\w+::(fsap-\w+)$`
+	regexpEFSVolumeID = `^fs-\w+:[^:]*:(fsap-\w+)$`
 
 	// supported AWS storage provisioners:
 	AWS_EBS_CSI    = "ebs.csi.aws.com"
@@ -64,10 +91,36 @@ const (
 	AWS_FSX_CSI    = "fsx.csi.aws.com"
 
 	// supported GCP storage provisioners:
-	GCP_PD_CSI    = "pd.csi.storage.gke.io"
-	GCP_PD_LEGACY = "kubernetes.io/gce-pd"
+	GCP_PD_CSI        = "pd.csi.storage.gke.io"
+	GCP_PD_LEGACY     = "kubernetes.io/gce-pd"
+	GCP_BIGTABLE_CSI  = "bigtable.csi.storage.gke.io"
+	GCP_FILESTORE_CSI = "filestore.csi.storage.gke.io"
+
+	// supported Azure storage provisioners:
+	AZURE_DISK_CSI    = "disk.csi.azure.com"
+	AZURE_DISK_LEGACY = "kubernetes.io/azure-disk"
+	AZURE_FILE_CSI    = "file.csi.azure.com"
+
+	// annotation set on a PV by the provisioner that created it
+	pvProvisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+	// annotation set on a PVC by the scheduler with the node its volume is
+	// provisioned for, with a WaitForFirstConsumer StorageClass
+	selectedNodeAnnotation = "volume.kubernetes.io/selected-node"
+
+	// annotation on a StorageClass naming the StorageClass it inherits labels from
+	storageClassParentAnnotation = "storageclass.kubernetes.io/parent"
+	maxStorageClassLabelDepth    = 5
 )
 
+// veleroAnnotations are the annotations Velero sets on the PVCs it backs up
+// that are copied to the volume with --propagate-velero-annotations
+var veleroAnnotations = []string{"velero.io/backup-name", "velero.io/schedule-name"}
+
+// labelValueTemplate enables rendering tag values as Go templates. It is
+// set with --label-value-template.
+var labelValueTemplate = true
+
 type TagTemplate struct {
 	Name        string
 	Namespace   string
@@ -75,17 +128,23 @@ type TagTemplate struct {
 	Annotations map[string]string
 }
 
+// BuildClient creates a Kubernetes client. An explicitly set kubeconfig takes
+// precedence over the in-cluster config, which in turn takes precedence over
+// the default kubeconfig file.
 func BuildClient(kubeconfig string, kubeContext string) (*kubernetes.Clientset, error) {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		if kubeconfig == "" {
-			kubeconfig = DefaultKubeConfigFile
-		}
+	var config *rest.Config
+	var err error
+	if kubeconfig != "" {
 		config, err = buildConfigFromFlags(kubeconfig, kubeContext)
+	} else {
+		config, err = rest.InClusterConfig()
 		if err != nil {
-			return nil, err
+			config, err = buildConfigFromFlags(DefaultKubeConfigFile, kubeContext)
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -102,7 +161,48 @@ func buildConfigFromFlags(kubeconfig string, context string) (*rest.Config, erro
 		}).ClientConfig()
 }
 
-func watchForPersistentVolumeClaims(ch chan struct{}, watchNamespace string) {
+// startPersistentVolumeInformer starts cluster wide PV and StorageClass
+// informers and sets pvInformer, pvLister and scLister once their caches have
+// synced. With --inherit-namespace-labels a Namespace informer is started as
+// well and nsLister and nsInformer are set. The Namespace informer is also
+// started for --namespace-selector. With --include-node-label-keys a Node
+// informer is started and nodeLister and nodeInformer are set.
+func startPersistentVolumeInformer(ctx context.Context) {
+	factory := informers.NewSharedInformerFactory(k8sClient, 0)
+	informer := factory.Core().V1().PersistentVolumes().Informer()
+	lister := factory.Core().V1().PersistentVolumes().Lister()
+	storageClassInformer := factory.Storage().V1().StorageClasses().Informer()
+	storageClasses := factory.Storage().V1().StorageClasses().Lister()
+	var namespaces corelisters.NamespaceLister
+	var namespaceInformer cache.SharedIndexInformer
+	if len(inheritNSLabels) > 0 || namespaceSelector != nil {
+		namespaceInformer = factory.Core().V1().Namespaces().Informer()
+		namespaces = factory.Core().V1().Namespaces().Lister()
+	}
+	var nodes corelisters.NodeLister
+	var nodesInformer cache.SharedIndexInformer
+	if len(inheritNodeLabels) > 0 {
+		nodesInformer = factory.Core().V1().Nodes().Informer()
+		nodes = factory.Core().V1().Nodes().Lister()
+	}
+	factory.Start(ctx.Done())
+	for informerType, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			log.Errorf("Failed to sync %v informer cache. Check RBAC permissions", informerType)
+			return
+		}
+	}
+	pvInformer = informer
+	pvLister = lister
+	scLister = storageClasses
+	scInformer = storageClassInformer
+	nsLister = namespaces
+	nsInformer = namespaceInformer
+	nodeLister = nodes
+	nodeInformer = nodesInformer
+}
+
+func watchForPersistentVolumeClaims(ctx context.Context, ch chan struct{}, watchNamespace string) {
 	var err error
 	var factory informers.SharedInformerFactory
 	log.WithFields(log.Fields{"namespace": watchNamespace}).Infoln("Starting informer")
@@ -112,144 +212,1186 @@ func watchForPersistentVolumeClaims(ch chan struct{}, watchNamespace string) {
 		factory = informers.NewSharedInformerFactoryWithOptions(k8sClient, 0, informers.WithNamespace(watchNamespace))
 	}
 
-	informer := factory.Core().V1().PersistentVolumeClaims().Informer()
+	informer := factory.Core().V1().PersistentVolumeClaims().Informer()
+	pvcLister := factory.Core().V1().PersistentVolumeClaims().Lister()
+	runInformer := true
+	if watchPVOnly {
+		// the PV informer was already started by startPersistentVolumeInformer
+		if pvInformer == nil {
+			log.Errorln("Can't watch PersistentVolumes, the PersistentVolume informer isn't running")
+			return
+		}
+		informer, pvcLister, runInformer = pvInformer, pvClaimLister{pvLister: pvLister}, false
+	}
+	addInformerSync(informer.HasSynced)
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sClient.CoreV1().Events("")})
+	defer broadcaster.Shutdown()
+
+	r := &pvcReconciler{
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "k8s-pvc-tagger"}),
+		pvcLister: pvcLister,
+	}
+	switch cloud {
+	case AWS:
+		r.efsClient, _ = newEFSClient()
+		r.ec2Client, _ = newEC2Client()
+		r.fsxClient, _ = newFSxClient()
+		r.fsxONTAPClient = r.fsxClient
+	case GCP:
+		r.gcpClient, err = newGCPClient(context.Background(), gcpHTTPTimeout)
+		if err != nil {
+			log.Fatalln("failed to create GCP client", err)
+		}
+		r.bigtableClient, err = newBigtableClient(context.Background(), gcpHTTPTimeout)
+		if err != nil {
+			log.Fatalln("failed to create Bigtable client", err)
+		}
+		r.filestoreClient, err = newFilestoreClient(context.Background(), gcpHTTPTimeout)
+		if err != nil {
+			log.Fatalln("failed to create Filestore client", err)
+		}
+		r.spannerClient, err = newSpannerClient(context.Background(), gcpHTTPTimeout)
+		if err != nil {
+			log.Fatalln("failed to create Spanner client", err)
+		}
+	case AZURE:
+		r.azureClient, err = newAzureDiskClient()
+		if err != nil {
+			log.Fatalln("failed to create Azure disk client", err)
+		}
+		r.azureFileClient, err = newAzureFileClient()
+		if err != nil {
+			log.Fatalln("failed to create Azure File client", err)
+		}
+	}
+
+	queue := newPVCQueue(maxConcurrentReconciles, watchNamespace)
+	registration, err := informer.AddEventHandler(pvcEventHandler(queue))
+	if err != nil {
+		log.Errorln("Can't setup PVC informer! Check RBAC permissions")
+		return
+	}
+	if !runInformer {
+		defer func() {
+			_ = informer.RemoveEventHandler(registration)
+		}()
+	}
+	if nsInformer != nil {
+		registration, err := nsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(old, new interface{}) {
+				for _, e := range namespaceUpdateEvents(old.(*corev1.Namespace), new.(*corev1.Namespace), pvcLister, watchNamespace) {
+					queue.Add(e)
+				}
+			},
+		})
+		if err != nil {
+			log.Errorln("Can't setup Namespace informer! Check RBAC permissions")
+			return
+		}
+		defer func() {
+			_ = nsInformer.RemoveEventHandler(registration)
+		}()
+	}
+	if nodeInformer != nil {
+		registration, err := nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(old, new interface{}) {
+				for _, e := range nodeUpdateEvents(old.(*corev1.Node), new.(*corev1.Node), pvcLister) {
+					queue.Add(e)
+				}
+			},
+		})
+		if err != nil {
+			log.Errorln("Can't setup Node informer! Check RBAC permissions")
+			return
+		}
+		defer func() {
+			_ = nodeInformer.RemoveEventHandler(registration)
+		}()
+	}
+	if keyMappingInformer != nil {
+		registration, err := keyMappingInformer.AddEventHandler(keyMappingEventHandler(queue, pvcLister))
+		if err != nil {
+			log.Errorln("Can't setup ConfigMap informer! Check RBAC permissions")
+			return
+		}
+		defer func() {
+			_ = keyMappingInformer.RemoveEventHandler(registration)
+		}()
+	}
+	if scDefaultsInformer != nil {
+		registration, err := scDefaultsInformer.AddEventHandler(storageClassDefaultsEventHandler(queue, pvcLister))
+		if err != nil {
+			log.Errorln("Can't setup ConfigMap informer! Check RBAC permissions")
+			return
+		}
+		defer func() {
+			_ = scDefaultsInformer.RemoveEventHandler(registration)
+		}()
+	}
+	if scInformer != nil {
+		registration, err := scInformer.AddEventHandler(storageClassDefaultLabelsEventHandler(queue, pvcLister))
+		if err != nil {
+			log.Errorln("Can't setup StorageClass informer! Check RBAC permissions")
+			return
+		}
+		defer func() {
+			_ = scInformer.RemoveEventHandler(registration)
+		}()
+	}
+	if syncPVLabels && pvInformer != nil {
+		registration, err := pvInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(old, new interface{}) {
+				if e := pvUpdateEvent(old.(*corev1.PersistentVolume), new.(*corev1.PersistentVolume), pvcLister); e != nil {
+					queue.Add(e)
+				}
+			},
+		})
+		if err != nil {
+			log.Errorln("Can't setup PersistentVolume informer! Check RBAC permissions")
+			return
+		}
+		defer func() {
+			_ = pvInformer.RemoveEventHandler(registration)
+		}()
+	}
+
+	go func() {
+		<-ch
+		queue.ShutDown()
+	}()
+	if runInformer {
+		go informer.Run(ch)
+	}
+	if backfillOnStart {
+		if cache.WaitForCacheSync(ch, informer.HasSynced) {
+			backfillPVCs(pvcLister, queue)
+		} else {
+			log.Warnln("Informer cache didn't sync, not backfilling PVCs")
+		}
+	}
+	if resyncPeriod > 0 {
+		resyncCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go resyncPVCs(resyncCtx, clocks.RealClock{}, resyncPeriod, pvcLister, queue)
+	}
+
+	r.runWorkers(ctx, queue)
+}
+
+// pvcEventHandler queues the events of the watched PVCs, or of the PVs with
+// --watch-pv-only. With --backfill-on-start the PVCs of the initial list are
+// left to backfillPVCs.
+func pvcEventHandler(queue eventQueue) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if backfillOnStart && isInInitialList {
+				return
+			}
+			queue.Add(newPVCEvent(pvcEventAdd, nil, getWatchedObject(obj)))
+		},
+		UpdateFunc: func(old, new interface{}) {
+			queue.Add(newPVCEvent(pvcEventUpdate, getWatchedObject(old), getWatchedObject(new)))
+		},
+	}
+}
+
+// backfillPVCs queues a pvcEventBackfill for every Bound PVC in the informer
+// cache. The events go through the queue's rate limiter, so that a large
+// backfill doesn't starve the events of new PVCs.
+func backfillPVCs(pvcLister corelisters.PersistentVolumeClaimLister, queue rateLimitedQueue) {
+	pvcs, err := pvcLister.List(labels.Everything())
+	if err != nil {
+		log.Errorln("Failed to list PVCs to backfill:", err)
+		return
+	}
+	queued := 0
+	for _, pvc := range pvcs {
+		if pvc.Status.Phase != corev1.ClaimBound {
+			continue
+		}
+		// objects in the informer cache must not be modified
+		queue.AddRateLimited(newPVCEvent(pvcEventBackfill, nil, getPVC(pvc.DeepCopy())))
+		promBackfillTotal.With(prometheus.Labels{"status": "queued"}).Inc()
+		queued++
+	}
+	log.WithFields(log.Fields{"pvcs": queued}).Infoln("Backfilling the tags of existing PVCs")
+}
+
+// eventQueue is where the informer event handlers queue PVC events
+type eventQueue interface {
+	Add(item interface{})
+}
+
+// rateLimitedQueue is where backfillPVCs queues the existing PVCs
+type rateLimitedQueue interface {
+	AddRateLimited(item interface{})
+}
+
+// pvcQueue spreads the PVC events over one work queue per worker. All the
+// events of a PVC go to the same shard so that they are processed in order.
+type pvcQueue struct {
+	shards []workqueue.RateLimitingInterface
+}
+
+func newPVCQueue(workers int, watchNamespace string) *pvcQueue {
+	q := &pvcQueue{}
+	metrics := workqueueMetricsProvider{namespace: watchNamespace}
+	for i := 0; i < max(workers, 1); i++ {
+		q.shards = append(q.shards, workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{
+			Name:            fmt.Sprintf("pvc-events-%d", i),
+			MetricsProvider: metrics,
+		}))
+	}
+	return q
+}
+
+// workqueueMetricsProvider exports the depth of the shards of a pvcQueue in
+// promQueueDepth, summed over the shards, and the time events wait on them in
+// promWorkqueueLatency. The global workqueue provider is taken by
+// controller-runtime, so it is set on each queue instead. The provider doesn't
+// know the event types: observeQueueLatency records the latency by event type
+// in promQueueLatency.
+type workqueueMetricsProvider struct {
+	namespace string
+}
+
+func (p workqueueMetricsProvider) NewDepthMetric(string) workqueue.GaugeMetric {
+	return promQueueDepth.With(prometheus.Labels{"namespace": p.namespace})
+}
+
+func (p workqueueMetricsProvider) NewLatencyMetric(string) workqueue.HistogramMetric {
+	return promWorkqueueLatency.With(prometheus.Labels{"namespace": p.namespace})
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(string) workqueue.CounterMetric {
+	return noopWorkqueueMetric{}
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(string) workqueue.HistogramMetric {
+	return noopWorkqueueMetric{}
+}
+
+func (workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return noopWorkqueueMetric{}
+}
+
+func (workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return noopWorkqueueMetric{}
+}
+
+func (workqueueMetricsProvider) NewRetriesMetric(string) workqueue.CounterMetric {
+	return noopWorkqueueMetric{}
+}
+
+// noopWorkqueueMetric is the workqueue metrics that aren't exported
+type noopWorkqueueMetric struct{}
+
+func (noopWorkqueueMetric) Inc()            {}
+func (noopWorkqueueMetric) Dec()            {}
+func (noopWorkqueueMetric) Set(float64)     {}
+func (noopWorkqueueMetric) Observe(float64) {}
+
+// Add queues a *pvcEvent on the shard of its PVC
+func (q *pvcQueue) Add(item interface{}) {
+	q.shard(item.(*pvcEvent)).Add(item)
+}
+
+// AddRateLimited queues a *pvcEvent on the shard of its PVC once the shard's
+// rate limiter allows it
+func (q *pvcQueue) AddRateLimited(item interface{}) {
+	q.shard(item.(*pvcEvent)).AddRateLimited(item)
+}
+
+// shard returns the shard of the PVC of the event
+func (q *pvcQueue) shard(e *pvcEvent) workqueue.RateLimitingInterface {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(e.pvc.GetNamespace() + "/" + e.pvc.GetName()))
+	return q.shards[h.Sum32()%uint32(len(q.shards))]
+}
+
+// Len returns the number of events waiting to be processed
+func (q *pvcQueue) Len() int {
+	n := 0
+	for _, shard := range q.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (q *pvcQueue) ShutDown() {
+	for _, shard := range q.shards {
+		shard.ShutDown()
+	}
+}
+
+const (
+	pvcEventAdd        = "add"
+	pvcEventUpdate     = "update"
+	pvcEventNamespace  = "namespace"
+	pvcEventPV         = "pv"
+	pvcEventNode       = "node"
+	pvcEventKeyMapping = "key-mapping"
+	pvcEventResync     = "resync"
+	// the PVC was unbound and is retried with --ignore-unbound-pvcs
+	pvcEventUnbound = "unbound"
+	// the PVC existed when the tagger started, see --backfill-on-start
+	pvcEventBackfill = "backfill"
+	// the default-labels annotation of the PVC's StorageClass changed
+	pvcEventStorageClass = "storageclass"
+	// the defaults of the PVC's StorageClass changed
+	pvcEventStorageClassDefaults = "storageclass-defaults"
+)
+
+// pvcEvent is a PVC informer event waiting on the work queue
+type pvcEvent struct {
+	eventType   string
+	oldPVC      *corev1.PersistentVolumeClaim
+	pvc         *corev1.PersistentVolumeClaim
+	enqueueTime time.Time
+
+	// oldSources are the tag sources that changed in a pvcEventNamespace,
+	// pvcEventPV, pvcEventNode, pvcEventKeyMapping, pvcEventStorageClass or
+	// pvcEventStorageClassDefaults as they were before the change
+	oldSources tagSources
+}
+
+func newPVCEvent(eventType string, oldPVC, pvc *corev1.PersistentVolumeClaim) *pvcEvent {
+	return &pvcEvent{
+		eventType:   eventType,
+		oldPVC:      oldPVC,
+		pvc:         pvc,
+		enqueueTime: clock.Now(),
+	}
+}
+
+// namespaceUpdateEvents returns a pvcEventNamespace for each PVC in the
+// updated namespace when the labels inherited with --inherit-namespace-labels
+// have changed
+func namespaceUpdateEvents(oldNS, newNS *corev1.Namespace, pvcLister corelisters.PersistentVolumeClaimLister, watchNamespace string) []*pvcEvent {
+	if watchNamespace != "" && newNS.GetName() != watchNamespace {
+		return nil
+	}
+	if !namespaceSelected(newNS) {
+		return nil
+	}
+	// a namespace that starts matching --namespace-selector has PVCs that
+	// were never tagged
+	oldLabels := inheritedNamespaceLabels(oldNS)
+	if namespaceSelected(oldNS) && maps.Equal(oldLabels, inheritedNamespaceLabels(newNS)) {
+		return nil
+	}
+	pvcs, err := pvcLister.PersistentVolumeClaims(newNS.GetName()).List(labels.Everything())
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": newNS.GetName()}).Errorln("Unable to list PVCs:", err)
+		return nil
+	}
+	log.WithFields(log.Fields{"namespace": newNS.GetName()}).Infoln("Namespace labels changed, reconciling", len(pvcs), "PVCs")
+	var events []*pvcEvent
+	for _, pvc := range pvcs {
+		// objects in the informer cache must not be modified
+		e := newPVCEvent(pvcEventNamespace, nil, getPVC(pvc.DeepCopy()))
+		e.oldSources.namespace = oldLabels
+		events = append(events, e)
+	}
+	return events
+}
+
+// nodeUpdateEvents returns a pvcEventNode for each PVC whose volume was
+// provisioned for the updated node when the labels inherited with
+// --include-node-label-keys have changed
+func nodeUpdateEvents(oldNode, newNode *corev1.Node, pvcLister corelisters.PersistentVolumeClaimLister) []*pvcEvent {
+	oldLabels := inheritedNodeLabels(oldNode)
+	if maps.Equal(oldLabels, inheritedNodeLabels(newNode)) {
+		return nil
+	}
+	pvcs, err := pvcLister.List(labels.Everything())
+	if err != nil {
+		log.WithFields(log.Fields{"node": newNode.GetName()}).Errorln("Unable to list PVCs:", err)
+		return nil
+	}
+	var events []*pvcEvent
+	for _, pvc := range pvcs {
+		if pvc.GetAnnotations()[selectedNodeAnnotation] != newNode.GetName() {
+			continue
+		}
+		// objects in the informer cache must not be modified
+		e := newPVCEvent(pvcEventNode, nil, getPVC(pvc.DeepCopy()))
+		e.oldSources.node = oldLabels
+		events = append(events, e)
+	}
+	log.WithFields(log.Fields{"node": newNode.GetName()}).Infoln("Node labels changed, reconciling", len(events), "PVCs")
+	return events
+}
+
+// pvUpdateEvent returns a pvcEventPV for the PVC bound to the updated PV when
+// the PV's labels have changed. It returns nil when the PVC is not in
+// pvcLister.
+func pvUpdateEvent(oldPV, newPV *corev1.PersistentVolume, pvcLister corelisters.PersistentVolumeClaimLister) *pvcEvent {
+	claimRef := newPV.Spec.ClaimRef
+	if claimRef == nil || maps.Equal(oldPV.GetLabels(), newPV.GetLabels()) {
+		return nil
+	}
+	pvc, err := pvcLister.PersistentVolumeClaims(claimRef.Namespace).Get(claimRef.Name)
+	if err != nil || pvc.Spec.VolumeName != newPV.GetName() {
+		return nil
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "pv": newPV.GetName()}).Infoln("PersistentVolume labels changed")
+	// objects in the informer cache must not be modified
+	e := newPVCEvent(pvcEventPV, nil, getPVC(pvc.DeepCopy()))
+	e.oldSources.pv = oldPV.GetLabels()
+	if e.oldSources.pv == nil {
+		e.oldSources.pv = map[string]string{}
+	}
+	return e
+}
+
+const (
+	operationAddLabels    = "add_labels"
+	operationDeleteLabels = "delete_labels"
+)
+
+// the reasons of the labels counted in promLabelsSkipped
+const (
+	labelsSkippedEmptyKey         = "empty_after_sanitization"
+	labelsSkippedQuotaExceeded    = "quota_exceeded"
+	labelsSkippedTagRemoved       = "removed_for_quota"
+	labelsSkippedDenylist         = "denylist"
+	labelsSkippedNoAllowlistMatch = "no_allowlist_match"
+)
+
+// countSkippedLabels counts n labels that were not set on a volume of the
+// StorageClass for the reason
+func countSkippedLabels(reason, storageclass string, n int) {
+	promLabelsSkipped.With(prometheus.Labels{"reason": reason, "cloud_provider": cloud, "storageclass": storageclass}).Add(float64(n))
+}
+
+// pvcStorageClass returns the name of the PVC's StorageClass, or "" when it
+// has none
+func pvcStorageClass(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName == nil {
+		return ""
+	}
+	return *pvc.Spec.StorageClassName
+}
+
+// observeOperationDuration records the time since start taken by a label
+// operation on a cloud volume
+func observeOperationDuration(operation, storageclass string, start time.Time) {
+	promOperationDuration.With(prometheus.Labels{"operation": operation, "cloud_provider": cloud, "storageclass": storageclass}).Observe(clock.Since(start).Seconds())
+}
+
+// countPollIteration counts one poll of the status of a label operation
+func countPollIteration(operation, storageclass string) {
+	promPollIterations.With(prometheus.Labels{"operation": operation, "cloud_provider": cloud, "storageclass": storageclass}).Inc()
+}
+
+// observeQueueLatency records how long the event waited on the work queue
+func observeQueueLatency(e *pvcEvent) {
+	promQueueLatency.With(prometheus.Labels{"event_type": e.eventType}).Observe(clock.Since(e.enqueueTime).Seconds())
+}
+
+// pvcReconciler tags the cloud volumes of the PVCs taken off the work queue
+type pvcReconciler struct {
+	efsClient       *EFSClient
+	ec2Client       *EBSClient
+	fsxClient       *FSxClient
+	fsxONTAPClient  FSxONTAPClient
+	gcpClient       GCPClient
+	bigtableClient  BigtableClient
+	filestoreClient FilestoreClient
+	spannerClient   SpannerClient
+	azureClient     AzureDiskClient
+	azureFileClient AzureFileClient
+
+	// recorder emits the outcome of the label operations as Events on the
+	// PVCs. No Events are emitted when it is nil.
+	recorder record.EventRecorder
+
+	// pvcLister looks up the current version of the PVCs that are retried
+	// because they were unbound. The PVC of the event is retried when it is
+	// nil.
+	pvcLister corelisters.PersistentVolumeClaimLister
+
+	// ops tracks the events being reconciled for the shutdown
+	ops inFlightOps
+}
+
+const (
+	eventReasonLabelsSynced    = "LabelsSynced"
+	eventReasonLabelSyncFailed = "LabelSyncFailed"
+	eventReasonTemplateFailed  = "TagTemplateFailed"
+	eventReasonInvalidExtra    = "InvalidExtraLabels"
+	eventReasonKeyCollision    = "LabelKeyCollision"
+	eventReasonLabelsDropped   = "LabelsDropped"
+	eventReasonTagsRemoved     = "TagsRemoved"
+)
+
+// recordLabelEvent records the outcome of syncing count labels to the volume
+// of the PVC as an Event on the PVC and in the circuit breaker. It returns
+// err, so that the outcomes of a reconcile can be collected.
+func (r *pvcReconciler) recordLabelEvent(pvc *corev1.PersistentVolumeClaim, count int, err error) error {
+	cloudBreaker.record(err)
+	if r.recorder == nil || dryRun {
+		return err
+	}
+	if err != nil {
+		r.recorder.Eventf(eventObject(pvc), corev1.EventTypeWarning, eventReasonLabelSyncFailed, "Failed to set labels: %s", err)
+		return err
+	}
+	if count > 0 {
+		r.recorder.Eventf(eventObject(pvc), corev1.EventTypeNormal, eventReasonLabelsSynced, "Successfully synced %d labels to cloud volume", count)
+	}
+	return nil
+}
+
+// recordTagErrors records a Warning Event on the PVC for each error of
+// building its tags: an invalid extra-labels annotation or a tag that was
+// skipped because its template failed to render
+func (r *pvcReconciler) recordTagErrors(pvc *corev1.PersistentVolumeClaim, errs []error) {
+	if r.recorder == nil || dryRun {
+		return
+	}
+	for _, err := range errs {
+		var extraErr *extraLabelsError
+		if errors.As(err, &extraErr) {
+			r.recorder.Eventf(eventObject(pvc), corev1.EventTypeWarning, eventReasonInvalidExtra, "Skipping extra labels: %s", err)
+			continue
+		}
+		r.recorder.Eventf(eventObject(pvc), corev1.EventTypeWarning, eventReasonTemplateFailed, "Failed to render tag template: %s", err)
+	}
+}
+
+// recordKeyCollisions records a Warning Event on the PVC for each GCP label
+// key that several of its tags become after sanitization
+func (r *pvcReconciler) recordKeyCollisions(pvc *corev1.PersistentVolumeClaim, tags map[string]string) {
+	collisions := gcpLabelKeyCollisions(tags)
+	if len(collisions) == 0 {
+		return
+	}
+	sanitizedKeys := make([]string, 0, len(collisions))
+	for k := range collisions {
+		sanitizedKeys = append(sanitizedKeys, k)
+	}
+	slices.Sort(sanitizedKeys)
+	for _, sanitizedKey := range sanitizedKeys {
+		keys := collisions[sanitizedKey]
+		winner, ok := resolveGCPKeyCollision(keys, tags)
+		if !ok {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "name": pvc.GetName(), "keys": keys, "gcp_key": sanitizedKey}).Warnln("Label keys collide after sanitization, skipping them")
+			if r.recorder != nil && !dryRun {
+				r.recorder.Eventf(eventObject(pvc), corev1.EventTypeWarning, eventReasonKeyCollision, "Label keys %s all become GCP label key %q, none of them is used", strings.Join(keys, ", "), sanitizedKey)
+			}
+			continue
+		}
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "name": pvc.GetName(), "keys": keys, "gcp_key": sanitizedKey}).Warnln("Label keys collide after sanitization, using", winner)
+		if r.recorder == nil || dryRun {
+			continue
+		}
+		r.recorder.Eventf(eventObject(pvc), corev1.EventTypeWarning, eventReasonKeyCollision, "Label keys %s all become GCP label key %q, only %q is used", strings.Join(keys, ", "), sanitizedKey, winner)
+	}
+}
+
+// recordResult records the outcome of a label operation as an Event on the
+// PVC. Only the labels that were changed are counted. It returns the error of
+// the operation.
+func (r *pvcReconciler) recordResult(pvc *corev1.PersistentVolumeClaim, res ReconcileResult) error {
+	if len(res.LabelsDropped) > 0 && r.recorder != nil && !dryRun {
+		provider, limit := "GCP", gcpMaxLabels
+		if cloud == AZURE {
+			provider, limit = "Azure", azureMaxTags
+		}
+		r.recorder.Eventf(eventObject(pvc), corev1.EventTypeWarning, eventReasonLabelsDropped, "Not setting labels %s, the volume would exceed %s's limit of %d labels", strings.Join(res.LabelsDropped, ", "), provider, limit)
+	}
+	if len(res.TagsRemoved) > 0 && r.recorder != nil && !dryRun {
+		r.recorder.Eventf(eventObject(pvc), corev1.EventTypeWarning, eventReasonTagsRemoved, "Removed tags %s not set by the PVC, the volume would exceed Azure's limit of %d tags", strings.Join(res.TagsRemoved, ", "), azureMaxTags)
+	}
+	return r.recordLabelEvent(pvc, len(res.LabelsAdded)+len(res.LabelsRemoved), res.Err)
+}
+
+// errRequeue is wrapped by the reconcile errors after which the PVC event is
+// put back on the queue to be retried
+var errRequeue = errors.New("requeue")
+
+// errUnbound is returned when the PVC was skipped by --ignore-unbound-pvcs
+// and is retried after --requeue-unbound-after
+var errUnbound = errors.New("PVC is not bound")
+
+// processNextEvent reconciles the next event on the queue. It returns false
+// once the queue has been shut down.
+func (r *pvcReconciler) processNextEvent(ctx context.Context, queue workqueue.RateLimitingInterface) bool {
+	item, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(item)
+	if !r.ops.start() {
+		// shutting down, the events left on the queue are dropped
+		return false
+	}
+	defer r.ops.done()
+
+	e := item.(*pvcEvent)
+	observeQueueLatency(e)
+	ctx = withPVCLogFields(ctx, e.pvc)
+	var err error
+	switch e.eventType {
+	case pvcEventAdd, pvcEventBackfill:
+		err = r.reconcileAdd(ctx, e.pvc)
+	case pvcEventUpdate:
+		err = r.reconcileUpdate(ctx, e.oldPVC, e.pvc)
+	case pvcEventNamespace, pvcEventPV, pvcEventNode, pvcEventKeyMapping, pvcEventStorageClass, pvcEventStorageClassDefaults:
+		err = r.reconcileSourcesUpdate(ctx, e.pvc, e.oldSources)
+	case pvcEventResync:
+		err = r.reconcileResync(ctx, e.pvc)
+	case pvcEventUnbound:
+		err = r.reconcileUnbound(ctx, e.pvc)
+	}
+	if errors.Is(err, errUnbound) {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": e.pvc.GetNamespace(), "pvc": e.pvc.GetName()}).Debugln("Retrying unbound PVC in", requeueUnboundAfter)
+		queue.Forget(item)
+		queue.AddAfter(newPVCEvent(pvcEventUnbound, nil, e.pvc), requeueUnboundAfter)
+		return true
+	}
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": e.pvc.GetNamespace(), "pvc": e.pvc.GetName()}).Infoln("Requeueing PVC event:", err)
+		queue.AddRateLimited(item)
+		return true
+	}
+	if e.eventType == pvcEventBackfill {
+		promBackfillTotal.With(prometheus.Labels{"status": "processed"}).Inc()
+	}
+	queue.Forget(item)
+	return true
+}
+
+// reconcileAdd tags the volume of a new PVC. It returns an error wrapping
+// errRequeue when the event should be retried.
+func (r *pvcReconciler) reconcileAdd(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Infoln("New PVC Added to Store")
+	if skipNamespaceNotSelected(pvc) || skipPVCNotSelected(pvc) || skipAnnotated(pvc) || skipNotStatefulSetOwned(pvc) {
+		return nil
+	}
+	if skipUnbound(pvc) {
+		// only the add event is retried, so that there is one retry per PVC
+		if ignoreUnboundPVCs && requeueUnboundAfter > 0 {
+			return errUnbound
+		}
+		return nil
+	}
+	if skipOtherCloudProvider(pvc) || skipDeleteReclaimed(ctx, pvc) {
+		return nil
+	}
+	if deleteRemovedLabels && len(getManagedLabelKeys(pvc)) > 0 {
+		// the PVC was synced before, e.g. before a restart, so the tags it
+		// lost since are deleted
+		return r.syncUpdatedTags(ctx, pvc, pvc, true, func() map[string]string { return nil })
+	}
+
+	volumeID, tags, tagErrs, err := processPersistentVolumeClaim(ctx, pvc)
+	if err != nil {
+		return nil
+	}
+	r.recordTagErrors(pvc, tagErrs)
+	if len(tags) == 0 {
+		return nil
+	}
+	if labelsAlreadySynced(pvc, volumeID, tags) {
+		return nil
+	}
+	if err := cloudBreaker.allow(); err != nil {
+		return fmt.Errorf("%w: %w", errRequeue, err)
+	}
+
+	var syncErrs []error
+	var requeueErr error
+	switch cloud {
+	case AWS:
+		if !provisionedByAwsEfs(pvc) && !provisionedByAwsEbs(pvc) && !provisionedByAwsFsx(pvc) {
+			return nil
+		}
+
+		if provisionedByAwsEfs(pvc) {
+			syncErrs = append(syncErrs, r.recordLabelEvent(pvc, len(tags), auditTagOperation(pvc, volumeID, auditOperationAdd, tags, r.efsClient.addEFSAccessPointTags(ctx, volumeID, tags, *pvc.Spec.StorageClassName))))
+		}
+		if provisionedByAwsEbs(pvc) {
+			err := r.ec2Client.addEBSVolumeTags(ctx, volumeID, tags, *pvc.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordLabelEvent(pvc, len(tags), auditTagOperation(pvc, volumeID, auditOperationAdd, tags, err)))
+			if err == nil && syncAWSSnapshots {
+				syncErrs = append(syncErrs, r.recordLabelEvent(pvc, 0, auditTagOperation(pvc, volumeID, auditOperationAdd, tags, r.ec2Client.addEBSSnapshotTags(ctx, volumeID, tags, *pvc.Spec.StorageClassName))))
+			}
+		}
+		if provisionedByAwsFsx(pvc) {
+			if isFSxONTAPVolumeHandle(volumeID) {
+				syncErrs = append(syncErrs, r.recordLabelEvent(pvc, len(tags), auditTagOperation(pvc, volumeID, auditOperationAdd, tags, addFSxONTAPVolumeTags(ctx, r.fsxONTAPClient, volumeID, tags, *pvc.Spec.StorageClassName))))
+			} else {
+				syncErrs = append(syncErrs, r.recordLabelEvent(pvc, len(tags), auditTagOperation(pvc, volumeID, auditOperationAdd, tags, r.fsxClient.addFSxVolumeTags(ctx, volumeID, tags, *pvc.Spec.StorageClassName))))
+			}
+		}
+	case GCP:
+		if !provisionedByGcpPD(pvc) && !provisionedByGcpBigtable(pvc) && !provisionedByGcpFilestore(pvc) {
+			return nil
+		}
+		r.recordKeyCollisions(pvc, tags)
+		if provisionedByGcpPD(pvc) {
+			res := addPDVolumeLabels(ctx, r.gcpClient, volumeID, tags, *pvc.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordResult(pvc, auditResult(pvc, volumeID, auditOperationAdd, tags, res)))
+			if res.Err == nil && !res.Skipped {
+				syncBackSanitizedKeys(ctx, pvc, tags)
+				if syncGCPSnapshots {
+					syncErrs = append(syncErrs, r.recordLabelEvent(pvc, 0, auditTagOperation(pvc, volumeID, auditOperationAdd, tags, addSnapshotLabels(ctx, r.gcpClient, volumeID, tags, *pvc.Spec.StorageClassName))))
+				}
+			} else if errors.Is(res.Err, errRequeue) {
+				requeueErr = res.Err
+			}
+		}
+		if provisionedByGcpBigtable(pvc) {
+			err := addBigtableInstanceLabels(ctx, r.bigtableClient, volumeID, tags, *pvc.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordLabelEvent(pvc, len(tags), auditTagOperation(pvc, volumeID, auditOperationAdd, tags, err)))
+			if err == nil {
+				syncBackSanitizedKeys(ctx, pvc, tags)
+			}
+		}
+		if provisionedByGcpFilestore(pvc) {
+			err := addFilestoreLabels(ctx, r.filestoreClient, volumeID, tags, *pvc.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordLabelEvent(pvc, len(tags), auditTagOperation(pvc, volumeID, auditOperationAdd, tags, err)))
+			if err == nil {
+				syncBackSanitizedKeys(ctx, pvc, tags)
+			}
+		}
+		if project, instance, ok := getSpannerInstance(pvc, volumeID); ok {
+			syncErrs = append(syncErrs, r.recordLabelEvent(pvc, len(tags), auditTagOperation(pvc, spannerInstanceName(project, instance), auditOperationAdd, tags, addSpannerInstanceLabels(ctx, r.spannerClient, project, instance, tags, *pvc.Spec.StorageClassName))))
+		}
+	case AZURE:
+		if provisionedByAzureDisk(pvc) {
+			res := addAzureDiskLabels(ctx, r.azureClient, volumeID, tags, *pvc.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordResult(pvc, auditResult(pvc, volumeID, auditOperationAdd, tags, res)))
+			if res.Err == nil && propagatesToSnapshots(pvc) {
+				syncErrs = append(syncErrs, r.recordLabelEvent(pvc, 0, auditTagOperation(pvc, volumeID, auditOperationAdd, tags, addAzureSnapshotTags(ctx, r.azureClient, volumeID, tags, *pvc.Spec.StorageClassName))))
+			}
+		}
+		if provisionedByAzureFile(pvc) {
+			res := addAzureFileShareTags(ctx, r.azureFileClient, volumeID, tags, *pvc.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordResult(pvc, auditResult(pvc, volumeID, auditOperationAdd, tags, res)))
+		}
+	}
+	syncErr := errors.Join(syncErrs...)
+	if syncErr == nil {
+		writeLabelFingerprint(ctx, pvc, volumeID, tags)
+		writeManagedLabelKeys(ctx, pvc, tags)
+	}
+	writeSyncStatus(ctx, pvc, syncErr)
+	return requeueErr
+}
+
+// reconcileUpdate syncs the tags of an updated PVC to its volume. It returns
+// an error wrapping errRequeue when the event should be retried.
+func (r *pvcReconciler) reconcileUpdate(ctx context.Context, oldPVC, newPVC *corev1.PersistentVolumeClaim) error {
+	if newPVC.ResourceVersion == oldPVC.ResourceVersion {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("ResourceVersion are the same")
+		return nil
+	}
+	if syncStatusAnnotations && onlySyncStatusChanged(oldPVC, newPVC) {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("Only the sync status annotations changed")
+		return nil
+	}
+	// the fingerprint is only trusted when the PVC's labels didn't change, and
+	// not when the PVC was opted back in to tagging or its tags are now
+	// propagated to snapshots
+	checkFingerprint := maps.Equal(oldPVC.GetLabels(), newPVC.GetLabels()) && !hasSkipAnnotation(oldPVC) &&
+		(propagatesToSnapshots(oldPVC) || !propagatesToSnapshots(newPVC))
+	return r.syncUpdatedTags(ctx, oldPVC, newPVC, checkFingerprint, func() map[string]string {
+		return buildTags(ctx, oldPVC)
+	})
+}
+
+// reconcileSourcesUpdate syncs the tags of a PVC after the labels it
+// inherits from its namespace, PV or node, the defaults of its StorageClass or the
+// key mapping changed. The tags the
+// PVC had are built from the old sources, where set, so that tags that are
+// gone are deleted from the volume.
+func (r *pvcReconciler) reconcileSourcesUpdate(ctx context.Context, pvc *corev1.PersistentVolumeClaim, oldSources tagSources) error {
+	return r.syncUpdatedTags(ctx, pvc, pvc, true, func() map[string]string {
+		sources := getTagSources(ctx, pvc)
+		if oldSources.namespace != nil {
+			sources.namespace = oldSources.namespace
+		}
+		if oldSources.pv != nil {
+			sources.pv = oldSources.pv
+		}
+		if oldSources.node != nil {
+			sources.node = oldSources.node
+		}
+		if oldSources.keyMapping != nil {
+			sources.keyMapping = oldSources.keyMapping
+		}
+		if oldSources.storageClassDefaults != nil {
+			sources.storageClassDefaults = oldSources.storageClassDefaults
+		}
+		if oldSources.storageClassDefaultLabels != nil {
+			sources.storageClassDefaultLabels = oldSources.storageClassDefaultLabels
+		}
+		tags, _ := buildTagsFromSources(ctx, pvc, sources)
+		return tags
+	})
+}
+
+// reconcileResync sets the tags of the PVC on its volume again, even when its
+// label fingerprint or the GCP label cache show they are synced, to repair
+// tags that drifted
+func (r *pvcReconciler) reconcileResync(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	ctx = withoutLabelCache(ctx)
+	return r.syncUpdatedTags(ctx, pvc, pvc, false, func() map[string]string {
+		return buildTags(ctx, pvc)
+	})
+}
+
+// reconcileUnbound retries a PVC that was skipped by --ignore-unbound-pvcs
+// with its current version, unless it has been deleted since
+func (r *pvcReconciler) reconcileUnbound(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	if r.pvcLister != nil {
+		current, err := r.pvcLister.PersistentVolumeClaims(pvc.GetNamespace()).Get(pvc.GetName())
+		if err != nil {
+			log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Not retrying unbound PVC:", err)
+			return nil
+		}
+		// objects in the informer cache must not be modified
+		pvc = getPVC(current.DeepCopy())
+	}
+	return r.reconcileAdd(ctx, pvc)
+}
+
+// resyncPVCs queues a pvcEventResync for every PVC in the informer cache
+// every period until ctx is done
+func resyncPVCs(ctx context.Context, c clocks.WithTicker, period time.Duration, pvcLister corelisters.PersistentVolumeClaimLister, queue eventQueue) {
+	ticker := c.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		pvcs, err := pvcLister.List(labels.Everything())
+		if err != nil {
+			log.Errorln("Failed to list PVCs to resync:", err)
+			continue
+		}
+		log.WithFields(log.Fields{"pvcs": len(pvcs)}).Infoln("Resyncing the tags of all PVCs")
+		for _, pvc := range pvcs {
+			queue.Add(newPVCEvent(pvcEventResync, nil, getPVC(pvc.DeepCopy())))
+		}
+	}
+}
+
+// syncUpdatedTags sets the tags of newPVC on its volume and deletes the tags
+// returned by buildOldTags that it no longer has. When checkFingerprint is set
+// nothing is done if the PVC's label fingerprint shows the tags are synced.
+func (r *pvcReconciler) syncUpdatedTags(ctx context.Context, oldPVC, newPVC *corev1.PersistentVolumeClaim, checkFingerprint bool, buildOldTags func() map[string]string) error {
+	if skipNamespaceNotSelected(newPVC) || skipPVCNotSelected(newPVC) || skipAnnotated(newPVC) || skipUnbound(newPVC) || skipNotStatefulSetOwned(newPVC) || skipOtherCloudProvider(newPVC) {
+		return nil
+	}
+	if newPVC.Spec.VolumeName == "" {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolume not created yet")
+		return nil
+	}
+	if newPVC.GetDeletionTimestamp() != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolumeClaim is being deleted")
+		return nil
+	}
+	if skipDeleteReclaimed(ctx, newPVC) {
+		return nil
+	}
+	log.WithContext(ctx).WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Infoln("Need to reconcile tags")
+	if deleteRemovedLabels {
+		buildOldTags = withManagedLabelKeys(newPVC, buildOldTags)
+	}
 
-	var efsClient *EFSClient
-	var ec2Client *EBSClient
-	var fsxClient *FSxClient
-	var gcpClient GCPClient
+	volumeID, tags, tagErrs, err := processPersistentVolumeClaim(ctx, newPVC)
+	if err != nil {
+		return nil
+	}
+	r.recordTagErrors(newPVC, tagErrs)
+	if checkFingerprint && labelsAlreadySynced(newPVC, volumeID, tags) {
+		return nil
+	}
+	if err := cloudBreaker.allow(); err != nil {
+		return fmt.Errorf("%w: %w", errRequeue, err)
+	}
 
+	var syncErrs []error
+	var requeueErr error
 	switch cloud {
 	case AWS:
-		efsClient, _ = newEFSClient()
-		ec2Client, _ = newEC2Client()
-		fsxClient, _ = newFSxClient()
-	case GCP:
-		gcpClient, err = newGCPClient(context.Background())
-		if err != nil {
-			log.Fatalln("failed to create GCP client", err)
+		if !provisionedByAwsEfs(newPVC) && !provisionedByAwsEbs(newPVC) && !provisionedByAwsFsx(newPVC) {
+			return nil
 		}
-	}
 
-	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			pvc := getPVC(obj)
-			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Infoln("New PVC Added to Store")
-
-			volumeID, tags, err := processPersistentVolumeClaim(pvc)
-			if err != nil || len(tags) == 0 {
-				return
+		if len(tags) > 0 {
+			if provisionedByAwsEfs(newPVC) {
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(tags), auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, r.efsClient.addEFSAccessPointTags(ctx, volumeID, tags, *newPVC.Spec.StorageClassName))))
 			}
-
-			switch cloud {
-			case AWS:
-				if !provisionedByAwsEfs(pvc) && !provisionedByAwsEbs(pvc) && !provisionedByAwsFsx(pvc) {
-					return
-				}
-
-				if provisionedByAwsEfs(pvc) {
-					efsClient.addEFSVolumeTags(volumeID, tags, *pvc.Spec.StorageClassName)
-				}
-				if provisionedByAwsEbs(pvc) {
-					ec2Client.addEBSVolumeTags(volumeID, tags, *pvc.Spec.StorageClassName)
+			if provisionedByAwsEbs(newPVC) {
+				err := r.ec2Client.addEBSVolumeTags(ctx, volumeID, tags, *newPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(tags), auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, err)))
+				if err == nil && syncAWSSnapshots {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, 0, auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, r.ec2Client.addEBSSnapshotTags(ctx, volumeID, tags, *newPVC.Spec.StorageClassName))))
 				}
-				if provisionedByAwsFsx(pvc) {
-					fsxClient.addFSxVolumeTags(volumeID, tags, *pvc.Spec.StorageClassName)
-				}
-			case GCP:
-				if !provisionedByGcpPD(pvc) {
-					return
-				}
-				addPDVolumeLabels(gcpClient, volumeID, tags, *pvc.Spec.StorageClassName)
 			}
-		},
-
-		UpdateFunc: func(old, new interface{}) {
-			newPVC := getPVC(new)
-			oldPVC := getPVC(old)
-			if newPVC.ResourceVersion == oldPVC.ResourceVersion {
-				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("ResourceVersion are the same")
-				return
+			if provisionedByAwsFsx(newPVC) {
+				if isFSxONTAPVolumeHandle(volumeID) {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(tags), auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, addFSxONTAPVolumeTags(ctx, r.fsxONTAPClient, volumeID, tags, *newPVC.Spec.StorageClassName))))
+				} else {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(tags), auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, r.fsxClient.addFSxVolumeTags(ctx, volumeID, tags, *newPVC.Spec.StorageClassName))))
+				}
 			}
-			if newPVC.Spec.VolumeName == "" {
-				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolume not created yet")
-				return
+		}
+		oldTags := buildOldTags()
+		var deletedTags []string
+		var deletedTagsPtr []*string
+		for k := range oldTags {
+			if _, ok := tags[k]; !ok {
+				deletedTags = append(deletedTags, k)
+				deletedTagsPtr = append(deletedTagsPtr, &k)
 			}
-			if newPVC.GetDeletionTimestamp() != nil {
-				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolumeClaim is being deleted")
-				return
+		}
+		if len(deletedTags) > 0 {
+			if provisionedByAwsEfs(newPVC) {
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(deletedTags), auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, r.efsClient.deleteEFSAccessPointTags(ctx, volumeID, deletedTags, *oldPVC.Spec.StorageClassName))))
 			}
-			log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Infoln("Need to reconcile tags")
-
-			volumeID, tags, err := processPersistentVolumeClaim(newPVC)
-			if err != nil {
-				return
+			if provisionedByAwsEbs(newPVC) {
+				err := r.ec2Client.deleteEBSVolumeTags(ctx, volumeID, deletedTags, *oldPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(deletedTags), auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, err)))
+				if err == nil && syncAWSSnapshots {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, 0, auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, r.ec2Client.deleteEBSSnapshotTags(ctx, volumeID, deletedTags, *oldPVC.Spec.StorageClassName))))
+				}
 			}
-
-			switch cloud {
-			case AWS:
-				if !provisionedByAwsEfs(newPVC) && !provisionedByAwsEbs(newPVC) && !provisionedByAwsFsx(newPVC) {
-					return
+			if provisionedByAwsFsx(newPVC) {
+				if isFSxONTAPVolumeHandle(volumeID) {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(deletedTags), auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, deleteFSxONTAPVolumeTags(ctx, r.fsxONTAPClient, volumeID, deletedTags, *oldPVC.Spec.StorageClassName))))
+				} else {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(deletedTags), auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, r.fsxClient.deleteFSxVolumeTags(ctx, volumeID, deletedTagsPtr, *oldPVC.Spec.StorageClassName))))
 				}
+			}
+		}
+	case GCP:
+		if !provisionedByGcpPD(newPVC) && !provisionedByGcpBigtable(newPVC) && !provisionedByGcpFilestore(newPVC) {
+			return nil
+		}
 
-				if len(tags) > 0 {
-					if provisionedByAwsEfs(newPVC) {
-						efsClient.addEFSVolumeTags(volumeID, tags, *newPVC.Spec.StorageClassName)
-					}
-					if provisionedByAwsEbs(newPVC) {
-						ec2Client.addEBSVolumeTags(volumeID, tags, *newPVC.Spec.StorageClassName)
-					}
-					if provisionedByAwsFsx(newPVC) {
-						fsxClient.addFSxVolumeTags(volumeID, tags, *newPVC.Spec.StorageClassName)
-					}
-				}
-				oldTags := buildTags(oldPVC)
-				var deletedTags []string
-				var deletedTagsPtr []*string
-				for k := range oldTags {
-					if _, ok := tags[k]; !ok {
-						deletedTags = append(deletedTags, k)
-						deletedTagsPtr = append(deletedTagsPtr, &k)
+		if len(tags) > 0 {
+			r.recordKeyCollisions(newPVC, tags)
+			if provisionedByGcpPD(newPVC) {
+				res := addPDVolumeLabels(ctx, r.gcpClient, volumeID, tags, *newPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordResult(newPVC, auditResult(newPVC, volumeID, auditOperationAdd, tags, res)))
+				if res.Err == nil && !res.Skipped {
+					syncBackSanitizedKeys(ctx, newPVC, tags)
+					if syncGCPSnapshots {
+						syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, 0, auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, addSnapshotLabels(ctx, r.gcpClient, volumeID, tags, *newPVC.Spec.StorageClassName))))
 					}
+				} else if errors.Is(res.Err, errRequeue) {
+					requeueErr = res.Err
 				}
-				if len(deletedTags) > 0 {
-					if provisionedByAwsEfs(newPVC) {
-						efsClient.deleteEFSVolumeTags(volumeID, deletedTags, *oldPVC.Spec.StorageClassName)
-					}
-					if provisionedByAwsEbs(newPVC) {
-						ec2Client.deleteEBSVolumeTags(volumeID, deletedTags, *oldPVC.Spec.StorageClassName)
-					}
-					if provisionedByAwsFsx(newPVC) {
-						fsxClient.deleteFSxVolumeTags(volumeID, deletedTagsPtr, *oldPVC.Spec.StorageClassName)
-					}
+			}
+			if provisionedByGcpBigtable(newPVC) {
+				err := addBigtableInstanceLabels(ctx, r.bigtableClient, volumeID, tags, *newPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(tags), auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, err)))
+				if err == nil {
+					syncBackSanitizedKeys(ctx, newPVC, tags)
 				}
-			case GCP:
-				if !provisionedByGcpPD(newPVC) {
-					return
+			}
+			if provisionedByGcpFilestore(newPVC) {
+				err := addFilestoreLabels(ctx, r.filestoreClient, volumeID, tags, *newPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(tags), auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, err)))
+				if err == nil {
+					syncBackSanitizedKeys(ctx, newPVC, tags)
 				}
-
-				if len(tags) > 0 {
-					addPDVolumeLabels(gcpClient, volumeID, tags, *newPVC.Spec.StorageClassName)
+			}
+		}
+		spannerProject, spannerInstance, syncSpanner := getSpannerInstance(newPVC, volumeID)
+		if syncSpanner && len(tags) > 0 {
+			syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(tags), auditTagOperation(newPVC, spannerInstanceName(spannerProject, spannerInstance), auditOperationAdd, tags, addSpannerInstanceLabels(ctx, r.spannerClient, spannerProject, spannerInstance, tags, *newPVC.Spec.StorageClassName))))
+		}
+		oldTags := buildOldTags()
+		var deletedTags []string
+		for k := range oldTags {
+			if _, ok := tags[k]; !ok {
+				deletedTags = append(deletedTags, k)
+			}
+		}
+		if len(deletedTags) > 0 {
+			if provisionedByGcpPD(newPVC) {
+				res := deletePDVolumeLabels(ctx, r.gcpClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordResult(newPVC, auditResult(newPVC, volumeID, auditOperationDelete, deletedTags, res)))
+				if errors.Is(res.Err, errRequeue) {
+					requeueErr = res.Err
 				}
-				oldTags := buildTags(oldPVC)
-				var deletedTags []string
-				for k := range oldTags {
-					if _, ok := tags[k]; !ok {
-						deletedTags = append(deletedTags, k)
-					}
+				if res.Err == nil && !res.Skipped && syncGCPSnapshots {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, 0, auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, deleteSnapshotLabels(ctx, r.gcpClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName))))
 				}
-				if len(deletedTags) > 0 {
-					deletePDVolumeLabels(gcpClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName)
+			}
+			if provisionedByGcpBigtable(newPVC) {
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(deletedTags), auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, deleteBigtableInstanceLabels(ctx, r.bigtableClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName))))
+			}
+			if provisionedByGcpFilestore(newPVC) {
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(deletedTags), auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, deleteFilestoreLabels(ctx, r.filestoreClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName))))
+			}
+			if syncSpanner {
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, len(deletedTags), auditTagOperation(newPVC, spannerInstanceName(spannerProject, spannerInstance), auditOperationDelete, deletedTags, deleteSpannerInstanceLabels(ctx, r.spannerClient, spannerProject, spannerInstance, deletedTags, *newPVC.Spec.StorageClassName))))
+			}
+		}
+	case AZURE:
+		isDisk, isFile := provisionedByAzureDisk(newPVC), provisionedByAzureFile(newPVC)
+		if !isDisk && !isFile {
+			return nil
+		}
+
+		oldTags := buildOldTags()
+		var deletedTags []string
+		for k := range oldTags {
+			if _, ok := tags[k]; !ok {
+				deletedTags = append(deletedTags, k)
+			}
+		}
+		if isDisk {
+			if len(tags) > 0 {
+				res := addAzureDiskLabels(ctx, r.azureClient, volumeID, tags, *newPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordResult(newPVC, auditResult(newPVC, volumeID, auditOperationAdd, tags, res)))
+				if res.Err == nil && propagatesToSnapshots(newPVC) {
+					syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, 0, auditTagOperation(newPVC, volumeID, auditOperationAdd, tags, addAzureSnapshotTags(ctx, r.azureClient, volumeID, tags, *newPVC.Spec.StorageClassName))))
 				}
 			}
-		},
-	})
+			res := deleteAzureDiskLabels(ctx, r.azureClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordResult(newPVC, auditResult(newPVC, volumeID, auditOperationDelete, deletedTags, res)))
+			if res.Err == nil && len(deletedTags) > 0 && propagatesToSnapshots(newPVC) {
+				syncErrs = append(syncErrs, r.recordLabelEvent(newPVC, 0, auditTagOperation(newPVC, volumeID, auditOperationDelete, deletedTags, deleteAzureSnapshotTags(ctx, r.azureClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName))))
+			}
+		}
+		if isFile {
+			if len(tags) > 0 {
+				res := addAzureFileShareTags(ctx, r.azureFileClient, volumeID, tags, *newPVC.Spec.StorageClassName)
+				syncErrs = append(syncErrs, r.recordResult(newPVC, auditResult(newPVC, volumeID, auditOperationAdd, tags, res)))
+			}
+			res := deleteAzureFileShareTags(ctx, r.azureFileClient, volumeID, deletedTags, *newPVC.Spec.StorageClassName)
+			syncErrs = append(syncErrs, r.recordResult(newPVC, auditResult(newPVC, volumeID, auditOperationDelete, deletedTags, res)))
+		}
+	}
+	syncErr := errors.Join(syncErrs...)
+	if syncErr == nil {
+		writeLabelFingerprint(ctx, newPVC, volumeID, tags)
+		writeManagedLabelKeys(ctx, newPVC, tags)
+	}
+	writeSyncStatus(ctx, newPVC, syncErr)
+	return requeueErr
+}
+
+// skipUnbound reports whether the PVC is skipped because it is not bound to a
+// PV yet, so there is no volume to tag. With --ignore-unbound-pvcs a PVC
+// without a volume name is unbound too.
+func skipUnbound(pvc *corev1.PersistentVolumeClaim) bool {
+	if ignoreUnboundPVCs {
+		if pvc.Spec.VolumeName != "" && pvc.Status.Phase == corev1.ClaimBound {
+			return false
+		}
+	} else if !skipBoundCheck || pvc.Status.Phase == corev1.ClaimBound {
+		return false
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "phase": pvc.Status.Phase}).Debugln("PersistentVolumeClaim is not bound yet")
+	storageclass := ""
+	if pvc.Spec.StorageClassName != nil {
+		storageclass = *pvc.Spec.StorageClassName
+	}
+	promSkippedUnboundTotal.With(prometheus.Labels{"storageclass": storageclass}).Inc()
+	return true
+}
+
+// skipAnnotation opts a PVC out of tagging: while it is "true" no cloud API
+// calls are made for the PVC's volume, and the tags the volume already has are
+// left alone. Removing the annotation reconciles the PVC.
+const skipAnnotation = "pvc-tagger.planetscale.com/skip"
+
+// hasSkipAnnotation reports whether the PVC's skipAnnotation is "true"
+func hasSkipAnnotation(pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.GetAnnotations()[skipAnnotation] == "true"
+}
+
+// skipAnnotated reports whether the PVC is skipped because it has the
+// skipAnnotation
+func skipAnnotated(pvc *corev1.PersistentVolumeClaim) bool {
+	if !hasSkipAnnotation(pvc) {
+		return false
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(skipAnnotation + " annotation is set")
+	return true
+}
+
+// namespaceSelected reports whether the namespace matches --namespace-selector
+func namespaceSelected(ns *corev1.Namespace) bool {
+	return namespaceSelector == nil || namespaceSelector.Matches(labels.Set(ns.GetLabels()))
+}
+
+// skipNamespaceNotSelected reports whether the PVC is skipped because its
+// namespace doesn't match --namespace-selector. The namespace is read from the
+// informer cache.
+func skipNamespaceNotSelected(pvc *corev1.PersistentVolumeClaim) bool {
+	if namespaceSelector == nil {
+		return false
+	}
+	if nsLister == nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Namespace informer is not running, skipping PersistentVolumeClaim")
+		return true
+	}
+	ns, err := nsLister.Get(pvc.GetNamespace())
 	if err != nil {
-		log.Errorln("Can't setup PVC informer! Check RBAC permissions")
-		return
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Unable to get Namespace, skipping PersistentVolumeClaim:", err)
+		return true
+	}
+	if namespaceSelected(ns) {
+		return false
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Namespace does not match the namespace selector")
+	return true
+}
+
+// skipPVCNotSelected reports whether the PVC is skipped because its labels
+// don't match --pvc-selector
+func skipPVCNotSelected(pvc *corev1.PersistentVolumeClaim) bool {
+	if pvcSelector == nil || pvcSelector.Matches(labels.Set(pvc.GetLabels())) {
+		return false
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("PersistentVolumeClaim does not match the PVC selector")
+	return true
+}
+
+// skipDeleteReclaimed reports whether the PVC is skipped because
+// --skip-delete-reclaim-policy is set and its PV has the Delete reclaim
+// policy. PVCs whose PV can't be found are left to processPersistentVolumeClaim.
+func skipDeleteReclaimed(ctx context.Context, pvc *corev1.PersistentVolumeClaim) bool {
+	if !skipDeleteReclaimPolicy || pvc.Spec.VolumeName == "" {
+		return false
+	}
+	pv, err := getBoundPV(ctx, pvc)
+	if err != nil || pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimDelete {
+		return false
 	}
+	log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "pv": pv.GetName()}).Debugln("PersistentVolume has the Delete reclaim policy")
+	return true
+}
 
-	informer.Run(ch)
+// skipNotStatefulSetOwned reports whether the PVC is skipped because
+// --watch-statefulset-pvcs-only is set and no StatefulSet owns the PVC
+func skipNotStatefulSetOwned(pvc *corev1.PersistentVolumeClaim) bool {
+	if !statefulSetPVCsOnly {
+		return false
+	}
+	for _, owner := range pvc.GetOwnerReferences() {
+		if owner.Kind == "StatefulSet" {
+			return false
+		}
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("PersistentVolumeClaim is not owned by a StatefulSet")
+	return true
 }
 
 func convertTagsToFSxTags(tags map[string]string) []*fsx.Tag {
@@ -299,7 +1441,85 @@ func parseAWSEFSVolumeID(k8sVolumeID string) string {
 	return string(matches[1])
 }
 
-func buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+func buildTags(ctx context.Context, pvc *corev1.PersistentVolumeClaim) map[string]string {
+	tags, _ := buildTagsFromSources(ctx, pvc, getTagSources(ctx, pvc))
+	return tags
+}
+
+// tagSources are the inputs of a PVC's tags that live outside the PVC
+type tagSources struct {
+	// namespace are the labels of the PVC's namespace selected with
+	// --inherit-namespace-labels
+	namespace map[string]string
+	// pv are the labels of the bound PV when --sync-pv-labels is set
+	pv map[string]string
+	// node are the labels of the node the PVC's volume was provisioned for,
+	// selected with --include-node-label-keys
+	node map[string]string
+	// keyMapping is the --label-key-mapping-configmap key mapping
+	keyMapping map[string]string
+	// storageClassDefaults are the default tags of the PVC's StorageClass in
+	// the --storageclass-defaults-configmap ConfigMap
+	storageClassDefaults map[string]string
+	// storageClassDefaultLabels are the tags in the default-labels annotation
+	// of the PVC's StorageClass
+	storageClassDefaultLabels map[string]string
+}
+
+// getTagSources returns the labels the PVC inherits from its namespace,
+// its PV and its node, the default tags of its StorageClass and the current key mapping
+func getTagSources(ctx context.Context, pvc *corev1.PersistentVolumeClaim) tagSources {
+	return tagSources{
+		namespace:                 getNamespaceLabels(ctx, pvc),
+		pv:                        getPVLabels(ctx, pvc),
+		node:                      getNodeLabels(ctx, pvc),
+		keyMapping:                getLabelKeyMapping(),
+		storageClassDefaults:      getStorageClassDefaults(pvc),
+		storageClassDefaultLabels: getStorageClassDefaultLabels(ctx, pvc),
+	}
+}
+
+// buildTagsFromSources builds the tags of the PVC, with the inherited
+// labels taking a lower priority than the PVC's own labels, and transforms
+// their keys with --strip-label-prefix and then the key mapping. It also
+// returns the errors of an invalid extra-labels annotation and of the tag
+// templates that failed to render.
+func buildTagsFromSources(ctx context.Context, pvc *corev1.PersistentVolumeClaim, sources tagSources) (map[string]string, []error) {
+	tags, errs := collectTags(ctx, pvc, sources)
+	return withoutEmptySanitizedKeys(ctx, pvc, remapTagKeys(stripTagKeyPrefixes(tags), sources.keyMapping)), errs
+}
+
+// sanitizeKeyForCloud sanitizes a tag key for the cloud provider. AWS keys are
+// returned as is.
+func sanitizeKeyForCloud(key string) string {
+	switch cloud {
+	case GCP:
+		return sanitizeKeyForGCP(key)
+	case AZURE:
+		return sanitizeKeyForAzure(key)
+	}
+	return key
+}
+
+// withoutEmptySanitizedKeys drops the tags whose key is empty once sanitized
+// for the cloud, e.g. an empty key in the tags annotation, which the cloud
+// APIs would reject
+func withoutEmptySanitizedKeys(ctx context.Context, pvc *corev1.PersistentVolumeClaim, tags map[string]string) map[string]string {
+	for k := range tags {
+		if sanitizeKeyForCloud(k) != "" {
+			continue
+		}
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "key": k}).Warnln("Tag key is empty after sanitization. Skipping...")
+		countSkippedLabels(labelsSkippedEmptyKey, pvcStorageClass(pvc), 1)
+		delete(tags, k)
+	}
+	return tags
+}
+
+// collectTags merges the tags of the PVC from all their sources and renders
+// their templates. It returns the errors of an invalid extra-labels
+// annotation and of the templates that failed to render.
+func collectTags(ctx context.Context, pvc *corev1.PersistentVolumeClaim, sources tagSources) (map[string]string, []error) {
 	tags := map[string]string{}
 	customTags := map[string]string{}
 	var tagString string
@@ -308,7 +1528,7 @@ func buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
 	annotations := pvc.GetAnnotations()
 	// Skip if the annotation says to ignore this PVC
 	if _, ok := annotations[annotationPrefix+"/ignore"]; ok {
-		log.Debugln(annotationPrefix + "/ignore annotation is set")
+		log.WithContext(ctx).Debugln(annotationPrefix + "/ignore annotation is set")
 		promIgnoredTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
 		promIgnoredLegacyTotal.Inc()
 		return renderTagTemplates(pvc, tags)
@@ -316,46 +1536,138 @@ func buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
 	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
 	if annotationPrefix == defaultAnnotationPrefix {
 		if _, ok := annotations[legacyAnnotationPrefix+"/ignore"]; ok {
-			log.Debugln(legacyAnnotationPrefix + "/ignore annotation is set")
+			log.WithContext(ctx).Debugln(legacyAnnotationPrefix + "/ignore annotation is set")
 			promIgnoredTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
 			promIgnoredLegacyTotal.Inc()
 			return renderTagTemplates(pvc, tags)
 		}
 	}
 
+	// The default-labels annotation of the StorageClass has the lowest
+	// priority, even below the global defaults
+	for k, v := range sources.storageClassDefaultLabels {
+		if !isValidTagName(k) && !allowAllTags {
+			log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
+			promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
+			promInvalidTagsLegacyTotal.Inc()
+			continue
+		}
+		tags[k] = v
+	}
+
 	// Set the default tags
 	for k, v := range defaultTags {
 		if !isValidTagName(k) {
 			if !allowAllTags {
-				log.Warnln(k, "is a restricted tag. Skipping...")
+				log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
 				promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
 				promInvalidTagsLegacyTotal.Inc()
 				continue
 			} else {
-				log.Warnln(k, "is a restricted tag but still allowing it to be set...")
+				log.WithContext(ctx).Warnln(k, "is a restricted tag but still allowing it to be set...")
 			}
 		}
 		tags[k] = v
 	}
 
+	// The defaults of the StorageClass override the global defaults and
+	// are overridden by every other source
+	for k, v := range sources.storageClassDefaults {
+		if !isValidTagName(k) && !allowAllTags {
+			log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
+			promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
+			promInvalidTagsLegacyTotal.Inc()
+			continue
+		}
+		tags[k] = v
+	}
+
+	// Namespace labels are copied first so the PVC's own labels win
+	for k, v := range sources.namespace {
+		if labelKeyFiltered(pvc, k) {
+			continue
+		}
+		if !isValidTagName(k) && !allowAllTags {
+			log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
+			promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
+			promInvalidTagsLegacyTotal.Inc()
+			continue
+		}
+		tags[k] = v
+	}
+
+	// Node labels are copied after the namespace labels and before the
+	// PVC's own labels
+	for k, v := range sources.node {
+		if labelKeyFiltered(pvc, k) {
+			continue
+		}
+		if !isValidTagName(k) && !allowAllTags {
+			log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
+			promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
+			promInvalidTagsLegacyTotal.Inc()
+			continue
+		}
+		tags[k] = v
+	}
+
+	// The PVC's annotations named by --annotation-keys are copied before its
+	// labels so the labels win
+	for _, k := range annotationKeys {
+		v, ok := annotations[k]
+		if !ok || v == "" {
+			continue
+		}
+		if labelKeyFiltered(pvc, k) {
+			continue
+		}
+		if !isValidTagName(k) && !allowAllTags {
+			log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
+			promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
+			promInvalidTagsLegacyTotal.Inc()
+			continue
+		}
+		tags[k] = v
+	}
+
 	if len(copyLabels) > 0 {
-		for k, v := range pvc.GetLabels() {
-			if copyLabels[0] == "*" || slices.Contains(copyLabels, k) {
-				if !isValidTagName(k) {
-					if !allowAllTags {
-						log.Warnln(k, "is a restricted tag. Skipping...")
-						promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
-						promInvalidTagsLegacyTotal.Inc()
-						continue
-					} else {
-						log.Warnln(k, "is a restricted tag but still allowing it to be set...")
-					}
-				}
+		// StorageClass and PV labels are copied first so the PVC's own labels win
+		copyLabelsToTags(pvc, getStorageClassLabels(ctx, pvc), tags)
+		copyLabelsToTags(pvc, sources.pv, tags)
+		if pvcLabelPrefix == "" {
+			copyLabelsToTags(pvc, pvc.GetLabels(), tags)
+		}
+	}
+	if pvcLabelPrefix != "" {
+		copyPrefixedLabelsToTags(pvc, tags)
+	}
+
+	if propagateVelero {
+		for _, k := range veleroAnnotations {
+			if v, ok := annotations[k]; ok && v != "" {
 				tags[k] = v
 			}
 		}
 	}
 
+	// The extra labels override the labels and are overridden by the tags
+	// annotation
+	var errs []error
+	extraLabels, err := parseExtraLabels(pvc)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Skipping extra labels:", err)
+		errs = append(errs, err)
+	}
+	for k, v := range extraLabels {
+		if !isValidTagName(k) && !allowAllTags {
+			log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
+			promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
+			promInvalidTagsLegacyTotal.Inc()
+			continue
+		}
+		tags[k] = v
+	}
+
 	var legacyOk bool
 	tagString, ok := annotations[annotationPrefix+"/tags"]
 	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
@@ -366,10 +1678,11 @@ func buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
 		legacyTagString = ""
 	}
 	if !ok && !legacyOk {
-		log.Debugln("Does not have " + annotationPrefix + "/tags or legacy " + legacyAnnotationPrefix + "/tags annotation")
-		return renderTagTemplates(pvc, tags)
+		log.WithContext(ctx).Debugln("Does not have " + annotationPrefix + "/tags or legacy " + legacyAnnotationPrefix + "/tags annotation")
+		rendered, templateErrs := renderTagTemplates(pvc, tags)
+		return rendered, append(errs, templateErrs...)
 	} else if ok && legacyOk {
-		log.Warnln("Has both " + annotationPrefix + "/tags AND legacy " + legacyAnnotationPrefix + "/tags annotation. Using newer " + annotationPrefix + "/tags annotation")
+		log.WithContext(ctx).Warnln("Has both " + annotationPrefix + "/tags AND legacy " + legacyAnnotationPrefix + "/tags annotation. Using newer " + annotationPrefix + "/tags annotation")
 	} else if legacyOk && !ok {
 		tagString = legacyTagString
 	}
@@ -378,28 +1691,151 @@ func buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
 	} else {
 		err := json.Unmarshal([]byte(tagString), &customTags)
 		if err != nil {
-			log.Errorln("Failed to Unmarshal JSON:", err)
+			log.WithContext(ctx).Errorln("Failed to Unmarshal JSON:", err)
 		}
 	}
 
 	for k, v := range customTags {
 		if !isValidTagName(k) {
 			if !allowAllTags {
-				log.Warnln(k, "is a restricted tag. Skipping...")
+				log.WithContext(ctx).Warnln(k, "is a restricted tag. Skipping...")
 				promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
 				promInvalidTagsLegacyTotal.Inc()
 				continue
 			} else {
-				log.Warnln(k, "is a restricted tag but still allowing it to be set...")
+				log.WithContext(ctx).Warnln(k, "is a restricted tag but still allowing it to be set...")
 			}
 		}
 		tags[k] = v
 	}
 
-	return renderTagTemplates(pvc, tags)
+	rendered, templateErrs := renderTagTemplates(pvc, tags)
+	return rendered, append(errs, templateErrs...)
+}
+
+// extraLabelsAnnotation holds a JSON encoded map of tags to set on the volume
+// of the PVC in addition to its labels, e.g. tags that can't be expressed as
+// Kubernetes labels
+const extraLabelsAnnotation = "pvc-tagger.planetscale.com/extra-labels"
+
+// extraLabelsError is returned when the extraLabelsAnnotation isn't a JSON
+// encoded map of strings
+type extraLabelsError struct {
+	err error
+}
+
+func (e *extraLabelsError) Error() string {
+	return fmt.Sprintf("%s annotation is not a JSON map of strings: %s", extraLabelsAnnotation, e.err)
+}
+
+func (e *extraLabelsError) Unwrap() error {
+	return e.err
+}
+
+// parseExtraLabels returns the tags in the PVC's extraLabelsAnnotation. An
+// empty annotation has no tags.
+func parseExtraLabels(pvc *corev1.PersistentVolumeClaim) (map[string]string, error) {
+	value := strings.TrimSpace(pvc.GetAnnotations()[extraLabelsAnnotation])
+	if value == "" {
+		return nil, nil
+	}
+	var extraLabels map[string]string
+	if err := json.Unmarshal([]byte(value), &extraLabels); err != nil {
+		return nil, &extraLabelsError{err: err}
+	}
+	return extraLabels, nil
+}
+
+// stripLabelPrefix removes the first --strip-label-prefix domain prefix the
+// key starts with
+func stripLabelPrefix(key string) string {
+	for _, prefix := range stripPrefixes {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return key[len(prefix):]
+		}
+	}
+	return key
+}
+
+// stripTagKeyPrefixes removes the --strip-label-prefix domain prefixes from
+// the tag keys. When two keys collide after stripping, a key that had no
+// prefix wins, otherwise the first key in sorted order.
+func stripTagKeyPrefixes(tags map[string]string) map[string]string {
+	if len(stripPrefixes) == 0 {
+		return tags
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	stripped := make(map[string]string, len(tags))
+	for _, k := range keys {
+		if stripLabelPrefix(k) == k {
+			stripped[k] = tags[k]
+		}
+	}
+	for _, k := range keys {
+		key := stripLabelPrefix(k)
+		if key == k {
+			continue
+		}
+		if _, ok := stripped[key]; ok {
+			log.Warnln("Skipping tag", k, "because", key, "is already set")
+			continue
+		}
+		stripped[key] = tags[k]
+	}
+	return stripped
+}
+
+// remapTagKeys renames the tag keys found in keyMapping. When a renamed key
+// collides with a key that wasn't renamed, the renamed key wins. When several
+// keys are renamed to the same key, the first in sorted order wins.
+func remapTagKeys(tags map[string]string, keyMapping map[string]string) map[string]string {
+	if len(keyMapping) == 0 {
+		return tags
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	remapped := make(map[string]string, len(tags))
+	for _, k := range keys {
+		if _, ok := keyMapping[k]; !ok {
+			remapped[k] = tags[k]
+		}
+	}
+	mappedFrom := map[string]string{}
+	for _, k := range keys {
+		target, ok := keyMapping[k]
+		if !ok {
+			continue
+		}
+		if from, ok := mappedFrom[target]; ok {
+			log.Warnln("Skipping tag", k, "because", from, "is already mapped to", target)
+			continue
+		}
+		if _, ok := remapped[target]; ok {
+			log.Warnln("Tag", k, "mapped to", target, "replaces an existing tag")
+		}
+		remapped[target] = tags[k]
+		mappedFrom[target] = k
+	}
+	return remapped
 }
 
-func renderTagTemplates(pvc *corev1.PersistentVolumeClaim, tags map[string]string) map[string]string {
+// renderTagTemplates renders the tag values as Go templates using the PVC's
+// metadata. Tags whose template fails to render are removed and their errors
+// returned. The rendered values are not rendered again.
+func renderTagTemplates(pvc *corev1.PersistentVolumeClaim, tags map[string]string) (map[string]string, []error) {
+	if !labelValueTemplate {
+		return tags, nil
+	}
 	tplData := TagTemplate{
 		Name:        pvc.GetName(),
 		Namespace:   pvc.GetNamespace(),
@@ -407,20 +1843,24 @@ func renderTagTemplates(pvc *corev1.PersistentVolumeClaim, tags map[string]strin
 		Annotations: pvc.GetAnnotations(),
 	}
 
+	var errs []error
 	for k, v := range tags {
-		tmpl, err := template.New("tag").Parse(v)
-		if err != nil {
-			continue
+		tmpl, err := template.New(k).Parse(v)
+		if err == nil {
+			buf := new(bytes.Buffer)
+			err = tmpl.Execute(buf, tplData)
+			v = buf.String()
 		}
-		buf := new(bytes.Buffer)
-		err = tmpl.Execute(buf, tplData)
 		if err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Skipping tag", k, "with invalid template:", err)
+			errs = append(errs, fmt.Errorf("tag %s: %w", k, err))
+			delete(tags, k)
 			continue
 		}
-		tags[k] = buf.String()
+		tags[k] = v
 	}
 
-	return tags
+	return tags, errs
 }
 
 func isValidTagName(name string) bool {
@@ -436,111 +1876,147 @@ func isValidTagName(name string) bool {
 }
 
 func provisionedByAwsEfs(pvc *corev1.PersistentVolumeClaim) bool {
-	annotations := pvc.GetAnnotations()
-	if annotations == nil {
+	provisionedBy, ok := getPVCProvisioner(pvc)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
+		return false
+	}
+
+	if provisionedBy == AWS_EFS_CSI {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EFS_CSI + " volume")
+		return true
+	}
+	return false
+}
+
+func provisionedByAwsEbs(pvc *corev1.PersistentVolumeClaim) bool {
+	provisionedBy, ok := getPVCProvisioner(pvc)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
 		return false
 	}
 
-	provisionedBy, ok := getProvisionedBy(annotations)
+	switch provisionedBy {
+	case AWS_EBS_LEGACY:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EBS_LEGACY + " volume")
+		return true
+	case AWS_EBS_CSI:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EBS_CSI + " volume")
+		return true
+	}
+	return false
+}
+
+func provisionedByAwsFsx(pvc *corev1.PersistentVolumeClaim) bool {
+	provisionedBy, ok := getPVCProvisioner(pvc)
 	if !ok {
 		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
 		return false
 	}
 
-	if provisionedBy == AWS_EFS_CSI {
-		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EFS_CSI + " volume")
+	if provisionedBy == AWS_FSX_CSI {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_FSX_CSI + " volume")
 		return true
 	}
 	return false
 }
 
-func provisionedByAwsEbs(pvc *corev1.PersistentVolumeClaim) bool {
-	annotations := pvc.GetAnnotations()
-	if annotations == nil {
-		return false
-	}
-
-	provisionedBy, ok := getProvisionedBy(annotations)
+func provisionedByGcpPD(pvc *corev1.PersistentVolumeClaim) bool {
+	provisionedBy, ok := getPVCProvisioner(pvc)
 	if !ok {
 		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
 		return false
 	}
 
 	switch provisionedBy {
-	case AWS_EBS_LEGACY:
-		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EBS_LEGACY + " volume")
+	case GCP_PD_LEGACY:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_PD_LEGACY + " volume")
 		return true
-	case AWS_EBS_CSI:
-		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EBS_CSI + " volume")
+	case GCP_PD_CSI:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_PD_CSI + " volume")
 		return true
 	}
 	return false
 }
 
-func provisionedByAwsFsx(pvc *corev1.PersistentVolumeClaim) bool {
-	annotations := pvc.GetAnnotations()
-	if annotations == nil {
+func provisionedByGcpBigtable(pvc *corev1.PersistentVolumeClaim) bool {
+	provisionedBy, ok := getPVCProvisioner(pvc)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
 		return false
 	}
 
-	provisionedBy, ok := getProvisionedBy(annotations)
+	if provisionedBy == GCP_BIGTABLE_CSI {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_BIGTABLE_CSI + " volume")
+		return true
+	}
+	return false
+}
+
+func provisionedByGcpFilestore(pvc *corev1.PersistentVolumeClaim) bool {
+	provisionedBy, ok := getPVCProvisioner(pvc)
 	if !ok {
 		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
 		return false
 	}
 
-	if provisionedBy == AWS_FSX_CSI {
-		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_FSX_CSI + " volume")
+	if provisionedBy == GCP_FILESTORE_CSI {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_FILESTORE_CSI + " volume")
 		return true
 	}
 	return false
 }
 
-func provisionedByGcpPD(pvc *corev1.PersistentVolumeClaim) bool {
-	annotations := pvc.GetAnnotations()
-	if annotations == nil {
+func provisionedByAzureDisk(pvc *corev1.PersistentVolumeClaim) bool {
+	provisionedBy, ok := getPVCProvisioner(pvc)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
 		return false
 	}
 
-	provisionedBy, ok := getProvisionedBy(annotations)
+	switch provisionedBy {
+	case AZURE_DISK_LEGACY:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AZURE_DISK_LEGACY + " volume")
+		return true
+	case AZURE_DISK_CSI:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AZURE_DISK_CSI + " volume")
+		return true
+	}
+	return false
+}
+
+func provisionedByAzureFile(pvc *corev1.PersistentVolumeClaim) bool {
+	provisionedBy, ok := getPVCProvisioner(pvc)
 	if !ok {
 		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
 		return false
 	}
 
-	switch provisionedBy {
-	case GCP_PD_LEGACY:
-		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_PD_LEGACY + " volume")
-		return true
-	case GCP_PD_CSI:
-		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_PD_CSI + " volume")
+	if provisionedBy == AZURE_FILE_CSI {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AZURE_FILE_CSI + " volume")
 		return true
 	}
 	return false
 }
 
-func processPersistentVolumeClaim(pvc *corev1.PersistentVolumeClaim) (string, map[string]string, error) {
-	tags := buildTags(pvc)
+// processPersistentVolumeClaim returns the volume ID and tags of the PVC,
+// along with the errors of building the tags
+func processPersistentVolumeClaim(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (string, map[string]string, []error, error) {
+	tags, tagErrs := buildTagsFromSources(ctx, pvc, getTagSources(ctx, pvc))
 
-	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "tags": tags}).Debugln("PVC Tags")
+	log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "tags": tags}).Debugln("PVC Tags")
 
-	pv, err := k8sClient.CoreV1().PersistentVolumes().Get(context.TODO(), pvc.Spec.VolumeName, metav1.GetOptions{})
+	pv, err := getBoundPV(ctx, pvc)
 	if err != nil {
-		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Get PV from kubernetes cluster error:", err)
-		return "", nil, err
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Get PV from kubernetes cluster error:", err)
+		return "", nil, nil, err
 	}
 
 	var volumeID string
-	annotations := pvc.GetAnnotations()
-	if annotations == nil {
-		log.Errorf("cannot get PVC annotations")
-		return "", nil, errors.New("cannot get PVC annotations")
-	}
-
-	provisionedBy, ok := getProvisionedBy(annotations)
+	provisionedBy, ok := getProvisioner(pvc, pv)
 	if !ok {
-		log.Errorf("cannot get volume.kubernetes.io/storage-provisioner annotation")
-		return "", nil, errors.New("cannot get volume.kubernetes.io/storage-provisioner annotation")
+		log.WithContext(ctx).Errorf("cannot get " + pvProvisionedByAnnotation + " or volume.kubernetes.io/storage-provisioner annotation")
+		return "", nil, nil, errors.New("cannot get " + pvProvisionedByAnnotation + " or volume.kubernetes.io/storage-provisioner annotation")
 	}
 
 	switch provisionedBy {
@@ -562,15 +2038,319 @@ func processPersistentVolumeClaim(pvc *corev1.PersistentVolumeClaim) (string, ma
 		volumeID = pv.Spec.GCEPersistentDisk.PDName
 	case GCP_PD_CSI:
 		volumeID = pv.Spec.CSI.VolumeHandle
+	case GCP_BIGTABLE_CSI, GCP_FILESTORE_CSI:
+		if pv.Spec.CSI != nil {
+			volumeID = pv.Spec.CSI.VolumeHandle
+		}
+	case AZURE_DISK_CSI:
+		if pv.Spec.CSI != nil {
+			volumeID = pv.Spec.CSI.VolumeHandle
+		} else if pv.Spec.AzureDisk != nil {
+			volumeID = pv.Spec.AzureDisk.DataDiskURI
+		}
+	case AZURE_DISK_LEGACY:
+		if pv.Spec.AzureDisk != nil {
+			volumeID = pv.Spec.AzureDisk.DataDiskURI
+		}
+	case AZURE_FILE_CSI:
+		if pv.Spec.CSI != nil {
+			volumeID = pv.Spec.CSI.VolumeHandle
+		}
 	}
 
-	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("parsed volumeID:", volumeID)
+	log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("parsed volumeID:", volumeID)
 	if len(volumeID) == 0 {
-		log.Errorf("Cannot parse VolumeID")
-		return "", nil, errors.New("cannot parse VolumeID")
+		log.WithContext(ctx).Errorf("Cannot parse VolumeID")
+		return "", nil, nil, errors.New("cannot parse VolumeID")
+	}
+	tags = withAzureZoneTag(ctx, pv, provisionedBy, tags)
+
+	return volumeID, tags, tagErrs, nil
+}
+
+// skipForDryRun reports whether the change to a cloud resource must be skipped
+// because of --dry-run. Skipped changes are logged and counted with the
+// dry-run status instead.
+func skipForDryRun(action, resource string, labels any, storageclass string) bool {
+	if !dryRun {
+		return false
+	}
+	log.WithFields(log.Fields{"resource": resource, "labels": labels, "storageclass": storageclass}).Infof("dry-run: would %s", action)
+	promActionsTotal.With(prometheus.Labels{"status": "dry-run", "storageclass": storageclass}).Inc()
+	return true
+}
+
+// sanitizedKeysAnnotation holds the json map of the PVC's tag keys to the
+// cloud label keys they were sanitized to, see --pvc-annotation-sync-back
+const sanitizedKeysAnnotation = "pvc-tagger.planetscale.com/sanitized-keys"
+
+// syncBackSanitizedKeys records on the PVC which cloud label key each of its
+// tag keys was sanitized to. Tag keys that are unchanged by sanitization are
+// left out.
+func syncBackSanitizedKeys(ctx context.Context, pvc *corev1.PersistentVolumeClaim, tags map[string]string) {
+	if !pvcAnnotationSyncBack || dryRun {
+		return
+	}
+
+	sanitizedKeys := map[string]string{}
+	for k := range tags {
+		if sanitizedKey := sanitizeKeyForGCP(k); sanitizedKey != k {
+			sanitizedKeys[k] = sanitizedKey
+		}
+	}
+	if len(sanitizedKeys) == 0 {
+		return
+	}
+
+	value, err := json.Marshal(sanitizedKeys)
+	if err != nil {
+		log.WithContext(ctx).Errorln("Failed to marshal sanitized keys:", err)
+		return
+	}
+	patchPVCAnnotation(ctx, pvc, sanitizedKeysAnnotation, string(value))
+}
+
+// labelFingerprintAnnotation holds a hash of the tags last synced to the
+// volume of the PVC, see --label-fingerprint
+const labelFingerprintAnnotation = "pvc-tagger.planetscale.com/label-fingerprint"
+
+// tagsFingerprint returns a hash of the tags of a volume
+func tagsFingerprint(volumeID string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", cloud, volumeID)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q=%q\n", k, tags[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// labelsAlreadySynced reports whether the PVC's label fingerprint shows that
+// tags were the last tags synced to the volume, so the cloud API isn't called
+func labelsAlreadySynced(pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string) bool {
+	if !labelFingerprint || dryRun {
+		return false
+	}
+	if pvc.GetAnnotations()[labelFingerprintAnnotation] != tagsFingerprint(volumeID, tags) {
+		return false
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Label fingerprint is unchanged, skipping cloud API calls")
+	return true
+}
+
+// writeLabelFingerprint stores the fingerprint of the tags synced to the
+// volume on the PVC
+func writeLabelFingerprint(ctx context.Context, pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string) {
+	if !labelFingerprint || dryRun {
+		return
+	}
+	patchPVCAnnotation(ctx, pvc, labelFingerprintAnnotation, tagsFingerprint(volumeID, tags))
+}
+
+// managedLabelKeysAnnotation holds a JSON array of the keys, before
+// sanitization, of the tags last synced to the volume of the PVC, see
+// --managed-label-keys and --delete-removed-labels
+const managedLabelKeysAnnotation = "pvc-tagger.planetscale.com/managed-label-keys"
+
+// getManagedLabelKeys returns the keys of the PVC's managed-label-keys
+// annotation
+func getManagedLabelKeys(pvc *corev1.PersistentVolumeClaim) []string {
+	value, ok := pvc.GetAnnotations()[managedLabelKeysAnnotation]
+	if !ok {
+		return nil
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(value), &keys); err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Ignoring invalid", managedLabelKeysAnnotation, "annotation:", err)
+		return nil
+	}
+	return keys
+}
+
+// withManagedLabelKeys returns a buildOldTags function for syncUpdatedTags
+// that adds the PVC's managed label keys to the tags built by buildOldTags,
+// so that the tags the tagger set but the PVC no longer has are deleted even
+// when they were removed before the tagger saw the old version of the PVC.
+// Tags set externally are never in the annotation and so are kept.
+func withManagedLabelKeys(pvc *corev1.PersistentVolumeClaim, buildOldTags func() map[string]string) func() map[string]string {
+	return func() map[string]string {
+		oldTags := buildOldTags()
+		if oldTags == nil {
+			oldTags = map[string]string{}
+		}
+		for _, k := range getManagedLabelKeys(pvc) {
+			if _, ok := oldTags[k]; !ok {
+				oldTags[k] = ""
+			}
+		}
+		return oldTags
+	}
+}
+
+// writeManagedLabelKeys stores the keys of the tags synced to the volume on
+// the PVC, with --managed-label-keys or --delete-removed-labels
+func writeManagedLabelKeys(ctx context.Context, pvc *corev1.PersistentVolumeClaim, tags map[string]string) {
+	if (!managedLabelKeys && !deleteRemovedLabels) || dryRun {
+		return
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	value, err := json.Marshal(keys)
+	if err != nil {
+		log.WithContext(ctx).Errorln("Failed to marshal managed label keys:", err)
+		return
+	}
+	patchPVCAnnotation(ctx, pvc, managedLabelKeysAnnotation, string(value))
+}
+
+// patchPVCAnnotation sets an annotation on the PVC unless it already has
+// the value
+func patchPVCAnnotation(ctx context.Context, pvc *corev1.PersistentVolumeClaim, annotation, value string) {
+	patchPVCAnnotations(ctx, pvc, map[string]string{annotation: value})
+}
+
+// patchPVCAnnotations sets the annotations on the PVC with a single merge
+// patch unless it already has all their values
+func patchPVCAnnotations(ctx context.Context, pvc *corev1.PersistentVolumeClaim, annotations map[string]string) {
+	changed := false
+	for k, v := range annotations {
+		if current, ok := pvc.GetAnnotations()[k]; !ok || current != v {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	var err error
+	if serverSideApply {
+		err = applyPVCAnnotations(ctx, pvc, annotations)
+	} else {
+		err = mergePatchPVCAnnotations(ctx, pvc, annotations)
+	}
+	if err != nil {
+		keys := make([]string, 0, len(annotations))
+		for k := range annotations {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Failed to write", strings.Join(keys, ", "), "annotations:", err)
+	}
+}
+
+// mergePatchPVCAnnotations sets the annotations on the PVC with a merge patch
+func mergePatchPVCAnnotations(ctx context.Context, pvc *corev1.PersistentVolumeClaim, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if watchPVOnly {
+		_, err = k8sClient.CoreV1().PersistentVolumes().Patch(ctx, pvc.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	}
+	_, err = k8sClient.CoreV1().PersistentVolumeClaims(pvc.GetNamespace()).Patch(ctx, pvc.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// fieldManager is the field manager of the PVC annotations written with
+// --server-side-apply
+const fieldManager = "pvc-tagger"
+
+// taggerAnnotations returns the PVC annotations written by the tagger
+func taggerAnnotations() []string {
+	return []string{sanitizedKeysAnnotation, labelFingerprintAnnotation, managedLabelKeysAnnotation, lastSyncTimeAnnotation, lastSyncErrorAnnotation}
+}
+
+// applyPVCAnnotations sets the annotations on the PVC with server-side apply.
+// The apply configuration only holds the tagger's annotations, but all of
+// them, as the ones left out would be removed, so the PVC is read first. With
+// --watch-pv-only the annotations are applied to the PV.
+func applyPVCAnnotations(ctx context.Context, pvc *corev1.PersistentVolumeClaim, annotations map[string]string) error {
+	if watchPVOnly {
+		pvs := k8sClient.CoreV1().PersistentVolumes()
+		current, err := pvs.Get(ctx, pvc.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		_, err = pvs.Apply(ctx, corev1ac.PersistentVolume(pvc.GetName()).WithAnnotations(ownedAnnotations(current, annotations)), metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+		return err
+	}
+	pvcs := k8sClient.CoreV1().PersistentVolumeClaims(pvc.GetNamespace())
+	current, err := pvcs.Get(ctx, pvc.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = pvcs.Apply(ctx, corev1ac.PersistentVolumeClaim(pvc.GetName(), pvc.GetNamespace()).WithAnnotations(ownedAnnotations(current, annotations)), metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	return err
+}
+
+// ownedAnnotations returns the tagger's annotations the object has, updated
+// with annotations
+func ownedAnnotations(current metav1.Object, annotations map[string]string) map[string]string {
+	owned := map[string]string{}
+	for _, k := range taggerAnnotations() {
+		if v, ok := current.GetAnnotations()[k]; ok {
+			owned[k] = v
+		}
+	}
+	maps.Copy(owned, annotations)
+	return owned
+}
+
+const (
+	// lastSyncTimeAnnotation holds the RFC3339 time of the last attempt to
+	// sync the tags of the PVC to its volume, see --sync-status-annotations
+	lastSyncTimeAnnotation = "pvc-tagger.planetscale.com/last-sync-time"
+	// lastSyncErrorAnnotation holds the error of the last attempt, or is
+	// empty when it succeeded
+	lastSyncErrorAnnotation = "pvc-tagger.planetscale.com/last-sync-error"
+)
+
+// writeSyncStatus stores the time and error of the attempt to sync the tags
+// of the PVC on the PVC
+func writeSyncStatus(ctx context.Context, pvc *corev1.PersistentVolumeClaim, err error) {
+	if !syncStatusAnnotations || dryRun {
+		return
 	}
+	syncError := ""
+	if err != nil {
+		syncError = err.Error()
+	}
+	patchPVCAnnotations(ctx, pvc, map[string]string{
+		lastSyncTimeAnnotation:  clock.Now().UTC().Format(time.RFC3339),
+		lastSyncErrorAnnotation: syncError,
+	})
+}
 
-	return volumeID, tags, nil
+// onlySyncStatusChanged reports whether the only change between the two
+// versions of a PVC is to its sync status annotations, i.e. the update was
+// made by writeSyncStatus and must not be reconciled again
+func onlySyncStatusChanged(oldPVC, newPVC *corev1.PersistentVolumeClaim) bool {
+	withoutStatus := func(pvc *corev1.PersistentVolumeClaim) map[string]string {
+		annotations := maps.Clone(pvc.GetAnnotations())
+		delete(annotations, lastSyncTimeAnnotation)
+		delete(annotations, lastSyncErrorAnnotation)
+		return annotations
+	}
+	return maps.Equal(withoutStatus(oldPVC), withoutStatus(newPVC)) &&
+		maps.Equal(oldPVC.GetLabels(), newPVC.GetLabels()) &&
+		reflect.DeepEqual(oldPVC.Spec, newPVC.Spec) &&
+		reflect.DeepEqual(oldPVC.Status, newPVC.Status) &&
+		oldPVC.GetDeletionTimestamp().Equal(newPVC.GetDeletionTimestamp()) &&
+		reflect.DeepEqual(oldPVC.GetOwnerReferences(), newPVC.GetOwnerReferences())
 }
 
 func getCurrentNamespace() string {
@@ -594,6 +2374,250 @@ func getProvisionedBy(annotations map[string]string) (string, bool) {
 	return provisionedBy, ok
 }
 
+// copyLabelsToTags copies the labels selected by --copy-labels to tags,
+// skipping restricted tag names unless allowAllTags is set
+func copyLabelsToTags(pvc *corev1.PersistentVolumeClaim, labels map[string]string, tags map[string]string) {
+	for k, v := range labels {
+		if copyLabels[0] == "*" || slices.Contains(copyLabels, k) {
+			if labelKeyFiltered(pvc, k) {
+				continue
+			}
+			if !isValidTagName(k) {
+				if !allowAllTags {
+					log.Warnln(k, "is a restricted tag. Skipping...")
+					promInvalidTagsTotal.With(prometheus.Labels{"storageclass": *pvc.Spec.StorageClassName}).Inc()
+					promInvalidTagsLegacyTotal.Inc()
+					continue
+				} else {
+					log.Warnln(k, "is a restricted tag but still allowing it to be set...")
+				}
+			}
+			tags[k] = v
+		}
+	}
+}
+
+// copyPrefixedLabelsToTags copies the PVC labels with the --pvc-label-prefix
+// to tags, with the prefix removed from their keys. Other PVC labels are not
+// copied, whatever --copy-labels and --label-prefix-allowlist are.
+func copyPrefixedLabelsToTags(pvc *corev1.PersistentVolumeClaim, tags map[string]string) {
+	for k, v := range pvc.GetLabels() {
+		key, ok := strings.CutPrefix(k, pvcLabelPrefix)
+		if !ok || key == "" {
+			continue
+		}
+		if slices.Contains(labelKeyDenylist, k) {
+			log.Debugln(k, "is in --label-key-denylist. Skipping...")
+			countSkippedLabels(labelsSkippedDenylist, pvcStorageClass(pvc), 1)
+			continue
+		}
+		if !isValidTagName(key) {
+			if !allowAllTags {
+				log.Warnln(key, "is a restricted tag. Skipping...")
+				promInvalidTagsTotal.With(prometheus.Labels{"storageclass": pvcStorageClass(pvc)}).Inc()
+				promInvalidTagsLegacyTotal.Inc()
+				continue
+			}
+			log.Warnln(key, "is a restricted tag but still allowing it to be set...")
+		}
+		tags[key] = v
+	}
+}
+
+// labelKeyFiltered reports whether the label key is in --label-key-denylist
+// or doesn't match --label-prefix-allowlist, and counts it in
+// promLabelsSkipped if so. It applies to every label copied from Kubernetes
+// objects, whatever object the label comes from.
+func labelKeyFiltered(pvc *corev1.PersistentVolumeClaim, key string) bool {
+	if slices.Contains(labelKeyDenylist, key) {
+		log.Debugln(key, "is in --label-key-denylist. Skipping...")
+		countSkippedLabels(labelsSkippedDenylist, pvcStorageClass(pvc), 1)
+		return true
+	}
+	if !hasAllowedLabelPrefix(key) {
+		log.Debugln(key, "does not match --label-prefix-allowlist. Skipping...")
+		countSkippedLabels(labelsSkippedNoAllowlistMatch, pvcStorageClass(pvc), 1)
+		return true
+	}
+	return false
+}
+
+// hasAllowedLabelPrefix reports whether the label key starts with one of
+// the prefixes in labelPrefixAllowlist. An empty allowlist allows every key.
+func hasAllowedLabelPrefix(key string) bool {
+	if len(labelPrefixAllowlist) == 0 {
+		return true
+	}
+	for _, prefix := range labelPrefixAllowlist {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getNamespaceLabels returns the labels listed in --inherit-namespace-labels
+// that are set on the PVC's namespace. The Namespace informer cache is used
+// when it is available, otherwise the namespace is fetched from the API server.
+func getNamespaceLabels(ctx context.Context, pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if len(inheritNSLabels) == 0 {
+		return nil
+	}
+	if nsLister != nil {
+		if ns, err := nsLister.Get(pvc.GetNamespace()); err == nil {
+			return inheritedNamespaceLabels(ns)
+		}
+	}
+	ns, err := k8sClient.CoreV1().Namespaces().Get(ctx, pvc.GetNamespace(), metav1.GetOptions{})
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Unable to get Namespace labels:", err)
+		return nil
+	}
+	return inheritedNamespaceLabels(ns)
+}
+
+// getPVLabels returns the labels of the PV bound to the PVC when
+// --sync-pv-labels is set
+func getPVLabels(ctx context.Context, pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if !syncPVLabels || pvc.Spec.VolumeName == "" {
+		return nil
+	}
+	pv, err := getBoundPV(ctx, pvc)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Unable to get PersistentVolume labels:", err)
+		return nil
+	}
+	return pv.GetLabels()
+}
+
+// getNodeLabels returns the labels listed in --include-node-label-keys of
+// the node the PVC's volume was provisioned for. PVs have no node, so it is
+// read from the volume.kubernetes.io/selected-node annotation the scheduler
+// sets on the PVCs of WaitForFirstConsumer StorageClasses.
+func getNodeLabels(ctx context.Context, pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if len(inheritNodeLabels) == 0 {
+		return nil
+	}
+	nodeName := pvc.GetAnnotations()[selectedNodeAnnotation]
+	if nodeName == "" {
+		return nil
+	}
+	if nodeLister != nil {
+		if node, err := nodeLister.Get(nodeName); err == nil {
+			return inheritedNodeLabels(node)
+		}
+	}
+	node, err := k8sClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "node": nodeName}).Warnln("Unable to get Node labels:", err)
+		return nil
+	}
+	return inheritedNodeLabels(node)
+}
+
+// inheritedNodeLabels returns the labels of the node listed in
+// --include-node-label-keys
+func inheritedNodeLabels(node *corev1.Node) map[string]string {
+	inherited := map[string]string{}
+	for _, k := range inheritNodeLabels {
+		if v, ok := node.GetLabels()[k]; ok {
+			inherited[k] = v
+		}
+	}
+	return inherited
+}
+
+// inheritedNamespaceLabels returns the labels of the namespace listed in
+// --inherit-namespace-labels
+func inheritedNamespaceLabels(ns *corev1.Namespace) map[string]string {
+	inherited := map[string]string{}
+	for _, k := range inheritNSLabels {
+		if v, ok := ns.GetLabels()[k]; ok {
+			inherited[k] = v
+		}
+	}
+	return inherited
+}
+
+// getStorageClassLabels returns the labels of the PVC's StorageClass merged
+// with those of its ancestors, following the storageclass.kubernetes.io/parent
+// annotation up to storageClassLabelDepth levels. A child's labels win over
+// its parent's.
+func getStorageClassLabels(ctx context.Context, pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if storageClassLabelDepth < 1 || pvc.Spec.StorageClassName == nil {
+		return nil
+	}
+	var chain []*storagev1.StorageClass
+	seen := map[string]bool{}
+	name := *pvc.Spec.StorageClassName
+	for len(chain) < storageClassLabelDepth && name != "" && !seen[name] {
+		seen[name] = true
+		sc, err := getStorageClass(ctx, name)
+		if err != nil {
+			log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "storageclass": name}).Warnln("Unable to get StorageClass labels:", err)
+			break
+		}
+		chain = append(chain, sc)
+		name = sc.GetAnnotations()[storageClassParentAnnotation]
+	}
+
+	labels := map[string]string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		maps.Copy(labels, chain[i].GetLabels())
+	}
+	return labels
+}
+
+// getStorageClass returns the named StorageClass from the informer cache when
+// it is available, otherwise from the API server
+func getStorageClass(ctx context.Context, name string) (*storagev1.StorageClass, error) {
+	if scLister != nil {
+		if sc, err := scLister.Get(name); err == nil {
+			return sc, nil
+		}
+	}
+	return k8sClient.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+}
+
+// getBoundPV returns the PV bound to the PVC. The PV informer cache is used
+// when it is available, otherwise the PV is fetched from the API server.
+func getBoundPV(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (*corev1.PersistentVolume, error) {
+	if pvLister != nil {
+		if pv, err := pvLister.Get(pvc.Spec.VolumeName); err == nil {
+			return pv, nil
+		}
+	}
+	return k8sClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+}
+
+// getProvisioner returns the provisioner of the volume. The PV's
+// provisioned-by annotation is preferred because the StorageClass may have
+// been deleted since the volume was provisioned. It falls back to the
+// StorageClass provisioner recorded in the PVC's storage-provisioner annotation.
+func getProvisioner(pvc *corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume) (string, bool) {
+	if pv != nil {
+		if provisionedBy := pv.GetAnnotations()[pvProvisionedByAnnotation]; provisionedBy != "" {
+			return provisionedBy, true
+		}
+	}
+	return getProvisionedBy(pvc.GetAnnotations())
+}
+
+// getPVCProvisioner looks up the PVC's bound PV in the informer cache and
+// returns the provisioner of the volume
+func getPVCProvisioner(pvc *corev1.PersistentVolumeClaim) (string, bool) {
+	var pv *corev1.PersistentVolume
+	if pvLister != nil && pvc.Spec.VolumeName != "" {
+		var err error
+		pv, err = pvLister.Get(pvc.Spec.VolumeName)
+		if err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("bound PV not found in cache:", err)
+			pv = nil
+		}
+	}
+	return getProvisioner(pvc, pv)
+}
+
 func getPVC(obj interface{}) *corev1.PersistentVolumeClaim {
 	pvc := obj.(*corev1.PersistentVolumeClaim)
 
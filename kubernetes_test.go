@@ -19,12 +19,46 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	clocks "k8s.io/utils/clock"
+	testingclock "k8s.io/utils/clock/testing"
+	"k8s.io/utils/ptr"
 )
 
 var dummyStorageClassName string = "fakeName"
@@ -81,6 +115,11 @@ func Test_parseAWSEFSVolumeID(t *testing.T) {
 			k8sVolumeID: "fs-05b82f747004ac501::fsap-06cc098e562d24942",
 			want:        "fsap-06cc098e562d24942",
 		},
+		{
+			name:        "AWS-EFS.VolumeID with subpath",
+			k8sVolumeID: "fs-05b82f747004ac501:/data:fsap-06cc098e562d24942",
+			want:        "fsap-06cc098e562d24942",
+		},
 		{
 			name:        "invalid AWS-EFS.VolumeID",
 			k8sVolumeID: "fsp-05b82f747004ac501::fsap-06cc098e562d24942",
@@ -347,6 +386,93 @@ func Test_provisionedByGcpPD(t *testing.T) {
 	}
 }
 
+func Test_getPVCProvisioner(t *testing.T) {
+	tests := []struct {
+		name            string
+		pvcAnnotations  map[string]string
+		pv              *corev1.PersistentVolume
+		wantProvisioner string
+		wantOk          bool
+		wantGcpPD       bool
+		wantAwsEbs      bool
+	}{
+		{
+			name:           "PV annotation routes to GCP",
+			pvcAnnotations: map[string]string{"volume.kubernetes.io/storage-provisioner": AWS_EBS_CSI},
+			pv: &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+				Name:        "pvc-1234",
+				Annotations: map[string]string{pvProvisionedByAnnotation: GCP_PD_CSI},
+			}},
+			wantProvisioner: GCP_PD_CSI,
+			wantOk:          true,
+			wantGcpPD:       true,
+		},
+		{
+			name:           "PV annotation without StorageClass provisioner",
+			pvcAnnotations: nil,
+			pv: &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+				Name:        "pvc-1234",
+				Annotations: map[string]string{pvProvisionedByAnnotation: AWS_EBS_CSI},
+			}},
+			wantProvisioner: AWS_EBS_CSI,
+			wantOk:          true,
+			wantAwsEbs:      true,
+		},
+		{
+			name:           "StorageClass provisioner fallback",
+			pvcAnnotations: map[string]string{"volume.kubernetes.io/storage-provisioner": AWS_EBS_CSI},
+			pv: &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+				Name: "pvc-1234",
+			}},
+			wantProvisioner: AWS_EBS_CSI,
+			wantOk:          true,
+			wantAwsEbs:      true,
+		},
+		{
+			name:            "absent PV",
+			pvcAnnotations:  map[string]string{"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI},
+			pv:              nil,
+			wantProvisioner: GCP_PD_CSI,
+			wantOk:          true,
+			wantGcpPD:       true,
+		},
+		{
+			name:           "absent PV and no annotation",
+			pvcAnnotations: nil,
+			pv:             nil,
+			wantOk:         false,
+		},
+	}
+	defer func() { pvLister = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if tt.pv != nil {
+				if err := indexer.Add(tt.pv); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pvLister = corelisters.NewPersistentVolumeLister(indexer)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetAnnotations(tt.pvcAnnotations)
+			pvc.Spec.VolumeName = "pvc-1234"
+
+			provisioner, ok := getPVCProvisioner(pvc)
+			if provisioner != tt.wantProvisioner || ok != tt.wantOk {
+				t.Errorf("getPVCProvisioner() = %v, %v, want %v, %v", provisioner, ok, tt.wantProvisioner, tt.wantOk)
+			}
+			if got := provisionedByGcpPD(pvc); got != tt.wantGcpPD {
+				t.Errorf("provisionedByGcpPD() = %v, want %v", got, tt.wantGcpPD)
+			}
+			if got := provisionedByAwsEbs(pvc); got != tt.wantAwsEbs {
+				t.Errorf("provisionedByAwsEbs() = %v, want %v", got, tt.wantAwsEbs)
+			}
+		})
+	}
+}
+
 func Test_buildTags(t *testing.T) {
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName("my-pvc")
@@ -668,7 +794,7 @@ func Test_buildTags(t *testing.T) {
 			if tt.copyLabels != nil {
 				copyLabels = tt.copyLabels
 			}
-			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("buildTags() = %v, want %v", got, tt.want)
 			}
 			tagFormat = "json"
@@ -677,472 +803,3829 @@ func Test_buildTags(t *testing.T) {
 	}
 }
 
-func Test_annotationPrefix(t *testing.T) {
-	pvc := &corev1.PersistentVolumeClaim{}
-	pvc.SetName("my-pvc")
-	defaultAnnotationPrefix := annotationPrefix
-	pvc.Spec.StorageClassName = &dummyStorageClassName
+func Test_promLabelsSkipped(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { labelKeyDenylist = old }(labelKeyDenylist)
+	defer func(old []string) { labelPrefixAllowlist = old }(labelPrefixAllowlist)
+	cloud = GCP
+	copyLabels = []string{"*"}
+	storageclass := "labels-skipped"
 
 	tests := []struct {
-		name             string
-		annotationPrefix string
-		defaultTags      map[string]string
-		annotations      map[string]string
-		want             map[string]string
+		name        string
+		denylist    []string
+		allowlist   []string
+		labels      map[string]string
+		tags        string
+		wantTags    map[string]string
+		wantSkipped map[string]float64
 	}{
 		{
-			name:             "annotationPrefix with proper ignore",
-			annotationPrefix: "something-else",
-			defaultTags:      map[string]string{"foo": "bar"},
-			annotations:      map[string]string{"something-else/ignore": ""},
-			want:             map[string]string{},
-		},
-		{
-			name:             "annotationPrefix with different ignore legacy",
-			annotationPrefix: "something-else",
-			defaultTags:      map[string]string{"foo": "bar"},
-			annotations:      map[string]string{"aws-ebs-tagger/ignore": ""},
-			want:             map[string]string{"foo": "bar"},
-		},
-		{
-			name:             "annotationPrefix with different ignore",
-			annotationPrefix: "something-else",
-			defaultTags:      map[string]string{"foo": "bar"},
-			annotations:      map[string]string{"k8s-pvc-tagger/ignore": ""},
-			want:             map[string]string{"foo": "bar"},
+			name:        "denylist",
+			denylist:    []string{"secret", "internal"},
+			labels:      map[string]string{"team": "db", "secret": "x", "internal": "y"},
+			wantTags:    map[string]string{"team": "db"},
+			wantSkipped: map[string]float64{labelsSkippedDenylist: 2},
 		},
 		{
-			name:             "annotationPrefix with default and custom tags",
-			annotationPrefix: "something-else",
-			defaultTags:      map[string]string{"foo": "bar"},
-			annotations:      map[string]string{"something-else/tags": "{\"something\": \"else\"}"},
-			want:             map[string]string{"foo": "bar", "something": "else"},
+			name:        "no allowlist match",
+			allowlist:   []string{"cost.acme.io/"},
+			labels:      map[string]string{"cost.acme.io/center": "abc", "team": "db"},
+			wantTags:    map[string]string{"cost.acme.io/center": "abc"},
+			wantSkipped: map[string]float64{labelsSkippedNoAllowlistMatch: 1},
 		},
 		{
-			name:             "annotationPrefix with default and different custom tags legacy",
-			annotationPrefix: "something-else",
-			defaultTags:      map[string]string{"foo": "bar"},
-			annotations:      map[string]string{"aws-ebs-tagger/tags": "{\"something\": \"else\"}"},
-			want:             map[string]string{"foo": "bar"},
+			name:        "empty after sanitization",
+			labels:      map[string]string{"team": "db"},
+			tags:        `{"": "empty", "owner": "me"}`,
+			wantTags:    map[string]string{"team": "db", "owner": "me"},
+			wantSkipped: map[string]float64{labelsSkippedEmptyKey: 1},
 		},
 		{
-			name:             "annotationPrefix with default and different custom tags",
-			annotationPrefix: "something-else",
-			defaultTags:      map[string]string{"foo": "bar"},
-			annotations:      map[string]string{"k8s-pvc-tagger/tags": "{\"something\": \"else\"}"},
-			want:             map[string]string{"foo": "bar"},
+			name:     "nothing skipped",
+			labels:   map[string]string{"team": "db"},
+			wantTags: map[string]string{"team": "db"},
 		},
 	}
+	reasons := []string{labelsSkippedEmptyKey, labelsSkippedDenylist, labelsSkippedNoAllowlistMatch}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			pvc.SetAnnotations(tt.annotations)
-			annotationPrefix = tt.annotationPrefix
-			defaultTags = tt.defaultTags
-			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			labelKeyDenylist = tt.denylist
+			labelPrefixAllowlist = tt.allowlist
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default", Labels: tt.labels},
+				Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &storageclass},
+			}
+			if tt.tags != "" {
+				pvc.SetAnnotations(map[string]string{annotationPrefix + "/tags": tt.tags})
+			}
+			before := map[string]float64{}
+			for _, reason := range reasons {
+				before[reason] = testutil.ToFloat64(promLabelsSkipped.WithLabelValues(reason, GCP, storageclass))
+			}
+
+			got, _ := buildTagsFromSources(context.Background(), pvc, tagSources{})
+			if !maps.Equal(got, tt.wantTags) {
+				t.Errorf("buildTagsFromSources() = %v, want %v", got, tt.wantTags)
+			}
+			for _, reason := range reasons {
+				if got := testutil.ToFloat64(promLabelsSkipped.WithLabelValues(reason, GCP, storageclass)) - before[reason]; got != tt.wantSkipped[reason] {
+					t.Errorf("promLabelsSkipped{reason=%q} increased by %v, want %v", reason, got, tt.wantSkipped[reason])
+				}
 			}
-			annotationPrefix = defaultAnnotationPrefix
-			defaultTags = map[string]string{}
 		})
 	}
 }
 
-func Test_processEBSPersistentVolumeClaim(t *testing.T) {
-	volumeName := "pvc-1234"
+func Test_buildTagsLabelPrefixAllowlist(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { labelPrefixAllowlist = old }(labelPrefixAllowlist)
+	copyLabels = []string{"*"}
+
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName("my-pvc")
-	pvc.Spec.VolumeName = volumeName
+	pvc.SetLabels(map[string]string{
+		"cost.acme.io/center": "abc",
+		"cost.acme.io":        "no-slash",
+		"environment":         "prod",
+		"env":                 "prod",
+		"team":                "platform",
+	})
+	pvc.SetAnnotations(map[string]string{annotationPrefix + "/tags": `{"owner": "me"}`})
 
 	tests := []struct {
-		name           string
-		provisionedBy  string
-		tagsAnnotation string
-		volumeID       string
-		volumeName     string
-		wantedTags     map[string]string
-		wantedVolumeID string
-		wantedErr      bool
+		name      string
+		allowlist []string
+		want      map[string]string
 	}{
 		{
-			name:           "csi with valid tags and volume id",
-			provisionedBy:  AWS_EBS_CSI,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			wantedTags:     map[string]string{"foo": "bar"},
-			wantedVolumeID: "vol-12345",
-			wantedErr:      false,
+			name:      "empty allowlist copies everything",
+			allowlist: []string{},
+			want: map[string]string{
+				"cost.acme.io/center": "abc",
+				"cost.acme.io":        "no-slash",
+				"environment":         "prod",
+				"env":                 "prod",
+				"team":                "platform",
+				"owner":               "me",
+			},
 		},
 		{
-			name:           "in-tree with valid tags and volume id",
-			provisionedBy:  AWS_EBS_LEGACY,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			volumeID:       "aws://us-east-1a/vol-12345",
-			wantedTags:     map[string]string{"foo": "bar"},
-			wantedVolumeID: "vol-12345",
-			wantedErr:      false,
+			name:      "prefix with slash",
+			allowlist: []string{"cost.acme.io/"},
+			want:      map[string]string{"cost.acme.io/center": "abc", "owner": "me"},
 		},
 		{
-			name:           "in-tree with valid tags and invalid volume id",
-			provisionedBy:  AWS_EBS_LEGACY,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			volumeID:       "aws://us-east-1a/abc123",
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:      "partial matches",
+			allowlist: []string{"env"},
+			want:      map[string]string{"environment": "prod", "env": "prod", "owner": "me"},
 		},
 		{
-			name:           "other with valid tags and volume id",
-			provisionedBy:  "foo",
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:      "multiple prefixes",
+			allowlist: []string{"cost.acme.io/", "team"},
+			want:      map[string]string{"cost.acme.io/center": "abc", "team": "platform", "owner": "me"},
 		},
 		{
-			name:           "in-tree with missing PV",
-			provisionedBy:  AWS_EBS_LEGACY,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     "asdf",
-			volumeID:       "aws://us-east-1a/vol-12345",
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:      "no matches",
+			allowlist: []string{"nothing/"},
+			want:      map[string]string{"owner": "me"},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			pvc.SetAnnotations(map[string]string{
-				annotationPrefix + "/tags":                 tt.tagsAnnotation,
-				"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
-			})
-
-			var pvSpec corev1.PersistentVolumeSpec
-			if tt.provisionedBy == AWS_EBS_CSI {
-				pvSpec = corev1.PersistentVolumeSpec{
-					StorageClassName: dummyStorageClassName,
-					PersistentVolumeSource: corev1.PersistentVolumeSource{
-						CSI: &corev1.CSIPersistentVolumeSource{
-							VolumeHandle: tt.wantedVolumeID,
-						},
-					},
-				}
-			} else {
-				pvSpec = corev1.PersistentVolumeSpec{
-					StorageClassName: dummyStorageClassName,
-					PersistentVolumeSource: corev1.PersistentVolumeSource{
-						AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{
-							VolumeID: tt.volumeID,
-						},
-					},
-				}
-			}
-			pv := &corev1.PersistentVolume{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:        tt.volumeName,
-					Annotations: map[string]string{},
-				},
-				Spec: pvSpec,
-			}
-			k8sClient = fake.NewSimpleClientset(pv)
-			volumeID, tags, err := processPersistentVolumeClaim(pvc)
-			if (err == nil) == tt.wantedErr {
-				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
-			}
-			if volumeID != tt.wantedVolumeID {
-				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
-			}
-			if !reflect.DeepEqual(tags, tt.wantedTags) {
-				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", tags, tt.wantedTags)
+			labelPrefixAllowlist = tt.allowlist
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_processEFSPersistentVolumeClaim(t *testing.T) {
-	volumeName := "pvc-1234"
+func Test_buildTagsPVCLabelPrefix(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old string) { pvcLabelPrefix = old }(pvcLabelPrefix)
+
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName("my-pvc")
-	pvc.Spec.VolumeName = volumeName
+	pvc.SetLabels(map[string]string{
+		"cloud-tag.example.com/team":        "platform",
+		"cloud-tag.example.com/cost-center": "abc",
+		"cloud-tag.example.com/":            "empty-key",
+		"cloud-tag.example.com":             "no-slash",
+		"app":                               "db",
+	})
+	pvc.SetAnnotations(map[string]string{annotationPrefix + "/tags": `{"owner": "me"}`})
 
 	tests := []struct {
-		name           string
-		provisionedBy  string
-		tagsAnnotation string
-		volumeID       string
-		volumeName     string
-		wantedTags     map[string]string
-		wantedVolumeID string
-		wantedErr      bool
+		name       string
+		prefix     string
+		copyLabels []string
+		want       map[string]string
 	}{
 		{
-			name:           "csi with valid tags and volume id",
-			provisionedBy:  AWS_EFS_CSI,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			volumeID:       "fs-05b82f74723423::fsap-06cc098e562d23425",
-			wantedTags:     map[string]string{"foo": "bar"},
-			wantedVolumeID: "fsap-06cc098e562d23425",
-			wantedErr:      false,
+			name:   "prefix is stripped",
+			prefix: "cloud-tag.example.com/",
+			want:   map[string]string{"team": "platform", "cost-center": "abc", "owner": "me"},
 		},
 		{
-			name:           "csi with valid tags and invalid volume id",
-			provisionedBy:  AWS_EFS_CSI,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			volumeID:       "asdf://us-east-1a/vol-12345",
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:       "other PVC labels are not copied",
+			prefix:     "cloud-tag.example.com/",
+			copyLabels: []string{"*"},
+			want:       map[string]string{"team": "platform", "cost-center": "abc", "owner": "me"},
 		},
 		{
-			name:           "other with valid tags and volume id",
-			provisionedBy:  "foo",
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:   "no matches",
+			prefix: "billing.example.com/",
+			want:   map[string]string{"owner": "me"},
 		},
 		{
-			name:           "csi with missing PV",
-			provisionedBy:  AWS_EFS_CSI,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     "asdf",
-			volumeID:       "fs-05b82f74723423::fsap-06cc098e562d23425",
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:       "empty prefix copies all labels",
+			copyLabels: []string{"*"},
+			want: map[string]string{
+				"cloud-tag.example.com/team":        "platform",
+				"cloud-tag.example.com/cost-center": "abc",
+				"cloud-tag.example.com/":            "empty-key",
+				"cloud-tag.example.com":             "no-slash",
+				"app":                               "db",
+				"owner":                             "me",
+			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			pvc.SetAnnotations(map[string]string{
-				annotationPrefix + "/tags":                 tt.tagsAnnotation,
-				"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
-			})
-
-			var pvSpec corev1.PersistentVolumeSpec
-			if tt.provisionedBy == AWS_EFS_CSI {
-				pvSpec = corev1.PersistentVolumeSpec{
-					PersistentVolumeSource: corev1.PersistentVolumeSource{
-						CSI: &corev1.CSIPersistentVolumeSource{
-							VolumeHandle: tt.volumeID,
-						},
-					},
-				}
-			}
-			pv := &corev1.PersistentVolume{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:        tt.volumeName,
-					Annotations: map[string]string{},
-				},
-				Spec: pvSpec,
-			}
-			k8sClient = fake.NewSimpleClientset(pv)
-			volumeID, tags, err := processPersistentVolumeClaim(pvc)
-			if (err == nil) == tt.wantedErr {
-				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
-			}
-			if volumeID != tt.wantedVolumeID {
-				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
-			}
-			if !reflect.DeepEqual(tags, tt.wantedTags) {
-				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", tags, tt.wantedTags)
+			pvcLabelPrefix, copyLabels = tt.prefix, tt.copyLabels
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
-	volumeName := "pvc-1234"
+func Test_buildTagsLabelKeyDenylist(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { labelPrefixAllowlist = old }(labelPrefixAllowlist)
+	defer func(old []string) { labelKeyDenylist = old }(labelKeyDenylist)
+	defer func(old bool) { allowAllTags = old }(allowAllTags)
+	copyLabels = []string{"*"}
+	allowAllTags = true
+
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName("my-pvc")
-	pvc.Spec.VolumeName = volumeName
+	pvc.SetLabels(map[string]string{
+		"kubernetes.io/pvc-name": "my-pvc",
+		"cost.acme.io/center":    "abc",
+		"cost.acme.io/owner":     "me",
+		"env":                    "prod",
+	})
 
 	tests := []struct {
-		name           string
-		provisionedBy  string
-		tagsAnnotation string
-		volumeID       string
-		volumeName     string
-		wantedTags     map[string]string
-		wantedVolumeID string
-		wantedErr      bool
+		name      string
+		allowlist []string
+		denylist  []string
+		want      map[string]string
 	}{
 		{
-			name:           "csi with valid tags and volume id",
-			provisionedBy:  GCP_PD_CSI,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			volumeID:       "projects/my-project/zones/us-east1-a/disks/my-disk",
-			wantedTags:     map[string]string{"foo": "bar"},
-			wantedVolumeID: "projects/my-project/zones/us-east1-a/disks/my-disk",
-			wantedErr:      false,
+			name:     "empty denylist copies everything",
+			denylist: []string{},
+			want: map[string]string{
+				"kubernetes.io/pvc-name": "my-pvc",
+				"cost.acme.io/center":    "abc",
+				"cost.acme.io/owner":     "me",
+				"env":                    "prod",
+			},
 		},
 		{
-			name:           "in-tree with valid tags and volume id",
-			provisionedBy:  GCP_PD_LEGACY,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			volumeID:       "projects/my-project/zones/us-east1-a/disks/my-disk",
-			wantedTags:     map[string]string{"foo": "bar"},
-			wantedVolumeID: "projects/my-project/zones/us-east1-a/disks/my-disk",
-			wantedErr:      false,
+			name:     "exact matches",
+			denylist: []string{"kubernetes.io/pvc-name", "env"},
+			want:     map[string]string{"cost.acme.io/center": "abc", "cost.acme.io/owner": "me"},
 		},
 		{
-			name:           "in-tree with valid tags and invalid volume id",
-			provisionedBy:  GCP_PD_LEGACY,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			volumeID:       "",
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:     "prefixes are not matched",
+			denylist: []string{"cost.acme.io/", "kubernetes.io"},
+			want: map[string]string{
+				"kubernetes.io/pvc-name": "my-pvc",
+				"cost.acme.io/center":    "abc",
+				"cost.acme.io/owner":     "me",
+				"env":                    "prod",
+			},
 		},
 		{
-			name:           "other with valid tags and volume id",
-			provisionedBy:  "foo",
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     volumeName,
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name:      "denylist wins over allowlist",
+			allowlist: []string{"cost.acme.io/"},
+			denylist:  []string{"cost.acme.io/owner"},
+			want:      map[string]string{"cost.acme.io/center": "abc"},
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labelPrefixAllowlist = tt.allowlist
+			labelKeyDenylist = tt.denylist
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildTagsInheritedLabelKeyFilters(t *testing.T) {
+	defer func(old []string) { labelPrefixAllowlist = old }(labelPrefixAllowlist)
+	defer func(old []string) { labelKeyDenylist = old }(labelKeyDenylist)
+	defer func(old []string) { annotationKeys = old }(annotationKeys)
+	annotationKeys = []string{"cost.acme.io/owner", "internal-annotation"}
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Name:        "my-pvc",
+		Namespace:   "default",
+		Annotations: map[string]string{"cost.acme.io/owner": "me", "internal-annotation": "x"},
+	}}
+	sources := tagSources{
+		namespace: map[string]string{"cost.acme.io/center": "abc", "internal-namespace": "x"},
+		node:      map[string]string{"cost.acme.io/pool": "gpu", "internal-node": "x"},
+	}
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		denylist  []string
+		want      map[string]string
+	}{
 		{
-			name:           "in-tree with missing PV",
-			provisionedBy:  GCP_PD_LEGACY,
-			tagsAnnotation: "{\"foo\": \"bar\"}",
-			volumeName:     "asdf",
-			volumeID:       "projects/my-project/zones/us-east1-a/disks/my-disk",
-			wantedTags:     nil,
-			wantedVolumeID: "",
-			wantedErr:      true,
+			name: "no filters",
+			want: map[string]string{
+				"cost.acme.io/center": "abc", "internal-namespace": "x",
+				"cost.acme.io/pool": "gpu", "internal-node": "x",
+				"cost.acme.io/owner": "me", "internal-annotation": "x",
+			},
+		},
+		{
+			name:     "denylisted keys are not inherited",
+			denylist: []string{"internal-namespace", "internal-node", "internal-annotation"},
+			want:     map[string]string{"cost.acme.io/center": "abc", "cost.acme.io/pool": "gpu", "cost.acme.io/owner": "me"},
+		},
+		{
+			name:      "keys not matching the allowlist are not inherited",
+			allowlist: []string{"cost.acme.io/"},
+			denylist:  []string{"cost.acme.io/pool"},
+			want:      map[string]string{"cost.acme.io/center": "abc", "cost.acme.io/owner": "me"},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			pvc.SetAnnotations(map[string]string{
-				annotationPrefix + "/tags":                 tt.tagsAnnotation,
-				"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
-			})
-
-			var pvSpec corev1.PersistentVolumeSpec
-			if tt.provisionedBy == GCP_PD_CSI {
-				pvSpec = corev1.PersistentVolumeSpec{
-					StorageClassName: dummyStorageClassName,
-					PersistentVolumeSource: corev1.PersistentVolumeSource{
-						CSI: &corev1.CSIPersistentVolumeSource{
-							VolumeHandle: tt.wantedVolumeID,
-						},
-					},
-				}
-			} else {
-				pvSpec = corev1.PersistentVolumeSpec{
-					StorageClassName: dummyStorageClassName,
-					PersistentVolumeSource: corev1.PersistentVolumeSource{
-						GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{
-							PDName: tt.volumeID,
-						},
-					},
-				}
-			}
-			pv := &corev1.PersistentVolume{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:        tt.volumeName,
-					Annotations: map[string]string{},
-				},
-				Spec: pvSpec,
-			}
-			k8sClient = fake.NewSimpleClientset(pv)
-			volumeID, tags, err := processPersistentVolumeClaim(pvc)
-			if (err == nil) == tt.wantedErr {
-				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
-			}
-			if volumeID != tt.wantedVolumeID {
-				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
+			labelPrefixAllowlist = tt.allowlist
+			labelKeyDenylist = tt.denylist
+			denied := promLabelsSkipped.With(prometheus.Labels{"reason": labelsSkippedDenylist, "cloud_provider": cloud, "storageclass": ""})
+			before := testutil.ToFloat64(denied)
+			if got, _ := buildTagsFromSources(context.Background(), pvc, sources); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTagsFromSources() = %v, want %v", got, tt.want)
 			}
-			if !reflect.DeepEqual(tags, tt.wantedTags) {
-				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", tags, tt.wantedTags)
+			if got, want := testutil.ToFloat64(denied)-before, float64(len(tt.denylist)); got != want {
+				t.Errorf("denylisted labels counted %v, want %v", got, want)
 			}
 		})
 	}
 }
 
-func Test_templatedTags(t *testing.T) {
+func Test_buildTagsAnnotationKeys(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { annotationKeys = old }(annotationKeys)
+	copyLabels = []string{"*"}
+	annotationKeys = []string{"billing.acme.io/Cost-Center", "owner", "empty", "missing"}
+
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName("my-pvc")
-	pvc.SetNamespace("my-namespace")
-	pvc.Spec.StorageClassName = &dummyStorageClassName
+	pvc.SetLabels(map[string]string{"owner": "db-team"})
+	pvc.SetAnnotations(map[string]string{
+		"billing.acme.io/Cost-Center": "cc-1234",
+		"owner":                       "billing-team",
+		"empty":                       "",
+		"not-listed":                  "x",
+	})
+
+	got := buildTags(context.Background(), pvc)
+	if want := map[string]string{"billing.acme.io/Cost-Center": "cc-1234", "owner": "db-team"}; !maps.Equal(got, want) {
+		t.Errorf("buildTags() = %v, want %v", got, want)
+	}
+	if got, want := sanitizeLabelsForGCP(got), map[string]string{"billing-acme-io_cost-center": "cc-1234", "owner": "db-team"}; !maps.Equal(got, want) {
+		t.Errorf("sanitizeLabelsForGCP() = %v, want %v", got, want)
+	}
+}
+
+func Test_stripTagKeyPrefixes(t *testing.T) {
+	defer func(old []string) { stripPrefixes = old }(stripPrefixes)
 
 	tests := []struct {
-		name        string
-		defaultTags map[string]string
-		annotations map[string]string
-		labels      map[string]string
-		want        map[string]string
+		name     string
+		prefixes []string
+		tags     map[string]string
+		want     map[string]string
 	}{
 		{
-			name:        "default tag with template",
-			defaultTags: map[string]string{"foo": "{{ .Name }}-{{ .Namespace }}"},
-			annotations: map[string]string{},
-			labels:      map[string]string{},
-			want:        map[string]string{"foo": "my-pvc-my-namespace"},
+			name:     "no prefixes",
+			prefixes: []string{},
+			tags:     map[string]string{"billing.acme.io/cost-center": "abc"},
+			want:     map[string]string{"billing.acme.io/cost-center": "abc"},
 		},
 		{
-			name:        "default tag overwritten with tag template",
-			defaultTags: map[string]string{"foo": "bar"},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Namespace }}\"}"},
-			labels:      map[string]string{},
-			want:        map[string]string{"foo": "my-pvc-my-namespace"},
+			name:     "multiple prefixes",
+			prefixes: []string{"billing.acme.io", "team.acme.io/"},
+			tags:     map[string]string{"billing.acme.io/cost-center": "abc", "team.acme.io/owner": "me"},
+			want:     map[string]string{"cost-center": "abc", "owner": "me"},
 		},
 		{
-			name:        "template using annotation",
-			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Annotations.TeamID }}\"}", "TeamID": "1234"},
-			labels:      map[string]string{},
-			want:        map[string]string{"foo": "my-pvc-1234"},
+			name:     "keys without the prefix are unchanged",
+			prefixes: []string{"billing.acme.io"},
+			tags:     map[string]string{"env": "prod", "other.acme.io/owner": "me", "billing.acme.io": "x", "billing.acme.io.evil/key": "y"},
+			want:     map[string]string{"env": "prod", "other.acme.io/owner": "me", "billing.acme.io": "x", "billing.acme.io.evil/key": "y"},
 		},
 		{
-			name:        "template using label",
-			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\"}"},
-			labels:      map[string]string{"TeamID": "1234"},
-			want:        map[string]string{"foo": "my-pvc-1234"},
+			name:     "unprefixed key wins a collision",
+			prefixes: []string{"billing.acme.io"},
+			tags:     map[string]string{"billing.acme.io/cost-center": "abc", "cost-center": "explicit"},
+			want:     map[string]string{"cost-center": "explicit"},
 		},
 		{
-			name:        "template using label and annotation",
-			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\",\"bar\": \"{{ .Name }}-{{ .Annotations.DeptID }}\"}", "DeptID": "ABC"},
-			labels:      map[string]string{"TeamID": "1234"},
-			want:        map[string]string{"foo": "my-pvc-1234", "bar": "my-pvc-ABC"},
+			name:     "first key in sorted order wins a collision",
+			prefixes: []string{"billing.acme.io", "a.acme.io"},
+			tags:     map[string]string{"billing.acme.io/cost-center": "billing", "a.acme.io/cost-center": "a"},
+			want:     map[string]string{"cost-center": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stripPrefixes = tt.prefixes
+			if got := stripTagKeyPrefixes(tt.tags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stripTagKeyPrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reconcileUpdateStripsDeletedKeys(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { stripPrefixes = old }(stripPrefixes)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	copyLabels = []string{"*"}
+	stripPrefixes = []string{"billing.acme.io"}
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	oldPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pvc",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"billing.acme.io/cost-center": "abc", "env": "prod"},
+			Annotations:     map[string]string{"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	newPVC := oldPVC.DeepCopy()
+	newPVC.ResourceVersion = "2"
+	newPVC.Labels = map[string]string{"env": "prod"}
+
+	diskLabels := map[string]string{"cost-center": "abc", "env": "prod"}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	if err := r.reconcileUpdate(context.Background(), oldPVC, newPVC); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	if want := map[string]string{"env": "prod"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("disk labels = %v, want %v", diskLabels, want)
+	}
+}
+
+func Test_reconcileLabelFingerprint(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old bool) { labelFingerprint = old }(labelFingerprint)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	copyLabels = []string{"team"}
+	labelFingerprint = true
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pvc",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"team": "db", "other": "a"},
+			Annotations:     map[string]string{"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pvc, &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+
+	getDiskCalls := 0
+	var setLabelsErr error
+	diskLabels := map[string]string{}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			getDiskCalls++
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			if setLabelsErr != nil {
+				return nil, setLabelsErr
+			}
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	ctx := context.Background()
+
+	// stored returns the PVC with the annotations written so far
+	stored := func(resourceVersion string) *corev1.PersistentVolumeClaim {
+		got, err := k8sClient.CoreV1().PersistentVolumeClaims("default").Get(ctx, "my-pvc", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.ResourceVersion = resourceVersion
+		return got
+	}
+	wantGetDiskCalls := func(step string, want int) {
+		t.Helper()
+		if getDiskCalls != want {
+			t.Errorf("%s: GetDisk() called %d times, want %d", step, getDiskCalls, want)
+		}
+	}
+
+	if err := r.reconcileAdd(ctx, pvc); err != nil {
+		t.Fatalf("reconcileAdd() error = %v", err)
+	}
+	wantGetDiskCalls("first sync", 1)
+	synced := stored("2")
+	if got, want := synced.Annotations[labelFingerprintAnnotation], tagsFingerprint(volumeID, map[string]string{"team": "db"}); got != want {
+		t.Fatalf("fingerprint annotation = %q, want %q", got, want)
+	}
+
+	// e.g. after a restart
+	if err := r.reconcileAdd(ctx, synced); err != nil {
+		t.Fatalf("reconcileAdd() error = %v", err)
+	}
+	wantGetDiskCalls("fingerprint matches", 1)
+
+	// the annotation update itself
+	if err := r.reconcileUpdate(ctx, pvc, synced); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	wantGetDiskCalls("annotation written", 1)
+
+	// a resync ignores the fingerprint and repairs labels removed from the disk
+	delete(diskLabels, "team")
+	if err := r.reconcileResync(ctx, synced); err != nil {
+		t.Fatalf("reconcileResync() error = %v", err)
+	}
+	wantGetDiskCalls("resync", 2)
+	if want := map[string]string{"team": "db"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("disk labels after resync = %v, want %v", diskLabels, want)
+	}
+
+	// any label change invalidates the fingerprint, even of labels that
+	// aren't copied
+	otherChanged := synced.DeepCopy()
+	otherChanged.ResourceVersion = "3"
+	otherChanged.Labels["other"] = "b"
+	if err := r.reconcileUpdate(ctx, synced, otherChanged); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	wantGetDiskCalls("uncopied label changed", 3)
+
+	teamChanged := otherChanged.DeepCopy()
+	teamChanged.ResourceVersion = "4"
+	teamChanged.Labels["team"] = "web"
+	if err := r.reconcileUpdate(ctx, otherChanged, teamChanged); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	wantGetDiskCalls("copied label changed", 4)
+	if want := map[string]string{"team": "web"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("disk labels = %v, want %v", diskLabels, want)
+	}
+	if got, want := stored("5").Annotations[labelFingerprintAnnotation], tagsFingerprint(volumeID, map[string]string{"team": "web"}); got != want {
+		t.Errorf("fingerprint annotation = %q, want %q", got, want)
+	}
+
+	// a failed sync keeps the old fingerprint, so the PVC is synced again
+	setLabelsErr = errors.New("failed")
+	failed := teamChanged.DeepCopy()
+	failed.ResourceVersion = "6"
+	failed.Labels["team"] = "api"
+	if err := r.reconcileUpdate(ctx, teamChanged, failed); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	if got, want := stored("7").Annotations[labelFingerprintAnnotation], tagsFingerprint(volumeID, map[string]string{"team": "web"}); got != want {
+		t.Errorf("fingerprint annotation after a failed sync = %q, want %q", got, want)
+	}
+}
+
+func Test_reconcileManagedLabelKeys(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old bool) { managedLabelKeys = old }(managedLabelKeys)
+	defer func(old bool) { deleteRemovedLabels = old }(deleteRemovedLabels)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	copyLabels = []string{"*"}
+	managedLabelKeys = false
+	deleteRemovedLabels = true
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pvc",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"team": "db", "app.kubernetes.io/name": "mysql"},
+			Annotations:     map[string]string{"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pvc, &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+
+	// owner is set on the disk outside of the tagger
+	diskLabels := map[string]string{"owner": "ops"}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	ctx := context.Background()
+
+	stored := func() *corev1.PersistentVolumeClaim {
+		got, err := k8sClient.CoreV1().PersistentVolumeClaims("default").Get(ctx, "my-pvc", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	wantDiskLabels := func(step string, want map[string]string) {
+		t.Helper()
+		if !maps.Equal(diskLabels, want) {
+			t.Errorf("%s: disk labels = %v, want %v", step, diskLabels, want)
+		}
+	}
+
+	if err := r.reconcileAdd(ctx, pvc); err != nil {
+		t.Fatalf("reconcileAdd() error = %v", err)
+	}
+	wantDiskLabels("first sync", map[string]string{"owner": "ops", "team": "db", "app-kubernetes-io_name": "mysql"})
+	synced := stored()
+	if got, want := synced.Annotations[managedLabelKeysAnnotation], `["app.kubernetes.io/name","team"]`; got != want {
+		t.Fatalf("managed label keys annotation = %q, want %q", got, want)
+	}
+
+	// the label is removed while the tagger isn't running, so only the add
+	// event of the new version is seen
+	removed := synced.DeepCopy()
+	delete(removed.Labels, "app.kubernetes.io/name")
+	if _, err := k8sClient.CoreV1().PersistentVolumeClaims("default").Update(ctx, removed, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcileAdd(ctx, removed); err != nil {
+		t.Fatalf("reconcileAdd() error = %v", err)
+	}
+	wantDiskLabels("label removed", map[string]string{"owner": "ops", "team": "db"})
+	if got, want := stored().Annotations[managedLabelKeysAnnotation], `["team"]`; got != want {
+		t.Errorf("managed label keys annotation = %q, want %q", got, want)
+	}
+
+	// an update whose old version already lacks the label still deletes it
+	diskLabels["team"] = "db"
+	diskLabels["env"] = "prod"
+	oldPVC := stored()
+	oldPVC.Annotations[managedLabelKeysAnnotation] = `["env","team"]`
+	newPVC := oldPVC.DeepCopy()
+	newPVC.ResourceVersion = oldPVC.ResourceVersion + "1"
+	if err := r.reconcileUpdate(ctx, oldPVC, newPVC); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	wantDiskLabels("update", map[string]string{"owner": "ops", "team": "db"})
+
+	// with just --managed-label-keys the annotation is written but removed
+	// labels are kept
+	managedLabelKeys = true
+	deleteRemovedLabels = false
+	diskLabels["env"] = "prod"
+	if err := r.reconcileAdd(ctx, oldPVC); err != nil {
+		t.Fatalf("reconcileAdd() error = %v", err)
+	}
+	wantDiskLabels("removed labels not deleted", map[string]string{"owner": "ops", "team": "db", "env": "prod"})
+	if got, want := stored().Annotations[managedLabelKeysAnnotation], `["team"]`; got != want {
+		t.Errorf("managed label keys annotation = %q, want %q", got, want)
+	}
+}
+
+func Test_getManagedLabelKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{
+			name: "no annotation",
 		},
 		{
-			name:        "template using invalid label",
-			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.SomeLabel }}\"}"},
-			labels:      map[string]string{"TeamID": "1234"},
-			want:        map[string]string{"foo": "my-pvc-"},
+			name:        "keys",
+			annotations: map[string]string{managedLabelKeysAnnotation: `["app.kubernetes.io/name","team"]`},
+			want:        []string{"app.kubernetes.io/name", "team"},
 		},
 		{
-			name:        "template using invalid field",
-			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Blah }}-{{ .Labels.TeamID }}\"}"},
-			labels:      map[string]string{"TeamID": "1234"},
-			want:        map[string]string{"foo": "{{ .Blah }}-{{ .Labels.TeamID }}"},
+			name:        "invalid json",
+			annotations: map[string]string{managedLabelKeysAnnotation: `team`},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			pvc.SetAnnotations(tt.annotations)
-			pvc.SetLabels(tt.labels)
-			defaultTags = tt.defaultTags
-			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			if got := getManagedLabelKeys(pvc); !slices.Equal(got, tt.want) {
+				t.Errorf("getManagedLabelKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reconcileSyncStatus(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old bool) { syncStatusAnnotations = old }(syncStatusAnnotations)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	fakeClock := testingclock.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	clock = fakeClock
+	defer func() { clock = clocks.RealClock{} }()
+	cloud = GCP
+	copyLabels = []string{"team"}
+	syncStatusAnnotations = true
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pvc",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"team": "db"},
+			Annotations:     map[string]string{"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pvc, &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+
+	getDiskCalls := 0
+	var setLabelsErr error
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			getDiskCalls++
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, setLabelsErr
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	ctx := context.Background()
+
+	// stored returns the PVC with the annotations written so far
+	stored := func(resourceVersion string) *corev1.PersistentVolumeClaim {
+		got, err := k8sClient.CoreV1().PersistentVolumeClaims("default").Get(ctx, "my-pvc", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.ResourceVersion = resourceVersion
+		return got
+	}
+	wantStatus := func(step string, pvc *corev1.PersistentVolumeClaim, wantTime, wantErr string) {
+		t.Helper()
+		if got := pvc.Annotations[lastSyncTimeAnnotation]; got != wantTime {
+			t.Errorf("%s: %s = %q, want %q", step, lastSyncTimeAnnotation, got, wantTime)
+		}
+		if got, ok := pvc.Annotations[lastSyncErrorAnnotation]; !ok || got != wantErr {
+			t.Errorf("%s: %s = %q, want %q", step, lastSyncErrorAnnotation, got, wantErr)
+		}
+	}
+
+	if err := r.reconcileAdd(ctx, pvc); err != nil {
+		t.Fatalf("reconcileAdd() error = %v", err)
+	}
+	synced := stored("2")
+	wantStatus("successful sync", synced, "2024-05-01T12:00:00Z", "")
+
+	// the update of the status annotations isn't reconciled
+	if err := r.reconcileUpdate(ctx, pvc, synced); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	if getDiskCalls != 1 {
+		t.Errorf("GetDisk() called %d times after the status update, want 1", getDiskCalls)
+	}
+
+	fakeClock.Step(time.Hour)
+	setLabelsErr = errors.New("permission denied")
+	changed := synced.DeepCopy()
+	changed.ResourceVersion = "3"
+	changed.Labels["team"] = "web"
+	if err := r.reconcileUpdate(ctx, synced, changed); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	failed := stored("4")
+	wantStatus("failed sync", failed, "2024-05-01T13:00:00Z", "permission denied")
+
+	fakeClock.Step(time.Hour)
+	setLabelsErr = nil
+	retried := failed.DeepCopy()
+	retried.ResourceVersion = "5"
+	retried.Labels["team"] = "storage"
+	if err := r.reconcileUpdate(ctx, failed, retried); err != nil {
+		t.Fatalf("reconcileUpdate() error = %v", err)
+	}
+	wantStatus("successful retry", stored("6"), "2024-05-01T14:00:00Z", "")
+}
+
+func Test_reconcileSyncGCPSnapshots(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old bool) { syncGCPSnapshots = old }(syncGCPSnapshots)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	newPVC := func(resourceVersion, tags string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "my-pvc",
+				Namespace:       "default",
+				ResourceVersion: resourceVersion,
+				Annotations: map[string]string{
+					annotationPrefix + "/tags":                 tags,
+					"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       "my-pv",
+				StorageClassName: &dummyStorageClassName,
+			},
+		}
+	}
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			syncGCPSnapshots = enabled
+			diskLabels := map[string]string{}
+			snapshotLabels := map[string]string{}
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					diskLabels = labelReq.Labels
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				fakeListSnapshots: func(ctx context.Context, project, filter string) ([]*compute.Snapshot, error) {
+					return []*compute.Snapshot{{Name: "my-snapshot", Labels: maps.Clone(snapshotLabels)}}, nil
+				},
+				fakeSetSnapshotLabels: func(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error) {
+					snapshotLabels = labelReq.Labels
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+				fakeGetGlobalGCEOp: func(ctx context.Context, project, name string) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+			}
+			r := &pvcReconciler{gcpClient: client}
+			ctx := context.Background()
+
+			added := newPVC("1", `{"app": "web", "team": "db"}`)
+			if err := r.reconcileAdd(ctx, added); err != nil {
+				t.Fatalf("reconcileAdd() error = %v", err)
+			}
+			if err := r.reconcileUpdate(ctx, added, newPVC("2", `{"app": "web"}`)); err != nil {
+				t.Fatalf("reconcileUpdate() error = %v", err)
+			}
+
+			want := map[string]string{}
+			if enabled {
+				want = map[string]string{"app": "web"}
+			}
+			if !maps.Equal(snapshotLabels, want) {
+				t.Errorf("snapshot labels = %v, want %v", snapshotLabels, want)
+			}
+		})
+	}
+}
+
+func Test_buildTagsStorageClassInheritance(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old int) { storageClassLabelDepth = old }(storageClassLabelDepth)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	copyLabels = []string{"*"}
+	k8sClient = fake.NewSimpleClientset(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+			Name:   "base",
+			Labels: map[string]string{"team": "platform", "tier": "base", "cost-center": "100"},
+		}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+			Name:        "fast",
+			Labels:      map[string]string{"tier": "fast", "iops": "high"},
+			Annotations: map[string]string{storageClassParentAnnotation: "base"},
+		}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+			Name:        "fast-encrypted",
+			Labels:      map[string]string{"encrypted": "true", "iops": "max"},
+			Annotations: map[string]string{storageClassParentAnnotation: "fast"},
+		}},
+	)
+
+	tests := []struct {
+		name  string
+		depth int
+		want  map[string]string
+	}{
+		{
+			name:  "own StorageClass only",
+			depth: 1,
+			want:  map[string]string{"encrypted": "true", "iops": "max", "cost-center": "abc"},
+		},
+		{
+			name:  "parent",
+			depth: 2,
+			want:  map[string]string{"encrypted": "true", "iops": "max", "tier": "fast", "cost-center": "abc"},
+		},
+		{
+			name:  "grandparent",
+			depth: 3,
+			want:  map[string]string{"encrypted": "true", "iops": "max", "tier": "fast", "team": "platform", "cost-center": "abc"},
+		},
+		{
+			name:  "depth beyond the chain",
+			depth: maxStorageClassLabelDepth,
+			want:  map[string]string{"encrypted": "true", "iops": "max", "tier": "fast", "team": "platform", "cost-center": "abc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageClassLabelDepth = tt.depth
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetLabels(map[string]string{"cost-center": "abc"})
+			pvc.Spec.StorageClassName = ptr.To("fast-encrypted")
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_annotationPrefix(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	defaultAnnotationPrefix := annotationPrefix
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+
+	tests := []struct {
+		name             string
+		annotationPrefix string
+		defaultTags      map[string]string
+		annotations      map[string]string
+		want             map[string]string
+	}{
+		{
+			name:             "annotationPrefix with proper ignore",
+			annotationPrefix: "something-else",
+			defaultTags:      map[string]string{"foo": "bar"},
+			annotations:      map[string]string{"something-else/ignore": ""},
+			want:             map[string]string{},
+		},
+		{
+			name:             "annotationPrefix with different ignore legacy",
+			annotationPrefix: "something-else",
+			defaultTags:      map[string]string{"foo": "bar"},
+			annotations:      map[string]string{"aws-ebs-tagger/ignore": ""},
+			want:             map[string]string{"foo": "bar"},
+		},
+		{
+			name:             "annotationPrefix with different ignore",
+			annotationPrefix: "something-else",
+			defaultTags:      map[string]string{"foo": "bar"},
+			annotations:      map[string]string{"k8s-pvc-tagger/ignore": ""},
+			want:             map[string]string{"foo": "bar"},
+		},
+		{
+			name:             "annotationPrefix with default and custom tags",
+			annotationPrefix: "something-else",
+			defaultTags:      map[string]string{"foo": "bar"},
+			annotations:      map[string]string{"something-else/tags": "{\"something\": \"else\"}"},
+			want:             map[string]string{"foo": "bar", "something": "else"},
+		},
+		{
+			name:             "annotationPrefix with default and different custom tags legacy",
+			annotationPrefix: "something-else",
+			defaultTags:      map[string]string{"foo": "bar"},
+			annotations:      map[string]string{"aws-ebs-tagger/tags": "{\"something\": \"else\"}"},
+			want:             map[string]string{"foo": "bar"},
+		},
+		{
+			name:             "annotationPrefix with default and different custom tags",
+			annotationPrefix: "something-else",
+			defaultTags:      map[string]string{"foo": "bar"},
+			annotations:      map[string]string{"k8s-pvc-tagger/tags": "{\"something\": \"else\"}"},
+			want:             map[string]string{"foo": "bar"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(tt.annotations)
+			annotationPrefix = tt.annotationPrefix
+			defaultTags = tt.defaultTags
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+			annotationPrefix = defaultAnnotationPrefix
+			defaultTags = map[string]string{}
+		})
+	}
+}
+
+func Test_processEBSPersistentVolumeClaim(t *testing.T) {
+	volumeName := "pvc-1234"
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.VolumeName = volumeName
+
+	tests := []struct {
+		name           string
+		provisionedBy  string
+		tagsAnnotation string
+		volumeID       string
+		volumeName     string
+		wantedTags     map[string]string
+		wantedVolumeID string
+		wantedErr      bool
+	}{
+		{
+			name:           "csi with valid tags and volume id",
+			provisionedBy:  AWS_EBS_CSI,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			wantedTags:     map[string]string{"foo": "bar"},
+			wantedVolumeID: "vol-12345",
+			wantedErr:      false,
+		},
+		{
+			name:           "in-tree with valid tags and volume id",
+			provisionedBy:  AWS_EBS_LEGACY,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "aws://us-east-1a/vol-12345",
+			wantedTags:     map[string]string{"foo": "bar"},
+			wantedVolumeID: "vol-12345",
+			wantedErr:      false,
+		},
+		{
+			name:           "in-tree with valid tags and invalid volume id",
+			provisionedBy:  AWS_EBS_LEGACY,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "aws://us-east-1a/abc123",
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+		{
+			name:           "other with valid tags and volume id",
+			provisionedBy:  "foo",
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+		{
+			name:           "in-tree with missing PV",
+			provisionedBy:  AWS_EBS_LEGACY,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     "asdf",
+			volumeID:       "aws://us-east-1a/vol-12345",
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(map[string]string{
+				annotationPrefix + "/tags":                 tt.tagsAnnotation,
+				"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
+			})
+
+			var pvSpec corev1.PersistentVolumeSpec
+			if tt.provisionedBy == AWS_EBS_CSI {
+				pvSpec = corev1.PersistentVolumeSpec{
+					StorageClassName: dummyStorageClassName,
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{
+							VolumeHandle: tt.wantedVolumeID,
+						},
+					},
+				}
+			} else {
+				pvSpec = corev1.PersistentVolumeSpec{
+					StorageClassName: dummyStorageClassName,
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{
+							VolumeID: tt.volumeID,
+						},
+					},
+				}
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        tt.volumeName,
+					Annotations: map[string]string{},
+				},
+				Spec: pvSpec,
+			}
+			k8sClient = fake.NewSimpleClientset(pv)
+			volumeID, tags, _, err := processPersistentVolumeClaim(context.Background(), pvc)
+			if (err == nil) == tt.wantedErr {
+				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
+			}
+			if volumeID != tt.wantedVolumeID {
+				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
+			}
+			if !reflect.DeepEqual(tags, tt.wantedTags) {
+				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", tags, tt.wantedTags)
+			}
+		})
+	}
+}
+
+func Test_processEFSPersistentVolumeClaim(t *testing.T) {
+	volumeName := "pvc-1234"
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.VolumeName = volumeName
+
+	tests := []struct {
+		name           string
+		provisionedBy  string
+		tagsAnnotation string
+		volumeID       string
+		volumeName     string
+		wantedTags     map[string]string
+		wantedVolumeID string
+		wantedErr      bool
+	}{
+		{
+			name:           "csi with valid tags and volume id",
+			provisionedBy:  AWS_EFS_CSI,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "fs-05b82f74723423::fsap-06cc098e562d23425",
+			wantedTags:     map[string]string{"foo": "bar"},
+			wantedVolumeID: "fsap-06cc098e562d23425",
+			wantedErr:      false,
+		},
+		{
+			name:           "csi with valid tags and invalid volume id",
+			provisionedBy:  AWS_EFS_CSI,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "asdf://us-east-1a/vol-12345",
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+		{
+			name:           "other with valid tags and volume id",
+			provisionedBy:  "foo",
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+		{
+			name:           "csi with missing PV",
+			provisionedBy:  AWS_EFS_CSI,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     "asdf",
+			volumeID:       "fs-05b82f74723423::fsap-06cc098e562d23425",
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(map[string]string{
+				annotationPrefix + "/tags":                 tt.tagsAnnotation,
+				"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
+			})
+
+			var pvSpec corev1.PersistentVolumeSpec
+			if tt.provisionedBy == AWS_EFS_CSI {
+				pvSpec = corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{
+							VolumeHandle: tt.volumeID,
+						},
+					},
+				}
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        tt.volumeName,
+					Annotations: map[string]string{},
+				},
+				Spec: pvSpec,
+			}
+			k8sClient = fake.NewSimpleClientset(pv)
+			volumeID, tags, _, err := processPersistentVolumeClaim(context.Background(), pvc)
+			if (err == nil) == tt.wantedErr {
+				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
+			}
+			if volumeID != tt.wantedVolumeID {
+				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
+			}
+			if !reflect.DeepEqual(tags, tt.wantedTags) {
+				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", tags, tt.wantedTags)
+			}
+		})
+	}
+}
+
+func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
+	volumeName := "pvc-1234"
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.VolumeName = volumeName
+
+	tests := []struct {
+		name           string
+		provisionedBy  string
+		tagsAnnotation string
+		volumeID       string
+		volumeName     string
+		wantedTags     map[string]string
+		wantedVolumeID string
+		wantedErr      bool
+	}{
+		{
+			name:           "csi with valid tags and volume id",
+			provisionedBy:  GCP_PD_CSI,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantedTags:     map[string]string{"foo": "bar"},
+			wantedVolumeID: "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantedErr:      false,
+		},
+		{
+			name:           "in-tree with valid tags and volume id",
+			provisionedBy:  GCP_PD_LEGACY,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantedTags:     map[string]string{"foo": "bar"},
+			wantedVolumeID: "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantedErr:      false,
+		},
+		{
+			name:           "in-tree with valid tags and invalid volume id",
+			provisionedBy:  GCP_PD_LEGACY,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "",
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+		{
+			name:           "other with valid tags and volume id",
+			provisionedBy:  "foo",
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+		{
+			name:           "in-tree with missing PV",
+			provisionedBy:  GCP_PD_LEGACY,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     "asdf",
+			volumeID:       "projects/my-project/zones/us-east1-a/disks/my-disk",
+			wantedTags:     nil,
+			wantedVolumeID: "",
+			wantedErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(map[string]string{
+				annotationPrefix + "/tags":                 tt.tagsAnnotation,
+				"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
+			})
+
+			var pvSpec corev1.PersistentVolumeSpec
+			if tt.provisionedBy == GCP_PD_CSI {
+				pvSpec = corev1.PersistentVolumeSpec{
+					StorageClassName: dummyStorageClassName,
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{
+							VolumeHandle: tt.wantedVolumeID,
+						},
+					},
+				}
+			} else {
+				pvSpec = corev1.PersistentVolumeSpec{
+					StorageClassName: dummyStorageClassName,
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{
+							PDName: tt.volumeID,
+						},
+					},
+				}
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        tt.volumeName,
+					Annotations: map[string]string{},
+				},
+				Spec: pvSpec,
+			}
+			k8sClient = fake.NewSimpleClientset(pv)
+			volumeID, tags, _, err := processPersistentVolumeClaim(context.Background(), pvc)
+			if (err == nil) == tt.wantedErr {
+				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
+			}
+			if volumeID != tt.wantedVolumeID {
+				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
+			}
+			if !reflect.DeepEqual(tags, tt.wantedTags) {
+				t.Errorf("processPersistentVolumeClaim() tags = %v, want %v", tags, tt.wantedTags)
+			}
+		})
+	}
+}
+
+func Test_templatedTags(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetNamespace("my-namespace")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+
+	tests := []struct {
+		name        string
+		defaultTags map[string]string
+		annotations map[string]string
+		labels      map[string]string
+		want        map[string]string
+	}{
+		{
+			name:        "default tag with template",
+			defaultTags: map[string]string{"foo": "{{ .Name }}-{{ .Namespace }}"},
+			annotations: map[string]string{},
+			labels:      map[string]string{},
+			want:        map[string]string{"foo": "my-pvc-my-namespace"},
+		},
+		{
+			name:        "default tag overwritten with tag template",
+			defaultTags: map[string]string{"foo": "bar"},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Namespace }}\"}"},
+			labels:      map[string]string{},
+			want:        map[string]string{"foo": "my-pvc-my-namespace"},
+		},
+		{
+			name:        "template using annotation",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Annotations.TeamID }}\"}", "TeamID": "1234"},
+			labels:      map[string]string{},
+			want:        map[string]string{"foo": "my-pvc-1234"},
+		},
+		{
+			name:        "template using label",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\"}"},
+			labels:      map[string]string{"TeamID": "1234"},
+			want:        map[string]string{"foo": "my-pvc-1234"},
+		},
+		{
+			name:        "template using label and annotation",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\",\"bar\": \"{{ .Name }}-{{ .Annotations.DeptID }}\"}", "DeptID": "ABC"},
+			labels:      map[string]string{"TeamID": "1234"},
+			want:        map[string]string{"foo": "my-pvc-1234", "bar": "my-pvc-ABC"},
+		},
+		{
+			name:        "template using invalid label",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.SomeLabel }}\"}"},
+			labels:      map[string]string{"TeamID": "1234"},
+			want:        map[string]string{"foo": "my-pvc-"},
+		},
+		{
+			name:        "template using invalid field",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Blah }}-{{ .Labels.TeamID }}\"}"},
+			labels:      map[string]string{"TeamID": "1234"},
+			want:        map[string]string{},
+		},
+		{
+			name:        "template using missing annotation",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Annotations.CostCenter }}\"}"},
+			want:        map[string]string{"foo": "my-pvc-"},
+		},
+		{
+			name:        "template using index for annotation with slash",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ index .Annotations \\\"billing/cost-center\\\" }}\"}", "billing/cost-center": "1234"},
+			want:        map[string]string{"foo": "1234"},
+		},
+		{
+			name:        "rendered values are not rendered again",
+			defaultTags: map[string]string{},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Annotations.Evil }}\"}", "Evil": "{{ .Annotations.Secret }}", "Secret": "hunter2"},
+			want:        map[string]string{"foo": "{{ .Annotations.Secret }}"},
+		},
+		{
+			name:        "invalid template only skips its tag",
+			defaultTags: map[string]string{"bar": "baz"},
+			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name \"}"},
+			want:        map[string]string{"bar": "baz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc.SetAnnotations(tt.annotations)
+			pvc.SetLabels(tt.labels)
+			defaultTags = tt.defaultTags
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+			defaultTags = map[string]string{}
+		})
+	}
+}
+
+func Test_renderTagTemplates(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetNamespace("my-namespace")
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		tags     map[string]string
+		want     map[string]string
+		wantErrs []string
+	}{
+		{
+			name:    "valid template",
+			enabled: true,
+			tags:    map[string]string{"foo": "{{ .Namespace }}-{{ .Name }}"},
+			want:    map[string]string{"foo": "my-namespace-my-pvc"},
+		},
+		{
+			name:     "render errors",
+			enabled:  true,
+			tags:     map[string]string{"foo": "{{ .Blah }}", "bar": "{{ .Name", "baz": "ok"},
+			want:     map[string]string{"baz": "ok"},
+			wantErrs: []string{"tag bar: ", "tag foo: "},
+		},
+		{
+			name:    "disabled",
+			enabled: false,
+			tags:    map[string]string{"foo": "{{ .Namespace }}-{{ .Name }}"},
+			want:    map[string]string{"foo": "{{ .Namespace }}-{{ .Name }}"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old bool) { labelValueTemplate = old }(labelValueTemplate)
+			labelValueTemplate = tt.enabled
+
+			got, errs := renderTagTemplates(pvc, tt.tags)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("renderTagTemplates() = %v, want %v", got, tt.want)
+			}
+			var gotErrs []string
+			for _, err := range errs {
+				gotErrs = append(gotErrs, err.Error())
+			}
+			slices.Sort(gotErrs)
+			if len(gotErrs) != len(tt.wantErrs) {
+				t.Fatalf("renderTagTemplates() errs = %q, want prefixes %q", gotErrs, tt.wantErrs)
+			}
+			for i := range gotErrs {
+				if !strings.HasPrefix(gotErrs[i], tt.wantErrs[i]) {
+					t.Errorf("renderTagTemplates() errs = %q, want prefixes %q", gotErrs, tt.wantErrs)
+				}
+			}
+		})
+	}
+}
+
+func Test_queueProcessingLatency(t *testing.T) {
+	fakeClock := testingclock.NewFakeClock(time.Now())
+	clock = fakeClock
+	defer func() { clock = clocks.RealClock{} }()
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.SetResourceVersion("1")
+
+	histogram := promQueueLatency.With(prometheus.Labels{"event_type": pvcEventUpdate}).(prometheus.Histogram)
+	before := &dto.Metric{}
+	if err := histogram.Write(before); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	queue.Add(newPVCEvent(pvcEventUpdate, pvc, pvc))
+	fakeClock.Step(100 * time.Millisecond)
+
+	r := &pvcReconciler{}
+	if !r.processNextEvent(context.Background(), queue) {
+		t.Fatal("processNextEvent() returned false")
+	}
+
+	after := &dto.Metric{}
+	if err := histogram.Write(after); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.GetHistogram().GetSampleCount() - before.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("histogram sample count increased by %v, want 1", got)
+	}
+	if got := after.GetHistogram().GetSampleSum() - before.GetHistogram().GetSampleSum(); got < 0.099 || got > 0.101 {
+		t.Errorf("histogram recorded %vs, want ~0.1s", got)
+	}
+}
+
+func Test_processNextEventCanceled(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pv)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	started := make(chan struct{})
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	queue.Add(newPVCEvent(pvcEventAdd, nil, pvc))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.processNextEvent(ctx, queue)
+		close(done)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetDiskLabels() was not called")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("processNextEvent() did not return after the context was canceled")
+	}
+}
+
+func Test_processNextEventRequeue(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pv)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	tests := []struct {
+		strategy    string
+		wantRequeue bool
+		wantEvents  []string
+	}{
+		{strategy: diskNotFoundSkip, wantRequeue: false, wantEvents: nil},
+		{strategy: diskNotFoundWarn, wantRequeue: false, wantEvents: nil},
+		{strategy: diskNotFoundFail, wantRequeue: true, wantEvents: []string{"Warning LabelSyncFailed Failed to set labels: requeue: googleapi: Error 404: not found"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			defer func(old string) { gcpDiskNotFound = old }(gcpDiskNotFound)
+			gcpDiskNotFound = tt.strategy
+
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "not found"}
+				},
+			}
+			recorder := record.NewFakeRecorder(10)
+			r := &pvcReconciler{gcpClient: client, recorder: recorder}
+			queue := workqueue.NewRateLimitingQueue(workqueue.NewItemFastSlowRateLimiter(time.Millisecond, time.Millisecond, 1))
+			defer queue.ShutDown()
+			e := newPVCEvent(pvcEventAdd, nil, pvc)
+			queue.Add(e)
+
+			r.processNextEvent(context.Background(), queue)
+
+			if got := queue.NumRequeues(e) > 0; got != tt.wantRequeue {
+				t.Errorf("requeued = %v, want %v", got, tt.wantRequeue)
+			}
+			if got := drainEvents(recorder); !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("events = %q, want %q", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func Test_pvcQueue(t *testing.T) {
+	queue := newPVCQueue(4, "queue-test")
+	if len(queue.shards) != 4 {
+		t.Fatalf("shards = %d, want 4", len(queue.shards))
+	}
+
+	const pvcs, eventsPerPVC = 20, 5
+	for i := 0; i < eventsPerPVC; i++ {
+		for j := 0; j < pvcs; j++ {
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetNamespace("default")
+			pvc.SetName(fmt.Sprintf("pvc-%d", j))
+			pvc.SetResourceVersion(strconv.Itoa(i))
+			queue.Add(newPVCEvent(pvcEventUpdate, nil, pvc))
+		}
+	}
+	depth := promQueueDepth.With(prometheus.Labels{"namespace": "queue-test"})
+	if got := testutil.ToFloat64(depth); got != pvcs*eventsPerPVC {
+		t.Errorf("queue depth = %v, want %v", got, pvcs*eventsPerPVC)
+	}
+
+	var mu sync.Mutex
+	processed := map[string][]string{}
+	var wg sync.WaitGroup
+	for _, shard := range queue.shards {
+		wg.Add(1)
+		go func(shard workqueue.RateLimitingInterface) {
+			defer wg.Done()
+			for {
+				item, shutdown := shard.Get()
+				if shutdown {
+					return
+				}
+				e := item.(*pvcEvent)
+				mu.Lock()
+				processed[e.pvc.GetName()] = append(processed[e.pvc.GetName()], e.pvc.GetResourceVersion())
+				mu.Unlock()
+				shard.Done(item)
+			}
+		}(shard)
+	}
+	queue.ShutDown()
+	wg.Wait()
+
+	if len(processed) != pvcs {
+		t.Errorf("processed events of %d PVCs, want %d", len(processed), pvcs)
+	}
+	want := []string{"0", "1", "2", "3", "4"}
+	for name, got := range processed {
+		if !slices.Equal(got, want) {
+			t.Errorf("events of %s processed in order %v, want %v", name, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(depth); got != 0 {
+		t.Errorf("queue depth after shutdown = %v, want 0", got)
+	}
+}
+
+func Test_pvcQueueDepth(t *testing.T) {
+	queue := newPVCQueue(2, "queue-depth-test")
+	defer queue.ShutDown()
+	depth := promQueueDepth.With(prometheus.Labels{"namespace": "queue-depth-test"})
+
+	for i := 0; i < 5; i++ {
+		pvc := &corev1.PersistentVolumeClaim{}
+		pvc.SetNamespace("default")
+		pvc.SetName(fmt.Sprintf("pvc-%d", i))
+		queue.Add(newPVCEvent(pvcEventAdd, nil, pvc))
+	}
+	if got := testutil.ToFloat64(depth); got != 5 {
+		t.Errorf("queue depth = %v, want 5", got)
+	}
+
+	processed := 0
+	for _, shard := range queue.shards {
+		for shard.Len() > 0 {
+			item, _ := shard.Get()
+			if got, want := testutil.ToFloat64(depth), float64(4-processed); got != want {
+				t.Errorf("queue depth while processing = %v, want %v", got, want)
+			}
+			shard.Done(item)
+			processed++
+		}
+	}
+	if processed != 5 {
+		t.Fatalf("processed %d events, want 5", processed)
+	}
+	if got := testutil.ToFloat64(depth); got != 0 {
+		t.Errorf("queue depth = %v, want 0", got)
+	}
+}
+
+func Test_pvcQueueLatency(t *testing.T) {
+	queue := newPVCQueue(2, "queue-latency-test")
+	defer queue.ShutDown()
+	histogram := promWorkqueueLatency.With(prometheus.Labels{"namespace": "queue-latency-test"}).(prometheus.Histogram)
+
+	for i := 0; i < 3; i++ {
+		pvc := &corev1.PersistentVolumeClaim{}
+		pvc.SetNamespace("default")
+		pvc.SetName(fmt.Sprintf("pvc-%d", i))
+		queue.Add(newPVCEvent(pvcEventAdd, nil, pvc))
+	}
+	for _, shard := range queue.shards {
+		for shard.Len() > 0 {
+			item, _ := shard.Get()
+			shard.Done(item)
+		}
+	}
+
+	m := &dto.Metric{}
+	if err := histogram.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("queue latency samples = %d, want 3", got)
+	}
+}
+
+func Test_pvcQueueConcurrentReconciles(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	cloud = GCP
+	gcpLabelCacheTTL = 0
+
+	const pvcs = 10
+	var objects []runtime.Object
+	var events []*pvcEvent
+	for i := 0; i < pvcs; i++ {
+		objects = append(objects, &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pv-%d", i)},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: fmt.Sprintf("projects/my-project/zones/us-east1-a/disks/disk-%d", i)},
+				},
+			},
+		})
+		events = append(events, newPVCEvent(pvcEventAdd, nil, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("pvc-%d", i),
+				Namespace: "default",
+				Annotations: map[string]string{
+					annotationPrefix + "/tags":                 fmt.Sprintf(`{"pvc": "%d"}`, i),
+					"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       fmt.Sprintf("pv-%d", i),
+				StorageClassName: &dummyStorageClassName,
+			},
+		}))
+	}
+	k8sClient = fake.NewSimpleClientset(objects...)
+
+	var mu sync.Mutex
+	diskLabels := map[string]map[string]string{}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			diskLabels[name] = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+
+	queue := newPVCQueue(4, "concurrent-test")
+	for _, e := range events {
+		queue.Add(e)
+	}
+	queue.ShutDown()
+	var wg sync.WaitGroup
+	for _, shard := range queue.shards {
+		wg.Add(1)
+		go func(shard workqueue.RateLimitingInterface) {
+			defer wg.Done()
+			for r.processNextEvent(context.Background(), shard) {
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	if len(diskLabels) != pvcs {
+		t.Errorf("labels set on %d disks, want %d", len(diskLabels), pvcs)
+	}
+	for i := 0; i < pvcs; i++ {
+		name := fmt.Sprintf("disk-%d", i)
+		if want := map[string]string{"pvc": strconv.Itoa(i)}; !maps.Equal(diskLabels[name], want) {
+			t.Errorf("labels of %s = %v, want %v", name, diskLabels[name], want)
+		}
+	}
+}
+
+func Test_reconcileAddVeleroAnnotations(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pv)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+				"velero.io/backup-name":                    "nightly-20240101",
+				"velero.io/schedule-name":                  "nightly",
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	tests := []struct {
+		name       string
+		propagate  bool
+		wantLabels map[string]string
+	}{
+		{
+			name:       "enabled",
+			propagate:  true,
+			wantLabels: map[string]string{"foo": "bar", "velero-io_backup-name": "nightly-20240101", "velero-io_schedule-name": "nightly"},
+		},
+		{
+			name:       "disabled",
+			propagate:  false,
+			wantLabels: map[string]string{"foo": "bar"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old bool) { propagateVelero = old }(propagateVelero)
+			propagateVelero = tt.propagate
+
+			var gotLabels map[string]string
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Name: name}, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					gotLabels = labelReq.Labels
+					return nil, errors.New("stop before waiting on the operation")
+				},
+			}
+			recorder := record.NewFakeRecorder(10)
+			r := &pvcReconciler{gcpClient: client, recorder: recorder}
+			r.reconcileAdd(context.Background(), pvc)
+
+			if !reflect.DeepEqual(gotLabels, tt.wantLabels) {
+				t.Errorf("SetDiskLabels() labels = %v, want %v", gotLabels, tt.wantLabels)
+			}
+			want := []string{"Warning LabelSyncFailed Failed to set labels: stop before waiting on the operation"}
+			if got := drainEvents(recorder); !slices.Equal(got, want) {
+				t.Errorf("events = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func Test_buildTagsNamespaceLabels(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { inheritNSLabels = old }(inheritNSLabels)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	copyLabels = []string{"*"}
+	inheritNSLabels = []string{"team", "cost-center"}
+	k8sClient = fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "billing",
+		Labels: map[string]string{"team": "platform", "cost-center": "100", "other": "ignored"},
+	}})
+
+	tests := []struct {
+		name      string
+		namespace string
+		pvcLabels map[string]string
+		want      map[string]string
+	}{
+		{
+			name:      "namespace labels are inherited",
+			namespace: "billing",
+			want:      map[string]string{"team": "platform", "cost-center": "100"},
+		},
+		{
+			name:      "PVC label wins",
+			namespace: "billing",
+			pvcLabels: map[string]string{"team": "storage"},
+			want:      map[string]string{"team": "storage", "cost-center": "100"},
+		},
+		{
+			name:      "missing namespace",
+			namespace: "missing",
+			pvcLabels: map[string]string{"team": "storage"},
+			want:      map[string]string{"team": "storage"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+				Name:      "my-pvc",
+				Namespace: tt.namespace,
+				Labels:    tt.pvcLabels,
+			}}
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildTagsPVLabels(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old bool) { syncPVLabels = old }(syncPVLabels)
+	defer func(old []string) { inheritNSLabels = old }(inheritNSLabels)
+	defer func(old int) { storageClassLabelDepth = old }(storageClassLabelDepth)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	copyLabels = []string{"*"}
+	storageClassLabelDepth = 1
+	inheritNSLabels = []string{"team"}
+	k8sClient = fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "default",
+			Labels: map[string]string{"team": "namespace"},
+		}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+			Name:   "fast",
+			Labels: map[string]string{"team": "storageclass", "tier": "storageclass", "zone": "storageclass"},
+		}},
+		&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+			Name:   "my-pv",
+			Labels: map[string]string{"team": "pv", "tier": "pv", "provisioner": "pv"},
+		}},
+	)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Labels:    map[string]string{"team": "pvc"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: ptr.To("fast"),
+		},
+	}
+
+	tests := []struct {
+		name   string
+		syncPV bool
+		want   map[string]string
+	}{
+		{
+			name:   "PVC wins over PV, PV wins over StorageClass and namespace",
+			syncPV: true,
+			want:   map[string]string{"team": "pvc", "tier": "pv", "provisioner": "pv", "zone": "storageclass"},
+		},
+		{
+			name:   "PV labels not synced",
+			syncPV: false,
+			want:   map[string]string{"team": "pvc", "tier": "storageclass", "zone": "storageclass"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncPVLabels = tt.syncPV
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pvUpdateEvent(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(&corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "my-pv"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pvcLister := corelisters.NewPersistentVolumeClaimLister(indexer)
+
+	pv := func(claim string, labels map[string]string) *corev1.PersistentVolume {
+		pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "my-pv", Labels: labels}}
+		if claim != "" {
+			pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "default", Name: claim}
+		}
+		return pv
+	}
+	tests := []struct {
+		name      string
+		oldPV     *corev1.PersistentVolume
+		newPV     *corev1.PersistentVolume
+		wantEvent bool
+		wantOld   map[string]string
+	}{
+		{
+			name:      "labels changed",
+			oldPV:     pv("my-pvc", map[string]string{"team": "a"}),
+			newPV:     pv("my-pvc", map[string]string{"team": "b"}),
+			wantEvent: true,
+			wantOld:   map[string]string{"team": "a"},
+		},
+		{
+			name:      "labels added",
+			oldPV:     pv("my-pvc", nil),
+			newPV:     pv("my-pvc", map[string]string{"team": "b"}),
+			wantEvent: true,
+			wantOld:   map[string]string{},
+		},
+		{
+			name:  "labels unchanged",
+			oldPV: pv("my-pvc", map[string]string{"team": "a"}),
+			newPV: pv("my-pvc", map[string]string{"team": "a"}),
+		},
+		{
+			name:  "not bound",
+			oldPV: pv("", map[string]string{"team": "a"}),
+			newPV: pv("", map[string]string{"team": "b"}),
+		},
+		{
+			name:  "PVC not watched",
+			oldPV: pv("other-pvc", map[string]string{"team": "a"}),
+			newPV: pv("other-pvc", map[string]string{"team": "b"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := pvUpdateEvent(tt.oldPV, tt.newPV, pvcLister)
+			if (e != nil) != tt.wantEvent {
+				t.Fatalf("pvUpdateEvent() = %v, want event %v", e, tt.wantEvent)
+			}
+			if e == nil {
+				return
+			}
+			if e.eventType != pvcEventPV || e.pvc.GetName() != "my-pvc" {
+				t.Errorf("pvUpdateEvent() = %s event for %s, want %s event for my-pvc", e.eventType, e.pvc.GetName(), pvcEventPV)
+			}
+			if e.oldSources.pv == nil || !maps.Equal(e.oldSources.pv, tt.wantOld) {
+				t.Errorf("oldSources.pv = %v, want %v", e.oldSources.pv, tt.wantOld)
+			}
+		})
+	}
+}
+
+func Test_namespaceUpdateEvents(t *testing.T) {
+	defer func(old []string) { inheritNSLabels = old }(inheritNSLabels)
+	inheritNSLabels = []string{"team"}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, pvc := range []*corev1.PersistentVolumeClaim{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Namespace: "billing"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-2", Namespace: "billing"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-3", Namespace: "other"}},
+	} {
+		if err := indexer.Add(pvc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvcLister := corelisters.NewPersistentVolumeClaimLister(indexer)
+
+	namespace := func(labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "billing", Labels: labels}}
+	}
+	tests := []struct {
+		name           string
+		oldLabels      map[string]string
+		newLabels      map[string]string
+		watchNamespace string
+		selector       string
+		wantPVCs       []string
+	}{
+		{
+			name:      "inherited label changed",
+			oldLabels: map[string]string{"team": "platform"},
+			newLabels: map[string]string{"team": "storage"},
+			wantPVCs:  []string{"pvc-1", "pvc-2"},
+		},
+		{
+			name:      "inherited label removed",
+			oldLabels: map[string]string{"team": "platform"},
+			newLabels: map[string]string{},
+			wantPVCs:  []string{"pvc-1", "pvc-2"},
+		},
+		{
+			name:      "other label changed",
+			oldLabels: map[string]string{"team": "platform", "other": "a"},
+			newLabels: map[string]string{"team": "platform", "other": "b"},
+		},
+		{
+			name:           "namespace not watched",
+			oldLabels:      map[string]string{"team": "platform"},
+			newLabels:      map[string]string{"team": "storage"},
+			watchNamespace: "other",
+		},
+		{
+			name:      "namespace starts matching the selector",
+			oldLabels: map[string]string{"team": "platform"},
+			newLabels: map[string]string{"team": "platform", "env": "production"},
+			selector:  "env=production",
+			wantPVCs:  []string{"pvc-1", "pvc-2"},
+		},
+		{
+			name:      "namespace stops matching the selector",
+			oldLabels: map[string]string{"team": "platform", "env": "production"},
+			newLabels: map[string]string{"team": "storage"},
+			selector:  "env=production",
+		},
+		{
+			name:      "inherited label changed in a matching namespace",
+			oldLabels: map[string]string{"team": "platform", "env": "production"},
+			newLabels: map[string]string{"team": "storage", "env": "production"},
+			selector:  "env=production",
+			wantPVCs:  []string{"pvc-1", "pvc-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old labels.Selector) { namespaceSelector = old }(namespaceSelector)
+			namespaceSelector = nil
+			if tt.selector != "" {
+				selector, err := labels.Parse(tt.selector)
+				if err != nil {
+					t.Fatal(err)
+				}
+				namespaceSelector = selector
+			}
+			events := namespaceUpdateEvents(namespace(tt.oldLabels), namespace(tt.newLabels), pvcLister, tt.watchNamespace)
+			var gotPVCs []string
+			for _, e := range events {
+				if e.eventType != pvcEventNamespace {
+					t.Errorf("eventType = %q, want %q", e.eventType, pvcEventNamespace)
+				}
+				if !maps.Equal(e.oldSources.namespace, inheritedNamespaceLabels(namespace(tt.oldLabels))) {
+					t.Errorf("oldSources.namespace = %v, want %v", e.oldSources.namespace, tt.oldLabels)
+				}
+				gotPVCs = append(gotPVCs, e.pvc.GetName())
+			}
+			slices.Sort(gotPVCs)
+			if !slices.Equal(gotPVCs, tt.wantPVCs) {
+				t.Errorf("namespaceUpdateEvents() PVCs = %v, want %v", gotPVCs, tt.wantPVCs)
+			}
+		})
+	}
+}
+
+func Test_nodeUpdateEvents(t *testing.T) {
+	defer func(old []string) { inheritNodeLabels = old }(inheritNodeLabels)
+	inheritNodeLabels = []string{"cloud.google.com/gke-nodepool"}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, pvc := range []*corev1.PersistentVolumeClaim{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Namespace: "billing", Annotations: map[string]string{selectedNodeAnnotation: "node-1"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-2", Namespace: "other", Annotations: map[string]string{selectedNodeAnnotation: "node-1"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-3", Namespace: "billing", Annotations: map[string]string{selectedNodeAnnotation: "node-2"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-4", Namespace: "billing"}},
+	} {
+		if err := indexer.Add(pvc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvcLister := corelisters.NewPersistentVolumeClaimLister(indexer)
+
+	node := func(labels map[string]string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: labels}}
+	}
+	tests := []struct {
+		name      string
+		oldLabels map[string]string
+		newLabels map[string]string
+		wantPVCs  []string
+	}{
+		{
+			name:      "inherited label changed",
+			oldLabels: map[string]string{"cloud.google.com/gke-nodepool": "pool-1"},
+			newLabels: map[string]string{"cloud.google.com/gke-nodepool": "pool-2"},
+			wantPVCs:  []string{"pvc-1", "pvc-2"},
+		},
+		{
+			name:      "inherited label removed",
+			oldLabels: map[string]string{"cloud.google.com/gke-nodepool": "pool-1"},
+			newLabels: map[string]string{},
+			wantPVCs:  []string{"pvc-1", "pvc-2"},
+		},
+		{
+			name:      "other label changed",
+			oldLabels: map[string]string{"cloud.google.com/gke-nodepool": "pool-1", "other": "a"},
+			newLabels: map[string]string{"cloud.google.com/gke-nodepool": "pool-1", "other": "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := nodeUpdateEvents(node(tt.oldLabels), node(tt.newLabels), pvcLister)
+			var gotPVCs []string
+			for _, e := range events {
+				if e.eventType != pvcEventNode {
+					t.Errorf("eventType = %q, want %q", e.eventType, pvcEventNode)
+				}
+				if !maps.Equal(e.oldSources.node, inheritedNodeLabels(node(tt.oldLabels))) {
+					t.Errorf("oldSources.node = %v, want %v", e.oldSources.node, tt.oldLabels)
+				}
+				gotPVCs = append(gotPVCs, e.pvc.GetName())
+			}
+			slices.Sort(gotPVCs)
+			if !slices.Equal(gotPVCs, tt.wantPVCs) {
+				t.Errorf("nodeUpdateEvents() PVCs = %v, want %v", gotPVCs, tt.wantPVCs)
+			}
+		})
+	}
+}
+
+func Test_buildTagsNodeLabels(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old []string) { inheritNodeLabels = old }(inheritNodeLabels)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	copyLabels = []string{"*"}
+	inheritNodeLabels = []string{"cloud.google.com/gke-nodepool"}
+	k8sClient = fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node-1",
+		Labels: map[string]string{"cloud.google.com/gke-nodepool": "pool-1", "other": "ignored"},
+	}})
+
+	tests := []struct {
+		name      string
+		node      string
+		pvcLabels map[string]string
+		want      map[string]string
+	}{
+		{
+			name: "node labels are inherited",
+			node: "node-1",
+			want: map[string]string{"cloud.google.com/gke-nodepool": "pool-1"},
+		},
+		{
+			name:      "PVC label wins",
+			node:      "node-1",
+			pvcLabels: map[string]string{"cloud.google.com/gke-nodepool": "mine"},
+			want:      map[string]string{"cloud.google.com/gke-nodepool": "mine"},
+		},
+		{
+			name:      "no selected node",
+			pvcLabels: map[string]string{"team": "storage"},
+			want:      map[string]string{"team": "storage"},
+		},
+		{
+			name:      "missing node",
+			node:      "missing",
+			pvcLabels: map[string]string{"team": "storage"},
+			want:      map[string]string{"team": "storage"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+				Name:      "my-pvc",
+				Namespace: "default",
+				Labels:    tt.pvcLabels,
+			}}
+			if tt.node != "" {
+				pvc.Annotations = map[string]string{selectedNodeAnnotation: tt.node}
+			}
+			if got := buildTags(context.Background(), pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reconcileSourcesUpdateRemovesLabels(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { inheritNSLabels = old }(inheritNSLabels)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	inheritNSLabels = []string{"team"}
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+				},
+			},
+		},
+		// the team label has been removed from the namespace
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "billing"}},
+	)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "billing",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	diskLabels := map[string]string{"foo": "bar", "team": "platform"}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	if err := r.reconcileSourcesUpdate(context.Background(), pvc, tagSources{namespace: map[string]string{"team": "platform"}}); err != nil {
+		t.Fatalf("reconcileSourcesUpdate() error = %v", err)
+	}
+	if want := map[string]string{"foo": "bar"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("disk labels = %v, want %v", diskLabels, want)
+	}
+}
+
+func Test_reconcileAddTemplateErrorEvent(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar", "broken": "{{ .Blah }}"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	var gotLabels map[string]string
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			gotLabels = labelReq.Labels
+			return nil, errors.New("stop before waiting on the operation")
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &pvcReconciler{gcpClient: client, recorder: recorder}
+	r.reconcileAdd(context.Background(), pvc)
+
+	if want := map[string]string{"foo": "bar"}; !maps.Equal(gotLabels, want) {
+		t.Errorf("SetDiskLabels() labels = %v, want %v", gotLabels, want)
+	}
+	events := drainEvents(recorder)
+	if len(events) == 0 || !strings.HasPrefix(events[0], "Warning TagTemplateFailed Failed to render tag template: tag broken: ") {
+		t.Errorf("events = %q, want a TagTemplateFailed warning first", events)
+	}
+}
+
+func Test_buildTagsExtraLabels(t *testing.T) {
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	copyLabels = []string{"*"}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "valid JSON",
+			annotations: map[string]string{extraLabelsAnnotation: `{"compliance": "pci", "owner": "billing"}`},
+			want:        map[string]string{"app": "web", "owner": "billing", "compliance": "pci"},
+		},
+		{
+			name:        "invalid JSON is skipped",
+			annotations: map[string]string{extraLabelsAnnotation: `{"compliance": "pci"`},
+			want:        map[string]string{"app": "web", "owner": "db-team"},
+			wantErr:     true,
+		},
+		{
+			name:        "non-string values are skipped",
+			annotations: map[string]string{extraLabelsAnnotation: `{"retention": 7}`},
+			want:        map[string]string{"app": "web", "owner": "db-team"},
+			wantErr:     true,
+		},
+		{
+			name:        "empty annotation",
+			annotations: map[string]string{extraLabelsAnnotation: ""},
+			want:        map[string]string{"app": "web", "owner": "db-team"},
+		},
+		{
+			name: "tags annotation overrides the extra labels",
+			annotations: map[string]string{
+				extraLabelsAnnotation:      `{"owner": "billing"}`,
+				annotationPrefix + "/tags": `{"owner": "finance"}`,
+			},
+			want: map[string]string{"app": "web", "owner": "finance"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "my-pvc",
+					Namespace:   "default",
+					Labels:      map[string]string{"app": "web", "owner": "db-team"},
+					Annotations: tt.annotations,
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &dummyStorageClassName},
+			}
+			got, errs := buildTagsFromSources(context.Background(), pvc, tagSources{})
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("buildTagsFromSources() = %v, want %v", got, tt.want)
+			}
+			var extraErr *extraLabelsError
+			if gotErr := len(errs) == 1 && errors.As(errs[0], &extraErr); gotErr != tt.wantErr {
+				t.Errorf("buildTagsFromSources() errors = %v, want an extra labels error: %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_reconcileAddExtraLabelsErrorEvent(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+				extraLabelsAnnotation:                      "compliance=pci",
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	var gotLabels map[string]string
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			gotLabels = labelReq.Labels
+			return nil, errors.New("stop before waiting on the operation")
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &pvcReconciler{gcpClient: client, recorder: recorder}
+	r.reconcileAdd(context.Background(), pvc)
+
+	if want := map[string]string{"foo": "bar"}; !maps.Equal(gotLabels, want) {
+		t.Errorf("SetDiskLabels() labels = %v, want %v", gotLabels, want)
+	}
+	events := drainEvents(recorder)
+	if len(events) == 0 || !strings.HasPrefix(events[0], "Warning InvalidExtraLabels Skipping extra labels: "+extraLabelsAnnotation) {
+		t.Errorf("events = %q, want an InvalidExtraLabels warning first", events)
+	}
+}
+
+// drainEvents returns the events recorded so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func Test_recordLabelEvent(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"}}
+	tests := []struct {
+		name       string
+		dryRun     bool
+		res        ReconcileResult
+		wantEvents []string
+	}{
+		{
+			name:       "labels added and removed",
+			res:        ReconcileResult{Changed: true, LabelsAdded: map[string]string{"foo": "bar", "team": "db"}, LabelsRemoved: map[string]string{"old": "value"}},
+			wantEvents: []string{"Normal LabelsSynced Successfully synced 3 labels to cloud volume"},
+		},
+		{
+			name: "nothing changed",
+			res:  ReconcileResult{},
+		},
+		{
+			name:       "error",
+			res:        ReconcileResult{Err: errors.New("permission denied")},
+			wantEvents: []string{"Warning LabelSyncFailed Failed to set labels: permission denied"},
+		},
+		{
+			name: "labels dropped",
+			res:  ReconcileResult{Changed: true, LabelsAdded: map[string]string{"foo": "bar"}, LabelsDropped: []string{"b", "team"}},
+			wantEvents: []string{
+				"Warning LabelsDropped Not setting labels b, team, the volume would exceed GCP's limit of 64 labels",
+				"Normal LabelsSynced Successfully synced 1 labels to cloud volume",
+			},
+		},
+		{
+			name:       "labels dropped without changes",
+			res:        ReconcileResult{LabelsDropped: []string{"team"}},
+			wantEvents: []string{"Warning LabelsDropped Not setting labels team, the volume would exceed GCP's limit of 64 labels"},
+		},
+		{
+			name: "tags removed",
+			res:  ReconcileResult{Changed: true, LabelsAdded: map[string]string{"foo": "bar"}, TagsRemoved: []string{"other"}},
+			wantEvents: []string{
+				"Warning TagsRemoved Removed tags other not set by the PVC, the volume would exceed Azure's limit of 50 tags",
+				"Normal LabelsSynced Successfully synced 1 labels to cloud volume",
+			},
+		},
+		{
+			name:   "dry-run",
+			dryRun: true,
+			res:    ReconcileResult{LabelsAdded: map[string]string{"foo": "bar"}, LabelsDropped: []string{"team"}, TagsRemoved: []string{"other"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old bool) { dryRun = old }(dryRun)
+			dryRun = tt.dryRun
+
+			recorder := record.NewFakeRecorder(10)
+			r := &pvcReconciler{recorder: recorder}
+			r.recordResult(pvc, tt.res)
+			if got := drainEvents(recorder); !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("events = %q, want %q", got, tt.wantEvents)
+			}
+		})
+	}
+
+	// no recorder
+	r := &pvcReconciler{}
+	r.recordLabelEvent(pvc, 1, nil)
+}
+
+func Test_skipPVCNotSelected(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old labels.Selector) { pvcSelector = old }(pvcSelector)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+
+	tests := []struct {
+		name        string
+		selector    string
+		labels      map[string]string
+		wantSkipped bool
+	}{
+		{
+			name:   "no selector",
+			labels: map[string]string{"team": "search"},
+		},
+		{
+			name:     "matching",
+			selector: "team=payments",
+			labels:   map[string]string{"team": "payments", "app": "db"},
+		},
+		{
+			name:        "not matching",
+			selector:    "team=payments",
+			labels:      map[string]string{"team": "search"},
+			wantSkipped: true,
+		},
+		{
+			name:        "no labels",
+			selector:    "team=payments",
+			wantSkipped: true,
+		},
+		{
+			name:     "set based",
+			selector: "team in (payments,billing),!legacy",
+			labels:   map[string]string{"team": "billing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if pvcSelector, err = parseSelector(tt.selector); err != nil {
+				t.Fatal(err)
+			}
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "my-pvc",
+					Namespace: "default",
+					Labels:    tt.labels,
+					Annotations: map[string]string{
+						annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+						"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+					},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					VolumeName:       "my-pv",
+					StorageClassName: &dummyStorageClassName,
+				},
+				Status: corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+			}
+			if got := skipPVCNotSelected(pvc); got != tt.wantSkipped {
+				t.Errorf("skipPVCNotSelected() = %v, want %v", got, tt.wantSkipped)
+			}
+
+			var labelsSet bool
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Name: name}, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					labelsSet = true
+					return nil, errors.New("stop before waiting on the operation")
+				},
+			}
+			r := &pvcReconciler{gcpClient: client}
+			_ = r.reconcileAdd(context.Background(), pvc)
+			if labelsSet == tt.wantSkipped {
+				t.Errorf("reconcileAdd() set labels = %v, want %v", labelsSet, !tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func Test_skipUnbound(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pv)
+	storageclass := "skip-unbound"
+
+	tests := []struct {
+		name           string
+		skipBoundCheck bool
+		ignoreUnbound  bool
+		noVolumeName   bool
+		phase          corev1.PersistentVolumeClaimPhase
+		wantSkipped    bool
+	}{
+		{
+			name:           "pending PVC is skipped",
+			skipBoundCheck: true,
+			phase:          corev1.ClaimPending,
+			wantSkipped:    true,
+		},
+		{
+			name:           "bound PVC is processed",
+			skipBoundCheck: true,
+			phase:          corev1.ClaimBound,
+			wantSkipped:    false,
+		},
+		{
+			name:           "pending PVC is processed without the bound check",
+			skipBoundCheck: false,
+			phase:          corev1.ClaimPending,
+			wantSkipped:    false,
+		},
+		{
+			name:          "pending PVC is skipped with ignore-unbound-pvcs",
+			ignoreUnbound: true,
+			phase:         corev1.ClaimPending,
+			wantSkipped:   true,
+		},
+		{
+			name:          "bound PVC without a volume name is skipped with ignore-unbound-pvcs",
+			ignoreUnbound: true,
+			noVolumeName:  true,
+			phase:         corev1.ClaimBound,
+			wantSkipped:   true,
+		},
+		{
+			name:          "bound PVC is processed with ignore-unbound-pvcs",
+			ignoreUnbound: true,
+			phase:         corev1.ClaimBound,
+			wantSkipped:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old bool) { skipBoundCheck = old }(skipBoundCheck)
+			defer func(old bool) { ignoreUnboundPVCs = old }(ignoreUnboundPVCs)
+			skipBoundCheck = tt.skipBoundCheck
+			ignoreUnboundPVCs = tt.ignoreUnbound
+
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "my-pvc",
+					Namespace: "default",
+					Annotations: map[string]string{
+						annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+						"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+					},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					VolumeName:       "my-pv",
+					StorageClassName: &storageclass,
+				},
+				Status: corev1.PersistentVolumeClaimStatus{Phase: tt.phase},
+			}
+			if tt.noVolumeName {
+				pvc.Spec.VolumeName = ""
+			}
+			getDiskCalled := false
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					getDiskCalled = true
+					return &compute.Disk{Name: name, Labels: map[string]string{"foo": "bar"}}, nil
+				},
+			}
+			before := testutil.ToFloat64(promSkippedUnboundTotal.WithLabelValues(storageclass))
+
+			r := &pvcReconciler{gcpClient: client}
+			err := r.reconcileAdd(context.Background(), pvc)
+			if wantRetry := tt.wantSkipped && tt.ignoreUnbound; errors.Is(err, errUnbound) != wantRetry {
+				t.Errorf("reconcileAdd() error = %v, want retry %v", err, wantRetry)
+			}
+			if getDiskCalled == tt.wantSkipped {
+				t.Errorf("GetDisk() called = %v, want %v", getDiskCalled, !tt.wantSkipped)
+			}
+			wantCount := 0.0
+			if tt.wantSkipped {
+				wantCount = 1
+			}
+			if got := testutil.ToFloat64(promSkippedUnboundTotal.WithLabelValues(storageclass)) - before; got != wantCount {
+				t.Errorf("promSkippedUnboundTotal increased by %v, want %v", got, wantCount)
+			}
+		})
+	}
+}
+
+func Test_processNextEventRequeueUnbound(t *testing.T) {
+	defer func(old bool) { ignoreUnboundPVCs = old }(ignoreUnboundPVCs)
+	defer func(old time.Duration) { requeueUnboundAfter = old }(requeueUnboundAfter)
+	ignoreUnboundPVCs = true
+	requeueUnboundAfter = 30 * time.Second
+
+	pending := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"}}
+	pending.Status.Phase = corev1.ClaimPending
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(pending); err != nil {
+		t.Fatal(err)
+	}
+	fakeClock := testingclock.NewFakeClock(time.Now())
+	queue := workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{Clock: fakeClock})
+	defer queue.ShutDown()
+	r := &pvcReconciler{pvcLister: corelisters.NewPersistentVolumeClaimLister(indexer)}
+
+	// waitForRetry steps the clock to just before and to the retry of the
+	// unbound PVC and returns the retry event
+	waitForRetry := func() *pvcEvent {
+		t.Helper()
+		fakeClock.Step(requeueUnboundAfter - time.Second)
+		if queue.Len() != 0 {
+			t.Fatalf("retried before %v", requeueUnboundAfter)
+		}
+		fakeClock.Step(time.Second)
+		if err := wait.PollUntilContextTimeout(context.Background(), time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+			return queue.Len() == 1, nil
+		}); err != nil {
+			t.Fatalf("not retried after %v", requeueUnboundAfter)
+		}
+		item, _ := queue.Get()
+		queue.Done(item)
+		queue.Add(item)
+		return item.(*pvcEvent)
+	}
+
+	queue.Add(newPVCEvent(pvcEventAdd, nil, pending.DeepCopy()))
+	r.processNextEvent(context.Background(), queue)
+	if e := waitForRetry(); e.eventType != pvcEventUnbound || e.pvc.GetName() != "my-pvc" {
+		t.Errorf("retry event = %s for %s, want %s for my-pvc", e.eventType, e.pvc.GetName(), pvcEventUnbound)
+	}
+
+	// still unbound, retried again
+	r.processNextEvent(context.Background(), queue)
+	waitForRetry()
+
+	// deleted PVCs are not retried
+	if err := indexer.Delete(pending); err != nil {
+		t.Fatal(err)
+	}
+	r.processNextEvent(context.Background(), queue)
+	fakeClock.Step(requeueUnboundAfter)
+	time.Sleep(10 * time.Millisecond)
+	if queue.Len() != 0 {
+		t.Errorf("deleted PVC retried, queue length = %d", queue.Len())
+	}
+}
+
+func Test_skipNamespaceNotSelected(t *testing.T) {
+	defer func(old corelisters.NamespaceLister) { nsLister = old }(nsLister)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "prod", Labels: map[string]string{"env": "production", "team": "db"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"env": "development"}}},
+	} {
+		if err := indexer.Add(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nsLister = corelisters.NewNamespaceLister(indexer)
+
+	tests := []struct {
+		name      string
+		selector  string
+		namespace string
+		wantSkip  bool
+	}{
+		{
+			name:      "empty selector matches all namespaces",
+			namespace: "dev",
+			wantSkip:  false,
+		},
+		{
+			name:      "matching namespace",
+			selector:  "env=production",
+			namespace: "prod",
+			wantSkip:  false,
+		},
+		{
+			name:      "matching set based selector",
+			selector:  "env in (production, staging), team",
+			namespace: "prod",
+			wantSkip:  false,
+		},
+		{
+			name:      "non-matching namespace",
+			selector:  "env=production",
+			namespace: "dev",
+			wantSkip:  true,
+		},
+		{
+			name:      "unknown namespace",
+			selector:  "env=production",
+			namespace: "missing",
+			wantSkip:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old labels.Selector) { namespaceSelector = old }(namespaceSelector)
+			namespaceSelector = nil
+			if tt.selector != "" {
+				selector, err := labels.Parse(tt.selector)
+				if err != nil {
+					t.Fatal(err)
+				}
+				namespaceSelector = selector
+			}
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: tt.namespace}}
+			if got := skipNamespaceNotSelected(pvc); got != tt.wantSkip {
+				t.Errorf("skipNamespaceNotSelected() = %v, want %v", got, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func Test_skipNotStatefulSetOwned(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pv)
+
+	tests := []struct {
+		name            string
+		statefulSetOnly bool
+		owners          []metav1.OwnerReference
+		wantProcessed   bool
+	}{
+		{
+			name:            "StatefulSet owned PVC is processed",
+			statefulSetOnly: true,
+			owners:          []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db"}},
+			wantProcessed:   true,
+		},
+		{
+			name:            "PVC without owner is skipped",
+			statefulSetOnly: true,
+			wantProcessed:   false,
+		},
+		{
+			name:            "PVC owned by something else is skipped",
+			statefulSetOnly: true,
+			owners:          []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: "my-pod"}},
+			wantProcessed:   false,
+		},
+		{
+			name:            "PVC without owner is processed when disabled",
+			statefulSetOnly: false,
+			wantProcessed:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old bool) { statefulSetPVCsOnly = old }(statefulSetPVCsOnly)
+			statefulSetPVCsOnly = tt.statefulSetOnly
+
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "data-db-0",
+					Namespace:       "default",
+					OwnerReferences: tt.owners,
+					Annotations: map[string]string{
+						annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+						"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+					},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					VolumeName:       "my-pv",
+					StorageClassName: &dummyStorageClassName,
+				},
+			}
+			getDiskCalled := false
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					getDiskCalled = true
+					return &compute.Disk{Name: name, Labels: map[string]string{"foo": "bar"}}, nil
+				},
+			}
+
+			r := &pvcReconciler{gcpClient: client}
+			r.reconcileAdd(context.Background(), pvc)
+
+			if getDiskCalled != tt.wantProcessed {
+				t.Errorf("GetDisk() called = %v, want %v", getDiskCalled, tt.wantProcessed)
+			}
+		})
+	}
+}
+
+func Test_skipAnnotation(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old bool) { labelFingerprint = old }(labelFingerprint)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	labelFingerprint = true
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	// the fingerprint of the tags, as if they were synced before the PVC
+	// was annotated
+	fingerprint := tagsFingerprint(volumeID, map[string]string{"foo": "bar"})
+
+	newPVC := func(resourceVersion, skip string) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "my-pvc",
+				Namespace:       "default",
+				ResourceVersion: resourceVersion,
+				Annotations: map[string]string{
+					annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+					"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+					labelFingerprintAnnotation:                 fingerprint,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       "my-pv",
+				StorageClassName: &dummyStorageClassName,
+			},
+		}
+		if skip != "" {
+			pvc.Annotations[skipAnnotation] = skip
+		}
+		return pvc
+	}
+
+	tests := []struct {
+		name          string
+		reconcile     func(r *pvcReconciler, ctx context.Context) error
+		wantProcessed bool
+	}{
+		{
+			name: "annotated PVC is skipped when added",
+			reconcile: func(r *pvcReconciler, ctx context.Context) error {
+				return r.reconcileAdd(ctx, newPVC("1", "true"))
+			},
+			wantProcessed: false,
+		},
+		{
+			name: "annotated PVC is skipped when updated",
+			reconcile: func(r *pvcReconciler, ctx context.Context) error {
+				updated := newPVC("2", "true")
+				updated.Annotations[annotationPrefix+"/tags"] = `{"foo": "baz"}`
+				return r.reconcileUpdate(ctx, newPVC("1", "true"), updated)
+			},
+			wantProcessed: false,
+		},
+		{
+			name: "annotated PVC is skipped when its sources change",
+			reconcile: func(r *pvcReconciler, ctx context.Context) error {
+				return r.reconcileSourcesUpdate(ctx, newPVC("1", "true"), tagSources{namespace: map[string]string{"team": "db"}})
+			},
+			wantProcessed: false,
+		},
+		{
+			name: "PVC without the annotation is processed",
+			reconcile: func(r *pvcReconciler, ctx context.Context) error {
+				pvc := newPVC("1", "")
+				delete(pvc.Annotations, labelFingerprintAnnotation)
+				return r.reconcileAdd(ctx, pvc)
+			},
+			wantProcessed: true,
+		},
+		{
+			name: "PVC with another value is processed",
+			reconcile: func(r *pvcReconciler, ctx context.Context) error {
+				pvc := newPVC("1", "false")
+				delete(pvc.Annotations, labelFingerprintAnnotation)
+				return r.reconcileAdd(ctx, pvc)
+			},
+			wantProcessed: true,
+		},
+		{
+			name: "removing the annotation reconciles the PVC despite its fingerprint",
+			reconcile: func(r *pvcReconciler, ctx context.Context) error {
+				return r.reconcileUpdate(ctx, newPVC("1", "true"), newPVC("2", ""))
+			},
+			wantProcessed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getDiskCalled := false
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					getDiskCalled = true
+					return &compute.Disk{Name: name, Labels: map[string]string{"foo": "bar"}}, nil
+				},
+			}
+
+			r := &pvcReconciler{gcpClient: client}
+			if err := tt.reconcile(r, context.Background()); err != nil {
+				t.Fatalf("reconcile error = %v", err)
+			}
+			if getDiskCalled != tt.wantProcessed {
+				t.Errorf("GetDisk() called = %v, want %v", getDiskCalled, tt.wantProcessed)
+			}
+		})
+	}
+}
+
+func TestBuildClientKubeconfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major": "1", "minor": "29", "gitVersion": "v1.29.0"}`))
+	}))
+	defer server.Close()
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	contents := `apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: ` + server.URL + `
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+current-context: fake
+users:
+- name: fake
+  user:
+    token: fake-token
+`
+	if err := os.WriteFile(kubeconfig, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// an explicit kubeconfig must win even when running in a cluster
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+	client, err := BuildClient(kubeconfig, "")
+	if err != nil {
+		t.Fatalf("BuildClient() error = %v", err)
+	}
+	version, err := client.Discovery().ServerVersion()
+	if err != nil {
+		t.Fatalf("ServerVersion() error = %v", err)
+	}
+	if version.GitVersion != "v1.29.0" {
+		t.Errorf("ServerVersion() = %v, want v1.29.0", version.GitVersion)
+	}
+
+	if _, err := BuildClient(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("BuildClient() with a missing kubeconfig did not return an error")
+	}
+}
+
+func Test_syncBackSanitizedKeys(t *testing.T) {
+	tests := []struct {
+		name           string
+		syncBack       bool
+		tags           map[string]string
+		wantAnnotation string
+		wantOk         bool
+	}{
+		{
+			name:           "sync back enabled",
+			syncBack:       true,
+			tags:           map[string]string{"kubernetes.io/app": "foo", "team": "bar"},
+			wantAnnotation: `{"kubernetes.io/app":"kubernetes-io_app"}`,
+			wantOk:         true,
+		},
+		{
+			name:     "sync back disabled",
+			syncBack: false,
+			tags:     map[string]string{"kubernetes.io/app": "foo", "team": "bar"},
+			wantOk:   false,
+		},
+		{
+			name:     "no keys sanitized",
+			syncBack: true,
+			tags:     map[string]string{"team": "bar"},
+			wantOk:   false,
+		},
+	}
+	defer func() { pvcAnnotationSyncBack = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvcAnnotationSyncBack = tt.syncBack
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "my-ns"}}
+			k8sClient = fake.NewSimpleClientset(pvc)
+
+			syncBackSanitizedKeys(context.Background(), pvc, tt.tags)
+
+			got, err := k8sClient.CoreV1().PersistentVolumeClaims("my-ns").Get(context.TODO(), "my-pvc", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			annotation, ok := got.GetAnnotations()[sanitizedKeysAnnotation]
+			if ok != tt.wantOk || annotation != tt.wantAnnotation {
+				t.Errorf("sanitized-keys annotation = %q (present %v), want %q (present %v)", annotation, ok, tt.wantAnnotation, tt.wantOk)
+			}
+		})
+	}
+}
+
+// BenchmarkReconcileBurst1000 measures how long 10 workers take to reconcile
+// a burst of 1000 PVCs, spread over 5 StorageClasses and 10 namespaces,
+// against a GCP client that responds immediately. Run it with -benchmem to
+// compare against previous runs.
+func BenchmarkReconcileBurst1000(b *testing.B) {
+	const (
+		numPVCs    = 1000
+		numWorkers = 10
+	)
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old log.Level) { log.SetLevel(old) }(log.GetLevel())
+	cloud = GCP
+	log.SetLevel(log.ErrorLevel)
+
+	var objects []runtime.Object
+	pvcs := make([]*corev1.PersistentVolumeClaim, 0, numPVCs)
+	for i := 0; i < numPVCs; i++ {
+		name := fmt.Sprintf("pvc-%d", i)
+		objects = append(objects, &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "projects/my-project/zones/us-east1-a/disks/" + name},
+				},
+			},
+		})
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: fmt.Sprintf("namespace-%d", i%10),
+				Annotations: map[string]string{
+					annotationPrefix + "/tags":                 `{"team": "storage", "env": "bench"}`,
+					"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       name,
+				StorageClassName: ptr.To(fmt.Sprintf("storageclass-%d", i%5)),
+			},
+		}
+		objects = append(objects, pvc)
+		pvcs = append(pvcs, pvc)
+	}
+	k8sClient = fake.NewSimpleClientset(objects...)
+
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			return &compute.Operation{Name: name, Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Name: name, Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		for _, pvc := range pvcs {
+			queue.Add(newPVCEvent(pvcEventAdd, nil, pvc))
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < numWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r.processNextEvent(context.Background(), queue) {
+				}
+			}()
+		}
+		queue.ShutDownWithDrain()
+		wg.Wait()
+	}
+}
+
+func Test_reconcileAddKeyCollisionEvent(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old string) { gcpCollisionStrategy = old }(gcpCollisionStrategy)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"app.foo/bar": "longest", "app-foo_bar": "short"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	tests := []struct {
+		strategy   string
+		wantLabels map[string]string
+		wantEvent  string
+	}{
+		{
+			strategy:   collisionFirstAlphabetical,
+			wantLabels: map[string]string{"app-foo_bar": "short"},
+			wantEvent:  `Warning LabelKeyCollision Label keys app-foo_bar, app.foo/bar all become GCP label key "app-foo_bar", only "app-foo_bar" is used`,
+		},
+		{
+			strategy:   collisionLastAlphabetical,
+			wantLabels: map[string]string{"app-foo_bar": "longest"},
+			wantEvent:  `Warning LabelKeyCollision Label keys app-foo_bar, app.foo/bar all become GCP label key "app-foo_bar", only "app.foo/bar" is used`,
+		},
+		{
+			strategy:   collisionLongestValue,
+			wantLabels: map[string]string{"app-foo_bar": "longest"},
+			wantEvent:  `Warning LabelKeyCollision Label keys app-foo_bar, app.foo/bar all become GCP label key "app-foo_bar", only "app.foo/bar" is used`,
+		},
+		{
+			strategy:  collisionError,
+			wantEvent: `Warning LabelKeyCollision Label keys app-foo_bar, app.foo/bar all become GCP label key "app-foo_bar", none of them is used`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			gcpCollisionStrategy = tt.strategy
+			var gotLabels map[string]string
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Name: name}, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					gotLabels = labelReq.Labels
+					return nil, errors.New("stop before waiting on the operation")
+				},
+			}
+			recorder := record.NewFakeRecorder(10)
+			r := &pvcReconciler{gcpClient: client, recorder: recorder}
+			r.reconcileAdd(context.Background(), pvc)
+
+			if !maps.Equal(gotLabels, tt.wantLabels) {
+				t.Errorf("SetDiskLabels() labels = %v, want %v", gotLabels, tt.wantLabels)
+			}
+			events := drainEvents(recorder)
+			if len(events) == 0 || events[0] != tt.wantEvent {
+				t.Errorf("events = %q, want %q first", events, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func Test_reconcileAddSkipDeleteReclaimPolicy(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old bool) { skipDeleteReclaimPolicy = old }(skipDeleteReclaimPolicy)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+
+	tests := []struct {
+		name          string
+		skip          bool
+		reclaimPolicy corev1.PersistentVolumeReclaimPolicy
+		wantTagged    bool
+	}{
+		{
+			name:          "Delete policy skipped",
+			skip:          true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			name:          "Retain policy tagged",
+			skip:          true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			wantTagged:    true,
+		},
+		{
+			name:          "Delete policy tagged without the flag",
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			wantTagged:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipDeleteReclaimPolicy = tt.skip
+			k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeReclaimPolicy: tt.reclaimPolicy,
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "projects/my-project/zones/us-east1-a/disks/my-disk"},
+					},
+				},
+			})
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "my-pvc",
+					Namespace: "default",
+					Annotations: map[string]string{
+						annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+						"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+					},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					VolumeName:       "my-pv",
+					StorageClassName: &dummyStorageClassName,
+				},
+			}
+
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Name: name}, nil
+				},
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					return nil, errors.New("stop before waiting on the operation")
+				},
+			}
+			r := &pvcReconciler{gcpClient: client}
+			r.reconcileAdd(context.Background(), pvc)
+			if client.setLabelsCalled != tt.wantTagged {
+				t.Errorf("SetDiskLabels() called = %v, want %v", client.setLabelsCalled, tt.wantTagged)
+			}
+		})
+	}
+}
+
+func Test_resyncPVCs(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		if err := indexer.Add(&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvcLister := corelisters.NewPersistentVolumeClaimLister(indexer)
+	queue := workqueue.New()
+	defer queue.ShutDown()
+	fakeClock := testingclock.NewFakeClock(time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		resyncPVCs(ctx, fakeClock, time.Hour, pvcLister, queue)
+		close(done)
+	}()
+
+	// queuedPVCs waits for the resync to queue want events and returns their PVCs
+	queuedPVCs := func(want int) []string {
+		t.Helper()
+		if err := wait.PollUntilContextTimeout(context.Background(), time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+			return queue.Len() >= want, nil
+		}); err != nil {
+			t.Fatalf("got %d queued events, want %d", queue.Len(), want)
+		}
+		var pvcs []string
+		for queue.Len() > 0 {
+			item, _ := queue.Get()
+			e := item.(*pvcEvent)
+			if e.eventType != pvcEventResync {
+				t.Errorf("event type = %s, want %s", e.eventType, pvcEventResync)
+			}
+			pvcs = append(pvcs, e.pvc.GetName())
+			queue.Done(item)
+		}
+		slices.Sort(pvcs)
+		return pvcs
+	}
+
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	fakeClock.Step(59 * time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if queue.Len() != 0 {
+		t.Errorf("got %d queued events before the resync period passed, want 0", queue.Len())
+	}
+	for i := 1; i <= 2; i++ {
+		fakeClock.Step(time.Hour)
+		if got, want := queuedPVCs(3), []string{"pvc-1", "pvc-2", "pvc-3"}; !slices.Equal(got, want) {
+			t.Errorf("resync %d queued %v, want %v", i, got, want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("resyncPVCs() didn't return after the context was cancelled")
+	}
+}
+
+func Test_patchPVCAnnotationsServerSideApply(t *testing.T) {
+	defer func(old bool) { serverSideApply = old }(serverSideApply)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	serverSideApply = true
+
+	stored := &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				labelFingerprintAnnotation: "fingerprint",
+				"other-controller/owned":   "value",
+			},
+		},
+	}
+	var gotContentType, gotFieldManager, gotForce string
+	var applied map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/persistentvolumeclaims/my-pvc" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			gotContentType = r.Header.Get("Content-Type")
+			gotFieldManager = r.URL.Query().Get("fieldManager")
+			gotForce = r.URL.Query().Get("force")
+			if err := json.NewDecoder(r.Body).Decode(&applied); err != nil {
+				t.Errorf("invalid apply configuration: %v", err)
+			}
+		default:
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stored)
+	}))
+	defer srv.Close()
+	var err error
+	k8sClient, err = kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the informer's copy doesn't have the fingerprint written earlier yet
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"}}
+	patchPVCAnnotations(context.Background(), pvc, map[string]string{lastSyncTimeAnnotation: "2024-01-01T00:00:00Z", lastSyncErrorAnnotation: ""})
+
+	if gotContentType != string(types.ApplyPatchType) {
+		t.Errorf("Content-Type = %q, want %q", gotContentType, types.ApplyPatchType)
+	}
+	if gotFieldManager != fieldManager {
+		t.Errorf("fieldManager = %q, want %q", gotFieldManager, fieldManager)
+	}
+	if gotForce != "true" {
+		t.Errorf("force = %q, want true", gotForce)
+	}
+	want := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolumeClaim",
+		"metadata": map[string]interface{}{
+			"name":      "my-pvc",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				labelFingerprintAnnotation: "fingerprint",
+				lastSyncTimeAnnotation:     "2024-01-01T00:00:00Z",
+				lastSyncErrorAnnotation:    "",
+			},
+		},
+	}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("apply configuration = %v, want %v", applied, want)
+	}
+}
+
+func Test_backfillPVCs(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, phase := range map[string]corev1.PersistentVolumeClaimPhase{
+		"pvc-1":   corev1.ClaimBound,
+		"pvc-2":   corev1.ClaimBound,
+		"pvc-3":   corev1.ClaimBound,
+		"pending": corev1.ClaimPending,
+	} {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				// skipped by the reconciler, so no cloud is needed
+				Annotations: map[string]string{skipAnnotation: "true"},
+			},
+			Status: corev1.PersistentVolumeClaimStatus{Phase: phase},
+		}
+		if err := indexer.Add(pvc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue := newPVCQueue(2, "backfill-test")
+	defer queue.ShutDown()
+	queued := promBackfillTotal.With(prometheus.Labels{"status": "queued"})
+	processed := promBackfillTotal.With(prometheus.Labels{"status": "processed"})
+	queuedBefore, processedBefore := testutil.ToFloat64(queued), testutil.ToFloat64(processed)
+
+	backfillPVCs(corelisters.NewPersistentVolumeClaimLister(indexer), queue)
+	if got := testutil.ToFloat64(queued) - queuedBefore; got != 3 {
+		t.Errorf("promBackfillTotal queued increased by %v, want 3", got)
+	}
+
+	// the rate limited events may take a moment to be queued
+	if err := wait.PollUntilContextTimeout(context.Background(), time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		return queue.Len() == 3, nil
+	}); err != nil {
+		t.Fatalf("got %d queued events, want 3", queue.Len())
+	}
+	var pvcs []string
+	r := &pvcReconciler{}
+	for _, shard := range queue.shards {
+		for _, item := range drainQueue(shard) {
+			e := item.(*pvcEvent)
+			if e.eventType != pvcEventBackfill {
+				t.Errorf("event type = %s, want %s", e.eventType, pvcEventBackfill)
+			}
+			pvcs = append(pvcs, e.pvc.GetName())
+			shard.Add(item)
+			r.processNextEvent(context.Background(), shard)
+		}
+	}
+	slices.Sort(pvcs)
+	if want := []string{"pvc-1", "pvc-2", "pvc-3"}; !slices.Equal(pvcs, want) {
+		t.Errorf("backfilled %v, want %v", pvcs, want)
+	}
+	if got := testutil.ToFloat64(processed) - processedBefore; got != 3 {
+		t.Errorf("promBackfillTotal processed increased by %v, want 3", got)
+	}
+}
+
+// drainQueue takes all the items off the queue
+func drainQueue(queue workqueue.Interface) []interface{} {
+	var items []interface{}
+	for queue.Len() > 0 {
+		item, _ := queue.Get()
+		queue.Done(item)
+		items = append(items, item)
+	}
+	return items
+}
+
+func Test_pvcEventHandler(t *testing.T) {
+	defer func(old bool) { backfillOnStart = old }(backfillOnStart)
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"}}
+
+	tests := []struct {
+		name            string
+		backfillOnStart bool
+		isInInitialList bool
+		wantQueued      bool
+	}{
+		{name: "initial list", isInInitialList: true, wantQueued: true},
+		{name: "initial list with backfill", backfillOnStart: true, isInInitialList: true, wantQueued: false},
+		{name: "new PVC with backfill", backfillOnStart: true, wantQueued: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backfillOnStart = tt.backfillOnStart
+			queue := workqueue.New()
+			defer queue.ShutDown()
+			pvcEventHandler(queue).OnAdd(pvc.DeepCopy(), tt.isInInitialList)
+			if got := queue.Len() == 1; got != tt.wantQueued {
+				t.Errorf("queued = %v, want %v", got, tt.wantQueued)
 			}
-			defaultTags = map[string]string{}
 		})
 	}
 }
@@ -0,0 +1,285 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	logBackendLogrus = "logrus"
+	logBackendSlog   = "slog"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// defaultLogFormat returns the log format set by the LOG_FORMAT environment
+// variable: json, unless it is set to something else
+func defaultLogFormat() string {
+	if logFormatEnv == "" || strings.ToLower(logFormatEnv) == logFormatJSON {
+		return logFormatJSON
+	}
+	return logFormatText
+}
+
+// setLogFormat makes logrus write the logs as text or json
+func setLogFormat(format string) error {
+	switch format {
+	case logFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, must be %s or %s", format, logFormatText, logFormatJSON)
+	}
+	logFormat = format
+	return nil
+}
+
+type pvcLogFieldsKey struct{}
+
+// withPVCLogFields returns a context that adds the pvc_name and namespace of
+// the PVC to the messages logged with it, see logFieldsHook
+func withPVCLogFields(ctx context.Context, pvc *corev1.PersistentVolumeClaim) context.Context {
+	return context.WithValue(ctx, pvcLogFieldsKey{}, log.Fields{"pvc_name": pvc.GetName(), "namespace": pvc.GetNamespace()})
+}
+
+// pvcLogFields returns the fields of the PVC set by withPVCLogFields, if any
+func pvcLogFields(ctx context.Context) (log.Fields, bool) {
+	fields, ok := ctx.Value(pvcLogFieldsKey{}).(log.Fields)
+	return fields, ok
+}
+
+// logFieldsHook adds the cloud_provider to every logrus message, and the
+// pvc_name and namespace to those logged with a context from withPVCLogFields.
+// Fields set by the message itself are kept.
+type logFieldsHook struct{}
+
+func (h *logFieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *logFieldsHook) Fire(entry *log.Entry) error {
+	fields := log.Fields{"cloud_provider": cloud}
+	if entry.Context != nil {
+		if pvcFields, ok := pvcLogFields(entry.Context); ok {
+			maps.Copy(fields, pvcFields)
+		}
+	}
+	for k, v := range fields {
+		if _, ok := entry.Data[k]; !ok {
+			entry.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// Logger is a structured logger. args are alternating keys and values, as
+// with log/slog.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+	// With returns a Logger that adds args to every message
+	With(args ...any) Logger
+	// WithContext returns a Logger that adds the fields of the PVC set on ctx
+	// by withPVCLogFields to every message
+	WithContext(ctx context.Context) Logger
+}
+
+// logger is the Logger selected with --log-backend
+var logger Logger = newLogrusLogger(log.StandardLogger())
+
+// setLogBackend makes logger use the backend. With slog, the messages still
+// logged with logrus are sent to slog too, so all logs have the same format.
+func setLogBackend(backend string) error {
+	switch backend {
+	case logBackendLogrus:
+		logger = newLogrusLogger(log.StandardLogger())
+	case logBackendSlog:
+		var handler slog.Handler
+		opts := &slog.HandlerOptions{Level: logrusLeveler{log.StandardLogger()}}
+		if logFormat == logFormatJSON {
+			handler = slog.NewJSONHandler(os.Stderr, opts)
+		} else {
+			handler = slog.NewTextHandler(os.Stderr, opts)
+		}
+		l := slog.New(handler)
+		logger = newSlogLogger(l)
+		log.SetOutput(io.Discard)
+		log.AddHook(&slogHook{logger: l})
+	default:
+		return fmt.Errorf("invalid log backend %q, must be %s or %s", backend, logBackendLogrus, logBackendSlog)
+	}
+	return nil
+}
+
+type logrusLogger struct {
+	entry *log.Entry
+}
+
+func newLogrusLogger(l *log.Logger) Logger {
+	return &logrusLogger{entry: log.NewEntry(l)}
+}
+
+func (l *logrusLogger) Debug(msg string, args ...any) {
+	l.entry.WithFields(argsToFields(args)).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, args ...any) {
+	l.entry.WithFields(argsToFields(args)).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, args ...any) {
+	l.entry.WithFields(argsToFields(args)).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, args ...any) {
+	l.entry.WithFields(argsToFields(args)).Error(msg)
+}
+
+func (l *logrusLogger) With(args ...any) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(argsToFields(args))}
+}
+
+// WithContext sets ctx on the logrus entries, whose PVC fields are added by
+// logFieldsHook
+func (l *logrusLogger) WithContext(ctx context.Context) Logger {
+	return &logrusLogger{entry: l.entry.WithContext(ctx)}
+}
+
+// argsToFields converts alternating keys and values to logrus fields. Like
+// log/slog, a value without a string key is logged with the key !BADKEY.
+func argsToFields(args []any) log.Fields {
+	fields := make(log.Fields, len(args)/2)
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			fields["!BADKEY"] = args[0]
+			args = args[1:]
+			continue
+		}
+		fields[key] = args[1]
+		args = args[2:]
+	}
+	return fields
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func newSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{logger: l}
+}
+
+func (l *slogLogger) Debug(msg string, args ...any) {
+	l.logger.Debug(msg, args...)
+}
+
+func (l *slogLogger) Info(msg string, args ...any) {
+	l.logger.Info(msg, args...)
+}
+
+func (l *slogLogger) Warn(msg string, args ...any) {
+	l.logger.Warn(msg, args...)
+}
+
+func (l *slogLogger) Error(msg string, args ...any) {
+	l.logger.Error(msg, args...)
+}
+
+func (l *slogLogger) With(args ...any) Logger {
+	return &slogLogger{logger: l.logger.With(args...)}
+}
+
+func (l *slogLogger) WithContext(ctx context.Context) Logger {
+	fields, ok := pvcLogFields(ctx)
+	if !ok {
+		return l
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	args := make([]any, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, fields[k])
+	}
+	return l.With(args...)
+}
+
+// logrusLeveler makes slog follow the level of a logrus logger, which is
+// set by the DEBUG environment variable
+type logrusLeveler struct {
+	logger *log.Logger
+}
+
+func (l logrusLeveler) Level() slog.Level {
+	return slogLevel(l.logger.GetLevel())
+}
+
+func slogLevel(level log.Level) slog.Level {
+	switch level {
+	case log.TraceLevel, log.DebugLevel:
+		return slog.LevelDebug
+	case log.InfoLevel:
+		return slog.LevelInfo
+	case log.WarnLevel:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// slogHook sends logrus entries to slog
+type slogHook struct {
+	logger *slog.Logger
+}
+
+func (h *slogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *slogHook) Fire(entry *log.Entry) error {
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	args := make([]any, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, entry.Data[k])
+	}
+	h.logger.Log(context.Background(), slogLevel(entry.Level), entry.Message, args...)
+	return nil
+}
@@ -0,0 +1,335 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// decodeLogLines returns the json log lines written to buf without their time
+func decodeLogLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	dec := json.NewDecoder(buf)
+	for {
+		line := map[string]any{}
+		if err := dec.Decode(&line); err == io.EOF {
+			return lines
+		} else if err != nil {
+			t.Fatalf("invalid log line: %v", err)
+		}
+		delete(line, "time")
+		lines = append(lines, line)
+	}
+}
+
+func TestLoggerAdapters(t *testing.T) {
+	tests := []struct {
+		name      string
+		newLogger func(buf *bytes.Buffer) Logger
+		want      []map[string]any
+	}{
+		{
+			name: "logrus",
+			newLogger: func(buf *bytes.Buffer) Logger {
+				l := log.New()
+				l.SetOutput(buf)
+				l.SetFormatter(&log.JSONFormatter{})
+				return newLogrusLogger(l)
+			},
+			want: []map[string]any{
+				{"level": "info", "msg": "info message", "volumeID": "vol-1"},
+				{"level": "warning", "msg": "warn message", "pvc": "my-pvc", "count": float64(2)},
+				{"level": "error", "msg": "error message", "pvc": "my-pvc", "namespace": "default", "!BADKEY": "odd"},
+			},
+		},
+		{
+			name: "slog",
+			newLogger: func(buf *bytes.Buffer) Logger {
+				return newSlogLogger(slog.New(slog.NewJSONHandler(buf, nil)))
+			},
+			want: []map[string]any{
+				{"level": "INFO", "msg": "info message", "volumeID": "vol-1"},
+				{"level": "WARN", "msg": "warn message", "pvc": "my-pvc", "count": float64(2)},
+				{"level": "ERROR", "msg": "error message", "pvc": "my-pvc", "namespace": "default", "!BADKEY": "odd"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := tt.newLogger(&buf)
+
+			l.Debug("debug message", "key", "value")
+			l.Info("info message", "volumeID", "vol-1")
+			l.With("pvc", "my-pvc").Warn("warn message", "count", 2)
+			l.With("pvc", "my-pvc").With("namespace", "default").Error("error message", "odd")
+
+			lines := decodeLogLines(t, &buf)
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got %d log lines, want %d: %v", len(lines), len(tt.want), lines)
+			}
+			for i := range tt.want {
+				if !maps.Equal(lines[i], tt.want[i]) {
+					t.Errorf("log line %d = %v, want %v", i, lines[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSlogHook(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New()
+	l.SetOutput(io.Discard)
+	l.SetLevel(log.DebugLevel)
+	l.AddHook(&slogHook{logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: logrusLeveler{l}}))})
+
+	l.WithFields(log.Fields{"volumeID": "vol-1", "count": 3}).Debugln("Tagged volume")
+	l.Warnf("%d labels dropped", 2)
+
+	want := []map[string]any{
+		{"level": "DEBUG", "msg": "Tagged volume", "volumeID": "vol-1", "count": float64(3)},
+		{"level": "WARN", "msg": "2 labels dropped"},
+	}
+	lines := decodeLogLines(t, &buf)
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines, want %d: %v", len(lines), len(want), lines)
+	}
+	for i := range want {
+		if !maps.Equal(lines[i], want[i]) {
+			t.Errorf("log line %d = %v, want %v", i, lines[i], want[i])
+		}
+	}
+
+	l.SetLevel(log.InfoLevel)
+	if (logrusLeveler{l}).Level() != slog.LevelInfo {
+		t.Errorf("logrusLeveler.Level() = %v, want %v", logrusLeveler{l}.Level(), slog.LevelInfo)
+	}
+}
+
+func TestSetLogBackend(t *testing.T) {
+	defer func(old Logger) { logger = old }(logger)
+
+	if err := setLogBackend(logBackendLogrus); err != nil {
+		t.Errorf("setLogBackend(%q) error = %v", logBackendLogrus, err)
+	}
+	if _, ok := logger.(*logrusLogger); !ok {
+		t.Errorf("logger = %T, want *logrusLogger", logger)
+	}
+	if err := setLogBackend("zap"); err == nil {
+		t.Error("setLogBackend(\"zap\") error = nil, want an error")
+	}
+}
+
+func TestLogFieldsHook(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+
+	var buf bytes.Buffer
+	l := log.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&log.JSONFormatter{})
+	l.AddHook(&logFieldsHook{})
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"}}
+	ctx := withPVCLogFields(context.Background(), pvc)
+	l.WithContext(ctx).Infoln("New PVC Added to Store")
+	l.WithContext(ctx).WithFields(log.Fields{"volumeID": "vol-1", "namespace": "other"}).Errorln("Could not create tags")
+	l.Warnln("no PVC")
+
+	want := []map[string]any{
+		{"level": "info", "msg": "New PVC Added to Store", "cloud_provider": "gcp", "pvc_name": "my-pvc", "namespace": "default"},
+		{"level": "error", "msg": "Could not create tags", "cloud_provider": "gcp", "pvc_name": "my-pvc", "namespace": "other", "volumeID": "vol-1"},
+		{"level": "warning", "msg": "no PVC", "cloud_provider": "gcp"},
+	}
+	lines := decodeLogLines(t, &buf)
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines, want %d: %v", len(lines), len(want), lines)
+	}
+	for i := range want {
+		if !maps.Equal(lines[i], want[i]) {
+			t.Errorf("log line %d = %v, want %v", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestSetLogFormat(t *testing.T) {
+	defer func(old log.Formatter) { log.SetFormatter(old) }(log.StandardLogger().Formatter)
+	defer func(old string) { logFormat = old }(logFormat)
+	defer func(old io.Writer) { log.SetOutput(old) }(log.StandardLogger().Out)
+
+	tests := []struct {
+		format   string
+		wantJSON bool
+		wantErr  bool
+	}{
+		{format: logFormatJSON, wantJSON: true},
+		{format: logFormatText},
+		{format: "yaml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if err := setLogFormat(tt.format); (err != nil) != tt.wantErr {
+				t.Fatalf("setLogFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			log.WithField("volumeID", "vol-1").Errorln("Could not create tags")
+
+			line := map[string]any{}
+			err := json.Unmarshal(buf.Bytes(), &line)
+			if tt.wantJSON && (err != nil || line["msg"] != "Could not create tags" || line["volumeID"] != "vol-1") {
+				t.Errorf("log line %q isn't the json message, err = %v", buf.String(), err)
+			}
+			if !tt.wantJSON && err == nil {
+				t.Errorf("log line %q is json, want text", buf.String())
+			}
+		})
+	}
+}
+
+func TestLoggerWithContext(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+
+	tests := []struct {
+		name      string
+		newLogger func(buf *bytes.Buffer) Logger
+		want      []map[string]any
+	}{
+		{
+			name: "logrus",
+			newLogger: func(buf *bytes.Buffer) Logger {
+				l := log.New()
+				l.SetOutput(buf)
+				l.SetFormatter(&log.JSONFormatter{})
+				l.AddHook(&logFieldsHook{})
+				return newLogrusLogger(l)
+			},
+			want: []map[string]any{
+				{"level": "info", "msg": "with PVC", "cloud_provider": "gcp", "pvc_name": "my-pvc", "namespace": "default", "volumeID": "vol-1"},
+				{"level": "info", "msg": "without PVC", "cloud_provider": "gcp"},
+			},
+		},
+		{
+			name: "slog",
+			newLogger: func(buf *bytes.Buffer) Logger {
+				return newSlogLogger(slog.New(slog.NewJSONHandler(buf, nil)))
+			},
+			want: []map[string]any{
+				{"level": "INFO", "msg": "with PVC", "pvc_name": "my-pvc", "namespace": "default", "volumeID": "vol-1"},
+				{"level": "INFO", "msg": "without PVC"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := tt.newLogger(&buf)
+
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default"}}
+			l.WithContext(withPVCLogFields(context.Background(), pvc)).Info("with PVC", "volumeID", "vol-1")
+			l.WithContext(context.Background()).Info("without PVC")
+
+			lines := decodeLogLines(t, &buf)
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got %d log lines, want %d: %v", len(lines), len(tt.want), lines)
+			}
+			for i := range tt.want {
+				if !maps.Equal(lines[i], tt.want[i]) {
+					t.Errorf("log line %d = %v, want %v", i, lines[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerReconcilePVCFields(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old Logger) { logger = old }(logger)
+	cloud = GCP
+
+	var buf bytes.Buffer
+	l := log.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&log.JSONFormatter{})
+	l.SetLevel(log.DebugLevel)
+	l.AddHook(&logFieldsHook{})
+	logger = newLogrusLogger(l)
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pv)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "logged-pvc",
+			Namespace: "logged-ns",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	r := &pvcReconciler{gcpClient: setupFakeGCPClient(t, nil, map[string]string{"foo": "bar"})}
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	queue.Add(newPVCEvent(pvcEventAdd, nil, pvc))
+
+	r.processNextEvent(context.Background(), queue)
+
+	for _, line := range decodeLogLines(t, &buf) {
+		if line["msg"] != "labels to add to PD volume" {
+			continue
+		}
+		if line["pvc_name"] != "logged-pvc" || line["namespace"] != "logged-ns" {
+			t.Errorf("log line %v, want pvc_name logged-pvc and namespace logged-ns", line)
+		}
+		return
+	}
+	t.Error("labels to add to PD volume was not logged")
+}
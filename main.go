@@ -29,15 +29,16 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
@@ -47,6 +48,7 @@ var (
 	buildTime               string = ""
 	debugEnv                string = os.Getenv("DEBUG")
 	logFormatEnv            string = os.Getenv("LOG_FORMAT")
+	logFormat               string
 	debug                   bool
 	defaultTags             map[string]string
 	defaultAnnotationPrefix string = "k8s-pvc-tagger"
@@ -57,6 +59,58 @@ var (
 	allowAllTags            bool
 	cloud                   string
 	copyLabels              []string
+	gcpEnableZonalFallback  bool
+	gcpZoneOverride         string
+	gcpHTTPTimeout          time.Duration
+	gcpPollInterval         time.Duration = time.Second
+	gcpOperationTimeout     time.Duration = time.Minute
+	gcpHyperdiskOpTimeout   time.Duration = 5 * time.Minute
+	cloudRequestTimeout     time.Duration = 30 * time.Second
+	cloudRetryAttempts      int           = 5
+	cloudRetryInterval      time.Duration = 500 * time.Millisecond
+	pvcAnnotationSyncBack   bool
+	labelFingerprint        bool
+	managedLabelKeys        bool
+	deleteRemovedLabels     bool
+	gcpProjectFromMetadata  bool
+	gcpLabelCacheTTL        time.Duration
+	awsInjectIOPS           bool
+	logSanitizationChanges  bool
+	propagateVelero         bool
+	gcpZoneDiskOps          int
+	gcpFingerprintRetries   int = 3
+	gcpImpersonateAccount   string
+	gcpWritesPerSecond      float64
+	resyncPeriod            time.Duration
+	serverSideApply         bool
+	skipBoundCheck          bool
+	skipDeleteReclaimPolicy bool
+	ignoreUnboundPVCs       bool
+	backfillOnStart         bool
+	requeueUnboundAfter     time.Duration = 30 * time.Second
+	shutdownTimeout         time.Duration = 30 * time.Second
+	maxConcurrentReconciles int           = 1
+	storageClassLabelDepth  int
+	gcpDiskNotFound         string
+	labelValueMaxLength     int
+	syncGCPSnapshots        bool
+	syncAWSSnapshots        bool
+	statefulSetPVCsOnly     bool
+	watchPVOnly             bool
+	dryRun                  bool
+	labelPrefixAllowlist    []string
+	pvcLabelPrefix          string
+	labelKeyDenylist        []string
+	inheritNSLabels         []string
+	inheritNodeLabels       []string
+	syncPVLabels            bool
+	stripPrefixes           []string
+	protectedLabelKeys      []string
+	gcpPriorityLabelKeys    []string
+	namespaceSelector       labels.Selector
+	pvcSelector             labels.Selector
+	annotationKeys          []string
+	syncStatusAnnotations   bool
 
 	promActionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "k8s_pvc_tagger_actions_total",
@@ -73,6 +127,74 @@ var (
 		Help: "The total number of invalid tags found",
 	}, []string{"storageclass"})
 
+	promDiskNotFoundTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_disk_not_found_total",
+		Help: "The total number of cloud disks not found while syncing labels",
+	}, []string{"storageclass"})
+
+	promSkippedUnboundTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_skipped_unbound_pvcs_total",
+		Help: "The total number of PVC events skipped because the PVC was not bound yet",
+	}, []string{"storageclass"})
+
+	promLabelsTruncatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_labels_truncated_total",
+		Help: "The total number of labels not set because the disk reached GCP's label limit",
+	}, []string{"storageclass"})
+
+	promFingerprintRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_gcp_fingerprint_retries_total",
+		Help: "The total number of PD label updates retried because the label fingerprint was stale",
+	}, []string{"storageclass"})
+
+	promLabelsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_labels_skipped_total",
+		Help: "The total number of labels not set on a volume, by reason",
+	}, []string{"reason", "cloud_provider", "storageclass"})
+
+	promBackfillTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_backfill_pvcs_total",
+		Help: "The total number of existing PVCs queued and processed by --backfill-on-start",
+	}, []string{"status"})
+
+	promQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_queue_depth",
+		Help: "The number of PVC events waiting on the work queue",
+	}, []string{"namespace"})
+
+	promQueueLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "k8s_pvc_tagger_queue_processing_latency_seconds",
+		Help:    "Time from a PVC event being queued until a worker starts processing it",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"event_type"})
+
+	promWorkqueueLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "k8s_pvc_tagger_queue_latency_seconds",
+		Help:    "Time a PVC event waits on the work queue until a worker takes it, as measured by the work queue",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"namespace"})
+
+	promOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "k8s_pvc_tagger_operation_duration_seconds",
+		Help:    "Time taken to add or delete the labels of a cloud volume, including waiting on the cloud operation",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"operation", "cloud_provider", "storageclass"})
+
+	promPollIterations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_operation_poll_iterations_total",
+		Help: "The total number of times the status of a cloud label operation was polled",
+	}, []string{"operation", "cloud_provider", "storageclass"})
+
+	promCircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_pvc_tagger_circuit_breaker_state",
+		Help: "The state of the cloud API circuit breaker: 0 closed, 1 open, 2 half-open",
+	}, []string{"cloud_provider"})
+
+	promCloudProviderMismatchTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_cloud_provider_mismatch_total",
+		Help: "The total number of PVCs skipped because the CSI driver of their volume belongs to another cloud provider",
+	}, []string{"cloud_provider", "driver"})
+
 	promActionsLegacyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "k8s_aws_ebs_tagger_actions_total",
 		Help: "The total number of PVCs tagged",
@@ -90,13 +212,14 @@ var (
 )
 
 const (
-	AWS = "aws"
-	GCP = "gcp"
+	AWS   = "aws"
+	GCP   = "gcp"
+	AZURE = "azure"
 )
 
 func init() {
-	if logFormatEnv == "" || strings.ToLower(logFormatEnv) == "json" {
-		log.SetFormatter(&log.JSONFormatter{})
+	if err := setLogFormat(defaultLogFormat()); err != nil {
+		log.Fatalln(err)
 	}
 
 	var err error
@@ -124,36 +247,185 @@ func main() {
 	var leaseLockName string
 	var leaseLockNamespace string
 	var leaseID string
+	var leaderElection bool
 	var defaultTagsString string
 	var statusPort string
 	var metricsPort string
+	var healthAddr string
+	var metricsAddr string
+	var webhookMode bool
+	var auditLogFile string
+	var webhookAddr, webhookService, webhookConfigName, webhookSecretName string
 	var copyLabelsString string
-
-	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
+	var gcpCharReplacementsString string
+	var labelPrefixAllowlistStr string
+	var labelKeyDenylistStr string
+	var inheritNSLabelsString string
+	var inheritNodeLabelsString string
+	var stripPrefixesString string
+	var protectedKeysString string
+	var priorityKeysString string
+	var namespaceSelectorStr string
+	var pvcSelectorStr string
+	var annotationKeysString string
+	var keyMappingConfigMap string
+	var scDefaultsConfigMap string
+	var logBackend string
+	var breakerThreshold int
+	var breakerTimeout time.Duration
+
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file. Takes precedence over the in-cluster config")
+	flag.StringVar(&kubeconfig, "kube-config", "", "alias for --kubeconfig")
 	flag.StringVar(&kubeContext, "context", "", "the context to use")
 	flag.StringVar(&region, "region", os.Getenv("AWS_REGION"), "the region")
 	flag.StringVar(&leaseID, "lease-id", uuid.New().String(), "the holder identity name")
 	flag.StringVar(&leaseLockName, "lease-lock-name", "k8s-pvc-tagger", "the lease lock resource name")
 	flag.StringVar(&leaseLockNamespace, "lease-lock-namespace", os.Getenv("NAMESPACE"), "the lease lock resource namespace")
+	flag.BoolVar(&leaderElection, "leader-election", true, "Only tag volumes while holding the lease, so that multiple replicas can run")
+	flag.StringVar(&leaseLockName, "leader-election-id", "k8s-pvc-tagger", "alias for --lease-lock-name")
+	flag.StringVar(&leaseLockNamespace, "leader-election-namespace", os.Getenv("NAMESPACE"), "alias for --lease-lock-namespace")
 	flag.StringVar(&defaultTagsString, "default-tags", "", "Default tags to add to EBS/EFS volume")
 	flag.StringVar(&tagFormat, "tag-format", "json", "Whether the tags are in json or csv format. Default: json")
 	flag.StringVar(&annotationPrefix, "annotation-prefix", "k8s-pvc-tagger", "Annotation prefix to check")
 	flag.StringVar(&watchNamespace, "watch-namespace", os.Getenv("WATCH_NAMESPACE"), "A specific namespace to watch (default is all namespaces)")
-	flag.StringVar(&statusPort, "status-port", "8000", "The healthz port")
-	flag.StringVar(&metricsPort, "metrics-port", "8001", "The prometheus metrics port")
+	flag.StringVar(&healthAddr, "health-addr", ":8081", "The address of the /healthz and /readyz endpoints")
+	flag.StringVar(&auditLogFile, "audit-log-file", "", "Append a JSON line for every add or delete of the labels of a cloud resource to this file")
+	flag.BoolVar(&webhookMode, "webhook-mode", false, "Serve a validating admission webhook that denies PVCs with labels whose keys collide once sanitized into tag keys instead of tagging volumes")
+	flag.StringVar(&webhookAddr, "webhook-addr", ":9443", "The address of the HTTPS admission webhook server of --webhook-mode")
+	flag.StringVar(&webhookService, "webhook-service", "k8s-pvc-tagger-webhook", "The <namespace>/<name> of the Service of the admission webhook, used in its generated certificate. The namespace defaults to the controller's namespace")
+	flag.StringVar(&webhookConfigName, "webhook-configuration-name", "", "The name of the ValidatingWebhookConfiguration whose CA bundle is set to the generated CA of the admission webhook")
+	flag.StringVar(&webhookSecretName, "webhook-secret-name", "k8s-pvc-tagger-webhook-cert", "The name of the Secret in the namespace of --webhook-service storing the certificate of the admission webhook shared by its replicas. If empty, every replica generates its own, so only a single replica is supported")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":8001", "The address of the prometheus /metrics endpoint")
+	flag.StringVar(&statusPort, "status-port", "", "Deprecated: use --health-addr. The healthz port")
+	flag.StringVar(&metricsPort, "metrics-port", "", "Deprecated: use --metrics-addr. The prometheus metrics port")
 	flag.BoolVar(&allowAllTags, "allow-all-tags", false, "Whether or not to allow any tag, even Kubernetes assigned ones, to be set")
-	flag.StringVar(&cloud, "cloud", AWS, "The cloud provider (aws or gcp)")
+	flag.StringVar(&cloud, "cloud-provider", cloudAuto, "The cloud provider (aws, gcp or azure), or auto to detect it from the CSI drivers of the PersistentVolumes")
+	flag.StringVar(&cloud, "cloud", cloudAuto, "Deprecated: use --cloud-provider")
 	flag.StringVar(&copyLabelsString, "copy-labels", "", "Comma-separated list of PVC labels to copy to volumes. Use '*' to copy all labels. (default \"\")")
+	flag.StringVar(&annotationKeysString, "annotation-keys", "", "Comma-separated list of PVC annotation keys copied to volumes as tags. Labels on the PVC take precedence")
+	flag.StringVar(&pvcLabelPrefix, "pvc-label-prefix", "", "Only copy the PVC labels whose key starts with this prefix, e.g. cloud-tag.example.com/, with the prefix removed from the tag key. Empty copies the PVC labels selected by --copy-labels")
+	flag.StringVar(&labelPrefixAllowlistStr, "label-prefix-allowlist", "", "Comma-separated list of label key prefixes. Only PVC labels matching one of them are copied to volumes. Empty copies all labels selected by --copy-labels")
+	flag.StringVar(&labelKeyDenylistStr, "label-key-denylist", "", "Comma-separated list of PVC label keys that are never copied to volumes. Takes precedence over --label-prefix-allowlist")
+	flag.StringVar(&namespaceSelectorStr, "namespace-selector", "", "Label selector, e.g. env=production, of the namespaces whose PVCs are tagged. Empty tags the PVCs of all namespaces")
+	flag.StringVar(&pvcSelectorStr, "pvc-selector", "", "Label selector, e.g. team=payments, of the PVCs that are tagged. Empty tags all PVCs")
+	flag.StringVar(&inheritNSLabelsString, "inherit-namespace-labels", "", "Comma-separated list of label keys copied from the PVC's namespace to volumes. Labels on the PVC take precedence")
+	flag.StringVar(&inheritNodeLabelsString, "include-node-label-keys", "", "Comma-separated list of label keys copied from the node selected for the PVC, e.g. cloud.google.com/gke-nodepool, to volumes. Labels on the PVC take precedence")
+	flag.BoolVar(&labelValueTemplate, "label-value-template", true, "Render tag values as Go templates using the PVC's Name, Namespace, Labels and Annotations")
+	flag.BoolVar(&syncPVLabels, "sync-pv-labels", false, "Also copy the labels of the PVC's bound PersistentVolume to the volume. Labels on the PVC take precedence")
+	flag.StringVar(&stripPrefixesString, "strip-label-prefix", "", "Comma-separated list of domain prefixes, e.g. billing.acme.io, removed from tag keys before they are sanitized")
+	flag.StringVar(&priorityKeysString, "gcp-priority-label-keys", "", "Comma-separated list of label keys that are set first when not all labels fit within GCP's limit of 64 labels")
+	flag.StringVar(&protectedKeysString, "protected-label-keys", "", "Comma-separated list of cloud label keys, e.g. set by a compliance tool, that are never set or removed on GCP PDs, nor removed from Azure disks to make room for the PVC labels")
+	flag.StringVar(&keyMappingConfigMap, "label-key-mapping-configmap", "", "The <namespace>/<name> of a ConfigMap with 'original-key: target-key' lines used to rename tag keys. The namespace defaults to the controller's namespace")
+	flag.StringVar(&scDefaultsConfigMap, "storageclass-defaults-configmap", "", "The <namespace>/<name> of a ConfigMap mapping StorageClass names to a JSON or YAML map of default tags for their volumes. The namespace defaults to the controller's namespace")
+	flag.BoolVar(&gcpEnableZonalFallback, "gcp-enable-zonal-fallback", false, "Retry failed regional disk lookups against the first zone of the region")
+	flag.StringVar(&gcpZoneOverride, "cloud-provider-zone-override", "", "The GCP zone used for all zonal PD API calls instead of the zone in the volume handle, e.g. to tag the disks restored into another zone")
+	flag.DurationVar(&gcpHTTPTimeout, "gcp-http-timeout", 30*time.Second, "Timeout for each GCP API request")
+	flag.DurationVar(&cloudRequestTimeout, "cloud-request-timeout", 30*time.Second, "Deadline of each cloud API call, including its retries by the cloud SDK. 0 disables the deadline")
+	flag.StringVar(&gcpImpersonateAccount, "gcp-impersonate-service-account", "", "The email of a GCP service account to impersonate for all GCP API calls, e.g. when Workload Identity isn't available")
+	flag.DurationVar(&gcpPollInterval, "gcp-poll-interval", time.Second, "How often the status of a GCP disk label operation is checked")
+	flag.IntVar(&cloudRetryAttempts, "cloud-retry-attempts", 5, "How many times a cloud API call failing with a rate limit or server error is attempted")
+	flag.DurationVar(&cloudRetryInterval, "cloud-retry-initial-interval", 500*time.Millisecond, "The wait before the first retry of a failed cloud API call, doubled for every further retry")
+	flag.IntVar(&breakerThreshold, "circuit-breaker-threshold", 10, "How many consecutive cloud API failures pause all cloud API calls. 0 disables the circuit breaker")
+	flag.DurationVar(&breakerTimeout, "circuit-breaker-timeout", time.Minute, "How long cloud API calls are paused before they are tried again")
+	flag.DurationVar(&gcpOperationTimeout, "gcp-operation-timeout", time.Minute, "How long to wait for a GCP disk label operation to finish")
+	flag.DurationVar(&gcpHyperdiskOpTimeout, "gcp-hyperdisk-operation-timeout", 5*time.Minute, "How long to wait for a label operation on a GCP Hyperdisk to finish, used when longer than gcp-operation-timeout")
+	flag.BoolVar(&syncStatusAnnotations, "sync-status-annotations", false, "After each attempt to sync the tags of a PVC, write its time and error to the PVC's last-sync-time and last-sync-error annotations")
+	flag.BoolVar(&managedLabelKeys, "managed-label-keys", false, "Write the keys of the synced labels to the PVC's "+managedLabelKeysAnnotation+" annotation")
+	flag.BoolVar(&deleteRemovedLabels, "delete-removed-labels", false, "Delete the volume's labels whose key is in the PVC's "+managedLabelKeysAnnotation+" annotation but was removed from the PVC. Implies --managed-label-keys")
+	flag.BoolVar(&labelFingerprint, "label-fingerprint", false, "Write a hash of the synced labels to the PVC's "+labelFingerprintAnnotation+" annotation and skip the cloud API calls while it matches")
+	flag.BoolVar(&pvcAnnotationSyncBack, "pvc-annotation-sync-back", false, "Write the sanitized cloud label keys back to the PVC's sanitized-keys annotation")
+	flag.BoolVar(&gcpProjectFromMetadata, "gcp-project-id-from-metadata", false, "Use the project ID from the GCE metadata server for volume handles without a project")
+	flag.DurationVar(&gcpLabelCacheTTL, "gcp-label-cache-ttl", time.Hour, "How long the labels last set on a PD are cached to skip unchanged updates. 0 disables the cache")
+	flag.BoolVar(&awsInjectIOPS, "aws-inject-iops", false, "Add the provisioned IOPS of io1/io2 EBS volumes as the ebs-iops tag")
+	flag.BoolVar(&logSanitizationChanges, "log-sanitization-changes", false, "Log every label key and value changed by sanitization at debug level")
+	flag.StringVar(&gcpCharReplacementsString, "gcp-char-replacement-map", "", "Comma-separated char=replacement pairs overriding how disallowed characters in GCP label keys are replaced. Overridden by the "+gcpCharReplacementsEnv+" environment variable")
+	flag.BoolVar(&propagateVelero, "propagate-velero-annotations", false, "Add the PVC's velero.io/backup-name and velero.io/schedule-name annotations as tags")
+	flag.Float64Var(&gcpWritesPerSecond, "gcp-writes-per-second", 10, "Maximum number of GCP Compute API label writes per second, shared by all PVCs. 0 disables the limit")
+	flag.IntVar(&gcpZoneDiskOps, "gcp-concurrent-disk-ops-per-zone", 5, "Maximum number of concurrent disk label operations per GCP zone. 0 disables the limit")
+	flag.IntVar(&gcpFingerprintRetries, "gcp-fingerprint-retry-count", 3, "How many times setting the labels of a PD is retried with the current labels when they were changed concurrently and GCP rejects the label fingerprint")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1, "How many PVC events are reconciled in parallel per watched namespace. Events of the same PVC are always processed in order")
+	flag.BoolVar(&skipBoundCheck, "skip-bound-check", true, "Skip PVCs that are not bound to a PV yet. Set to false to process PVCs in any phase")
+	flag.BoolVar(&skipDeleteReclaimPolicy, "skip-delete-reclaim-policy", false, "Don't tag the volumes of PVs with the Delete reclaim policy, which are deleted along with their PVC")
+	flag.BoolVar(&ignoreUnboundPVCs, "ignore-unbound-pvcs", false, "Skip PVCs without a spec.volumeName or that are not Bound, whatever --skip-bound-check is, and retry them after --requeue-unbound-after")
+	flag.BoolVar(&backfillOnStart, "backfill-on-start", false, "Once the informer cache has synced, queue all existing Bound PVCs, rate limited, instead of reconciling the PVCs of the initial list as they arrive")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait on termination for the PVCs being reconciled to finish their cloud operations before they are canceled")
+	flag.DurationVar(&requeueUnboundAfter, "requeue-unbound-after", 30*time.Second, "How long to wait before retrying a PVC skipped by --ignore-unbound-pvcs. 0 disables the retry")
+	flag.IntVar(&storageClassLabelDepth, "storageclass-label-inheritance-depth", 1, fmt.Sprintf("How many StorageClasses to walk up the %s annotation chain when copying StorageClass labels (max %d)", storageClassParentAnnotation, maxStorageClassLabelDepth))
+	flag.BoolVar(&syncAWSSnapshots, "sync-aws-snapshots", false, "After tagging an EBS volume, also set its tags on the snapshots of the volume")
+	flag.BoolVar(&syncGCPSnapshots, "sync-gcp-snapshots", false, "After labeling a PD, also set its labels on the snapshots of the PD")
+	flag.IntVar(&gcpSanitizer.KeyMaxLen, "gcp-label-key-max-length", gcpMaxLabelLength, "The maximum length of GCP label keys, longer keys are truncated")
+	flag.IntVar(&labelValueMaxLength, "label-value-max-length", 0, "Truncate label values to this length instead of the cloud provider's limit (63 for gcp, 256 for aws and azure). 0 uses the provider's limit")
+	flag.StringVar(&gcpCollisionStrategy, "collision-strategy", collisionFirstAlphabetical, "Which of the label keys that become the same GCP label key is used: first-alphabetical, last-alphabetical, longest-value or error (use none of them and record a Warning Event)")
+	flag.StringVar(&gcpDiskNotFound, "gcp-disk-not-found-strategy", diskNotFoundSkip, "How to handle GCP disks that are not found: skip (log a warning), warn (also count it in k8s_pvc_tagger_disk_not_found_total) or fail (log an error and retry the PVC)")
+	flag.BoolVar(&statefulSetPVCsOnly, "watch-statefulset-pvcs-only", false, "Only tag the volumes of PVCs owned by a StatefulSet")
+	flag.BoolVar(&watchPVOnly, "watch-pv-only", false, "Watch PersistentVolumes instead of PVCs and set the labels of each PV on its volume")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the labels that would be set or removed on the cloud volumes without changing them")
+	flag.StringVar(&azureSubscriptionID, "azure-subscription-id", os.Getenv("AZURE_SUBSCRIPTION_ID"), "The subscription of Azure File shares whose volume handle doesn't include one")
+	flag.BoolVar(&azureInjectZoneTag, "inject-az-zone-label", false, "Set the zone of zonal Azure Managed Disks, read from the PV's node affinity, as the az-zone tag")
+	flag.BoolVar(&serverSideApply, "server-side-apply", false, "Write the tagger's PVC annotations with server-side apply, as the pvc-tagger field manager, instead of a merge patch")
+	flag.DurationVar(&resyncPeriod, "resync-period", 12*time.Hour, "How often the tags of all PVCs are set on their volumes again, even when unchanged, to repair drift. 0 disables the resync")
+	flag.StringVar(&logBackend, "log-backend", logBackendLogrus, "The logging library to use: logrus or slog")
+	flag.StringVar(&logFormat, "log-format", logFormat, "The format of the logs: text or json. Defaults to the LOG_FORMAT environment variable, or json")
 	flag.Parse()
 
-	if leaseLockName == "" {
-		log.Fatalln("unable to get lease lock resource name (missing lease-lock-name flag).")
+	if err := setLogFormat(logFormat); err != nil {
+		log.Fatalln(err)
+	}
+	log.AddHook(&logFieldsHook{})
+	if err := setLogBackend(logBackend); err != nil {
+		log.Fatalln(err)
+	}
+
+	if statusPort != "" {
+		healthAddr = ":" + statusPort
+	}
+	if metricsPort != "" {
+		metricsAddr = ":" + metricsPort
+	}
+
+	k8sClient, err = BuildClient(kubeconfig, kubeContext)
+	if err != nil {
+		log.Fatalln("Unable to create kubernetes client", err)
+		os.Exit(1)
+	}
+
+	if cloud == cloudAuto {
+		pvs, err := k8sClient.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			log.Fatalln("Failed to list PersistentVolumes to detect the cloud provider:", err)
+		}
+		cloud, err = detectCloudProvider(pvs.Items)
+		if err != nil {
+			log.Fatalln("Failed to detect the cloud provider:", err)
+		}
+		log.WithFields(log.Fields{"cloud": cloud}).Infoln("Detected the cloud provider from the PersistentVolumes")
 	}
-	if leaseLockNamespace == "" {
-		leaseLockNamespace = getCurrentNamespace()
+
+	subcommand := flag.Arg(0)
+	switch subcommand {
+	case "":
+		if !leaderElection || webhookMode {
+			break
+		}
+		if leaseLockName == "" {
+			log.Fatalln("unable to get lease lock resource name (missing lease-lock-name flag).")
+		}
 		if leaseLockNamespace == "" {
-			log.Fatalln("unable to get lease lock resource namespace (missing lease-lock-namespace flag).")
+			leaseLockNamespace = getCurrentNamespace()
+			if leaseLockNamespace == "" {
+				log.Fatalln("unable to get lease lock resource namespace (missing lease-lock-namespace flag).")
+			}
+		}
+	case reportSubcommand:
+		if cloud != AWS {
+			log.Fatalln("The report subcommand only supports aws")
 		}
+	case listStaleSubcommand:
+		if cloud != AWS && cloud != GCP {
+			log.Fatalln("The list-stale subcommand only supports aws and gcp")
+		}
+	default:
+		log.Fatalln("Unknown subcommand:", subcommand)
 	}
 
 	switch cloud {
@@ -179,10 +451,95 @@ func main() {
 			}
 			os.Exit(1)
 		}
+		awsAccountID, err = getAWSAccountID()
+		if err != nil {
+			log.Warnln("FSx for ONTAP volumes will not be tagged:", err)
+		}
 	case GCP:
 		log.Infoln("Running in GCP mode")
+		if gcpProjectFromMetadata {
+			gcpDefaultProject, err = getMetadataProjectID()
+			if err != nil {
+				log.Fatalln("Failed to get GCP project ID:", err)
+			}
+			log.WithFields(log.Fields{"project": gcpDefaultProject}).Debugln("GCE metadata project")
+		}
+		charReplacements, err := loadGCPCharReplacements(gcpCharReplacementsString)
+		if err != nil {
+			log.Fatalln("Failed to parse GCP character replacements:", err)
+		}
+		if len(charReplacements) > 0 {
+			log.WithFields(log.Fields{"replacements": charReplacements}).Infoln("GCP label key character replacements")
+		}
+		gcpSanitizer.ReplacementTable = newGCPKeyReplacer(charReplacements)
+		if gcpSanitizer.KeyMaxLen < 1 {
+			log.Fatalln("gcp-label-key-max-length must be positive")
+		}
+		switch gcpDiskNotFound {
+		case diskNotFoundSkip, diskNotFoundWarn, diskNotFoundFail:
+		default:
+			log.Fatalf("gcp-disk-not-found-strategy must be one of %s, %s or %s", diskNotFoundSkip, diskNotFoundWarn, diskNotFoundFail)
+		}
+		switch gcpCollisionStrategy {
+		case collisionFirstAlphabetical, collisionLastAlphabetical, collisionLongestValue, collisionError:
+		default:
+			log.Fatalf("collision-strategy must be one of %s, %s, %s or %s", collisionFirstAlphabetical, collisionLastAlphabetical, collisionLongestValue, collisionError)
+		}
+		if gcpPollInterval <= 0 || gcpOperationTimeout < gcpPollInterval {
+			log.Fatalln("gcp-poll-interval must be positive and not longer than gcp-operation-timeout")
+		}
+		if gcpHyperdiskOpTimeout <= 0 {
+			log.Fatalln("gcp-hyperdisk-operation-timeout must be positive")
+		}
+		if gcpWritesPerSecond < 0 {
+			log.Fatalln("gcp-writes-per-second must not be negative")
+		}
+		gcpWriteLimiter = newGCPWriteLimiter(gcpWritesPerSecond)
+		if gcpZoneOverride != "" {
+			if isGCPRegion(gcpZoneOverride) {
+				log.Fatalf("cloud-provider-zone-override must be a zone, got region %s", gcpZoneOverride)
+			}
+			log.WithFields(log.Fields{"zone": gcpZoneOverride}).Infoln("Overriding the zone of zonal PDs")
+		}
+	case AZURE:
+		log.Infoln("Running in Azure mode")
+		if azureInjectZoneTag {
+			log.Infof("Setting the zone of Managed Disks as the %s tag", azureZoneTagKey)
+		}
 	default:
-		log.Fatalln("Cloud provider must be either aws or gcp")
+		log.Fatalln("Cloud provider must be aws, gcp, azure or auto")
+	}
+	if gcpZoneOverride != "" && cloud != GCP {
+		log.Warnln("cloud-provider-zone-override is ignored, it only applies to gcp")
+	}
+	if azureInjectZoneTag && cloud != AZURE {
+		log.Warnln("inject-az-zone-label is ignored, it only applies to azure")
+	}
+	if err := setLabelValueMaxLength(cloud, labelValueMaxLength); err != nil {
+		log.Fatalln(err)
+	}
+
+	if resyncPeriod < 0 {
+		log.Fatalln("resync-period must not be negative")
+	}
+	if cloudRequestTimeout < 0 {
+		log.Fatalln("cloud-request-timeout must not be negative")
+	}
+	if shutdownTimeout < 0 {
+		log.Fatalln("shutdown-timeout must not be negative")
+	}
+	if requeueUnboundAfter < 0 {
+		log.Fatalln("requeue-unbound-after must not be negative")
+	}
+	if breakerThreshold < 0 || breakerTimeout <= 0 {
+		log.Fatalln("circuit-breaker-threshold must not be negative and circuit-breaker-timeout must be positive")
+	}
+	if breakerThreshold > 0 {
+		cloudBreaker = newCircuitBreaker(cloud, breakerThreshold, breakerTimeout)
+	}
+
+	if dryRun {
+		log.Infoln("Running in dry-run mode, cloud resources will not be changed")
 	}
 
 	defaultTags = make(map[string]string)
@@ -203,20 +560,116 @@ func main() {
 		copyLabels = strings.Split(copyLabelsString, ",")
 		log.Infof("Copying PVC labels to tags: %v", copyLabels)
 	}
-
-	k8sClient, err = BuildClient(kubeconfig, kubeContext)
+	annotationKeys = parseLabelKeyList(annotationKeysString)
+	if len(annotationKeys) > 0 {
+		log.Infof("Copying PVC annotations to tags: %v", annotationKeys)
+	}
+	labelPrefixAllowlist = parseLabelKeyList(labelPrefixAllowlistStr)
+	if len(labelPrefixAllowlist) > 0 {
+		log.Infof("Only copying labels with prefixes: %v", labelPrefixAllowlist)
+	}
+	labelKeyDenylist = parseLabelKeyList(labelKeyDenylistStr)
+	if len(labelKeyDenylist) > 0 {
+		log.Infof("Never copying labels: %v", labelKeyDenylist)
+	}
+	if pvcLabelPrefix != "" {
+		log.Infof("Only copying PVC labels with the prefix %s", pvcLabelPrefix)
+	}
+	stripPrefixes = parseLabelKeyList(stripPrefixesString)
+	if len(stripPrefixes) > 0 {
+		log.Infof("Stripping prefixes from tag keys: %v", stripPrefixes)
+	}
+	protectedLabelKeys = parseLabelKeyList(protectedKeysString)
+	if len(protectedLabelKeys) > 0 {
+		log.Infof("Never changing protected labels: %v", protectedLabelKeys)
+	}
+	// the keys are compared to the sanitized label keys
+	gcpPriorityLabelKeys = sanitizeKeysForGCP(parseLabelKeyList(priorityKeysString))
+	if len(gcpPriorityLabelKeys) > 0 {
+		log.Infof("Setting priority labels first: %v", gcpPriorityLabelKeys)
+	}
+	var keyMappingNamespace, keyMappingName string
+	if keyMappingConfigMap != "" {
+		keyMappingNamespace, keyMappingName, err = parseConfigMapName("label-key-mapping-configmap", keyMappingConfigMap)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Infof("Renaming tag keys with ConfigMap %s/%s", keyMappingNamespace, keyMappingName)
+	}
+	var scDefaultsNamespace, scDefaultsName string
+	if scDefaultsConfigMap != "" {
+		scDefaultsNamespace, scDefaultsName, err = parseConfigMapName("storageclass-defaults-configmap", scDefaultsConfigMap)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Infof("Setting StorageClass default tags from ConfigMap %s/%s", scDefaultsNamespace, scDefaultsName)
+	}
+	namespaceSelector, err = parseSelector(namespaceSelectorStr)
 	if err != nil {
-		log.Fatalln("Unable to create kubernetes client", err)
-		os.Exit(1)
+		log.Fatalln("Failed to parse namespace-selector:", err)
+	}
+	if namespaceSelector != nil {
+		log.Infof("Only tagging the PVCs of namespaces matching: %s", namespaceSelector)
+	}
+	pvcSelector, err = parseSelector(pvcSelectorStr)
+	if err != nil {
+		log.Fatalln("Failed to parse pvc-selector:", err)
+	}
+	if pvcSelector != nil {
+		log.Infof("Only tagging the PVCs matching: %s", pvcSelector)
+	}
+	inheritNSLabels = parseLabelKeyList(inheritNSLabelsString)
+	if len(inheritNSLabels) > 0 {
+		log.Infof("Copying namespace labels to tags: %v", inheritNSLabels)
+	}
+	inheritNodeLabels = parseLabelKeyList(inheritNodeLabelsString)
+	if len(inheritNodeLabels) > 0 {
+		log.Infof("Copying node labels to tags: %v", inheritNodeLabels)
+	}
+	if watchPVOnly {
+		if watchNamespace != "" || namespaceSelector != nil || len(inheritNSLabels) > 0 || len(inheritNodeLabels) > 0 || statefulSetPVCsOnly || syncPVLabels {
+			log.Fatalln("watch-pv-only can't be combined with watch-namespace, namespace-selector, inherit-namespace-labels, include-node-label-keys, watch-statefulset-pvcs-only or sync-pv-labels")
+		}
+		log.Infoln("Watching PersistentVolumes instead of PersistentVolumeClaims")
+	}
+	if maxConcurrentReconciles < 1 {
+		log.Fatalln("max-concurrent-reconciles must be at least 1")
+	}
+	if cloudRetryAttempts < 1 || cloudRetryInterval <= 0 {
+		log.Fatalln("cloud-retry-attempts must be at least 1 and cloud-retry-initial-interval must be positive")
+	}
+	if gcpFingerprintRetries < 0 {
+		log.Fatalln("gcp-fingerprint-retry-count must not be negative")
+	}
+	if gcpImpersonateAccount != "" && !strings.Contains(gcpImpersonateAccount, "@") {
+		log.Fatalf("gcp-impersonate-service-account %q is not a service account email", gcpImpersonateAccount)
+	}
+	if storageClassLabelDepth < 1 || storageClassLabelDepth > maxStorageClassLabelDepth {
+		log.Fatalf("storageclass-label-inheritance-depth must be between 1 and %d", maxStorageClassLabelDepth)
+	}
+
+	if subcommand == reportSubcommand {
+		if err := runReport(context.Background(), flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalln("Failed to create tag report:", err)
+		}
+		return
+	}
+	if subcommand == listStaleSubcommand {
+		stale, err := runListStale(context.Background(), flag.Args()[1:], os.Stdout)
+		if err != nil {
+			log.Fatalln("Failed to list stale labels:", err)
+		}
+		if stale > 0 {
+			os.Exit(1)
+		}
+		return
 	}
 
 	go func() {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/healthz", statusHandler)
 		server := &http.Server{
-			Addr:              "0.0.0.0:" + statusPort,
+			Addr:              healthAddr,
 			ReadHeaderTimeout: 3 * time.Second,
-			Handler:           mux,
+			Handler:           newHealthMux(),
 		}
 		err := server.ListenAndServe()
 		if err != nil {
@@ -226,12 +679,10 @@ func main() {
 
 	go func() {
 		// Handle just the /metrics endpoint on the metrics port
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", promhttp.Handler())
 		server := &http.Server{
-			Addr:              "0.0.0.0:" + metricsPort,
+			Addr:              metricsAddr,
 			ReadHeaderTimeout: 3 * time.Second,
-			Handler:           mux,
+			Handler:           newMetricsMux(),
 		}
 		err := server.ListenAndServe()
 		if err != nil {
@@ -239,6 +690,35 @@ func main() {
 		}
 	}()
 
+	controllerInitialized.Store(true)
+
+	if webhookMode {
+		webhookNamespace, webhookServiceName, err := parseConfigMapName("webhook-service", webhookService)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if err := runWebhook(ctx, webhookAddr, webhookNamespace, webhookServiceName, webhookConfigName, webhookSecretName); err != nil {
+			log.Fatalln("Failed to run the admission webhook:", err)
+		}
+		return
+	}
+
+	if auditLogFile != "" {
+		auditLog, err = openAuditLog(auditLogFile)
+		if err != nil {
+			log.Fatalln("Failed to open the audit log file:", err)
+		}
+		// flush the buffered records on shutdown
+		defer func() {
+			if err := auditLog.Close(); err != nil {
+				log.Errorln("Failed to write the audit log file:", err)
+			}
+		}()
+		log.Infof("Writing the audit log to %s", auditLogFile)
+	}
+
 	run := func(ctx context.Context) {
 		var namespaces []string
 		if watchNamespace != "" {
@@ -246,9 +726,27 @@ func main() {
 		} else {
 			namespaces = append(namespaces, "")
 		}
+		// not ready again once the lease is lost
+		expectInformerSyncs(len(namespaces))
+		defer expectInformerSyncs(0)
+
+		startPersistentVolumeInformer(ctx)
+		if keyMappingName != "" {
+			startKeyMappingInformer(ctx, keyMappingNamespace, keyMappingName)
+		}
+		if scDefaultsName != "" {
+			startStorageClassDefaultsInformer(ctx, scDefaultsNamespace, scDefaultsName)
+		}
+
+		var wg sync.WaitGroup
 		for _, ns := range namespaces {
-			go runWatchNamespaceTask(ctx, ns)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runWatchNamespaceTask(ctx, ns)
+			}()
 		}
+		wg.Wait()
 	}
 
 	// use a Go context so we can tell the leaderelection code when we
@@ -267,6 +765,11 @@ func main() {
 		cancel()
 	}()
 
+	if !leaderElection {
+		run(ctx)
+		return
+	}
+
 	// we use the Lease lock type since edits to Leases are less common
 	// and fewer objects in the cluster watch "all Leases".
 	lock := &resourcelock.LeaseLock{
@@ -279,51 +782,62 @@ func main() {
 			Identity: leaseID,
 		},
 	}
-
-	// start the leader election code loop
-	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
-		Lock: lock,
-		// IMPORTANT: you MUST ensure that any code you have that
-		// is protected by the lease must terminate **before**
-		// you call cancel. Otherwise, you could have a background
-		// loop still running and another process could
-		// get elected before your background loop finished, violating
-		// the stated goal of the lease.
-		ReleaseOnCancel: true,
-		LeaseDuration:   60 * time.Second,
-		RenewDeadline:   15 * time.Second,
-		RetryPeriod:     5 * time.Second,
-		Callbacks: leaderelection.LeaderCallbacks{
-			OnStartedLeading: func(ctx context.Context) {
-				run(ctx)
-			},
-			OnStoppedLeading: func() {
-				log.Infoln("leader lost:", leaseID)
-				os.Exit(0)
-			},
-			OnNewLeader: func(identity string) {
-				// we're notified when new leader elected
-				if identity == leaseID {
-					return
-				}
-				log.Infoln("new leader elected:", identity)
-			},
-		},
-	})
+	runWithLeaderElection(ctx, lock, run)
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusNotImplemented)
-		_, err := w.Write([]byte("method is not implemented"))
-		if err != nil {
-			log.Errorln("Cannot write status message:", err)
+// leader election timings
+var (
+	leaseDuration      = 60 * time.Second
+	leaseRenewDeadline = 15 * time.Second
+	leaseRetryPeriod   = 5 * time.Second
+)
+
+// runWithLeaderElection calls run while holding the lease. When the lease is
+// lost, run's context is canceled and, once run has returned, the lease is
+// tried again. It returns when ctx is canceled. run must not return before
+// its context is canceled.
+func runWithLeaderElection(ctx context.Context, lock resourcelock.Interface, run func(ctx context.Context)) {
+	for ctx.Err() == nil {
+		elected := make(chan context.Context, 1)
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+				Lock: lock,
+				// IMPORTANT: you MUST ensure that any code you have that
+				// is protected by the lease must terminate **before**
+				// you call cancel. Otherwise, you could have a background
+				// loop still running and another process could
+				// get elected before your background loop finished, violating
+				// the stated goal of the lease.
+				ReleaseOnCancel: true,
+				LeaseDuration:   leaseDuration,
+				RenewDeadline:   leaseRenewDeadline,
+				RetryPeriod:     leaseRetryPeriod,
+				Callbacks: leaderelection.LeaderCallbacks{
+					OnStartedLeading: func(ctx context.Context) {
+						elected <- ctx
+					},
+					OnStoppedLeading: func() {
+						log.Infoln("leader lost:", lock.Identity())
+					},
+					OnNewLeader: func(identity string) {
+						// we're notified when new leader elected
+						if identity == lock.Identity() {
+							return
+						}
+						log.Infoln("new leader elected:", identity)
+					},
+				},
+			})
+		}()
+
+		select {
+		case leaderCtx := <-elected:
+			run(leaderCtx)
+			<-stopped
+		case <-stopped:
 		}
-		return
-	}
-	_, err := w.Write([]byte("OK"))
-	if err != nil {
-		log.Errorln("Cannot write status message:", err)
 	}
 }
 
@@ -331,10 +845,16 @@ func runWatchNamespaceTask(ctx context.Context, namespace string) {
 	// Make the informer's channel here so we can close it when the
 	// context is Done()
 	ch := make(chan struct{})
-	go watchForPersistentVolumeClaims(ch, namespace)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchForPersistentVolumeClaims(ctx, ch, namespace)
+	}()
 
 	<-ctx.Done()
 	close(ch)
+	// wait for the event being processed to finish
+	<-done
 }
 
 func parseCsv(value string) map[string]string {
@@ -369,3 +889,25 @@ func parseCopyLabels(copyLabelsString string) []string {
 	}
 	return strings.Split(copyLabelsString, ",")
 }
+
+// parseSelector parses a label selector flag. An empty selector is returned as
+// nil, which selects everything.
+func parseSelector(s string) (labels.Selector, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return labels.Parse(s)
+}
+
+// parseLabelKeyList splits a comma-separated list of label keys or key
+// prefixes, dropping empty entries
+func parseLabelKeyList(s string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
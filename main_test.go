@@ -19,8 +19,16 @@
 package main
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/utils/ptr"
 )
 
 func Test_parseCsv(t *testing.T) {
@@ -109,3 +117,150 @@ func Test_parseCopyLabels(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseLabelKeyList(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want []string
+	}{
+		{name: "empty", s: "", want: []string{}},
+		{name: "one prefix", s: "env", want: []string{"env"}},
+		{name: "multiple prefixes", s: "cost.acme.io/,env", want: []string{"cost.acme.io/", "env"}},
+		{name: "spaces and empty entries", s: " cost.acme.io/ ,,env,", want: []string{"cost.acme.io/", "env"}},
+		{name: "keys with slashes", s: "kubernetes.io/pvc-name,app", want: []string{"kubernetes.io/pvc-name", "app"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLabelKeyList(tt.s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLabelKeyList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseSelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "empty", s: "", wantNil: true},
+		{name: "equality", s: "team=payments", want: "team=payments"},
+		{name: "set based", s: "team in (payments,billing),!legacy", want: "!legacy,team in (billing,payments)"},
+		{name: "missing key", s: "=payments", wantErr: true},
+		{name: "invalid operator", s: "team in payments", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSelector(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Fatalf("parseSelector() = %v, want nil %v", got, tt.wantNil)
+			}
+			if got != nil && got.String() != tt.want {
+				t.Errorf("parseSelector() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+// leaderRun is a run func for runWithLeaderElection that reports when it
+// starts and stops
+type leaderRun struct {
+	started chan struct{}
+	stopped chan struct{}
+}
+
+func newLeaderRun() *leaderRun {
+	return &leaderRun{started: make(chan struct{}, 10), stopped: make(chan struct{}, 10)}
+}
+
+func (l *leaderRun) run(ctx context.Context) {
+	l.started <- struct{}{}
+	<-ctx.Done()
+	l.stopped <- struct{}{}
+}
+
+func newTestLeaseLock(client kubernetes.Interface, identity string) resourcelock.Interface {
+	return &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: "k8s-pvc-tagger", Namespace: "default"},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+}
+
+func waitFor(t *testing.T, ch chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func Test_runWithLeaderElection(t *testing.T) {
+	defer func(duration, renew, retry time.Duration) {
+		leaseDuration, leaseRenewDeadline, leaseRetryPeriod = duration, renew, retry
+	}(leaseDuration, leaseRenewDeadline, leaseRetryPeriod)
+	leaseDuration, leaseRenewDeadline, leaseRetryPeriod = time.Second, 500*time.Millisecond, 100*time.Millisecond
+
+	client := fake.NewSimpleClientset()
+
+	// replica a acquires the lease
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	a := newLeaderRun()
+	doneA := make(chan struct{})
+	go func() {
+		runWithLeaderElection(ctxA, newTestLeaseLock(client, "a"), a.run)
+		close(doneA)
+	}()
+	waitFor(t, a.started, "replica a to start leading")
+
+	// replica b waits for the lease
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	b := newLeaderRun()
+	doneB := make(chan struct{})
+	go func() {
+		runWithLeaderElection(ctxB, newTestLeaseLock(client, "b"), b.run)
+		close(doneB)
+	}()
+	select {
+	case <-b.started:
+		t.Fatal("replica b started leading while replica a holds the lease")
+	case <-time.After(3 * leaseRetryPeriod):
+	}
+
+	// replica a shuts down and releases the lease to replica b
+	cancelA()
+	waitFor(t, a.stopped, "replica a to stop leading")
+	waitFor(t, doneA, "replica a to return")
+	waitFor(t, b.started, "replica b to start leading")
+
+	// replica b loses the lease to another holder and stops, then acquires
+	// it again once the other holder doesn't renew it
+	lease, err := client.CoordinationV1().Leases("default").Get(context.Background(), "k8s-pvc-tagger", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease.Spec.HolderIdentity = ptr.To("other")
+	lease.Spec.RenewTime = &metav1.MicroTime{Time: time.Now()}
+	if _, err := client.CoordinationV1().Leases("default").Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, b.stopped, "replica b to stop leading")
+	waitFor(t, b.started, "replica b to lead again")
+
+	cancelB()
+	waitFor(t, b.stopped, "replica b to stop leading")
+	waitFor(t, doneB, "replica b to return")
+}
@@ -0,0 +1,116 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// pvcFromPV returns a PVC standing in for the PV with --watch-pv-only, so that
+// the PV is reconciled like a PVC. The stand-in has the PV's name, labels and
+// annotations and is bound to the PV, whose volume handle is looked up as
+// usual. A CSI PV without a provisioned-by annotation, e.g. one created
+// directly instead of by a provisioner, uses its CSI driver as the
+// provisioner.
+func pvcFromPV(pv *corev1.PersistentVolume) *corev1.PersistentVolumeClaim {
+	meta := pv.ObjectMeta.DeepCopy()
+	if _, ok := getProvisioner(&corev1.PersistentVolumeClaim{}, pv); !ok && pv.Spec.CSI != nil {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations["volume.kubernetes.io/storage-provisioner"] = pv.Spec.CSI.Driver
+	}
+	storageClassName := pv.Spec.StorageClassName
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: *meta,
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       pv.GetName(),
+			StorageClassName: &storageClassName,
+		},
+		Status: corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+	}
+}
+
+// getWatchedObject returns the PVC of an informer event, or the stand-in PVC
+// of the PV with --watch-pv-only
+func getWatchedObject(obj interface{}) *corev1.PersistentVolumeClaim {
+	if pv, ok := obj.(*corev1.PersistentVolume); ok {
+		return pvcFromPV(pv)
+	}
+	return getPVC(obj)
+}
+
+// eventObject returns the object the Events about the PVC are recorded on:
+// the PVC itself, or the PV with --watch-pv-only
+func eventObject(pvc *corev1.PersistentVolumeClaim) runtime.Object {
+	if watchPVOnly {
+		return &corev1.PersistentVolume{ObjectMeta: pvc.ObjectMeta}
+	}
+	return pvc
+}
+
+// pvClaimLister lists the stand-in PVCs of the PVs in a PV lister, so that
+// the PVs are found wherever the PVCs in the informer cache are listed, e.g.
+// for a resync. The stand-ins have no namespace.
+type pvClaimLister struct {
+	pvLister corelisters.PersistentVolumeLister
+}
+
+func (l pvClaimLister) List(selector labels.Selector) ([]*corev1.PersistentVolumeClaim, error) {
+	pvs, err := l.pvLister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	pvcs := make([]*corev1.PersistentVolumeClaim, 0, len(pvs))
+	for _, pv := range pvs {
+		pvcs = append(pvcs, pvcFromPV(pv))
+	}
+	return pvcs, nil
+}
+
+func (l pvClaimLister) PersistentVolumeClaims(namespace string) corelisters.PersistentVolumeClaimNamespaceLister {
+	return pvClaimNamespaceLister{pvClaimLister: l, namespace: namespace}
+}
+
+type pvClaimNamespaceLister struct {
+	pvClaimLister
+	namespace string
+}
+
+func (l pvClaimNamespaceLister) List(selector labels.Selector) ([]*corev1.PersistentVolumeClaim, error) {
+	if l.namespace != "" {
+		return nil, nil
+	}
+	return l.pvClaimLister.List(selector)
+}
+
+func (l pvClaimNamespaceLister) Get(name string) (*corev1.PersistentVolumeClaim, error) {
+	if l.namespace != "" {
+		return nil, apierrors.NewNotFound(corev1.Resource("persistentvolumeclaims"), name)
+	}
+	pv, err := l.pvLister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return pvcFromPV(pv), nil
+}
@@ -0,0 +1,230 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_pvcFromPV(t *testing.T) {
+	tests := []struct {
+		name            string
+		pv              *corev1.PersistentVolume
+		wantProvisioner string
+		wantOK          bool
+	}{
+		{
+			name: "provisioned by annotation",
+			pv: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{pvProvisionedByAnnotation: GCP_PD_CSI}},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{Driver: "other.csi.example.com"},
+					},
+				},
+			},
+			wantProvisioner: GCP_PD_CSI,
+			wantOK:          true,
+		},
+		{
+			name: "csi driver",
+			pv: &corev1.PersistentVolume{
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{Driver: AWS_EBS_CSI},
+					},
+				},
+			},
+			wantProvisioner: AWS_EBS_CSI,
+			wantOK:          true,
+		},
+		{
+			name: "in-tree volume without annotation",
+			pv: &corev1.PersistentVolume{
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "my-disk"},
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.pv.SetName("my-pv")
+			tt.pv.SetLabels(map[string]string{"team": "db"})
+			tt.pv.Spec.StorageClassName = "standard"
+			before := maps.Clone(tt.pv.GetAnnotations())
+
+			pvc := pvcFromPV(tt.pv)
+			if pvc.GetName() != "my-pv" || pvc.GetNamespace() != "" {
+				t.Errorf("pvcFromPV() = %s/%s, want /my-pv", pvc.GetNamespace(), pvc.GetName())
+			}
+			if !maps.Equal(pvc.GetLabels(), tt.pv.GetLabels()) {
+				t.Errorf("pvcFromPV() labels = %v, want %v", pvc.GetLabels(), tt.pv.GetLabels())
+			}
+			if pvc.Spec.VolumeName != "my-pv" || pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "standard" {
+				t.Errorf("pvcFromPV() spec = %+v, want volume my-pv and StorageClass standard", pvc.Spec)
+			}
+			if pvc.Status.Phase != corev1.ClaimBound {
+				t.Errorf("pvcFromPV() phase = %s, want %s", pvc.Status.Phase, corev1.ClaimBound)
+			}
+			provisioner, ok := getProvisioner(pvc, tt.pv)
+			if provisioner != tt.wantProvisioner || ok != tt.wantOK {
+				t.Errorf("getProvisioner() = %q, %v, want %q, %v", provisioner, ok, tt.wantProvisioner, tt.wantOK)
+			}
+			if !maps.Equal(tt.pv.GetAnnotations(), before) {
+				t.Errorf("pvcFromPV() modified the PV annotations to %v", tt.pv.GetAnnotations())
+			}
+		})
+	}
+}
+
+func Test_pvClaimLister(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range []string{"pv-1", "pv-2"} {
+		if err := indexer.Add(&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lister := pvClaimLister{pvLister: corelisters.NewPersistentVolumeLister(indexer)}
+
+	pvcs, err := lister.List(labels.Everything())
+	if err != nil || len(pvcs) != 2 {
+		t.Errorf("List() = %d PVCs, %v, want 2", len(pvcs), err)
+	}
+	pvcs, err = lister.PersistentVolumeClaims("default").List(labels.Everything())
+	if err != nil || len(pvcs) != 0 {
+		t.Errorf("PersistentVolumeClaims(default).List() = %d PVCs, %v, want 0", len(pvcs), err)
+	}
+	pvc, err := lister.PersistentVolumeClaims("").Get("pv-2")
+	if err != nil || pvc.Spec.VolumeName != "pv-2" {
+		t.Errorf("Get(pv-2) = %v, %v, want the stand-in of pv-2", pvc, err)
+	}
+	if _, err := lister.PersistentVolumeClaims("default").Get("pv-2"); !apierrors.IsNotFound(err) {
+		t.Errorf("PersistentVolumeClaims(default).Get(pv-2) error = %v, want not found", err)
+	}
+}
+
+func Test_watchPVOnlyEvents(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old bool) { watchPVOnly = old }(watchPVOnly)
+	defer func(old bool) { labelFingerprint = old }(labelFingerprint)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	cloud = GCP
+	copyLabels = []string{"*"}
+	watchPVOnly = true
+	labelFingerprint = true
+	gcpLabelCacheTTL = 0
+
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pv",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"team": "db"},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			StorageClassName: "standard",
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       GCP_PD_CSI,
+					VolumeHandle: "projects/my-project/zones/us-east1-a/disks/my-disk",
+				},
+			},
+		},
+	}
+	k8sClient = fake.NewSimpleClientset(pv)
+
+	diskLabels := map[string]string{}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &pvcReconciler{gcpClient: client, recorder: recorder}
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	ctx := context.Background()
+
+	// the informer event handlers queue the PV's stand-in PVC
+	queue.Add(newPVCEvent(pvcEventAdd, nil, getWatchedObject(pv)))
+	r.processNextEvent(ctx, queue)
+	if want := map[string]string{"team": "db"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("after add: disk labels = %v, want %v", diskLabels, want)
+	}
+	if events := drainEvents(recorder); len(events) != 1 {
+		t.Errorf("after add: events = %q, want 1", events)
+	}
+	stored, err := k8sClient.CoreV1().PersistentVolumes().Get(ctx, "my-pv", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.GetAnnotations()[labelFingerprintAnnotation] == "" {
+		t.Errorf("after add: PV annotations = %v, want the label fingerprint", stored.GetAnnotations())
+	}
+
+	updated := stored.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Labels = map[string]string{"team": "web", "env": "prod"}
+	queue.Add(newPVCEvent(pvcEventUpdate, getWatchedObject(pv), getWatchedObject(updated)))
+	r.processNextEvent(ctx, queue)
+	if want := map[string]string{"team": "web", "env": "prod"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("after update: disk labels = %v, want %v", diskLabels, want)
+	}
+}
+
+func Test_eventObject(t *testing.T) {
+	defer func(old bool) { watchPVOnly = old }(watchPVOnly)
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pv"}}
+
+	watchPVOnly = false
+	if _, ok := eventObject(pvc).(*corev1.PersistentVolumeClaim); !ok {
+		t.Errorf("eventObject() = %T, want the PVC", eventObject(pvc))
+	}
+	watchPVOnly = true
+	pv, ok := eventObject(pvc).(*corev1.PersistentVolume)
+	if !ok || pv.GetName() != "my-pv" {
+		t.Errorf("eventObject() = %#v, want PV my-pv", eventObject(pvc))
+	}
+}
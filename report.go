@@ -0,0 +1,198 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reportSubcommand prints a report comparing the tags of the EBS volumes of
+// the PVCs with the tags the PVCs want them to have, then exits
+const reportSubcommand = "report"
+
+// tagReportRow is the tag compliance of the EBS volume of one PVC
+type tagReportRow struct {
+	VolumeID     string            `json:"volumeID"`
+	PVCName      string            `json:"pvcName"`
+	PVCNamespace string            `json:"pvcNamespace"`
+	CurrentTags  map[string]string `json:"currentTags"`
+	DesiredTags  map[string]string `json:"desiredTags"`
+	MissingTags  []string          `json:"missingTags"`
+	ExtraTags    []string          `json:"extraTags"`
+	WrongValues  []string          `json:"wrongValues"`
+}
+
+// runReport writes the tag compliance report of the EBS volumes of the PVCs
+// in watchNamespace to w. It makes no changes to the volumes.
+func runReport(ctx context.Context, args []string, w io.Writer) error {
+	reportFlags := flag.NewFlagSet(reportSubcommand, flag.ContinueOnError)
+	format := reportFlags.String("format", "csv", "The report format (csv or json)")
+	if err := reportFlags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+
+	ec2Client, err := newEC2Client()
+	if err != nil {
+		return err
+	}
+	rows, err := buildTagReport(ctx, ec2Client, watchNamespace)
+	if err != nil {
+		return err
+	}
+	return writeTagReport(w, *format, rows)
+}
+
+// buildTagReport compares the tags of the EBS volume of each PVC with the
+// tags the PVC wants it to have
+func buildTagReport(ctx context.Context, client *EBSClient, namespace string) ([]tagReportRow, error) {
+	volumeTags, err := client.listEBSVolumeTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pvcs, err := k8sClient.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list PVCs: %w", err)
+	}
+
+	rows := []tagReportRow{}
+	for i := range pvcs.Items {
+		pvc := getPVC(&pvcs.Items[i])
+		if pvc.Spec.VolumeName == "" || !provisionedByAwsEbs(pvc) {
+			continue
+		}
+		volumeID, desiredTags, _, err := processPersistentVolumeClaim(ctx, pvc)
+		if err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Skipping PVC in report:", err)
+			continue
+		}
+
+		row := tagReportRow{
+			VolumeID:     volumeID,
+			PVCName:      pvc.GetName(),
+			PVCNamespace: pvc.GetNamespace(),
+			CurrentTags:  volumeTags[volumeID],
+			DesiredTags:  desiredTags,
+			MissingTags:  []string{},
+			ExtraTags:    []string{},
+			WrongValues:  []string{},
+		}
+		if row.CurrentTags == nil {
+			row.CurrentTags = map[string]string{}
+		}
+		for k, v := range row.DesiredTags {
+			current, ok := row.CurrentTags[k]
+			if !ok {
+				row.MissingTags = append(row.MissingTags, k)
+			} else if current != v {
+				row.WrongValues = append(row.WrongValues, k)
+			}
+		}
+		for k := range row.CurrentTags {
+			if _, ok := row.DesiredTags[k]; !ok {
+				row.ExtraTags = append(row.ExtraTags, k)
+			}
+		}
+		slices.Sort(row.MissingTags)
+		slices.Sort(row.ExtraTags)
+		slices.Sort(row.WrongValues)
+		rows = append(rows, row)
+	}
+
+	slices.SortFunc(rows, func(a, b tagReportRow) int {
+		if c := strings.Compare(a.PVCNamespace, b.PVCNamespace); c != 0 {
+			return c
+		}
+		return strings.Compare(a.PVCName, b.PVCName)
+	})
+	return rows, nil
+}
+
+// listEBSVolumeTags returns the tags of every EBS volume in the region, keyed
+// by volumeID
+func (client *EBSClient) listEBSVolumeTags(ctx context.Context) (map[string]map[string]string, error) {
+	volumeTags := map[string]map[string]string{}
+	input := &ec2.DescribeVolumesInput{}
+	for {
+		output, err := client.DescribeVolumesWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("could not describe EBS volumes: %w", err)
+		}
+		for _, volume := range output.Volumes {
+			tags := map[string]string{}
+			for _, tag := range volume.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			volumeTags[aws.StringValue(volume.VolumeId)] = tags
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			return volumeTags, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+func writeTagReport(w io.Writer, format string, rows []tagReportRow) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+
+	writer := csv.NewWriter(w)
+	records := [][]string{{"volume_id", "pvc_namespace", "pvc_name", "current_tags", "desired_tags", "missing_tags", "extra_tags", "wrong_values"}}
+	for _, row := range rows {
+		records = append(records, []string{
+			row.VolumeID,
+			row.PVCNamespace,
+			row.PVCName,
+			formatCsv(row.CurrentTags),
+			formatCsv(row.DesiredTags),
+			strings.Join(row.MissingTags, ","),
+			strings.Join(row.ExtraTags, ","),
+			strings.Join(row.WrongValues, ","),
+		})
+	}
+	return writer.WriteAll(records)
+}
+
+// formatCsv encodes tags in the same key=value csv format parseCsv reads
+func formatCsv(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
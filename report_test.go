@@ -0,0 +1,177 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func setupReportTest(t *testing.T) *EBSClient {
+	t.Helper()
+
+	newPVC := func(name, provisioner, volumeName, tags string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					annotationPrefix + "/tags":                 tags,
+					"volume.kubernetes.io/storage-provisioner": provisioner,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       volumeName,
+				StorageClassName: &dummyStorageClassName,
+			},
+		}
+	}
+	newPV := func(name, volumeHandle string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeHandle},
+				},
+			},
+		}
+	}
+
+	k8sClient = fake.NewSimpleClientset(
+		newPVC("compliant", AWS_EBS_CSI, "pv-compliant", `{"team": "db"}`),
+		newPV("pv-compliant", "vol-1"),
+		newPVC("drifted", AWS_EBS_CSI, "pv-drifted", `{"team": "db", "env": "prod"}`),
+		newPV("pv-drifted", "vol-2"),
+		newPVC("untagged", AWS_EBS_CSI, "pv-untagged", `{"team": "web"}`),
+		newPV("pv-untagged", "vol-3"),
+		newPVC("efs", AWS_EFS_CSI, "pv-efs", `{"team": "db"}`),
+		newPV("pv-efs", "fs-1::fsap-1"),
+		newPVC("pending", AWS_EBS_CSI, "", `{"team": "db"}`),
+	)
+
+	return &EBSClient{&fakeEC2Client{volumes: []*ec2.Volume{
+		{VolumeId: aws.String("vol-1"), Tags: []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("db")}}},
+		{VolumeId: aws.String("vol-2"), Tags: []*ec2.Tag{
+			{Key: aws.String("team"), Value: aws.String("web")},
+			{Key: aws.String("ebs.csi.aws.com/cluster"), Value: aws.String("true")},
+		}},
+		{VolumeId: aws.String("vol-3")},
+		{VolumeId: aws.String("vol-unused"), Tags: []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("db")}}},
+	}}}
+}
+
+func Test_buildTagReport(t *testing.T) {
+	client := setupReportTest(t)
+
+	got, err := buildTagReport(context.Background(), client, "")
+	if err != nil {
+		t.Fatalf("buildTagReport() error = %v", err)
+	}
+
+	want := []tagReportRow{
+		{
+			VolumeID:     "vol-1",
+			PVCName:      "compliant",
+			PVCNamespace: "default",
+			CurrentTags:  map[string]string{"team": "db"},
+			DesiredTags:  map[string]string{"team": "db"},
+			MissingTags:  []string{},
+			ExtraTags:    []string{},
+			WrongValues:  []string{},
+		},
+		{
+			VolumeID:     "vol-2",
+			PVCName:      "drifted",
+			PVCNamespace: "default",
+			CurrentTags:  map[string]string{"team": "web", "ebs.csi.aws.com/cluster": "true"},
+			DesiredTags:  map[string]string{"team": "db", "env": "prod"},
+			MissingTags:  []string{"env"},
+			ExtraTags:    []string{"ebs.csi.aws.com/cluster"},
+			WrongValues:  []string{"team"},
+		},
+		{
+			VolumeID:     "vol-3",
+			PVCName:      "untagged",
+			PVCNamespace: "default",
+			CurrentTags:  map[string]string{},
+			DesiredTags:  map[string]string{"team": "web"},
+			MissingTags:  []string{"team"},
+			ExtraTags:    []string{},
+			WrongValues:  []string{},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTagReport() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_writeTagReport(t *testing.T) {
+	client := setupReportTest(t)
+	rows, err := buildTagReport(context.Background(), client, "")
+	if err != nil {
+		t.Fatalf("buildTagReport() error = %v", err)
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeTagReport(&buf, "csv", rows); err != nil {
+			t.Fatalf("writeTagReport() error = %v", err)
+		}
+		want := `volume_id,pvc_namespace,pvc_name,current_tags,desired_tags,missing_tags,extra_tags,wrong_values
+vol-1,default,compliant,team=db,team=db,,,
+vol-2,default,drifted,"ebs.csi.aws.com/cluster=true,team=web","env=prod,team=db",env,ebs.csi.aws.com/cluster,team
+vol-3,default,untagged,,team=web,team,,
+`
+		if got := buf.String(); got != want {
+			t.Errorf("writeTagReport() =\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeTagReport(&buf, "json", rows); err != nil {
+			t.Fatalf("writeTagReport() error = %v", err)
+		}
+		var got []tagReportRow
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("writeTagReport() wrote invalid json: %v", err)
+		}
+		if !reflect.DeepEqual(got, rows) {
+			t.Errorf("writeTagReport() = %+v, want %+v", got, rows)
+		}
+		var fields []map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"volumeID", "pvcName", "pvcNamespace", "currentTags", "desiredTags", "missingTags", "extraTags", "wrongValues"} {
+			if _, ok := fields[0][key]; !ok {
+				t.Errorf("writeTagReport() json is missing the %s field", key)
+			}
+		}
+	})
+}
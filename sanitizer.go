@@ -0,0 +1,146 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// SanitizerConfig holds the constraints a cloud provider puts on the keys and
+// values of its labels or tags
+type SanitizerConfig struct {
+	// KeyMaxLen and ValueMaxLen are the maximum lengths in characters
+	KeyMaxLen   int
+	ValueMaxLen int
+	// AllowedKeyChars and AllowedValueChars report whether a character may be
+	// used; other characters are replaced with '_'. nil allows all characters.
+	AllowedKeyChars   func(rune) bool
+	AllowedValueChars func(rune) bool
+	// ReplacementTable replaces characters of keys before AllowedKeyChars is
+	// checked. nil replaces nothing.
+	ReplacementTable *strings.Replacer
+}
+
+var (
+	gcpSanitizer = SanitizerConfig{
+		KeyMaxLen:        gcpMaxLabelLength,
+		ValueMaxLen:      gcpMaxLabelLength,
+		AllowedKeyChars:  isGCPLabelKeyChar,
+		ReplacementTable: newGCPKeyReplacer(nil),
+	}
+	awsSanitizer = SanitizerConfig{
+		KeyMaxLen:   awsMaxTagKeyLength,
+		ValueMaxLen: awsMaxTagValueLength,
+	}
+	azureSanitizer = SanitizerConfig{
+		KeyMaxLen:        azureMaxTagKeyLength,
+		ValueMaxLen:      azureMaxTagValueLength,
+		ReplacementTable: azureTagKeyReplacer,
+	}
+)
+
+// sanitizerConfig returns the SanitizerConfig of the cloud provider
+func sanitizerConfig(provider string) *SanitizerConfig {
+	switch provider {
+	case AWS:
+		return &awsSanitizer
+	case GCP:
+		return &gcpSanitizer
+	case AZURE:
+		return &azureSanitizer
+	}
+	return nil
+}
+
+// setLabelValueMaxLength lowers the maximum value length of the cloud
+// provider to n, see --label-value-max-length. 0 keeps the provider's limit.
+func setLabelValueMaxLength(provider string, n int) error {
+	config := sanitizerConfig(provider)
+	if config == nil || n == 0 {
+		return nil
+	}
+	if n < 0 || n > config.ValueMaxLen {
+		return fmt.Errorf("label-value-max-length must be between 1 and %d for %s", config.ValueMaxLen, provider)
+	}
+	config.ValueMaxLen = n
+	return nil
+}
+
+// replaceKeyChars applies the ReplacementTable to key and replaces the
+// characters AllowedKeyChars doesn't allow with '_'
+func (c *SanitizerConfig) replaceKeyChars(key string) string {
+	if c.ReplacementTable != nil {
+		key = c.ReplacementTable.Replace(key)
+	}
+	return replaceDisallowed(key, c.AllowedKeyChars)
+}
+
+// truncateKey truncates key to KeyMaxLen characters
+func (c *SanitizerConfig) truncateKey(key string) string {
+	return truncateRunes(key, c.KeyMaxLen)
+}
+
+// sanitizeKey replaces the disallowed characters of key and truncates it
+func (c *SanitizerConfig) sanitizeKey(key string) string {
+	return c.truncateKey(c.replaceKeyChars(key))
+}
+
+// sanitizeValue replaces the characters AllowedValueChars doesn't allow with
+// '_' and truncates value to ValueMaxLen characters
+func (c *SanitizerConfig) sanitizeValue(value string) string {
+	return truncateRunes(replaceDisallowed(value, c.AllowedValueChars), c.ValueMaxLen)
+}
+
+// labelKeyCollisions returns the label keys that become the same key once
+// sanitized with sanitizeKey, by sanitized key. The keys are sorted.
+func labelKeyCollisions(labels map[string]string, sanitizeKey func(string) string) map[string][]string {
+	originals := map[string][]string{}
+	for k := range labels {
+		sanitizedKey := sanitizeKey(k)
+		originals[sanitizedKey] = append(originals[sanitizedKey], k)
+	}
+	collisions := map[string][]string{}
+	for sanitizedKey, keys := range originals {
+		if len(keys) > 1 {
+			slices.Sort(keys)
+			collisions[sanitizedKey] = keys
+		}
+	}
+	return collisions
+}
+
+func replaceDisallowed(s string, allowed func(rune) bool) string {
+	if allowed == nil {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if allowed(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// isGCPLabelKeyChar reports whether r may be used in a GCP label key
+func isGCPLabelKeyChar(r rune) bool {
+	return isGCPLabelLetter(r) || unicode.IsNumber(r) || r == '-' || r == '_'
+}
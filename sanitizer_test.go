@@ -0,0 +1,114 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizerConfigLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		key      int
+		value    int
+	}{
+		{name: "gcp", provider: GCP, key: 63, value: 63},
+		{name: "aws", provider: AWS, key: 128, value: 256},
+		{name: "azure", provider: AZURE, key: 512, value: 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := sanitizerConfig(tt.provider)
+			if got := config.sanitizeKey(strings.Repeat("k", tt.key)); len(got) != tt.key {
+				t.Errorf("sanitizeKey() of %d characters = %d characters, want %d", tt.key, len(got), tt.key)
+			}
+			if got := config.sanitizeKey(strings.Repeat("k", tt.key+1)); len(got) != tt.key {
+				t.Errorf("sanitizeKey() of %d characters = %d characters, want %d", tt.key+1, len(got), tt.key)
+			}
+			if got := config.sanitizeValue(strings.Repeat("v", tt.value)); len(got) != tt.value {
+				t.Errorf("sanitizeValue() of %d characters = %d characters, want %d", tt.value, len(got), tt.value)
+			}
+			if got := config.sanitizeValue(strings.Repeat("v", tt.value+1)); len(got) != tt.value {
+				t.Errorf("sanitizeValue() of %d characters = %d characters, want %d", tt.value+1, len(got), tt.value)
+			}
+		})
+	}
+}
+
+func TestSanitizerConfigChars(t *testing.T) {
+	config := SanitizerConfig{
+		KeyMaxLen:         10,
+		ValueMaxLen:       10,
+		AllowedKeyChars:   func(r rune) bool { return r >= 'a' && r <= 'z' },
+		AllowedValueChars: func(r rune) bool { return r != ' ' },
+		ReplacementTable:  strings.NewReplacer(".", "dot"),
+	}
+	if got, want := config.sanitizeKey("a.b/c"), "adotb_c"; got != want {
+		t.Errorf("sanitizeKey() = %q, want %q", got, want)
+	}
+	if got, want := config.sanitizeKey("a.b.c.d"), "adotbdotcd"; got != want {
+		t.Errorf("sanitizeKey() = %q, want %q", got, want)
+	}
+	if got, want := config.sanitizeValue("a b.c"), "a_b.c"; got != want {
+		t.Errorf("sanitizeValue() = %q, want %q", got, want)
+	}
+	if got, want := (&SanitizerConfig{KeyMaxLen: 3, ValueMaxLen: 3}).sanitizeKey("a/b.c"), "a/b"; got != want {
+		t.Errorf("sanitizeKey() without constraints = %q, want %q", got, want)
+	}
+}
+
+func TestSetLabelValueMaxLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		length   int
+		want     int
+		wantErr  bool
+	}{
+		{name: "provider limit kept", provider: AWS, length: 0, want: 256},
+		{name: "lowered", provider: AWS, length: 100, want: 100},
+		{name: "provider limit", provider: AZURE, length: 256, want: 256},
+		{name: "above provider limit", provider: GCP, length: 64, want: 63, wantErr: true},
+		{name: "negative", provider: GCP, length: -1, want: 63, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := sanitizerConfig(tt.provider)
+			defer func(old int) { config.ValueMaxLen = old }(config.ValueMaxLen)
+
+			err := setLabelValueMaxLength(tt.provider, tt.length)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setLabelValueMaxLength() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if config.ValueMaxLen != tt.want {
+				t.Errorf("ValueMaxLen = %d, want %d", config.ValueMaxLen, tt.want)
+			}
+		})
+	}
+
+	defer func(old int) { awsSanitizer.ValueMaxLen = old }(awsSanitizer.ValueMaxLen)
+	if err := setLabelValueMaxLength(AWS, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := sanitizeLabelsForAWS(map[string]string{"key": "long-value"}); got["key"] != "long-" {
+		t.Errorf("sanitizeLabelsForAWS() = %v, want the value truncated to 5 characters", got)
+	}
+}
@@ -0,0 +1,272 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"maps"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// scDefaultsInformer watches the --storageclass-defaults-configmap
+	// ConfigMap. It is nil when no ConfigMap is configured.
+	scDefaultsInformer cache.SharedIndexInformer
+	// scDefaultsKey is the namespace/name key of the ConfigMap
+	scDefaultsKey string
+)
+
+// startStorageClassDefaultsInformer starts watching the StorageClass defaults
+// ConfigMap and sets scDefaultsInformer once its cache has synced
+func startStorageClassDefaultsInformer(ctx context.Context, namespace, name string) {
+	informer := startConfigMapInformer(ctx, namespace, name)
+	if informer == nil {
+		return
+	}
+	scDefaultsKey = namespace + "/" + name
+	scDefaultsInformer = informer
+}
+
+// getStorageClassDefaults returns the default tags in the ConfigMap for the
+// PVC's StorageClass. It is empty when no ConfigMap is configured, the
+// ConfigMap doesn't exist or has no defaults for the StorageClass.
+func getStorageClassDefaults(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if scDefaultsInformer == nil || pvc.Spec.StorageClassName == nil {
+		return nil
+	}
+	obj, exists, err := scDefaultsInformer.GetStore().GetByKey(scDefaultsKey)
+	if err != nil || !exists {
+		return map[string]string{}
+	}
+	defaults, _ := parseStorageClassDefaults(obj.(*corev1.ConfigMap))
+	if defaults[*pvc.Spec.StorageClassName] == nil {
+		return map[string]string{}
+	}
+	return defaults[*pvc.Spec.StorageClassName]
+}
+
+// parseStorageClassDefaults parses the default tags of each StorageClass in
+// the ConfigMap. Each key is the name of a StorageClass and its value a JSON
+// or YAML map of tags. The StorageClasses whose value can't be parsed are
+// skipped and returned.
+func parseStorageClassDefaults(cm *corev1.ConfigMap) (map[string]map[string]string, []string) {
+	defaults := map[string]map[string]string{}
+	var invalid []string
+	for storageClass, data := range cm.Data {
+		tags := map[string]string{}
+		if err := yaml.Unmarshal([]byte(data), &tags); err != nil {
+			invalid = append(invalid, storageClass)
+			continue
+		}
+		defaults[storageClass] = tags
+	}
+	return defaults, invalid
+}
+
+// storageClassDefaultsFromObject returns the defaults of a ConfigMap received
+// from the informer, logging the StorageClasses that can't be parsed
+func storageClassDefaultsFromObject(obj interface{}) map[string]map[string]string {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return map[string]map[string]string{}
+	}
+	defaults, invalid := parseStorageClassDefaults(cm)
+	for _, storageClass := range invalid {
+		log.WithFields(log.Fields{"namespace": cm.GetNamespace(), "configmap": cm.GetName(), "storageclass": storageClass}).Warnln("Skipping invalid StorageClass defaults, the value must be a map of tags")
+	}
+	return defaults
+}
+
+// storageClassDefaultsEvents returns a pvcEventStorageClassDefaults for every
+// PVC in pvcLister whose StorageClass's defaults have changed
+func storageClassDefaultsEvents(oldDefaults, newDefaults map[string]map[string]string, pvcLister corelisters.PersistentVolumeClaimLister) []*pvcEvent {
+	changed := map[string]bool{}
+	for storageClass := range oldDefaults {
+		changed[storageClass] = !maps.Equal(oldDefaults[storageClass], newDefaults[storageClass])
+	}
+	for storageClass := range newDefaults {
+		changed[storageClass] = !maps.Equal(oldDefaults[storageClass], newDefaults[storageClass])
+	}
+
+	pvcs, err := pvcLister.List(labels.Everything())
+	if err != nil {
+		log.Errorln("Unable to list PVCs:", err)
+		return nil
+	}
+	var events []*pvcEvent
+	for _, pvc := range pvcs {
+		if pvc.Spec.StorageClassName == nil || !changed[*pvc.Spec.StorageClassName] {
+			continue
+		}
+		// objects in the informer cache must not be modified
+		e := newPVCEvent(pvcEventStorageClassDefaults, nil, getPVC(pvc.DeepCopy()))
+		e.oldSources.storageClassDefaults = oldDefaults[*pvc.Spec.StorageClassName]
+		if e.oldSources.storageClassDefaults == nil {
+			e.oldSources.storageClassDefaults = map[string]string{}
+		}
+		events = append(events, e)
+	}
+	if len(events) > 0 {
+		log.Infoln("StorageClass defaults changed, reconciling", len(events), "PVCs")
+	}
+	return events
+}
+
+// storageClassDefaultsEventHandler queues a pvcEventStorageClassDefaults for
+// the PVCs affected by the creation, update or deletion of the StorageClass
+// defaults ConfigMap
+func storageClassDefaultsEventHandler(queue eventQueue, pvcLister corelisters.PersistentVolumeClaimLister) cache.ResourceEventHandler {
+	enqueue := func(oldDefaults, newDefaults map[string]map[string]string) {
+		for _, e := range storageClassDefaultsEvents(oldDefaults, newDefaults, pvcLister) {
+			queue.Add(e)
+		}
+	}
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if !isInInitialList {
+				enqueue(map[string]map[string]string{}, storageClassDefaultsFromObject(obj))
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			enqueue(storageClassDefaultsFromObject(old), storageClassDefaultsFromObject(new))
+		},
+		DeleteFunc: func(obj interface{}) {
+			enqueue(storageClassDefaultsFromObject(obj), map[string]map[string]string{})
+		},
+	}
+}
+
+// defaultLabelsAnnotation on a StorageClass holds a JSON or YAML map of tags
+// set on the volumes of all PVCs of the StorageClass, with a lower priority
+// than every other source of tags
+const defaultLabelsAnnotation = "pvc-tagger.planetscale.com/default-labels"
+
+// parseDefaultLabels parses the default-labels annotation of the StorageClass.
+// It is empty when the StorageClass has no annotation.
+func parseDefaultLabels(sc *storagev1.StorageClass) (map[string]string, error) {
+	tags := map[string]string{}
+	value, ok := sc.GetAnnotations()[defaultLabelsAnnotation]
+	if !ok {
+		return tags, nil
+	}
+	if err := yaml.Unmarshal([]byte(value), &tags); err != nil {
+		return map[string]string{}, err
+	}
+	return tags, nil
+}
+
+// storageClassDefaultLabels returns the tags of the StorageClass's
+// default-labels annotation, logging an annotation that can't be parsed
+func storageClassDefaultLabels(sc *storagev1.StorageClass) map[string]string {
+	tags, err := parseDefaultLabels(sc)
+	if err != nil {
+		log.WithFields(log.Fields{"storageclass": sc.GetName()}).Warnln("Skipping invalid "+defaultLabelsAnnotation+" annotation, the value must be a map of tags:", err)
+	}
+	return tags
+}
+
+// getStorageClassDefaultLabels returns the tags of the default-labels
+// annotation of the PVC's StorageClass, read from the informer cache. It is
+// nil when the StorageClass informer isn't running or the PVC has no
+// StorageClass, and empty when the StorageClass doesn't exist (anymore).
+func getStorageClassDefaultLabels(ctx context.Context, pvc *corev1.PersistentVolumeClaim) map[string]string {
+	if scLister == nil || pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return nil
+	}
+	sc, err := scLister.Get(*pvc.Spec.StorageClassName)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.WithContext(ctx).WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "storageclass": *pvc.Spec.StorageClassName}).Warnln("Unable to get StorageClass default labels:", err)
+		}
+		return map[string]string{}
+	}
+	return storageClassDefaultLabels(sc)
+}
+
+// storageClassDefaultLabelsEvents returns a pvcEventStorageClass for every
+// PVC of the StorageClass in pvcLister when its default labels have changed
+func storageClassDefaultLabelsEvents(name string, oldLabels, newLabels map[string]string, pvcLister corelisters.PersistentVolumeClaimLister) []*pvcEvent {
+	if maps.Equal(oldLabels, newLabels) {
+		return nil
+	}
+	pvcs, err := pvcLister.List(labels.Everything())
+	if err != nil {
+		log.Errorln("Unable to list PVCs:", err)
+		return nil
+	}
+	var events []*pvcEvent
+	for _, pvc := range pvcs {
+		// objects in the informer cache must not be modified
+		pvc = getPVC(pvc.DeepCopy())
+		if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != name {
+			continue
+		}
+		e := newPVCEvent(pvcEventStorageClass, nil, pvc)
+		e.oldSources.storageClassDefaultLabels = oldLabels
+		events = append(events, e)
+	}
+	if len(events) > 0 {
+		log.WithFields(log.Fields{"storageclass": name}).Infoln("StorageClass default labels changed, reconciling", len(events), "PVCs")
+	}
+	return events
+}
+
+// storageClassDefaultLabelsEventHandler queues a pvcEventStorageClass for the
+// PVCs of a StorageClass whose default-labels annotation changed, including
+// when the StorageClass is created or deleted
+func storageClassDefaultLabelsEventHandler(queue eventQueue, pvcLister corelisters.PersistentVolumeClaimLister) cache.ResourceEventHandler {
+	enqueue := func(name string, oldLabels, newLabels map[string]string) {
+		for _, e := range storageClassDefaultLabelsEvents(name, oldLabels, newLabels, pvcLister) {
+			queue.Add(e)
+		}
+	}
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if sc, ok := obj.(*storagev1.StorageClass); ok && !isInInitialList {
+				enqueue(sc.GetName(), map[string]string{}, storageClassDefaultLabels(sc))
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldSC, ok := old.(*storagev1.StorageClass)
+			newSC, newOK := new.(*storagev1.StorageClass)
+			if ok && newOK {
+				enqueue(newSC.GetName(), storageClassDefaultLabels(oldSC), storageClassDefaultLabels(newSC))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if sc, ok := obj.(*storagev1.StorageClass); ok {
+				enqueue(sc.GetName(), storageClassDefaultLabels(sc), map[string]string{})
+			}
+		},
+	}
+}
@@ -0,0 +1,541 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_parseStorageClassDefaults(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{
+		"premium-ssd":  `{"tier": "premium", "backup": "daily"}`,
+		"standard-hdd": "tier: standard\n# comment\nbackup: \"7\"\n",
+		"empty":        "",
+		"not-a-map":    "- tier\n- standard",
+		"number-value": "retention: 7",
+	}}
+	defaults, invalid := parseStorageClassDefaults(cm)
+	want := map[string]map[string]string{
+		"premium-ssd":  {"tier": "premium", "backup": "daily"},
+		"standard-hdd": {"tier": "standard", "backup": "7"},
+		"empty":        {},
+		"number-value": {"retention": "7"},
+	}
+	if !reflect.DeepEqual(defaults, want) {
+		t.Errorf("parseStorageClassDefaults() defaults = %v, want %v", defaults, want)
+	}
+	slices.Sort(invalid)
+	if want := []string{"not-a-map"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("parseStorageClassDefaults() invalid = %q, want %q", invalid, want)
+	}
+}
+
+func Test_buildTagsStorageClassDefaults(t *testing.T) {
+	defer func(old map[string]string) { defaultTags = old }(defaultTags)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defaultTags = map[string]string{"tier": "default", "owner": "platform", "global": "yes"}
+	copyLabels = []string{"*"}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Labels:    map[string]string{"owner": "db-team"},
+			Annotations: map[string]string{
+				annotationPrefix + "/tags": `{"backup": "hourly"}`,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &dummyStorageClassName},
+	}
+	tests := []struct {
+		name    string
+		sources tagSources
+		want    map[string]string
+	}{
+		{
+			name:    "no defaults",
+			sources: tagSources{},
+			want:    map[string]string{"tier": "default", "owner": "db-team", "global": "yes", "backup": "hourly"},
+		},
+		{
+			name:    "defaults override the global defaults and nothing else",
+			sources: tagSources{storageClassDefaults: map[string]string{"tier": "premium", "owner": "storage", "backup": "daily", "class": "ssd"}},
+			want:    map[string]string{"tier": "premium", "owner": "db-team", "global": "yes", "backup": "hourly", "class": "ssd"},
+		},
+		{
+			name: "namespace labels override the defaults",
+			sources: tagSources{
+				storageClassDefaults: map[string]string{"class": "ssd"},
+				namespace:            map[string]string{"class": "nvme"},
+			},
+			want: map[string]string{"tier": "default", "owner": "db-team", "global": "yes", "backup": "hourly", "class": "nvme"},
+		},
+		{
+			name:    "restricted keys are skipped",
+			sources: tagSources{storageClassDefaults: map[string]string{"kubernetes.io/created-for/pvc/name": "x", "class": "ssd"}},
+			want:    map[string]string{"tier": "default", "owner": "db-team", "global": "yes", "backup": "hourly", "class": "ssd"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := buildTagsFromSources(context.Background(), pvc, tt.sources)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("buildTagsFromSources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getStorageClassDefaults(t *testing.T) {
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old cache.SharedIndexInformer) { scDefaultsInformer = old }(scDefaultsInformer)
+
+	premium, other := "premium-ssd", "other"
+	pvc := func(storageClass *string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: storageClass}}
+	}
+
+	scDefaultsInformer = nil
+	if got := getStorageClassDefaults(pvc(&premium)); got != nil {
+		t.Errorf("getStorageClassDefaults() without a ConfigMap = %v, want nil", got)
+	}
+
+	k8sClient = fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "sc-defaults", Namespace: "default"},
+		Data:       map[string]string{premium: "tier: premium"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startStorageClassDefaultsInformer(ctx, "default", "sc-defaults")
+
+	if got, want := getStorageClassDefaults(pvc(&premium)), map[string]string{"tier": "premium"}; !maps.Equal(got, want) {
+		t.Errorf("getStorageClassDefaults() = %v, want %v", got, want)
+	}
+	if got := getStorageClassDefaults(pvc(&other)); got == nil || len(got) > 0 {
+		t.Errorf("getStorageClassDefaults() of a StorageClass without defaults = %v, want empty", got)
+	}
+	if got := getStorageClassDefaults(pvc(nil)); got != nil {
+		t.Errorf("getStorageClassDefaults() without a StorageClass = %v, want nil", got)
+	}
+
+	// deleting the ConfigMap falls back to no defaults
+	if err := k8sClient.CoreV1().ConfigMaps("default").Delete(ctx, "sc-defaults", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(getStorageClassDefaults(pvc(&premium))) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("getStorageClassDefaults() = %v after the ConfigMap was deleted, want empty", getStorageClassDefaults(pvc(&premium)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_storageClassDefaultsEventHandler(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	premium, standard := "premium-ssd", "standard-hdd"
+	for name, storageClass := range map[string]*string{"pvc-1": &premium, "pvc-2": &premium, "pvc-3": &standard, "pvc-4": nil} {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: storageClass},
+		}
+		if err := indexer.Add(pvc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvcLister := corelisters.NewPersistentVolumeClaimLister(indexer)
+
+	configMap := func(data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{Data: data}
+	}
+	tests := []struct {
+		name         string
+		notify       func(h cache.ResourceEventHandler)
+		wantPVCs     []string
+		wantDefaults map[string]string
+	}{
+		{
+			name: "initial list",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnAdd(configMap(map[string]string{premium: "tier: premium"}), true)
+			},
+		},
+		{
+			name: "created",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnAdd(configMap(map[string]string{premium: "tier: premium"}), false)
+			},
+			wantPVCs:     []string{"pvc-1", "pvc-2"},
+			wantDefaults: map[string]string{},
+		},
+		{
+			name: "one StorageClass updated",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnUpdate(
+					configMap(map[string]string{premium: "tier: premium", standard: "tier: standard"}),
+					configMap(map[string]string{premium: "tier: premium", standard: "tier: cheap"}),
+				)
+			},
+			wantPVCs:     []string{"pvc-3"},
+			wantDefaults: map[string]string{"tier": "standard"},
+		},
+		{
+			name: "reformatted without changing the defaults",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnUpdate(configMap(map[string]string{premium: "tier: premium"}), configMap(map[string]string{premium: `{"tier": "premium"}`}))
+			},
+		},
+		{
+			name: "deleted",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnDelete(cache.DeletedFinalStateUnknown{Obj: configMap(map[string]string{standard: "tier: standard"})})
+			},
+			wantPVCs:     []string{"pvc-3"},
+			wantDefaults: map[string]string{"tier": "standard"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := workqueue.New()
+			defer queue.ShutDown()
+			tt.notify(storageClassDefaultsEventHandler(queue, pvcLister))
+
+			var gotPVCs []string
+			for queue.Len() > 0 {
+				item, _ := queue.Get()
+				e := item.(*pvcEvent)
+				gotPVCs = append(gotPVCs, e.pvc.GetName())
+				if e.eventType != pvcEventStorageClassDefaults || e.oldSources.storageClassDefaults == nil || !maps.Equal(e.oldSources.storageClassDefaults, tt.wantDefaults) {
+					t.Errorf("event = %s with old defaults %v, want %s with %v", e.eventType, e.oldSources.storageClassDefaults, pvcEventStorageClassDefaults, tt.wantDefaults)
+				}
+				queue.Done(item)
+			}
+			slices.Sort(gotPVCs)
+			if !slices.Equal(gotPVCs, tt.wantPVCs) {
+				t.Errorf("queued events for %v, want %v", gotPVCs, tt.wantPVCs)
+			}
+		})
+	}
+}
+
+func Test_reconcileSourcesUpdateStorageClassDefaults(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old cache.SharedIndexInformer) { scDefaultsInformer = old }(scDefaultsInformer)
+	cloud = GCP
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+				},
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "sc-defaults", Namespace: "default"},
+			Data:       map[string]string{dummyStorageClassName: "tier: premium"},
+		},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startStorageClassDefaultsInformer(ctx, "default", "sc-defaults")
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"app": "web"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	// the defaults had a backup tag that was removed from the ConfigMap
+	diskLabels := map[string]string{"app": "web", "tier": "standard", "backup": "daily"}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	oldSources := tagSources{storageClassDefaults: map[string]string{"tier": "standard", "backup": "daily"}}
+	if err := r.reconcileSourcesUpdate(ctx, pvc, oldSources); err != nil {
+		t.Fatalf("reconcileSourcesUpdate() error = %v", err)
+	}
+	if want := map[string]string{"app": "web", "tier": "premium"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("disk labels = %v, want %v", diskLabels, want)
+	}
+}
+
+func Test_buildTagsStorageClassDefaultLabels(t *testing.T) {
+	defer func(old map[string]string) { defaultTags = old }(defaultTags)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defaultTags = map[string]string{"tier": "default", "global": "yes"}
+	copyLabels = []string{"*"}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Labels:    map[string]string{"owner": "db-team"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &dummyStorageClassName},
+	}
+	sources := tagSources{
+		storageClassDefaultLabels: map[string]string{"cost-center": "storage", "tier": "annotated", "global": "no", "owner": "storage"},
+		storageClassDefaults:      map[string]string{"tier": "premium"},
+	}
+	got, _ := buildTagsFromSources(context.Background(), pvc, sources)
+	want := map[string]string{"cost-center": "storage", "tier": "premium", "global": "yes", "owner": "db-team"}
+	if !maps.Equal(got, want) {
+		t.Errorf("buildTagsFromSources() = %v, want %v", got, want)
+	}
+}
+
+func Test_getStorageClassDefaultLabels(t *testing.T) {
+	defer func(old storagelisters.StorageClassLister) { scLister = old }(scLister)
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, annotations := range map[string]map[string]string{
+		"annotated": {defaultLabelsAnnotation: `{"cost-center": "storage"}`},
+		"yaml":      {defaultLabelsAnnotation: "cost-center: storage\nretention: 7"},
+		"invalid":   {defaultLabelsAnnotation: "- cost-center"},
+		"plain":     nil,
+	} {
+		sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}
+		if err := indexer.Add(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvc := func(storageClass string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass}}
+	}
+
+	scLister = nil
+	if got := getStorageClassDefaultLabels(context.Background(), pvc("annotated")); got != nil {
+		t.Errorf("getStorageClassDefaultLabels() without the informer = %v, want nil", got)
+	}
+
+	scLister = storagelisters.NewStorageClassLister(indexer)
+	tests := []struct {
+		storageClass string
+		want         map[string]string
+	}{
+		{storageClass: "annotated", want: map[string]string{"cost-center": "storage"}},
+		{storageClass: "yaml", want: map[string]string{"cost-center": "storage", "retention": "7"}},
+		{storageClass: "invalid", want: map[string]string{}},
+		{storageClass: "plain", want: map[string]string{}},
+		{storageClass: "deleted", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.storageClass, func(t *testing.T) {
+			got := getStorageClassDefaultLabels(context.Background(), pvc(tt.storageClass))
+			if got == nil || !maps.Equal(got, tt.want) {
+				t.Errorf("getStorageClassDefaultLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_storageClassDefaultLabelsEventHandler(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	premium, standard := "premium-ssd", "standard-hdd"
+	for name, storageClass := range map[string]*string{"pvc-1": &premium, "pvc-2": &premium, "pvc-3": &standard, "pvc-4": nil} {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: storageClass},
+		}
+		if err := indexer.Add(pvc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvcLister := corelisters.NewPersistentVolumeClaimLister(indexer)
+
+	storageClass := func(name, defaultLabels string) *storagev1.StorageClass {
+		sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if defaultLabels != "" {
+			sc.SetAnnotations(map[string]string{defaultLabelsAnnotation: defaultLabels})
+		}
+		return sc
+	}
+	tests := []struct {
+		name       string
+		notify     func(h cache.ResourceEventHandler)
+		wantPVCs   []string
+		wantLabels map[string]string
+	}{
+		{
+			name: "initial list",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnAdd(storageClass(premium, "cost-center: storage"), true)
+			},
+		},
+		{
+			name: "created",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnAdd(storageClass(premium, "cost-center: storage"), false)
+			},
+			wantPVCs:   []string{"pvc-1", "pvc-2"},
+			wantLabels: map[string]string{},
+		},
+		{
+			name: "created without annotation",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnAdd(storageClass(premium, ""), false)
+			},
+		},
+		{
+			name: "annotation changed",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnUpdate(storageClass(standard, "cost-center: storage"), storageClass(standard, "cost-center: billing"))
+			},
+			wantPVCs:   []string{"pvc-3"},
+			wantLabels: map[string]string{"cost-center": "storage"},
+		},
+		{
+			name: "other changes",
+			notify: func(h cache.ResourceEventHandler) {
+				old, new := storageClass(standard, "cost-center: storage"), storageClass(standard, `{"cost-center": "storage"}`)
+				new.SetLabels(map[string]string{"team": "storage"})
+				h.OnUpdate(old, new)
+			},
+		},
+		{
+			name: "deleted",
+			notify: func(h cache.ResourceEventHandler) {
+				h.OnDelete(cache.DeletedFinalStateUnknown{Obj: storageClass(premium, "cost-center: storage")})
+			},
+			wantPVCs:   []string{"pvc-1", "pvc-2"},
+			wantLabels: map[string]string{"cost-center": "storage"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := workqueue.New()
+			defer queue.ShutDown()
+			tt.notify(storageClassDefaultLabelsEventHandler(queue, pvcLister))
+
+			var gotPVCs []string
+			for queue.Len() > 0 {
+				item, _ := queue.Get()
+				e := item.(*pvcEvent)
+				gotPVCs = append(gotPVCs, e.pvc.GetName())
+				if e.eventType != pvcEventStorageClass || e.oldSources.storageClassDefaultLabels == nil || !maps.Equal(e.oldSources.storageClassDefaultLabels, tt.wantLabels) {
+					t.Errorf("event = %s with old default labels %v, want %s with %v", e.eventType, e.oldSources.storageClassDefaultLabels, pvcEventStorageClass, tt.wantLabels)
+				}
+				queue.Done(item)
+			}
+			slices.Sort(gotPVCs)
+			if !slices.Equal(gotPVCs, tt.wantPVCs) {
+				t.Errorf("queued events for %v, want %v", gotPVCs, tt.wantPVCs)
+			}
+		})
+	}
+}
+
+func Test_reconcileSourcesUpdateStorageClassDeleted(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old storagelisters.StorageClassLister) { scLister = old }(scLister)
+	cloud = GCP
+	gcpLabelCacheTTL = 0
+
+	volumeID := "projects/my-project/zones/us-east1-a/disks/my-disk"
+	k8sClient = fake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			},
+		},
+	})
+	// the StorageClass is no longer in the informer cache
+	scLister = storagelisters.NewStorageClassLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationPrefix + "/tags":                 `{"app": "web"}`,
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "my-pv",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+
+	diskLabels := map[string]string{"app": "web", "cost-center": "storage"}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: maps.Clone(diskLabels)}, nil
+		},
+		fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			diskLabels = labelReq.Labels
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+	r := &pvcReconciler{gcpClient: client}
+	oldSources := tagSources{storageClassDefaultLabels: map[string]string{"cost-center": "storage"}}
+	if err := r.reconcileSourcesUpdate(context.Background(), pvc, oldSources); err != nil {
+		t.Fatalf("reconcileSourcesUpdate() error = %v", err)
+	}
+	if want := map[string]string{"app": "web"}; !maps.Equal(diskLabels, want) {
+		t.Errorf("disk labels = %v, want %v", diskLabels, want)
+	}
+}
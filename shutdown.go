@@ -0,0 +1,112 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// inFlightOps tracks the PVC events being reconciled, and with them the cloud
+// operations they started, so that shutdown can wait for them to finish
+type inFlightOps struct {
+	wg sync.WaitGroup
+
+	// mu guards the fields below
+	mu       sync.Mutex
+	n        int
+	stopping bool
+}
+
+// start registers a reconcile. It returns false once stop was called, when no
+// new reconciles may start.
+func (o *inFlightOps) start() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stopping {
+		return false
+	}
+	o.wg.Add(1)
+	o.n++
+	return true
+}
+
+// done unregisters a reconcile registered with start
+func (o *inFlightOps) done() {
+	o.mu.Lock()
+	o.n--
+	o.mu.Unlock()
+	o.wg.Done()
+}
+
+// stop stops new reconciles from starting and waits up to timeout for those in
+// flight. It returns how many were still in flight after the timeout.
+func (o *inFlightOps) stop(timeout time.Duration) int {
+	o.mu.Lock()
+	o.stopping = true
+	o.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(finished)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return 0
+	case <-timer.C:
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.n
+	}
+}
+
+// runWorkers reconciles the events on the queue, one worker per shard, until
+// the queue is shut down. The reconciles aren't canceled with ctx: once it is
+// done the events left on the queue are dropped, and the cloud operations in
+// flight get up to --shutdown-timeout to finish before they are canceled.
+func (r *pvcReconciler) runWorkers(ctx context.Context, queue *pvcQueue) {
+	opCtx, cancelOps := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelOps()
+	stopShutdown := context.AfterFunc(ctx, func() {
+		if n := r.ops.stop(shutdownTimeout); n > 0 {
+			log.Warnf("%d PVCs were still being reconciled after the shutdown timeout of %s, canceling their cloud operations", n, shutdownTimeout)
+		}
+		cancelOps()
+	})
+	defer stopShutdown()
+
+	// each worker drains its own shard until the queue is shut down
+	var wg sync.WaitGroup
+	for _, shard := range queue.shards {
+		wg.Add(1)
+		go func(shard workqueue.RateLimitingInterface) {
+			defer wg.Done()
+			for r.processNextEvent(opCtx, shard) {
+			}
+		}(shard)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,188 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_runWorkersShutdown(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old kubernetes.Interface) { k8sClient = old }(k8sClient)
+	defer func(old time.Duration) { gcpLabelCacheTTL = old }(gcpLabelCacheTTL)
+	defer func(old time.Duration) { shutdownTimeout = old }(shutdownTimeout)
+	cloud = GCP
+	gcpLabelCacheTTL = 0
+
+	var objects []runtime.Object
+	var events []*pvcEvent
+	for i := 0; i < 2; i++ {
+		objects = append(objects, &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pv-%d", i)},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: fmt.Sprintf("projects/my-project/zones/us-east1-a/disks/disk-%d", i)},
+				},
+			},
+		})
+		events = append(events, newPVCEvent(pvcEventAdd, nil, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("pvc-%d", i),
+				Namespace: "default",
+				Annotations: map[string]string{
+					annotationPrefix + "/tags":                 `{"foo": "bar"}`,
+					"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       fmt.Sprintf("pv-%d", i),
+				StorageClassName: &dummyStorageClassName,
+			},
+		}))
+	}
+	k8sClient = fake.NewSimpleClientset(objects...)
+
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		release     bool
+		wantErr     error
+		wantWarning bool
+	}{
+		{
+			name:    "in-flight operation finishes",
+			timeout: time.Minute,
+			release: true,
+		},
+		{
+			name:        "in-flight operation canceled after the timeout",
+			timeout:     50 * time.Millisecond,
+			wantErr:     context.Canceled,
+			wantWarning: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+			shutdownTimeout = tt.timeout
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var mu sync.Mutex
+			var calls []string
+			var gotErr error
+			client := &fakeGCPClient{
+				fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Name: name}, nil
+				},
+				// a slow label operation that only finishes once released
+				fakeSetDiskLabels: func(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					mu.Lock()
+					calls = append(calls, name)
+					mu.Unlock()
+					close(started)
+					select {
+					case <-release:
+						return &compute.Operation{Status: "DONE"}, nil
+					case <-ctx.Done():
+						gotErr = ctx.Err()
+						return nil, ctx.Err()
+					}
+				},
+				fakeGetGCEOp: func(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+			}
+			r := &pvcReconciler{gcpClient: client}
+			queue := newPVCQueue(1, "shutdown-"+strings.ReplaceAll(tt.name, " ", "-"))
+			for _, e := range events {
+				queue.Add(e)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				r.runWorkers(ctx, queue)
+			}()
+
+			<-started
+			cancel()
+			queue.ShutDown()
+			if tt.release {
+				// the operation must still be running after the shutdown began
+				time.Sleep(10 * time.Millisecond)
+				close(release)
+			}
+			select {
+			case <-stopped:
+			case <-time.After(10 * time.Second):
+				t.Fatal("workers didn't stop")
+			}
+
+			if gotErr != tt.wantErr {
+				t.Errorf("SetDiskLabels() context error = %v, want %v", gotErr, tt.wantErr)
+			}
+			if len(calls) != 1 || calls[0] != "disk-0" {
+				t.Errorf("SetDiskLabels() called for %v, want only disk-0 once the shutdown began", calls)
+			}
+			var warned bool
+			for _, entry := range hook.AllEntries() {
+				if strings.Contains(entry.Message, "still being reconciled after the shutdown timeout") {
+					warned = true
+				}
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("shutdown timeout warning logged = %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func Test_inFlightOps(t *testing.T) {
+	var ops inFlightOps
+	if !ops.start() {
+		t.Fatal("start() = false before stop")
+	}
+	if n := ops.stop(10 * time.Millisecond); n != 1 {
+		t.Errorf("stop() = %d in flight, want 1", n)
+	}
+	if ops.start() {
+		t.Error("start() = true after stop")
+	}
+	ops.done()
+	if n := ops.stop(time.Second); n != 0 {
+		t.Errorf("stop() = %d in flight after done, want 0", n)
+	}
+}
@@ -0,0 +1,261 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listStaleSubcommand prints the labels of the volumes of the bound PVCs that
+// differ from the labels the PVCs want them to have, then exits with 1 when
+// there are any
+const listStaleSubcommand = "list-stale"
+
+// staleLabel is a volume label that isn't synced. Current is nil when the
+// label is missing from the volume and Desired is nil when it should have
+// been removed, see --delete-removed-labels.
+type staleLabel struct {
+	Key     string  `json:"key"`
+	Current *string `json:"current"`
+	Desired *string `json:"desired"`
+}
+
+// staleLabelsRow is the stale labels of the volume of one PVC
+type staleLabelsRow struct {
+	PVCNamespace string       `json:"pvcNamespace"`
+	PVCName      string       `json:"pvcName"`
+	VolumeID     string       `json:"volumeID"`
+	Labels       []staleLabel `json:"labels"`
+}
+
+// volumeLabelsFunc returns the current labels of a volume
+type volumeLabelsFunc func(ctx context.Context, volumeID string) (map[string]string, error)
+
+// runListStale writes the stale labels of the volumes of the PVCs in
+// watchNamespace to w and returns the number of PVCs with stale labels. It
+// makes no changes to the volumes.
+func runListStale(ctx context.Context, args []string, w io.Writer) (int, error) {
+	staleFlags := flag.NewFlagSet(listStaleSubcommand, flag.ContinueOnError)
+	output := staleFlags.String("output", "table", "The output format (table or json)")
+	if err := staleFlags.Parse(args); err != nil {
+		return 0, err
+	}
+	if *output != "table" && *output != "json" {
+		return 0, fmt.Errorf("unknown output format %q", *output)
+	}
+
+	var currentLabels volumeLabelsFunc
+	switch cloud {
+	case AWS:
+		ec2Client, err := newEC2Client()
+		if err != nil {
+			return 0, err
+		}
+		currentLabels = ebsVolumeLabels(ec2Client)
+	case GCP:
+		gcpClient, err := newGCPClient(ctx, gcpHTTPTimeout)
+		if err != nil {
+			return 0, err
+		}
+		currentLabels = pdVolumeLabels(gcpClient)
+	default:
+		return 0, fmt.Errorf("the %s subcommand only supports %s and %s", listStaleSubcommand, AWS, GCP)
+	}
+
+	rows, err := buildStaleLabels(ctx, watchNamespace, currentLabels)
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), writeStaleLabels(w, *output, rows)
+}
+
+// ebsVolumeLabels returns the volumeLabelsFunc of EBS volumes, which lists
+// the tags of all volumes once
+func ebsVolumeLabels(client *EBSClient) volumeLabelsFunc {
+	var volumeTags map[string]map[string]string
+	return func(ctx context.Context, volumeID string) (map[string]string, error) {
+		if volumeTags == nil {
+			var err error
+			if volumeTags, err = client.listEBSVolumeTags(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return volumeTags[volumeID], nil
+	}
+}
+
+// pdVolumeLabels returns the volumeLabelsFunc of GCP Persistent Disks
+func pdVolumeLabels(c GCPClient) volumeLabelsFunc {
+	return func(ctx context.Context, volumeID string) (map[string]string, error) {
+		project, location, name, err := parseVolumeID(volumeID)
+		if err != nil {
+			return nil, err
+		}
+		disk, _, _, err := getDisk(ctx, c, project, pdLocation(volumeID, location), name, isRegionalVolumeID(volumeID))
+		if err != nil {
+			return nil, err
+		}
+		return disk.Labels, nil
+	}
+}
+
+// provisionedForListStale reports whether the volume of the PVC is supported
+// by the list-stale subcommand
+func provisionedForListStale(pvc *corev1.PersistentVolumeClaim) bool {
+	switch cloud {
+	case AWS:
+		return provisionedByAwsEbs(pvc)
+	case GCP:
+		return provisionedByGcpPD(pvc)
+	}
+	return false
+}
+
+// desiredVolumeLabels returns the tags of a PVC as they are set on its
+// volume, i.e. sanitized for the cloud provider
+func desiredVolumeLabels(volumeID string, tags map[string]string) map[string]string {
+	switch cloud {
+	case AWS:
+		return sanitizeLabelsForAWS(tags)
+	case GCP:
+		return withoutProtectedLabels(sanitizeLabelsForGCP(tags), volumeID)
+	}
+	return tags
+}
+
+// buildStaleLabels compares the labels of the volume of each bound PVC with
+// the labels the PVC wants it to have. Only the PVCs with stale labels are
+// returned: labels that are missing or have another value, and with a
+// managed-label-keys annotation the labels whose key was removed from the PVC.
+// Labels set outside of the tagger aren't stale.
+func buildStaleLabels(ctx context.Context, namespace string, currentLabels volumeLabelsFunc) ([]staleLabelsRow, error) {
+	pvcs, err := k8sClient.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list PVCs: %w", err)
+	}
+
+	rows := []staleLabelsRow{}
+	for i := range pvcs.Items {
+		pvc := getPVC(&pvcs.Items[i])
+		if pvc.Status.Phase != corev1.ClaimBound || !provisionedForListStale(pvc) {
+			continue
+		}
+		volumeID, tags, _, err := processPersistentVolumeClaim(ctx, pvc)
+		if err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Warnln("Skipping PVC:", err)
+			continue
+		}
+		current, err := currentLabels(ctx, volumeID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get the labels of volume %s of PVC %s/%s: %w", volumeID, pvc.GetNamespace(), pvc.GetName(), err)
+		}
+
+		labels := diffStaleLabels(current, desiredVolumeLabels(volumeID, tags), removedLabelKeys(pvc, tags))
+		if len(labels) == 0 {
+			continue
+		}
+		rows = append(rows, staleLabelsRow{
+			PVCNamespace: pvc.GetNamespace(),
+			PVCName:      pvc.GetName(),
+			VolumeID:     volumeID,
+			Labels:       labels,
+		})
+	}
+
+	slices.SortFunc(rows, func(a, b staleLabelsRow) int {
+		if c := strings.Compare(a.PVCNamespace, b.PVCNamespace); c != 0 {
+			return c
+		}
+		return strings.Compare(a.PVCName, b.PVCName)
+	})
+	return rows, nil
+}
+
+// removedLabelKeys returns the volume label keys of the PVC's managed label
+// keys that are no longer tags of the PVC
+func removedLabelKeys(pvc *corev1.PersistentVolumeClaim, tags map[string]string) []string {
+	var keys []string
+	for _, k := range getManagedLabelKeys(pvc) {
+		if _, ok := tags[k]; !ok {
+			keys = append(keys, sanitizeKeyForCloud(k))
+		}
+	}
+	return keys
+}
+
+// diffStaleLabels returns the labels of desired that current is missing or
+// has another value of, and the removed keys current still has, sorted by key
+func diffStaleLabels(current, desired map[string]string, removed []string) []staleLabel {
+	var labels []staleLabel
+	for k, v := range desired {
+		if currentValue, ok := current[k]; !ok {
+			labels = append(labels, staleLabel{Key: k, Desired: &v})
+		} else if currentValue != v {
+			labels = append(labels, staleLabel{Key: k, Current: &currentValue, Desired: &v})
+		}
+	}
+	for _, k := range removed {
+		if _, ok := desired[k]; ok {
+			continue
+		}
+		if currentValue, ok := current[k]; ok {
+			labels = append(labels, staleLabel{Key: k, Current: &currentValue})
+		}
+	}
+	slices.SortFunc(labels, func(a, b staleLabel) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return labels
+}
+
+func writeStaleLabels(w io.Writer, output string, rows []staleLabelsRow) error {
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tPVC\tVOLUME\tLABEL\tCURRENT\tDESIRED")
+	for _, row := range rows {
+		for _, label := range row.Labels {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", row.PVCNamespace, row.PVCName, row.VolumeID, label.Key, formatStaleValue(label.Current), formatStaleValue(label.Desired))
+		}
+	}
+	return tw.Flush()
+}
+
+// formatStaleValue formats a label value for the table output
+func formatStaleValue(value *string) string {
+	if value == nil {
+		return "<none>"
+	}
+	return *value
+}
@@ -0,0 +1,239 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func setupListStaleTest(t *testing.T, provisioner string, volumeHandles [4]string) {
+	t.Helper()
+
+	newPVC := func(name, volumeName, tags, managedKeys string, phase corev1.PersistentVolumeClaimPhase) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					annotationPrefix + "/tags":                 tags,
+					"volume.kubernetes.io/storage-provisioner": provisioner,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       volumeName,
+				StorageClassName: &dummyStorageClassName,
+			},
+			Status: corev1.PersistentVolumeClaimStatus{Phase: phase},
+		}
+		if managedKeys != "" {
+			pvc.Annotations[managedLabelKeysAnnotation] = managedKeys
+		}
+		return pvc
+	}
+	newPV := func(name, volumeHandle string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeHandle},
+				},
+			},
+		}
+	}
+
+	k8sClient = fake.NewSimpleClientset(
+		newPVC("compliant", "pv-compliant", `{"team": "db"}`, "", corev1.ClaimBound),
+		newPV("pv-compliant", volumeHandles[0]),
+		newPVC("drifted", "pv-drifted", `{"team": "db", "env": "prod"}`, "", corev1.ClaimBound),
+		newPV("pv-drifted", volumeHandles[1]),
+		newPVC("removed", "pv-removed", `{"team": "db"}`, `["team","owner"]`, corev1.ClaimBound),
+		newPV("pv-removed", volumeHandles[2]),
+		newPVC("lost", "pv-lost", `{"team": "db"}`, "", corev1.ClaimLost),
+		newPV("pv-lost", volumeHandles[3]),
+		newPVC("pending", "", `{"team": "db"}`, "", corev1.ClaimPending),
+	)
+}
+
+// wantStaleLabels are the stale labels of setupListStaleTest for the volume
+// IDs of the drifted and removed PVCs
+func wantStaleLabels(drifted, removed string) []staleLabelsRow {
+	return []staleLabelsRow{
+		{
+			PVCNamespace: "default",
+			PVCName:      "drifted",
+			VolumeID:     drifted,
+			Labels: []staleLabel{
+				{Key: "env", Desired: ptr.To("prod")},
+				{Key: "team", Current: ptr.To("web"), Desired: ptr.To("db")},
+			},
+		},
+		{
+			PVCNamespace: "default",
+			PVCName:      "removed",
+			VolumeID:     removed,
+			Labels: []staleLabel{
+				{Key: "owner", Current: ptr.To("alice")},
+			},
+		},
+	}
+}
+
+func Test_buildStaleLabelsAWS(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = AWS
+	setupListStaleTest(t, AWS_EBS_CSI, [4]string{"vol-1", "vol-2", "vol-3", "vol-4"})
+
+	client := &EBSClient{&fakeEC2Client{volumes: []*ec2.Volume{
+		{VolumeId: aws.String("vol-1"), Tags: []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("db")}}},
+		{VolumeId: aws.String("vol-2"), Tags: []*ec2.Tag{
+			{Key: aws.String("team"), Value: aws.String("web")},
+			{Key: aws.String("ebs.csi.aws.com/cluster"), Value: aws.String("true")},
+		}},
+		{VolumeId: aws.String("vol-3"), Tags: []*ec2.Tag{
+			{Key: aws.String("team"), Value: aws.String("db")},
+			{Key: aws.String("owner"), Value: aws.String("alice")},
+		}},
+		{VolumeId: aws.String("vol-4")},
+	}}}
+
+	got, err := buildStaleLabels(context.Background(), "", ebsVolumeLabels(client))
+	if err != nil {
+		t.Fatalf("buildStaleLabels() error = %v", err)
+	}
+	if want := wantStaleLabels("vol-2", "vol-3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildStaleLabels() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_buildStaleLabelsGCP(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	cloud = GCP
+	volumeHandles := [4]string{
+		"projects/myproject/zones/us-central1-a/disks/disk-1",
+		"projects/myproject/zones/us-central1-a/disks/disk-2",
+		"projects/myproject/zones/us-central1-a/disks/disk-3",
+		"projects/myproject/zones/us-central1-a/disks/disk-4",
+	}
+	setupListStaleTest(t, GCP_PD_CSI, volumeHandles)
+
+	diskLabels := map[string]map[string]string{
+		"disk-1": {"team": "db"},
+		"disk-2": {"team": "web", "goog-gke-volume": ""},
+		"disk-3": {"team": "db", "owner": "alice"},
+	}
+	client := &fakeGCPClient{
+		fakeGetDisk: func(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Name: name, Labels: diskLabels[name]}, nil
+		},
+	}
+
+	got, err := buildStaleLabels(context.Background(), "", pdVolumeLabels(client))
+	if err != nil {
+		t.Fatalf("buildStaleLabels() error = %v", err)
+	}
+	if want := wantStaleLabels(volumeHandles[1], volumeHandles[2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildStaleLabels() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_diffStaleLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		current map[string]string
+		desired map[string]string
+		removed []string
+		want    []staleLabel
+	}{
+		{
+			name:    "in sync",
+			current: map[string]string{"team": "db", "other": "value"},
+			desired: map[string]string{"team": "db"},
+			want:    nil,
+		},
+		{
+			name:    "missing and wrong values",
+			current: map[string]string{"team": "web"},
+			desired: map[string]string{"team": "db", "env": "prod"},
+			want: []staleLabel{
+				{Key: "env", Desired: ptr.To("prod")},
+				{Key: "team", Current: ptr.To("web"), Desired: ptr.To("db")},
+			},
+		},
+		{
+			name:    "removed keys",
+			current: map[string]string{"team": "db", "owner": "alice"},
+			desired: map[string]string{"team": "db"},
+			removed: []string{"owner", "team", "gone"},
+			want: []staleLabel{
+				{Key: "owner", Current: ptr.To("alice")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffStaleLabels(tt.current, tt.desired, tt.removed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffStaleLabels() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_writeStaleLabels(t *testing.T) {
+	rows := wantStaleLabels("vol-2", "vol-3")
+
+	t.Run("table", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeStaleLabels(&buf, "table", rows); err != nil {
+			t.Fatalf("writeStaleLabels() error = %v", err)
+		}
+		want := "NAMESPACE  PVC      VOLUME  LABEL  CURRENT  DESIRED\n" +
+			"default    drifted  vol-2   env    <none>   prod\n" +
+			"default    drifted  vol-2   team   web      db\n" +
+			"default    removed  vol-3   owner  alice    <none>\n"
+		if got := buf.String(); got != want {
+			t.Errorf("writeStaleLabels() =\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeStaleLabels(&buf, "json", rows); err != nil {
+			t.Fatalf("writeStaleLabels() error = %v", err)
+		}
+		var got []staleLabelsRow
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, rows) {
+			t.Errorf("writeStaleLabels() = %+v, want %+v", got, rows)
+		}
+	})
+}
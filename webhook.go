@@ -0,0 +1,389 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/retry"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// webhookPath is the path of the validating admission webhook for PVCs
+const webhookPath = "/validate-pvc"
+
+// webhookCertValidity is how long the generated CA and serving certificate
+// are valid
+const webhookCertValidity = 365 * 24 * time.Hour
+
+// webhookCertRenewBefore is how long before it expires the certificate in the
+// --webhook-secret-name Secret is replaced on start
+const webhookCertRenewBefore = 30 * 24 * time.Hour
+
+// pvcLabelValidator denies PVCs with labels that would be copied to tags but
+// whose keys become the same tag key once sanitized for the cloud provider,
+// see --webhook-mode
+type pvcLabelValidator struct {
+	decoder *admission.Decoder
+}
+
+func (v *pvcLabelValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := v.decoder.Decode(req, pvc); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	collisions := collidingLabelKeys(pvc)
+	if len(collisions) == 0 {
+		return admission.Allowed("")
+	}
+	tagKeys := make([]string, 0, len(collisions))
+	for tagKey := range collisions {
+		tagKeys = append(tagKeys, tagKey)
+	}
+	slices.Sort(tagKeys)
+	reasons := make([]string, 0, len(tagKeys))
+	for _, tagKey := range tagKeys {
+		reasons = append(reasons, fmt.Sprintf("label keys %s become the %s tag key %s", strings.Join(collisions[tagKey], ", "), cloud, tagKey))
+	}
+	log.WithFields(log.Fields{"namespace": req.Namespace, "pvc": req.Name, "collisions": collisions}).Infoln("Denying PVC with label keys that collide once sanitized")
+	return admission.Denied(strings.Join(reasons, "; "))
+}
+
+// webhookKeySanitizer returns the sanitizer of the tag keys whose collisions
+// fail or lose a label when tagging, or nil if collisions are resolved by
+// --collision-strategy
+func webhookKeySanitizer() func(string) string {
+	switch cloud {
+	case GCP:
+		if gcpCollisionStrategy == collisionError {
+			return sanitizeKeyForGCP
+		}
+		return nil
+	case AZURE:
+		return sanitizeKeyForAzure
+	case AWS:
+		return awsSanitizer.sanitizeKey
+	}
+	return nil
+}
+
+// collidingLabelKeys returns the label keys of the PVC that are copied to
+// tags, see --copy-labels and --pvc-label-prefix, but become the same key once
+// sanitized for the cloud provider, by that sanitized key
+func collidingLabelKeys(pvc *corev1.PersistentVolumeClaim) map[string][]string {
+	sanitizeKey := webhookKeySanitizer()
+	if sanitizeKey == nil {
+		return nil
+	}
+	// the PVC label key by tag key
+	labelKeys := map[string]string{}
+	for k := range pvc.GetLabels() {
+		tagKey := k
+		if pvcLabelPrefix != "" {
+			if !strings.HasPrefix(k, pvcLabelPrefix) {
+				continue
+			}
+			tagKey = strings.TrimPrefix(k, pvcLabelPrefix)
+		} else if len(copyLabels) == 0 || (copyLabels[0] != "*" && !slices.Contains(copyLabels, k)) {
+			continue
+		}
+		labelKeys[tagKey] = k
+	}
+	collisions := labelKeyCollisions(labelKeys, sanitizeKey)
+	for _, keys := range collisions {
+		for i, k := range keys {
+			keys[i] = labelKeys[k]
+		}
+		slices.Sort(keys)
+	}
+	return collisions
+}
+
+// webhookServiceDNSNames returns the names the webhook is reached at through
+// its Service
+func webhookServiceDNSNames(namespace, name string) []string {
+	return []string{
+		name,
+		name + "." + namespace,
+		name + "." + namespace + ".svc",
+		name + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// generateWebhookCertificate creates a self-signed CA and a serving
+// certificate for dnsNames signed by it. It returns the PEM encoded CA
+// certificate, which the API server must trust, and the serving certificate.
+func generateWebhookCertificate(dnsNames []string, now time.Time) ([]byte, tls.Certificate, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "k8s-pvc-tagger-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(webhookCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(webhookCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), cert, nil
+}
+
+// webhookCertificateFromSecret returns the CA and serving certificate stored in
+// the Secret, or an error if they are missing, invalid, not for dnsNames or
+// expire within webhookCertRenewBefore
+func webhookCertificateFromSecret(secret *corev1.Secret, dnsNames []string, now time.Time) ([]byte, tls.Certificate, error) {
+	caPEM := secret.Data["ca.crt"]
+	if len(caPEM) == 0 {
+		return nil, tls.Certificate{}, fmt.Errorf("no ca.crt")
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	if now.Add(webhookCertRenewBefore).After(leaf.NotAfter) {
+		return nil, tls.Certificate{}, fmt.Errorf("the certificate expires at %s", leaf.NotAfter)
+	}
+	for _, name := range dnsNames {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return nil, tls.Certificate{}, err
+		}
+	}
+	return caPEM, cert, nil
+}
+
+// webhookCertificateSecretData returns the Secret data storing the CA and
+// serving certificate
+func webhookCertificateSecretData(caPEM []byte, cert tls.Certificate) (map[string][]byte, error) {
+	key, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		"ca.crt":                caPEM,
+		corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// loadWebhookCertificate returns the CA and serving certificate stored in the
+// Secret, shared by all the replicas of the webhook. The first replica to
+// start generates them and creates the Secret, and they are generated again
+// when they're about to expire, keeping the previous CA in the bundle. A
+// replica losing the race to create or update
+// the Secret uses the one of the winner.
+func loadWebhookCertificate(ctx context.Context, client kubernetes.Interface, namespace, name string, dnsNames []string, now time.Time) ([]byte, tls.Certificate, error) {
+	secrets := client.CoreV1().Secrets(namespace)
+	var caPEM []byte
+	var cert tls.Certificate
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err)
+	}, func() error {
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		found := err == nil
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if found {
+			caPEM, cert, err = webhookCertificateFromSecret(secret, dnsNames, now)
+			if err == nil {
+				return nil
+			}
+			log.WithError(err).Infof("Generating a new webhook certificate for Secret %s/%s", namespace, name)
+		}
+
+		caPEM, cert, err = generateWebhookCertificate(dnsNames, now)
+		if err != nil {
+			return err
+		}
+		if found {
+			// keep trusting the previous CA, replicas started before still
+			// serve a certificate signed by it
+			if block, _ := pem.Decode(secret.Data["ca.crt"]); block != nil {
+				caPEM = append(caPEM, pem.EncodeToMemory(block)...)
+			}
+		}
+		data, err := webhookCertificateSecretData(caPEM, cert)
+		if err != nil {
+			return err
+		}
+		if !found {
+			_, err = secrets.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Type:       corev1.SecretTypeTLS,
+				Data:       data,
+			}, metav1.CreateOptions{})
+			return err
+		}
+		secret.Data = data
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	return caPEM, cert, nil
+}
+
+// injectWebhookCABundle sets the CA bundle of every webhook of the
+// ValidatingWebhookConfiguration, so that the API server trusts the
+// generated certificate
+func injectWebhookCABundle(ctx context.Context, client kubernetes.Interface, name string, caPEM []byte) error {
+	configs := client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := configs.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range config.Webhooks {
+			config.Webhooks[i].ClientConfig.CABundle = caPEM
+		}
+		_, err = configs.Update(ctx, config, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// newWebhookServer returns the HTTPS server of the admission webhook,
+// listening on addr with cert
+func newWebhookServer(addr string, cert tls.Certificate) (webhook.Server, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+	server := webhook.NewServer(webhook.Options{
+		Host: host,
+		Port: port,
+		TLSOpts: []func(*tls.Config){func(c *tls.Config) {
+			c.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}},
+	})
+	server.Register(webhookPath, &admission.Webhook{
+		Handler: &pvcLabelValidator{decoder: admission.NewDecoder(scheme.Scheme)},
+	})
+	return server, nil
+}
+
+// runWebhook serves the admission webhook of --webhook-mode until ctx is
+// done. It is ready once the server listens. Its certificate is stored in the
+// Secret secretName of serviceNamespace, or generated for this process alone
+// if secretName is empty.
+func runWebhook(ctx context.Context, addr, serviceNamespace, serviceName, configName, secretName string) error {
+	ctrllog.SetLogger(funcr.New(func(prefix, args string) {
+		log.WithField("logger", prefix).Debugln(args)
+	}, funcr.Options{}))
+
+	dnsNames := webhookServiceDNSNames(serviceNamespace, serviceName)
+	var caPEM []byte
+	var cert tls.Certificate
+	var err error
+	if secretName != "" {
+		caPEM, cert, err = loadWebhookCertificate(ctx, k8sClient, serviceNamespace, secretName, dnsNames, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to load the webhook certificate from Secret %s/%s: %w", serviceNamespace, secretName, err)
+		}
+	} else {
+		caPEM, cert, err = generateWebhookCertificate(dnsNames, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to generate the webhook certificate: %w", err)
+		}
+	}
+	if configName != "" {
+		if err := injectWebhookCABundle(ctx, k8sClient, configName, caPEM); err != nil {
+			return fmt.Errorf("failed to set the CA bundle of ValidatingWebhookConfiguration %s: %w", configName, err)
+		}
+		log.Infof("Set the CA bundle of ValidatingWebhookConfiguration %s", configName)
+	}
+
+	server, err := newWebhookServer(addr, cert)
+	if err != nil {
+		return fmt.Errorf("invalid webhook-addr: %w", err)
+	}
+	started := server.StartedChecker()
+	expectInformerSyncs(1)
+	addInformerSync(func() bool { return started(nil) == nil })
+
+	log.WithFields(log.Fields{"addr": addr, "path": webhookPath}).Infoln("Serving the PVC admission webhook")
+	return server.Start(ctx)
+}
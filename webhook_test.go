@@ -0,0 +1,396 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func Test_pvcLabelValidator(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old string) { pvcLabelPrefix = old }(pvcLabelPrefix)
+	defer func(old string) { gcpCollisionStrategy = old }(gcpCollisionStrategy)
+
+	tests := []struct {
+		name              string
+		cloud             string
+		collisionStrategy string
+		copyLabels        []string
+		prefix            string
+		labels            map[string]string
+		wantAllowed       bool
+		wantMessage       string
+	}{
+		{
+			name:              "no labels",
+			cloud:             GCP,
+			collisionStrategy: collisionError,
+			copyLabels:        []string{"*"},
+			wantAllowed:       true,
+		},
+		{
+			name:              "valid labels",
+			cloud:             GCP,
+			collisionStrategy: collisionError,
+			copyLabels:        []string{"*"},
+			labels:            map[string]string{"app.kubernetes.io/name": "mysql", "Team": "db"},
+			wantAllowed:       true,
+		},
+		{
+			name:              "gcp collision with the error strategy",
+			cloud:             GCP,
+			collisionStrategy: collisionError,
+			copyLabels:        []string{"*"},
+			labels:            map[string]string{"Team": "a", "team": "b", "app": "c"},
+			wantMessage:       "label keys Team, team become the gcp tag key team",
+		},
+		{
+			name:              "gcp collision resolved by the strategy",
+			cloud:             GCP,
+			collisionStrategy: collisionFirstAlphabetical,
+			copyLabels:        []string{"*"},
+			labels:            map[string]string{"Team": "a", "team": "b"},
+			wantAllowed:       true,
+		},
+		{
+			name:        "azure collision",
+			cloud:       AZURE,
+			copyLabels:  []string{"*"},
+			labels:      map[string]string{"dom.tld/key": "a", "dom.tld_key": "b", "app": "c"},
+			wantMessage: "label keys dom.tld/key, dom.tld_key become the azure tag key dom.tld_key",
+		},
+		{
+			name:        "azure collision after removing the prefix",
+			cloud:       AZURE,
+			prefix:      "tag-",
+			labels:      map[string]string{"tag-dom.tld/key": "a", "tag-dom.tld_key": "b"},
+			wantMessage: "label keys tag-dom.tld/key, tag-dom.tld_key become the azure tag key dom.tld_key",
+		},
+		{
+			name:        "keys without the prefix aren't copied",
+			cloud:       AZURE,
+			prefix:      "tag-",
+			labels:      map[string]string{"dom.tld/key": "a", "dom.tld_key": "b"},
+			wantAllowed: true,
+		},
+		{
+			name:        "labels not copied aren't checked",
+			cloud:       AZURE,
+			copyLabels:  []string{"dom.tld/key"},
+			labels:      map[string]string{"dom.tld/key": "a", "dom.tld_key": "b"},
+			wantAllowed: true,
+		},
+		{
+			name:        "no labels copied",
+			cloud:       AZURE,
+			labels:      map[string]string{"dom.tld/key": "a", "dom.tld_key": "b"},
+			wantAllowed: true,
+		},
+		{
+			name:        "aws keys are kept as is",
+			cloud:       AWS,
+			copyLabels:  []string{"*"},
+			labels:      map[string]string{"dom.tld/key": "a", "dom.tld_key": "b", "Team": "c", "team": "d"},
+			wantAllowed: true,
+		},
+	}
+	validator := &pvcLabelValidator{decoder: admission.NewDecoder(scheme.Scheme)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the API server rejects invalid label keys before the webhook
+			for k := range tt.labels {
+				if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+					t.Fatalf("invalid label key %q: %v", k, errs)
+				}
+			}
+			cloud = tt.cloud
+			gcpCollisionStrategy = tt.collisionStrategy
+			copyLabels = tt.copyLabels
+			pvcLabelPrefix = tt.prefix
+
+			resp := validator.Handle(context.Background(), newPVCAdmissionRequest(t, tt.labels))
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("Allowed = %v, want %v", resp.Allowed, tt.wantAllowed)
+			}
+			if got := resp.Result.Message; !strings.Contains(got, tt.wantMessage) {
+				t.Errorf("message = %q, want it to contain %q", got, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func Test_pvcLabelValidatorInvalidObject(t *testing.T) {
+	validator := &pvcLabelValidator{decoder: admission.NewDecoder(scheme.Scheme)}
+	resp := validator.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: []byte(`{"kind":`)},
+	}})
+	if resp.Allowed || resp.Result.Code != http.StatusBadRequest {
+		t.Errorf("response = %+v, want a %d error", resp.Result, http.StatusBadRequest)
+	}
+}
+
+func Test_webhookServer(t *testing.T) {
+	defer func(old string) { cloud = old }(cloud)
+	defer func(old []string) { copyLabels = old }(copyLabels)
+	defer func(old string) { pvcLabelPrefix = old }(pvcLabelPrefix)
+	cloud = AZURE
+	pvcLabelPrefix = "tag-"
+
+	dnsNames := webhookServiceDNSNames("pvc-tagger", "k8s-pvc-tagger-webhook")
+	caPEM, cert, err := generateWebhookCertificate(dnsNames, time.Now())
+	if err != nil {
+		t.Fatalf("generateWebhookCertificate() error = %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	server, err := newWebhookServer(addr, cert)
+	if err != nil {
+		t.Fatalf("newWebhookServer() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := server.Start(ctx); err != nil {
+			t.Errorf("Start() error = %v", err)
+		}
+	}()
+
+	// the API server verifies the certificate with the CA bundle
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("invalid CA PEM")
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "k8s-pvc-tagger-webhook.pvc-tagger.svc", MinVersion: tls.VersionTLS12},
+	}}
+	started := server.StartedChecker()
+	for i := 0; started(nil) != nil; i++ {
+		if i == 100 {
+			t.Fatal("webhook server not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		wantAllowed bool
+	}{
+		{
+			name:        "allowed",
+			labels:      map[string]string{"tag-team": "db", "tag-dom.tld/key": "a"},
+			wantAllowed: true,
+		},
+		{
+			name:   "denied",
+			labels: map[string]string{"tag-dom.tld/key": "a", "tag-dom.tld_key": "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newPVCAdmissionRequest(t, tt.labels)
+			review, err := json.Marshal(admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request:  &req.AdmissionRequest,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Post("https://"+addr+webhookPath, "application/json", bytes.NewReader(review))
+			if err != nil {
+				t.Fatalf("POST %s error = %v", webhookPath, err)
+			}
+			defer resp.Body.Close()
+
+			var got admissionv1.AdmissionReview
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Response == nil {
+				t.Fatal("no response in the AdmissionReview")
+			}
+			if got.Response.UID != req.UID {
+				t.Errorf("UID = %q, want %q", got.Response.UID, req.UID)
+			}
+			if got.Response.Allowed != tt.wantAllowed {
+				t.Errorf("Allowed = %v, want %v", got.Response.Allowed, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func Test_injectWebhookCABundle(t *testing.T) {
+	client := fake.NewSimpleClientset(&admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-pvc-tagger"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "pvc-labels.pvc-tagger.planetscale.com"},
+			{Name: "pvc-labels-2.pvc-tagger.planetscale.com", ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte("old")}},
+		},
+	})
+	caPEM := []byte("-----BEGIN CERTIFICATE-----\n")
+
+	if err := injectWebhookCABundle(context.Background(), client, "k8s-pvc-tagger", caPEM); err != nil {
+		t.Fatalf("injectWebhookCABundle() error = %v", err)
+	}
+	got, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), "k8s-pvc-tagger", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range got.Webhooks {
+		if !bytes.Equal(w.ClientConfig.CABundle, caPEM) {
+			t.Errorf("CA bundle of %s = %q, want %q", w.Name, w.ClientConfig.CABundle, caPEM)
+		}
+	}
+
+	if err := injectWebhookCABundle(context.Background(), client, "missing", caPEM); err == nil {
+		t.Error("injectWebhookCABundle() error = nil for a missing ValidatingWebhookConfiguration")
+	}
+}
+
+func Test_loadWebhookCertificate(t *testing.T) {
+	ctx := context.Background()
+	dnsNames := webhookServiceDNSNames("pvc-tagger", "k8s-pvc-tagger-webhook")
+	now := time.Now()
+	client := fake.NewSimpleClientset()
+
+	caPEM, cert, err := loadWebhookCertificate(ctx, client, "pvc-tagger", "webhook-cert", dnsNames, now)
+	if err != nil {
+		t.Fatalf("loadWebhookCertificate() error = %v", err)
+	}
+	secret, err := client.CoreV1().Secrets("pvc-tagger").Get(ctx, "webhook-cert", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Secret not created: %v", err)
+	}
+	if secret.Type != corev1.SecretTypeTLS || !bytes.Equal(secret.Data["ca.crt"], caPEM) {
+		t.Errorf("Secret = %+v, want a TLS Secret with the CA", secret)
+	}
+
+	// another replica uses the same certificate
+	caPEM2, cert2, err := loadWebhookCertificate(ctx, client, "pvc-tagger", "webhook-cert", dnsNames, now)
+	if err != nil {
+		t.Fatalf("loadWebhookCertificate() error = %v", err)
+	}
+	if !bytes.Equal(caPEM2, caPEM) || !bytes.Equal(cert2.Certificate[0], cert.Certificate[0]) {
+		t.Error("loadWebhookCertificate() generated a new certificate, want the one of the Secret")
+	}
+
+	// the certificate is replaced before it expires, the previous CA is kept
+	caPEM3, cert3, err := loadWebhookCertificate(ctx, client, "pvc-tagger", "webhook-cert", dnsNames, now.Add(webhookCertValidity-webhookCertRenewBefore/2))
+	if err != nil {
+		t.Fatalf("loadWebhookCertificate() error = %v", err)
+	}
+	if bytes.Equal(cert3.Certificate[0], cert.Certificate[0]) {
+		t.Error("loadWebhookCertificate() kept the expiring certificate")
+	}
+	if !bytes.HasSuffix(caPEM3, caPEM) || bytes.Equal(caPEM3, caPEM) {
+		t.Errorf("CA bundle = %q, want the new CA and %q", caPEM3, caPEM)
+	}
+
+	// the certificate is replaced for other DNS names
+	_, cert4, err := loadWebhookCertificate(ctx, client, "pvc-tagger", "webhook-cert", webhookServiceDNSNames("other", "k8s-pvc-tagger-webhook"), now)
+	if err != nil {
+		t.Fatalf("loadWebhookCertificate() error = %v", err)
+	}
+	if bytes.Equal(cert4.Certificate[0], cert3.Certificate[0]) {
+		t.Error("loadWebhookCertificate() kept the certificate of other DNS names")
+	}
+}
+
+func Test_loadWebhookCertificateRace(t *testing.T) {
+	ctx := context.Background()
+	dnsNames := webhookServiceDNSNames("pvc-tagger", "k8s-pvc-tagger-webhook")
+	client := fake.NewSimpleClientset()
+	// another replica creates the Secret first
+	var winnerCA []byte
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if winnerCA != nil {
+			return false, nil, nil
+		}
+		caPEM, cert, err := generateWebhookCertificate(dnsNames, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := webhookCertificateSecretData(caPEM, cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		winnerCA = caPEM
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "webhook-cert", Namespace: "pvc-tagger"}, Data: data}
+		if err := client.Tracker().Add(secret); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, apierrors.NewAlreadyExists(corev1.Resource("secrets"), "webhook-cert")
+	})
+
+	caPEM, _, err := loadWebhookCertificate(ctx, client, "pvc-tagger", "webhook-cert", dnsNames, time.Now())
+	if err != nil {
+		t.Fatalf("loadWebhookCertificate() error = %v", err)
+	}
+	if !bytes.Equal(caPEM, winnerCA) {
+		t.Error("loadWebhookCertificate() didn't use the certificate of the Secret created by the other replica")
+	}
+}
+
+// newPVCAdmissionRequest returns the admission request to create a PVC with
+// the labels
+func newPVCAdmissionRequest(t *testing.T, labels map[string]string) admission.Request {
+	t.Helper()
+	raw, err := json.Marshal(&corev1.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "default", Labels: labels},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       "705ab4f5-6393-11e8-b7cc-42010a800002",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"},
+		Operation: admissionv1.Create,
+		Name:      "my-pvc",
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}